@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"github.com/thakurnishu/MinimalDo/model"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	defaultActivityLimit = 50
+	maxActivityLimit     = 200
+)
+
+var activityTypes = []string{
+	model.ActivityCreated, model.ActivityUpdated, model.ActivityCompleted,
+	model.ActivityDeleted, model.ActivityRestored,
+}
+
+// activityType derives the event type of a todo_history row. An update or
+// revert that marks the todo done is a completion.
+const activityType = `CASE h.action
+	WHEN 'create' THEN 'created'
+	WHEN 'delete' THEN 'deleted'
+	WHEN 'restore' THEN 'restored'
+	ELSE CASE WHEN (h.changes->'completed'->>'new')::boolean IS TRUE THEN 'completed' ELSE 'updated' END
+END`
+
+// lastReadActivity returns the id up to which userID has read the feed of
+// the current workspace, 0 if they never marked it read.
+func lastReadActivity(ctx context.Context, db dbtx, userID, workspaceID int) (int64, error) {
+	var lastRead int64
+	err := db.QueryRowContext(ctx, `
+		SELECT last_read_id FROM activity_read_markers WHERE user_id = $1 AND workspace_id = $2
+	`, userID, workspaceID).Scan(&lastRead)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return lastRead, err
+}
+
+// getActivity returns the changes to the todos the caller can see in the
+// current workspace, newest first. The feed is built from the todo history,
+// so it shows exactly what the handlers recorded.
+func (s *Server) getActivity(c *gin.Context) {
+	ctx, span := s.tracer.Start(c.Request.Context(), "get_activity")
+	defer span.End()
+
+	userID := currentUserID(c)
+	span.SetAttributes(attribute.Int("user.id", userID))
+
+	filter, err := parseActivityFilter(c, userID)
+	if err != nil {
+		logError("invalid activity filter", ctx, s.logger, span, err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tx, err := s.beginTenantTx(ctx, c)
+	if err != nil {
+		logError("begin transaction failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	listID, ok := s.listFilter(c, ctx, span, tx)
+	if !ok {
+		return
+	}
+	lastRead, err := lastReadActivity(ctx, tx, userID, currentWorkspaceID(c))
+	if err != nil {
+		logError("read marker lookup failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// one row more than the page tells whether there is a next page
+	rows, err := tx.QueryContext(ctx, `
+		SELECT e.id, e.type, todo_uuid(e.todo_id), e.list_id, e.title, e.changes, e.changed_at,
+			u.id, u.username, u.created_at
+		FROM (
+			SELECT h.id, `+activityType+` AS type, h.todo_id, h.list_id, h.owner_id,
+				h.snapshot->>'title' AS title, h.changes, h.changed_by, h.changed_at
+			FROM todo_history h
+		) e
+		LEFT JOIN users u ON u.id = e.changed_by
+		WHERE `+visibleTodos+`
+		AND ($2::bigint IS NULL OR e.id < $2)
+		AND ($3::text[] IS NULL OR e.type = ANY($3))
+		AND ($4::uuid IS NULL OR e.todo_id = (SELECT todo_id FROM todo_ids WHERE uuid = $4))
+		AND ($5::int IS NULL OR e.list_id = $5)
+		AND ($6::int IS NULL OR e.changed_by = $6)
+		AND ($7::timestamp IS NULL OR e.changed_at >= $7)
+		ORDER BY e.id DESC
+		LIMIT $8
+	`, userID, filter.cursor, filter.types, filter.todoID, listID, filter.actor, filter.since, filter.limit+1)
+	if err != nil {
+		logError("query failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	page := model.ActivityPage{Events: []model.ActivityEvent{}}
+	for rows.Next() {
+		var e model.ActivityEvent
+		var changes []byte
+		var actorID *int
+		var actorName *string
+		var actorCreated sql.NullTime
+		err := rows.Scan(&e.ID, &e.Type, &e.TodoID, &e.ListID, &e.Title, &changes, &e.At,
+			&actorID, &actorName, &actorCreated)
+		if err != nil {
+			logError("rows scan failed", ctx, s.logger, span, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if err := json.Unmarshal(changes, &e.Changes); err != nil {
+			logError("decoding changes failed", ctx, s.logger, span, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if actorID != nil {
+			e.Actor = &model.User{ID: *actorID, Username: *actorName, CreatedAt: actorCreated.Time}
+		}
+		e.Unread = e.ID > lastRead && (actorID == nil || *actorID != userID)
+		page.Events = append(page.Events, e)
+	}
+	if err := rows.Err(); err != nil {
+		logError("row iteration failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if len(page.Events) > filter.limit {
+		page.Events = page.Events[:filter.limit]
+		page.NextCursor = strconv.FormatInt(page.Events[filter.limit-1].ID, 10)
+	}
+
+	// the unread count ignores the filters, it backs the sidebar badge
+	err = tx.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM todo_history
+		WHERE `+visibleTodos+` AND id > $2 AND changed_by IS DISTINCT FROM $1
+	`, userID, lastRead).Scan(&page.UnreadCount)
+	if err != nil {
+		logError("unread count failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	span.SetAttributes(
+		attribute.Int("activity.event_count", len(page.Events)),
+		attribute.Int("activity.unread_count", page.UnreadCount),
+	)
+	c.JSON(http.StatusOK, page)
+}
+
+type activityFilter struct {
+	cursor *int64
+	types  any // pq.Array of the requested types, nil for all
+	todoID *string
+	actor  *int
+	since  *time.Time
+	limit  int
+}
+
+func parseActivityFilter(c *gin.Context, userID int) (activityFilter, error) {
+	f := activityFilter{limit: defaultActivityLimit}
+
+	if v := c.Query("cursor"); v != "" {
+		cursor, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return f, errors.New("invalid cursor")
+		}
+		f.cursor = &cursor
+	}
+	if v := c.Query("type"); v != "" {
+		types := strings.Split(v, ",")
+		for _, t := range types {
+			if !slices.Contains(activityTypes, t) {
+				return f, errors.New("unknown type " + strconv.Quote(t) + ", want one of " + strings.Join(activityTypes, ", "))
+			}
+		}
+		f.types = pq.Array(types)
+	}
+	if v := c.Query("todo_id"); v != "" {
+		id, err := uuid.Parse(v)
+		if err != nil {
+			return f, errors.New("invalid todo_id")
+		}
+		todoID := id.String()
+		f.todoID = &todoID
+	}
+	if v := c.Query("actor"); v == "me" {
+		f.actor = &userID
+	} else if v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			return f, errors.New("actor must be me or a user ID")
+		}
+		f.actor = &id
+	}
+	if v := c.Query("since"); v != "" {
+		since, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return f, errors.New("since must be an RFC 3339 time")
+		}
+		since = since.UTC()
+		f.since = &since
+	}
+	if v := c.Query("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxActivityLimit {
+			return f, errors.New("limit must be between 1 and " + strconv.Itoa(maxActivityLimit))
+		}
+		f.limit = limit
+	}
+	return f, nil
+}
+
+// markActivityRead moves the caller's read marker forward, to up_to or to
+// the newest event. It never moves back, so a stale tab can't mark read
+// events unread again.
+func (s *Server) markActivityRead(c *gin.Context) {
+	ctx, span := s.tracer.Start(c.Request.Context(), "mark_activity_read")
+	defer span.End()
+
+	userID := currentUserID(c)
+	workspaceID := currentWorkspaceID(c)
+	span.SetAttributes(attribute.Int("user.id", userID))
+
+	var req model.ActivityReadRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.BindJSON(&req); err != nil {
+			logError("failed to parse json", ctx, s.logger, span, err)
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	tx, err := s.beginTenantTx(ctx, c)
+	if err != nil {
+		logError("begin transaction failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	upTo := req.UpTo
+	if upTo == nil {
+		var latest sql.NullInt64
+		if err := tx.QueryRowContext(ctx, "SELECT MAX(id) FROM todo_history").Scan(&latest); err != nil {
+			logError("query failed", ctx, s.logger, span, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		upTo = &latest.Int64
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO activity_read_markers (user_id, workspace_id, last_read_id)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (user_id, workspace_id) DO UPDATE
+		SET last_read_id = GREATEST(activity_read_markers.last_read_id, EXCLUDED.last_read_id),
+			read_at = CURRENT_TIMESTAMP
+	`, userID, workspaceID, *upTo)
+	if err != nil {
+		logError("query execution failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		logError("commit failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	s.logger.InfoContext(ctx, "activity marked read",
+		slog.Int("user_id", userID),
+		slog.Int("workspace_id", workspaceID),
+		slog.Int64("up_to", *upTo),
+	)
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"github.com/thakurnishu/MinimalDo/model"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// maxAssignees bounds the assignee list of a single todo.
+const maxAssignees = 20
+
+// assigneeFilter reads the optional assignee query parameter of the todo list
+// endpoints: "me", a user id or "none" for unassigned todos. ok is false when
+// the response has already been written.
+func (s *Server) assigneeFilter(c *gin.Context, ctx context.Context, span trace.Span) (assignee *int, unassigned bool, ok bool) {
+	v := c.Query("assignee")
+	switch v {
+	case "":
+		return nil, false, true
+	case "none":
+		return nil, true, true
+	case "me":
+		id := currentUserID(c)
+		return &id, false, true
+	}
+	id, err := strconv.Atoi(v)
+	if err != nil {
+		logError("invalid assignee filter", ctx, s.logger, span, err,
+			slog.String("assignee", v),
+		)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "assignee must be me, none or a user ID"})
+		return nil, false, false
+	}
+	return &id, false, true
+}
+
+// assigneeClause is the WHERE clause for assigneeFilter, with the user id and
+// the unassigned flag bound to the given parameters.
+func assigneeClause(idParam, noneParam int) string {
+	id, none := "$"+strconv.Itoa(idParam), "$"+strconv.Itoa(noneParam)
+	return `(` + id + `::int IS NULL OR id IN (SELECT todo_id FROM todo_assignees WHERE user_id = ` + id + `))
+		AND (NOT ` + none + `::bool OR NOT EXISTS (SELECT 1 FROM todo_assignees a WHERE a.todo_id = todos.id))`
+}
+
+// loadAssignees fills in the Assignees of todos with one query.
+func loadAssignees(ctx context.Context, db dbtx, todos []model.Todo) error {
+	if len(todos) == 0 {
+		return nil
+	}
+	ids := make([]string, 0, len(todos))
+	byID := make(map[string]*model.Todo, len(todos))
+	for i := range todos {
+		todos[i].Assignees = []model.User{}
+		// the query returns IDs in canonical form
+		if u, err := uuid.Parse(todos[i].ID); err == nil {
+			ids = append(ids, u.String())
+			byID[u.String()] = &todos[i]
+		}
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT k.uuid, u.id, u.username, u.created_at
+		FROM todo_assignees a
+		JOIN todo_ids k ON k.todo_id = a.todo_id
+		JOIN users u ON u.id = a.user_id
+		WHERE k.uuid = ANY($1::uuid[])
+		ORDER BY a.assigned_at, u.id
+	`, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var todoID string
+		var u model.User
+		if err := rows.Scan(&todoID, &u.ID, &u.Username, &u.CreatedAt); err != nil {
+			return err
+		}
+		if t := byID[todoID]; t != nil {
+			t.Assignees = append(t.Assignees, u)
+		}
+	}
+	return rows.Err()
+}
+
+// setAssignees replaces the assignees of a todo. Only the owner can be
+// assigned a personal todo, list todos can be assigned to any list member.
+// Every change is written to the assignment log.
+func (s *Server) setAssignees(c *gin.Context) {
+	ctx, span := s.tracer.Start(c.Request.Context(), "set_task_assignees")
+	defer span.End()
+
+	id, ok := s.todoParam(c, ctx, span)
+	if !ok {
+		return
+	}
+	userID := currentUserID(c)
+	span.SetAttributes(
+		attribute.Int("task.id", id),
+		attribute.Int("user.id", userID),
+	)
+
+	var req model.AssigneesRequest
+	if err := c.BindJSON(&req); err != nil {
+		logError("failed to parse json", ctx, s.logger, span, err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	slices.Sort(req.UserIDs)
+	req.UserIDs = slices.Compact(req.UserIDs)
+	if len(req.UserIDs) > maxAssignees {
+		logError("too many assignees", ctx, s.logger, span, errors.New("too many assignees"),
+			slog.Int("assignee_count", len(req.UserIDs)),
+		)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A task can have at most " + strconv.Itoa(maxAssignees) + " assignees"})
+		return
+	}
+
+	tx, err := s.beginTenantTx(ctx, c)
+	if err != nil {
+		logError("begin transaction failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	if !s.authorizeTodo(c, ctx, span, tx, id, roleEditor) {
+		return
+	}
+
+	// the lock serializes concurrent changes so the log matches the table
+	var listID *int
+	var ownerID int
+	err = tx.QueryRowContext(ctx, `
+		SELECT list_id, owner_id FROM todos WHERE id = $1 FOR UPDATE
+	`, id).Scan(&listID, &ownerID)
+	if err != nil {
+		logError("task lookup failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	var eligible []int
+	if listID == nil {
+		eligible = []int{ownerID}
+	} else {
+		rows, err := tx.QueryContext(ctx, `
+			SELECT user_id FROM list_members WHERE list_id = $1
+		`, *listID)
+		if err != nil {
+			logError("query failed", ctx, s.logger, span, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		for rows.Next() {
+			var memberID int
+			if err := rows.Scan(&memberID); err != nil {
+				rows.Close()
+				logError("rows scan failed", ctx, s.logger, span, err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			eligible = append(eligible, memberID)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			logError("row iteration failed", ctx, s.logger, span, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	for _, assignee := range req.UserIDs {
+		if !slices.Contains(eligible, assignee) {
+			logError("assignee not eligible", ctx, s.logger, span, errors.New("assignee cannot see the task"),
+				slog.Int("task_id", id),
+				slog.Int("assignee_id", assignee),
+			)
+			msg := "Personal tasks can only be assigned to their owner"
+			if listID != nil {
+				msg = "User " + strconv.Itoa(assignee) + " is not a member of the task's list"
+			}
+			c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+			return
+		}
+	}
+
+	var current []int64
+	err = tx.QueryRowContext(ctx, `
+		SELECT COALESCE(array_agg(user_id), '{}') FROM todo_assignees WHERE todo_id = $1
+	`, id).Scan(pq.Array(&current))
+	if err != nil {
+		logError("query failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	var added, removed []int64
+	for _, assignee := range req.UserIDs {
+		if !slices.Contains(current, int64(assignee)) {
+			added = append(added, int64(assignee))
+		}
+	}
+	for _, assignee := range current {
+		if !slices.Contains(req.UserIDs, int(assignee)) {
+			removed = append(removed, assignee)
+		}
+	}
+
+	if len(removed) > 0 {
+		_, err = tx.ExecContext(ctx, `
+			DELETE FROM todo_assignees WHERE todo_id = $1 AND user_id = ANY($2)
+		`, id, pq.Array(removed))
+		if err == nil {
+			err = logAssignments(ctx, tx, id, removed, "unassigned", userID)
+		}
+	}
+	if err == nil && len(added) > 0 {
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO todo_assignees (todo_id, user_id, assigned_by)
+			SELECT $1, unnest($2::int[]), $3
+		`, id, pq.Array(added), userID)
+		if err == nil {
+			err = logAssignments(ctx, tx, id, added, "assigned", userID)
+		}
+	}
+	if err != nil {
+		logError("assignment change failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	todos := []model.Todo{{ID: c.Param("id")}}
+	if err := loadAssignees(ctx, tx, todos); err != nil {
+		logError("assignee lookup failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		logError("commit failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	s.logger.InfoContext(ctx, "task assignees changed",
+		slog.Int("task_id", id),
+		slog.Int("assigned_count", len(added)),
+		slog.Int("unassigned_count", len(removed)),
+	)
+	span.SetAttributes(
+		attribute.Int("task.assignee_count", len(todos[0].Assignees)),
+	)
+
+	c.JSON(http.StatusOK, todos[0].Assignees)
+}
+
+func logAssignments(ctx context.Context, db dbtx, todoID int, userIDs []int64, action string, changedBy int) error {
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO todo_assignment_log (todo_id, user_id, action, changed_by)
+		SELECT $1, unnest($2::int[]), $3, $4
+	`, todoID, pq.Array(userIDs), action, changedBy)
+	return err
+}
+
+// getAssignments returns the assignment log of a todo, newest first.
+func (s *Server) getAssignments(c *gin.Context) {
+	ctx, span := s.tracer.Start(c.Request.Context(), "get_task_assignments")
+	defer span.End()
+
+	id, ok := s.todoParam(c, ctx, span)
+	if !ok {
+		return
+	}
+	span.SetAttributes(attribute.Int("task.id", id))
+
+	tx, err := s.beginTenantTx(ctx, c)
+	if err != nil {
+		logError("begin transaction failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	if !s.authorizeTodo(c, ctx, span, tx, id, roleViewer) {
+		return
+	}
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT u.id, u.username, u.created_at, l.action,
+			b.id, b.username, b.created_at, l.changed_at
+		FROM todo_assignment_log l
+		JOIN users u ON u.id = l.user_id
+		LEFT JOIN users b ON b.id = l.changed_by
+		WHERE l.todo_id = $1
+		ORDER BY l.changed_at DESC, l.id DESC
+	`, id)
+	if err != nil {
+		logError("query failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	assignments := []model.Assignment{}
+	for rows.Next() {
+		var a model.Assignment
+		var byID *int
+		var byName *string
+		var byCreated sql.NullTime
+		err := rows.Scan(&a.User.ID, &a.User.Username, &a.User.CreatedAt, &a.Action,
+			&byID, &byName, &byCreated, &a.ChangedAt)
+		if err != nil {
+			logError("rows scan failed", ctx, s.logger, span, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		// changed_by is null once that user is deleted
+		if byID != nil {
+			a.ChangedBy = &model.User{ID: *byID, Username: *byName, CreatedAt: byCreated.Time}
+		}
+		assignments = append(assignments, a)
+	}
+	if err := rows.Err(); err != nil {
+		logError("row iteration failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, assignments)
+}
+
+// getMyTasks returns the todos assigned to the caller across all of their
+// workspaces. Completed todos are left out unless include_completed=true.
+func (s *Server) getMyTasks(c *gin.Context) {
+	ctx, span := s.tracer.Start(c.Request.Context(), "get_my_tasks")
+	defer span.End()
+
+	userID := currentUserID(c)
+	span.SetAttributes(attribute.Int("user.id", userID))
+
+	includeCompleted := false
+	if v := c.Query("include_completed"); v != "" {
+		var err error
+		includeCompleted, err = strconv.ParseBool(v)
+		if err != nil {
+			logError("invalid include_completed", ctx, s.logger, span, err,
+				slog.String("include_completed", v),
+			)
+			c.JSON(http.StatusBadRequest, gin.H{"error": "include_completed must be true or false"})
+			return
+		}
+	}
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT w.id, w.name, m.role, COALESCE(w.personal_user_id = $1, FALSE), w.created_at
+		FROM workspaces w
+		JOIN workspace_members m ON m.workspace_id = w.id AND m.user_id = $1
+		ORDER BY 4 DESC, w.name
+	`, userID)
+	if err != nil {
+		logError("query failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	var workspaces []model.Workspace
+	for rows.Next() {
+		var w model.Workspace
+		if err := rows.Scan(&w.ID, &w.Name, &w.Role, &w.Personal, &w.CreatedAt); err != nil {
+			rows.Close()
+			logError("rows scan failed", ctx, s.logger, span, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		workspaces = append(workspaces, w)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		logError("row iteration failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// each workspace is read in its own tenant transaction so row level
+	// security applies exactly as it does for the workspace scoped routes
+	result := []model.WorkspaceTasks{}
+	total := 0
+	for _, w := range workspaces {
+		todos, err := s.assignedTodos(ctx, w.ID, userID, includeCompleted)
+		if err != nil {
+			logError("query failed", ctx, s.logger, span, err,
+				slog.Int("workspace_id", w.ID),
+			)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if len(todos) == 0 {
+			continue
+		}
+		result = append(result, model.WorkspaceTasks{Workspace: w, Todos: todos})
+		total += len(todos)
+	}
+
+	s.logger.InfoContext(ctx, "fetched assigned tasks",
+		slog.Int("user_id", userID),
+		slog.Int("total_tasks", total),
+		slog.Int("workspace_count", len(result)),
+	)
+	span.SetAttributes(
+		attribute.Int("task.count", total),
+		attribute.Int("workspace.count", len(result)),
+	)
+
+	c.JSON(http.StatusOK, result)
+}
+
+func (s *Server) assignedTodos(ctx context.Context, workspaceID, userID int, includeCompleted bool) ([]model.Todo, error) {
+	tx, err := s.beginWorkspaceTx(ctx, workspaceID)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT todo_uuid(id), title, description, completed, list_id, priority, due_at, `+commentCount+`, created_at, updated_at
+		FROM todos
+		WHERE `+visibleTodos+`
+		AND id IN (SELECT todo_id FROM todo_assignees WHERE user_id = $1)
+		AND ($2 OR NOT completed)
+		ORDER BY created_at DESC
+	`, userID, includeCompleted)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var todos []model.Todo
+	for rows.Next() {
+		var t model.Todo
+		if err := rows.Scan(&t.ID, &t.Title, &t.Description, &t.Completed, &t.ListID, &t.Priority, &t.DueAt, &t.CommentCount, &t.CreatedAt, &t.UpdatedAt); err != nil {
+			return nil, err
+		}
+		todos = append(todos, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return todos, loadAssignees(ctx, tx, todos)
+}
@@ -0,0 +1,476 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/thakurnishu/MinimalDo/blobstore"
+	"github.com/thakurnishu/MinimalDo/model"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// multipartOverhead is what a request may carry on top of the file itself,
+// boundaries and part headers.
+const multipartOverhead = 1 << 20
+
+func setupBlobStore(cfg *Config) (blobstore.Store, error) {
+	switch cfg.BlobStore {
+	case "local":
+		return blobstore.NewLocal(cfg.BlobDir)
+	case "s3":
+		return blobstore.NewS3(context.Background(), blobstore.S3Config{
+			Endpoint:  cfg.S3Endpoint,
+			Region:    cfg.S3Region,
+			Bucket:    cfg.S3Bucket,
+			AccessKey: cfg.S3AccessKey,
+			SecretKey: cfg.S3SecretKey,
+			UseSSL:    cfg.S3UseSSL,
+		})
+	}
+	return nil, fmt.Errorf("unknown BLOB_STORE %q, want local or s3", cfg.BlobStore)
+}
+
+// sizeLimitedReader fails once more than limit bytes were read, so a blob
+// store never finishes an oversized upload.
+type sizeLimitedReader struct {
+	r        io.Reader
+	n, limit int64
+	exceeded bool
+}
+
+var errAttachmentTooLarge = errors.New("attachment too large")
+
+func (l *sizeLimitedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.n += int64(n)
+	if l.n > l.limit {
+		l.exceeded = true
+		return n, errAttachmentTooLarge
+	}
+	return n, err
+}
+
+// sanitizeFilename keeps the base name of an uploaded file, which is only
+// ever shown to users and used in Content-Disposition.
+func sanitizeFilename(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimSpace(strings.ToValidUTF8(name, ""))
+	if name == "." || name == "/" {
+		return ""
+	}
+	if len(name) > 255 {
+		name = strings.ToValidUTF8(name[:255], "")
+	}
+	return name
+}
+
+func queryAttachments(ctx context.Context, db dbtx, todoID, attachmentID int) ([]model.Attachment, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT a.id, todo_uuid(a.todo_id), a.filename, a.content_type, a.size_bytes, a.created_at,
+			u.id, u.username, u.created_at
+		FROM todo_attachments a
+		LEFT JOIN users u ON u.id = a.uploaded_by
+		WHERE a.todo_id = $1 AND ($2 = 0 OR a.id = $2)
+		ORDER BY a.created_at, a.id
+	`, todoID, attachmentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	attachments := []model.Attachment{}
+	for rows.Next() {
+		var a model.Attachment
+		var uploaderID *int
+		var uploaderName *string
+		var uploaderCreated sql.NullTime
+		err := rows.Scan(&a.ID, &a.TodoID, &a.Filename, &a.ContentType, &a.Size, &a.CreatedAt,
+			&uploaderID, &uploaderName, &uploaderCreated)
+		if err != nil {
+			return nil, err
+		}
+		if uploaderID != nil {
+			a.UploadedBy = &model.User{ID: *uploaderID, Username: *uploaderName, CreatedAt: uploaderCreated.Time}
+		}
+		attachments = append(attachments, a)
+	}
+	return attachments, rows.Err()
+}
+
+// attachmentKeys returns the blob keys of the attachments matched by where,
+// for deleting the blobs once the rows are gone.
+func attachmentKeys(ctx context.Context, db dbtx, where string, arg any) ([]string, error) {
+	rows, err := db.QueryContext(ctx, "SELECT storage_key FROM todo_attachments WHERE "+where, arg)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// deleteBlobs removes blobs after their rows were deleted. A failure only
+// leaves an orphaned blob behind, so it is logged and not returned.
+func (s *Server) deleteBlobs(ctx context.Context, keys []string) {
+	// the rows are gone, finish even if the client hung up
+	ctx = context.WithoutCancel(ctx)
+	for _, key := range keys {
+		if err := s.blobs.Delete(ctx, key); err != nil {
+			s.logger.WarnContext(ctx, "failed to delete attachment blob",
+				slog.String("storage_key", key),
+				slog.String("error", err.Error()),
+			)
+		}
+	}
+}
+
+// attachmentParams parses the todo and attachment ids of the single
+// attachment routes.
+func (s *Server) attachmentParams(c *gin.Context, ctx context.Context, span trace.Span) (todoID, attachmentID int, ok bool) {
+	if todoID, ok = s.todoParam(c, ctx, span); !ok {
+		return 0, 0, false
+	}
+	if attachmentID, ok = s.paramID(c, ctx, span, "attachment_id"); !ok {
+		return 0, 0, false
+	}
+	span.SetAttributes(
+		attribute.Int("task.id", todoID),
+		attribute.Int("attachment.id", attachmentID),
+	)
+	return todoID, attachmentID, true
+}
+
+func (s *Server) getAttachments(c *gin.Context) {
+	ctx, span := s.tracer.Start(c.Request.Context(), "get_attachments")
+	defer span.End()
+
+	todoID, ok := s.todoParam(c, ctx, span)
+	if !ok {
+		return
+	}
+	span.SetAttributes(attribute.Int("task.id", todoID))
+
+	tx, err := s.beginTenantTx(ctx, c)
+	if err != nil {
+		logError("begin transaction failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	if !s.authorizeTodo(c, ctx, span, tx, todoID, roleViewer) {
+		return
+	}
+
+	attachments, err := queryAttachments(ctx, tx, todoID, 0)
+	if err != nil {
+		logError("query failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	span.SetAttributes(attribute.Int("attachment.count", len(attachments)))
+	c.JSON(http.StatusOK, attachments)
+}
+
+// uploadAttachment streams the "file" part of a multipart request into the
+// blob store. The type is detected from the content, what the client claims
+// is ignored.
+func (s *Server) uploadAttachment(c *gin.Context) {
+	ctx, span := s.tracer.Start(c.Request.Context(), "upload_attachment")
+	defer span.End()
+
+	todoID, ok := s.todoParam(c, ctx, span)
+	if !ok {
+		return
+	}
+	userID := currentUserID(c)
+	span.SetAttributes(
+		attribute.Int("task.id", todoID),
+		attribute.Int("user.id", userID),
+	)
+
+	// check access before reading the upload, the transaction isn't held
+	// open while the file streams in
+	tx, err := s.beginTenantTx(ctx, c)
+	if err != nil {
+		logError("begin transaction failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	allowed := s.authorizeTodo(c, ctx, span, tx, todoID, roleEditor)
+	tx.Rollback()
+	if !allowed {
+		return
+	}
+
+	maxBytes := s.cfg.AttachmentMaxBytes
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxBytes+multipartOverhead)
+	mr, err := c.Request.MultipartReader()
+	if err != nil {
+		logError("invalid multipart request", ctx, s.logger, span, err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Upload the file as multipart/form-data in a field named file"})
+		return
+	}
+	part, err := mr.NextPart()
+	for err == nil && part.FormName() != "file" {
+		part, err = mr.NextPart()
+	}
+	if err != nil {
+		logError("file part missing", ctx, s.logger, span, err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Upload the file as multipart/form-data in a field named file"})
+		return
+	}
+	defer part.Close()
+
+	filename := sanitizeFilename(part.FileName())
+	if filename == "" {
+		logError("missing filename", ctx, s.logger, span, errors.New("file part has no filename"))
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The file needs a filename"})
+		return
+	}
+
+	br := bufio.NewReaderSize(part, 512)
+	head, err := br.Peek(512)
+	if err != nil && err != io.EOF {
+		s.uploadFailed(c, ctx, span, err)
+		return
+	}
+	contentType, _, _ := mime.ParseMediaType(http.DetectContentType(head))
+	if !slices.Contains(s.cfg.AttachmentTypes, contentType) {
+		logError("attachment type not allowed", ctx, s.logger, span, errors.New("type not allowed"),
+			slog.String("content_type", contentType),
+			slog.String("filename", filename),
+		)
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Files of type " + contentType + " can't be attached, allowed are " + strings.Join(s.cfg.AttachmentTypes, ", ")})
+		return
+	}
+
+	secret, err := newToken()
+	if err != nil {
+		logError("key generation failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	key := fmt.Sprintf("attachments/%d/%d/%s", currentWorkspaceID(c), todoID, secret)
+
+	body := &sizeLimitedReader{r: br, limit: maxBytes}
+	if err := s.blobs.Put(ctx, key, body, -1, contentType); err != nil {
+		if body.exceeded {
+			err = errAttachmentTooLarge
+		}
+		s.uploadFailed(c, ctx, span, err)
+		return
+	}
+
+	tx, err = s.beginTenantTx(ctx, c)
+	if err != nil {
+		s.deleteBlobs(ctx, []string{key})
+		logError("begin transaction failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	// the todo may have gone away while the file was uploading
+	if !s.authorizeTodo(c, ctx, span, tx, todoID, roleEditor) {
+		s.deleteBlobs(ctx, []string{key})
+		return
+	}
+
+	var attachmentID int
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO todo_attachments (todo_id, uploaded_by, filename, content_type, size_bytes, storage_key)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id
+	`, todoID, userID, filename, contentType, body.n, key).Scan(&attachmentID)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		s.deleteBlobs(ctx, []string{key})
+		logError("saving attachment failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	attachments, err := queryAttachments(ctx, s.db, todoID, attachmentID)
+	if err != nil || len(attachments) == 0 {
+		logError("attachment lookup failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Attachment saved but could not be read back"})
+		return
+	}
+
+	s.logger.InfoContext(ctx, "attachment uploaded",
+		slog.Int("task_id", todoID),
+		slog.Int("attachment_id", attachmentID),
+		slog.String("content_type", contentType),
+		slog.Int64("size_bytes", body.n),
+	)
+	span.SetAttributes(
+		attribute.Int("attachment.id", attachmentID),
+		attribute.Int64("attachment.size_bytes", body.n),
+	)
+
+	c.JSON(http.StatusCreated, attachments[0])
+}
+
+func (s *Server) uploadFailed(c *gin.Context, ctx context.Context, span trace.Span, err error) {
+	var maxBytesErr *http.MaxBytesError
+	if errors.Is(err, errAttachmentTooLarge) || errors.As(err, &maxBytesErr) {
+		logError("attachment too large", ctx, s.logger, span, err,
+			slog.Int64("max_bytes", s.cfg.AttachmentMaxBytes),
+		)
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Attachments can be at most %d bytes", s.cfg.AttachmentMaxBytes)})
+		return
+	}
+	logError("upload failed", ctx, s.logger, span, err)
+	c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+}
+
+// downloadAttachment streams an attachment. http.ServeContent answers range
+// and conditional requests, so large logs can be fetched in pieces.
+func (s *Server) downloadAttachment(c *gin.Context) {
+	ctx, span := s.tracer.Start(c.Request.Context(), "download_attachment")
+	defer span.End()
+
+	todoID, attachmentID, ok := s.attachmentParams(c, ctx, span)
+	if !ok {
+		return
+	}
+
+	tx, err := s.beginTenantTx(ctx, c)
+	if err != nil {
+		logError("begin transaction failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	if !s.authorizeTodo(c, ctx, span, tx, todoID, roleViewer) {
+		return
+	}
+	var a model.Attachment
+	var key string
+	err = tx.QueryRowContext(ctx, `
+		SELECT filename, content_type, created_at, storage_key
+		FROM todo_attachments WHERE id = $1 AND todo_id = $2
+	`, attachmentID, todoID).Scan(&a.Filename, &a.ContentType, &a.CreatedAt, &key)
+	if err == sql.ErrNoRows {
+		logError("attachment not found", ctx, s.logger, span, err,
+			slog.Int("attachment_id", attachmentID),
+		)
+		c.JSON(http.StatusNotFound, gin.H{"error": "Attachment not found"})
+		return
+	}
+	if err != nil {
+		logError("attachment lookup failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	// nothing else needs the database, don't keep the connection while streaming
+	tx.Rollback()
+
+	blob, err := s.blobs.Open(ctx, key)
+	if errors.Is(err, blobstore.ErrNotFound) {
+		logError("attachment blob missing", ctx, s.logger, span, err,
+			slog.String("storage_key", key),
+		)
+		c.JSON(http.StatusNotFound, gin.H{"error": "Attachment not found"})
+		return
+	}
+	if err != nil {
+		logError("opening attachment failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer blob.Close()
+
+	// only images are shown inline, everything else is downloaded
+	disposition := "attachment"
+	if strings.HasPrefix(a.ContentType, "image/") {
+		disposition = "inline"
+	}
+	c.Header("Content-Type", a.ContentType)
+	c.Header("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": a.Filename}))
+	c.Header("X-Content-Type-Options", "nosniff")
+	http.ServeContent(c.Writer, c.Request, a.Filename, a.CreatedAt, blob)
+}
+
+func (s *Server) deleteAttachment(c *gin.Context) {
+	ctx, span := s.tracer.Start(c.Request.Context(), "delete_attachment")
+	defer span.End()
+
+	todoID, attachmentID, ok := s.attachmentParams(c, ctx, span)
+	if !ok {
+		return
+	}
+
+	tx, err := s.beginTenantTx(ctx, c)
+	if err != nil {
+		logError("begin transaction failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	if !s.authorizeTodo(c, ctx, span, tx, todoID, roleEditor) {
+		return
+	}
+
+	var key string
+	err = tx.QueryRowContext(ctx, `
+		DELETE FROM todo_attachments WHERE id = $1 AND todo_id = $2 RETURNING storage_key
+	`, attachmentID, todoID).Scan(&key)
+	if err == sql.ErrNoRows {
+		logError("attachment not found", ctx, s.logger, span, err,
+			slog.Int("attachment_id", attachmentID),
+		)
+		c.JSON(http.StatusNotFound, gin.H{"error": "Attachment not found"})
+		return
+	}
+	if err != nil {
+		logError("query execution failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		logError("commit failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	s.deleteBlobs(ctx, []string{key})
+
+	s.logger.InfoContext(ctx, "attachment deleted",
+		slog.Int("task_id", todoID),
+		slog.Int("attachment_id", attachmentID),
+	)
+	c.Status(http.StatusNoContent)
+}
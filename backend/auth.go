@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"github.com/thakurnishu/MinimalDo/model"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// gin context keys set by AuthMiddleware
+	ctxUserID    = "user_id"
+	ctxTokenID   = "token_id"
+	ctxSessionID = "session_id"
+	ctxTokenExp  = "token_expires_at"
+	// only set for personal access tokens
+	ctxAPITokenID = "api_token_id"
+	ctxScopes     = "token_scopes"
+
+	minPasswordLength = 8
+	// bcrypt ignores everything after 72 bytes
+	maxPasswordLength = 72
+)
+
+var usernamePattern = regexp.MustCompile(`^[a-zA-Z0-9_.-]{3,64}$`)
+
+var errInvalidCredentials = errors.New("invalid username or password")
+
+func (s *Server) registerUser(c *gin.Context) {
+	ctx, span := s.tracer.Start(c.Request.Context(), "register_user")
+	defer span.End()
+
+	var req model.RegisterRequest
+	if err := c.BindJSON(&req); err != nil {
+		logError("failed to parse json", ctx, s.logger, span, err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.Username = strings.TrimSpace(req.Username)
+	req.Email = strings.TrimSpace(req.Email)
+
+	if err := validateRegistration(req); err != nil {
+		logError("invalid registration", ctx, s.logger, span, err,
+			slog.String("username", req.Username),
+		)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		logError("password hashing failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		logError("begin transaction failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	var u model.User
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO users (username, email, password_hash)
+		VALUES ($1, NULLIF($2, ''), $3)
+		RETURNING id, username, COALESCE(email, ''), created_at
+	`, req.Username, req.Email, string(hash)).Scan(&u.ID, &u.Username, &u.Email, &u.CreatedAt)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			logError("user already exists", ctx, s.logger, span, err,
+				slog.String("username", req.Username),
+			)
+			c.JSON(http.StatusConflict, gin.H{"error": "Username or email already taken"})
+			return
+		}
+		logError("row scan failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// The account named by ADOPT_TODOS_USER adopts the todos created before
+	// accounts existed, into the personal workspace the users trigger just
+	// created.
+	var claimed int64
+	if s.cfg.AdoptTodosUser != "" && u.Username == s.cfg.AdoptTodosUser {
+		claimed, err = adoptTodos(ctx, tx, u.ID)
+		if err != nil {
+			logError("claiming unowned todos failed", ctx, s.logger, span, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	session, err := s.issueSession(ctx, tx, u, "")
+	if err != nil {
+		logError("session creation failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		logError("commit failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	s.logger.InfoContext(ctx, "user registered",
+		slog.Int("user_id", u.ID),
+		slog.String("username", u.Username),
+		slog.Int64("claimed_tasks", claimed),
+	)
+	span.SetAttributes(
+		attribute.Int("user.id", u.ID),
+		attribute.Int64("user.claimed_tasks", claimed),
+	)
+
+	c.JSON(http.StatusCreated, session)
+}
+
+// adoptTodos gives the todos from before accounts existed to a user, in their
+// personal workspace, and returns how many there were.
+func adoptTodos(ctx context.Context, tx *sql.Tx, userID int) (int64, error) {
+	result, err := tx.ExecContext(ctx, `
+		UPDATE todos SET owner_id = $1,
+			workspace_id = (SELECT id FROM workspaces WHERE personal_user_id = $1)
+		WHERE owner_id IS NULL
+	`, userID)
+	if err != nil {
+		return 0, err
+	}
+	claimed, _ := result.RowsAffected()
+	if claimed == 0 {
+		return 0, nil
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO todo_ids (uuid, todo_id, workspace_id)
+		SELECT uuid_v7(created_at), id, workspace_id FROM todos t
+		WHERE owner_id = $1 AND NOT EXISTS (SELECT 1 FROM todo_ids k WHERE k.todo_id = t.id)
+	`, userID)
+	return claimed, err
+}
+
+// adoptTodosOnStartup hands the todos from before accounts existed to the
+// ADOPT_TODOS_USER account, if it exists already. Otherwise it gets them when
+// it registers.
+func (s *Server) adoptTodosOnStartup() error {
+	if s.cfg.AdoptTodosUser == "" {
+		return nil
+	}
+	ctx := context.Background()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var userID int
+	err = tx.QueryRowContext(ctx, "SELECT id FROM users WHERE username = $1", s.cfg.AdoptTodosUser).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	claimed, err := adoptTodos(ctx, tx, userID)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if claimed > 0 {
+		s.logger.Info("unowned todos adopted",
+			slog.Int("user_id", userID),
+			slog.Int64("claimed_tasks", claimed),
+		)
+	}
+	return nil
+}
+
+func (s *Server) loginUser(c *gin.Context) {
+	ctx, span := s.tracer.Start(c.Request.Context(), "login_user")
+	defer span.End()
+
+	var req model.LoginRequest
+	if err := c.BindJSON(&req); err != nil {
+		logError("failed to parse json", ctx, s.logger, span, err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var u model.User
+	// NULL for accounts that only log in through OIDC
+	var passwordHash sql.NullString
+	err := s.db.QueryRowContext(ctx, `
+		SELECT id, username, COALESCE(email, ''), created_at, password_hash
+		FROM users
+		WHERE username = $1
+	`, strings.TrimSpace(req.Username)).Scan(&u.ID, &u.Username, &u.Email, &u.CreatedAt, &passwordHash)
+	if err != nil && err != sql.ErrNoRows {
+		logError("row scan failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err == sql.ErrNoRows || !passwordHash.Valid {
+		// Spend the same time as a real check so usernames can't be probed.
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(req.Password))
+		logError("login failed", ctx, s.logger, span, errInvalidCredentials,
+			slog.String("username", req.Username),
+		)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": errInvalidCredentials.Error()})
+		return
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(passwordHash.String), []byte(req.Password)); err != nil {
+		logError("login failed", ctx, s.logger, span, errInvalidCredentials,
+			slog.Int("user_id", u.ID),
+		)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": errInvalidCredentials.Error()})
+		return
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		logError("begin transaction failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	session, err := s.issueSession(ctx, tx, u, "")
+	if err != nil {
+		logError("session creation failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		logError("commit failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	s.logger.InfoContext(ctx, "user logged in",
+		slog.Int("user_id", u.ID),
+	)
+	span.SetAttributes(
+		attribute.Int("user.id", u.ID),
+	)
+
+	c.JSON(http.StatusOK, session)
+}
+
+func (s *Server) currentUser(c *gin.Context) {
+	ctx, span := s.tracer.Start(c.Request.Context(), "get_current_user")
+	defer span.End()
+
+	userID := currentUserID(c)
+	var u model.User
+	err := s.db.QueryRowContext(ctx, `
+		SELECT id, username, COALESCE(email, ''), created_at
+		FROM users
+		WHERE id = $1
+	`, userID).Scan(&u.ID, &u.Username, &u.Email, &u.CreatedAt)
+	if err != nil {
+		logError("row scan failed", ctx, s.logger, span, err,
+			slog.Int("user_id", userID),
+		)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, u)
+}
+
+// currentUserID returns the user set by AuthMiddleware.
+func currentUserID(c *gin.Context) int {
+	return c.GetInt(ctxUserID)
+}
+
+func validateRegistration(req model.RegisterRequest) error {
+	if !usernamePattern.MatchString(req.Username) {
+		return errors.New("username must be 3-64 letters, digits, '.', '_' or '-'")
+	}
+	if req.Email != "" && !strings.Contains(req.Email, "@") {
+		return errors.New("invalid email address")
+	}
+	if len(req.Password) < minPasswordLength {
+		return errors.New("password must be at least 8 characters")
+	}
+	if len(req.Password) > maxPasswordLength {
+		return errors.New("password must be at most 72 bytes")
+	}
+	return nil
+}
+
+func bearerToken(c *gin.Context) (string, bool) {
+	header := c.GetHeader("Authorization")
+	if header == "" {
+		return wsBearerToken(c.Request)
+	}
+	scheme, token, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || strings.TrimSpace(token) == "" {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+// newToken returns 32 random bytes, URL-safe encoded.
+func newToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken is what gets stored, so a leaked token table can't be replayed.
+func hashToken(token string) []byte {
+	sum := sha256.Sum256([]byte(token))
+	return sum[:]
+}
+
+// dummyPasswordHash is compared against when the username does not exist.
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("minimaldo-dummy-password"), bcrypt.DefaultCost)
@@ -0,0 +1,26 @@
+// Package blobstore stores the file contents of attachments, on the local
+// filesystem or in an S3 compatible object store. Metadata lives in Postgres,
+// a Store only knows keys and bytes.
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// ErrNotFound is returned by Open for a key that isn't stored.
+var ErrNotFound = errors.New("blob not found")
+
+// Store is a flat key to bytes store. Keys are slash separated paths made
+// up by the caller, e.g. "attachments/3/42/abc".
+type Store interface {
+	// Put stores r under key. size is -1 when the length isn't known up
+	// front. A failed Put leaves nothing behind under key.
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	// Open returns the blob for reading. It can seek, so it can be served
+	// with http.ServeContent for range requests.
+	Open(ctx context.Context, key string) (io.ReadSeekCloser, error)
+	// Delete removes a blob. Deleting a missing key is not an error.
+	Delete(ctx context.Context, key string) error
+}
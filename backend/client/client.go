@@ -0,0 +1,360 @@
+// Package client is a small HTTP client for the MinimalDo REST API.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/thakurnishu/MinimalDo/model"
+)
+
+var (
+	// ErrNotFound is returned when the requested todo does not exist.
+	ErrNotFound = errors.New("todo not found")
+	// ErrAmbiguous is returned when a shortened todo ID matches several.
+	ErrAmbiguous = errors.New("todo id is ambiguous")
+	// ErrUnauthorized is returned when the token is missing, expired or revoked.
+	ErrUnauthorized = errors.New("not logged in")
+)
+
+// APIError is a non-2xx response from the backend.
+type APIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("api error (%d): %s", e.StatusCode, e.Message)
+}
+
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	workspace  string
+
+	// mu guards the tokens, they change when the session is refreshed.
+	mu           sync.Mutex
+	token        string
+	refreshToken string
+	onRefresh    func(model.Session)
+}
+
+// New returns a client for the API rooted at baseURL, e.g. http://localhost:8090/api.
+// token is sent as a bearer token when non-empty.
+func New(baseURL, token string) *Client {
+	return &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		token:      token,
+		httpClient: &http.Client{Timeout: 15 * time.Second},
+	}
+}
+
+// SetWorkspace sends every request to the workspace with the given id
+// instead of the user's personal workspace.
+func (c *Client) SetWorkspace(id string) {
+	c.workspace = id
+}
+
+// SetRefreshToken enables transparent refreshing: when a request is rejected
+// as unauthorized, the refresh token is exchanged for a new session and the
+// request is retried once. onRefresh is called with every new session so the
+// caller can persist the rotated tokens.
+func (c *Client) SetRefreshToken(refreshToken string, onRefresh func(model.Session)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.refreshToken = refreshToken
+	c.onRefresh = onRefresh
+}
+
+// Login exchanges a username and password for a session token. The client
+// itself keeps using the token it was created with.
+func (c *Client) Login(ctx context.Context, username, password string) (model.Session, error) {
+	var session model.Session
+	req := model.LoginRequest{Username: username, Password: password}
+	if err := c.do(ctx, http.MethodPost, "/auth/login", req, &session); err != nil {
+		return model.Session{}, err
+	}
+	return session, nil
+}
+
+func (c *Client) Register(ctx context.Context, req model.RegisterRequest) (model.Session, error) {
+	var session model.Session
+	if err := c.do(ctx, http.MethodPost, "/auth/register", req, &session); err != nil {
+		return model.Session{}, err
+	}
+	return session, nil
+}
+
+func (c *Client) Logout(ctx context.Context) error {
+	return c.do(ctx, http.MethodPost, "/auth/logout", nil, nil)
+}
+
+// Revoke revokes the session the refresh token belongs to. It works even
+// when the access token has already expired.
+func (c *Client) Revoke(ctx context.Context) error {
+	c.mu.Lock()
+	refreshToken := c.refreshToken
+	c.mu.Unlock()
+	if refreshToken == "" {
+		return nil
+	}
+	return c.send(ctx, http.MethodPost, "/auth/revoke", "", model.RefreshRequest{RefreshToken: refreshToken}, nil)
+}
+
+// Refresh exchanges the refresh token for a new session and starts using it.
+func (c *Client) Refresh(ctx context.Context) (model.Session, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.refreshLocked(ctx)
+}
+
+func (c *Client) refreshLocked(ctx context.Context) (model.Session, error) {
+	if c.refreshToken == "" {
+		return model.Session{}, ErrUnauthorized
+	}
+
+	var session model.Session
+	req := model.RefreshRequest{RefreshToken: c.refreshToken}
+	if err := c.send(ctx, http.MethodPost, "/auth/refresh", "", req, &session); err != nil {
+		return model.Session{}, err
+	}
+
+	c.token, c.refreshToken = session.AccessToken, session.RefreshToken
+	if c.onRefresh != nil {
+		c.onRefresh(session)
+	}
+	return session, nil
+}
+
+func (c *Client) Me(ctx context.Context) (model.User, error) {
+	var u model.User
+	if err := c.do(ctx, http.MethodGet, "/auth/me", nil, &u); err != nil {
+		return model.User{}, err
+	}
+	return u, nil
+}
+
+func (c *Client) ListTodos(ctx context.Context) ([]model.Todo, error) {
+	var todos []model.Todo
+	if err := c.do(ctx, http.MethodGet, "/todos", nil, &todos); err != nil {
+		return nil, err
+	}
+	return todos, nil
+}
+
+// TodosByDate mirrors GET /todos/by-date. The day view is returned as a single
+// group so callers can treat every range the same way, groups are ordered
+// newest day first.
+func (c *Client) TodosByDate(ctx context.Context, rangeType string, date time.Time) ([]model.GroupedTodos, error) {
+	dateStr := date.Format("2006-01-02")
+	q := url.Values{}
+	q.Set("range", rangeType)
+	q.Set("date", dateStr)
+	path := "/todos/by-date?" + q.Encode()
+
+	if rangeType == "day" {
+		var todos []model.Todo
+		if err := c.do(ctx, http.MethodGet, path, nil, &todos); err != nil {
+			return nil, err
+		}
+		if len(todos) == 0 {
+			return nil, nil
+		}
+		return []model.GroupedTodos{{Date: dateStr, Todos: todos}}, nil
+	}
+
+	var groups []model.GroupedTodos
+	if err := c.do(ctx, http.MethodGet, path, nil, &groups); err != nil {
+		return nil, err
+	}
+	// The API builds the groups from a map, so their order is random.
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Date > groups[j].Date })
+	return groups, nil
+}
+
+const shortIDLen = 8
+
+// ShortID is the end of a todo ID, what users type to refer to it. The start
+// of an ID is a timestamp, todos created around the same time share it.
+func ShortID(id string) string {
+	if len(id) <= shortIDLen {
+		return id
+	}
+	return id[len(id)-shortIDLen:]
+}
+
+// GetTodo looks a single todo up by its ID, or by the end of it as long as
+// that matches only one todo.
+func (c *Client) GetTodo(ctx context.Context, id string) (model.Todo, error) {
+	todos, err := c.ListTodos(ctx)
+	if err != nil {
+		return model.Todo{}, err
+	}
+	id = strings.ToLower(id)
+	var found []model.Todo
+	for _, t := range todos {
+		if t.ID == id {
+			return t, nil
+		}
+		if strings.HasSuffix(t.ID, id) {
+			found = append(found, t)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return model.Todo{}, ErrNotFound
+	case 1:
+		return found[0], nil
+	default:
+		return model.Todo{}, fmt.Errorf("%w: %q matches %d todos", ErrAmbiguous, id, len(found))
+	}
+}
+
+func (c *Client) CreateTodo(ctx context.Context, t model.Todo) (model.Todo, error) {
+	var created model.Todo
+	if err := c.do(ctx, http.MethodPost, "/todos", t, &created); err != nil {
+		return model.Todo{}, err
+	}
+	return created, nil
+}
+
+func (c *Client) UpdateTodo(ctx context.Context, t model.Todo) (model.Todo, error) {
+	var updated model.Todo
+	if err := c.do(ctx, http.MethodPut, "/todos/"+url.PathEscape(t.ID), t, &updated); err != nil {
+		return model.Todo{}, err
+	}
+	return updated, nil
+}
+
+func (c *Client) DeleteTodo(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/todos/"+url.PathEscape(id), nil, nil)
+}
+
+func (c *Client) Workspaces(ctx context.Context) ([]model.Workspace, error) {
+	var workspaces []model.Workspace
+	if err := c.do(ctx, http.MethodGet, "/workspaces", nil, &workspaces); err != nil {
+		return nil, err
+	}
+	return workspaces, nil
+}
+
+func (c *Client) ListTokens(ctx context.Context) ([]model.APIToken, error) {
+	var tokens []model.APIToken
+	if err := c.do(ctx, http.MethodGet, "/tokens", nil, &tokens); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+func (c *Client) CreateToken(ctx context.Context, req model.CreateTokenRequest) (model.CreatedToken, error) {
+	var created model.CreatedToken
+	if err := c.do(ctx, http.MethodPost, "/tokens", req, &created); err != nil {
+		return model.CreatedToken{}, err
+	}
+	return created, nil
+}
+
+func (c *Client) RevokeToken(ctx context.Context, id int) error {
+	return c.do(ctx, http.MethodDelete, "/tokens/"+strconv.Itoa(id), nil, nil)
+}
+
+// noRefresh lists the endpoints whose 401 means bad credentials rather than
+// an expired access token.
+var noRefresh = map[string]bool{
+	"/auth/login":    true,
+	"/auth/register": true,
+	"/auth/refresh":  true,
+	"/auth/logout":   true,
+}
+
+func (c *Client) do(ctx context.Context, method, path string, body, out any) error {
+	c.mu.Lock()
+	token := c.token
+	c.mu.Unlock()
+
+	err := c.send(ctx, method, path, token, body, out)
+	if !errors.Is(err, ErrUnauthorized) || noRefresh[path] {
+		return err
+	}
+
+	c.mu.Lock()
+	if c.token == token {
+		// Nobody refreshed in the meantime, do it now.
+		if _, refreshErr := c.refreshLocked(ctx); refreshErr != nil {
+			c.mu.Unlock()
+			return err
+		}
+	}
+	token = c.token
+	c.mu.Unlock()
+
+	return c.send(ctx, method, path, token, body, out)
+}
+
+func (c *Client) send(ctx context.Context, method, path, token string, body, out any) error {
+	var reqBody io.Reader
+	if body != nil {
+		buf, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("encode request: %w", err)
+		}
+		reqBody = bytes.NewReader(buf)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if c.workspace != "" {
+		req.Header.Set("X-Workspace-ID", c.workspace)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		msg := resp.Status
+		if err := json.NewDecoder(resp.Body).Decode(&apiErr); err == nil && apiErr.Error != "" {
+			msg = apiErr.Error
+		}
+		switch resp.StatusCode {
+		case http.StatusNotFound:
+			return fmt.Errorf("%w: %s", ErrNotFound, msg)
+		case http.StatusUnauthorized:
+			return fmt.Errorf("%w: %s", ErrUnauthorized, msg)
+		}
+		return &APIError{StatusCode: resp.StatusCode, Message: msg}
+	}
+
+	if out == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("decode response: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+
+	"github.com/thakurnishu/MinimalDo/client"
+	"github.com/thakurnishu/MinimalDo/model"
+)
+
+func cmdLogin(ctx context.Context, app *App, args []string) error {
+	fs := newFlagSet("login", "[-u username]")
+	username := fs.String("u", "", "username")
+
+	if _, err := app.parseFlags(fs, args); err != nil {
+		return err
+	}
+	if *username == "" {
+		*username = readLine("Username: ")
+	}
+	password, err := readPassword("Password: ")
+	if err != nil {
+		return err
+	}
+
+	session, err := app.client.Login(ctx, *username, password)
+	if err != nil {
+		return err
+	}
+	return app.saveSession(session)
+}
+
+func cmdRegister(ctx context.Context, app *App, args []string) error {
+	fs := newFlagSet("register", "[-u username] [-e email]")
+	username := fs.String("u", "", "username")
+	email := fs.String("e", "", "email (optional)")
+
+	if _, err := app.parseFlags(fs, args); err != nil {
+		return err
+	}
+	if *username == "" {
+		*username = readLine("Username: ")
+	}
+	password, err := readPassword("Password: ")
+	if err != nil {
+		return err
+	}
+	confirm, err := readPassword("Repeat password: ")
+	if err != nil {
+		return err
+	}
+	if password != confirm {
+		return errors.New("passwords do not match")
+	}
+
+	session, err := app.client.Register(ctx, model.RegisterRequest{
+		Username: *username,
+		Email:    *email,
+		Password: password,
+	})
+	if err != nil {
+		return err
+	}
+	return app.saveSession(session)
+}
+
+func cmdLogout(ctx context.Context, app *App, args []string) error {
+	fs := newFlagSet("logout", "")
+
+	if _, err := app.parseFlags(fs, args); err != nil {
+		return err
+	}
+	// Revoking the refresh token ends the session even if the access token
+	// has already expired, logout also revokes the access token itself.
+	if app.cfg.Token != "" {
+		if err := app.client.Logout(ctx); err != nil && !errors.Is(err, client.ErrUnauthorized) {
+			fmt.Fprintln(os.Stderr, "mdo: server logout failed:", err)
+		}
+	}
+	if err := app.client.Revoke(ctx); err != nil {
+		fmt.Fprintln(os.Stderr, "mdo: revoking session failed:", err)
+	}
+
+	fileCfg, err := readConfigFile(app.configPath)
+	if err != nil {
+		return err
+	}
+	fileCfg.Token, fileCfg.RefreshToken = "", ""
+	if err := saveConfig(app.configPath, fileCfg); err != nil {
+		return err
+	}
+	fmt.Fprintln(app.out, "logged out")
+	return nil
+}
+
+func cmdWhoami(ctx context.Context, app *App, args []string) error {
+	fs := newFlagSet("whoami", "")
+
+	if _, err := app.parseFlags(fs, args); err != nil {
+		return err
+	}
+	u, err := app.client.Me(ctx)
+	if err != nil {
+		return err
+	}
+	if app.cfg.Output == "json" {
+		return app.printJSON(u)
+	}
+	fmt.Fprintf(app.out, "%s (id %d)\n", u.Username, u.ID)
+	return nil
+}
+
+// saveSession stores a new login in the config file.
+func (app *App) saveSession(session model.Session) error {
+	if err := app.storeTokens(session); err != nil {
+		return err
+	}
+	fmt.Fprintf(app.out, "logged in as %s, token saved to %s\n", session.User.Username, app.configPath)
+	return nil
+}
+
+// storeTokens writes the session's tokens to the config file.
+func (app *App) storeTokens(session model.Session) error {
+	fileCfg, err := readConfigFile(app.configPath)
+	if err != nil {
+		return err
+	}
+	fileCfg.Token = session.AccessToken
+	fileCfg.RefreshToken = session.RefreshToken
+	if fileCfg.APIURL == "" {
+		fileCfg.APIURL = app.cfg.APIURL
+	}
+	return saveConfig(app.configPath, fileCfg)
+}
+
+func readLine(label string) string {
+	fmt.Fprint(os.Stderr, label)
+	line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	return strings.TrimSpace(line)
+}
+
+// readPassword reads without echo when stdin is a terminal, so it can also be
+// piped in from a password manager.
+func readPassword(label string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return readLine(""), nil
+	}
+	fmt.Fprint(os.Stderr, label)
+	password, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", fmt.Errorf("read password: %w", err)
+	}
+	return string(password), nil
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/thakurnishu/MinimalDo/client"
+	"github.com/thakurnishu/MinimalDo/model"
+)
+
+const dateLayout = "2006-01-02"
+
+func cmdAdd(ctx context.Context, app *App, args []string) error {
+	fs := newFlagSet("add", "<title> [-d description]")
+	description := fs.String("d", "", "description")
+	done := fs.Bool("done", false, "create the todo as already completed")
+
+	positional, err := app.parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	title := joinArgs(positional)
+	if title == "" {
+		fs.Usage()
+		return errors.New("a title is required")
+	}
+
+	todo, err := app.client.CreateTodo(ctx, model.Todo{
+		Title:       title,
+		Description: *description,
+		Completed:   *done,
+	})
+	if err != nil {
+		return err
+	}
+	return app.printTodo(todo)
+}
+
+func cmdList(ctx context.Context, app *App, args []string) error {
+	fs := newFlagSet("ls", "[--range day|week|month] [--date YYYY-MM-DD]")
+	rangeType := fs.String("range", "", "date range: day, week or month")
+	dateStr := fs.String("date", "", "reference date (YYYY-MM-DD), defaults to today")
+	pending := fs.Bool("pending", false, "only show todos that are not completed")
+
+	if _, err := app.parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	filter := func(todos []model.Todo) []model.Todo {
+		if !*pending {
+			return todos
+		}
+		var open []model.Todo
+		for _, t := range todos {
+			if !t.Completed {
+				open = append(open, t)
+			}
+		}
+		return open
+	}
+
+	// Without a range the whole list is returned, like GET /api/todos.
+	if *rangeType == "" && *dateStr == "" {
+		todos, err := app.client.ListTodos(ctx)
+		if err != nil {
+			return err
+		}
+		return app.printTodos(filter(todos))
+	}
+
+	if *rangeType == "" {
+		*rangeType = "day"
+	}
+	switch *rangeType {
+	case "day", "week", "month":
+	default:
+		return fmt.Errorf("invalid range %q, want day, week or month", *rangeType)
+	}
+
+	date := time.Now()
+	if *dateStr != "" {
+		parsed, err := time.Parse(dateLayout, *dateStr)
+		if err != nil {
+			return fmt.Errorf("invalid date %q, want YYYY-MM-DD", *dateStr)
+		}
+		date = parsed
+	}
+
+	groups, err := app.client.TodosByDate(ctx, *rangeType, date)
+	if err != nil {
+		return err
+	}
+	for i := range groups {
+		groups[i].Todos = filter(groups[i].Todos)
+	}
+	return app.printGroups(groups)
+}
+
+func cmdDone(ctx context.Context, app *App, args []string) error {
+	fs := newFlagSet("done", "<id> [--undo]")
+	undo := fs.Bool("undo", false, "mark the todo as not completed")
+
+	positional, err := app.parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	id, err := parseID(positional)
+	if err != nil {
+		fs.Usage()
+		return err
+	}
+
+	todo, err := app.client.GetTodo(ctx, id)
+	if err != nil {
+		return err
+	}
+	todo.Completed = !*undo
+
+	updated, err := app.client.UpdateTodo(ctx, todo)
+	if err != nil {
+		return err
+	}
+	return app.printTodo(updated)
+}
+
+func cmdRemove(ctx context.Context, app *App, args []string) error {
+	fs := newFlagSet("rm", "<id>")
+
+	positional, err := app.parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	id, err := parseID(positional)
+	if err != nil {
+		fs.Usage()
+		return err
+	}
+
+	todo, err := app.client.GetTodo(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := app.client.DeleteTodo(ctx, todo.ID); err != nil {
+		return err
+	}
+	if app.cfg.Output == "json" {
+		return app.printJSON(map[string]any{"id": todo.ID, "deleted": true})
+	}
+	fmt.Fprintf(app.out, "deleted todo %s\n", client.ShortID(todo.ID))
+	return nil
+}
+
+func cmdEdit(ctx context.Context, app *App, args []string) error {
+	fs := newFlagSet("edit", "<id> [-t title] [-d description]")
+	title := fs.String("t", "", "new title")
+	description := fs.String("d", "", "new description")
+
+	positional, err := app.parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	id, err := parseID(positional)
+	if err != nil {
+		fs.Usage()
+		return err
+	}
+
+	todo, err := app.client.GetTodo(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	if set["t"] || set["d"] {
+		if set["t"] {
+			todo.Title = *title
+		}
+		if set["d"] {
+			todo.Description = *description
+		}
+	} else {
+		// No flags given, edit the todo in $EDITOR.
+		todo.Title, todo.Description, err = editInEditor(todo.Title, todo.Description)
+		if err != nil {
+			return err
+		}
+	}
+	if strings.TrimSpace(todo.Title) == "" {
+		return errors.New("title must not be empty")
+	}
+
+	updated, err := app.client.UpdateTodo(ctx, todo)
+	if err != nil {
+		return err
+	}
+	return app.printTodo(updated)
+}
+
+func cmdConfig(ctx context.Context, app *App, args []string) error {
+	fs := newFlagSet("config", "[set <key> <value>]")
+
+	positional, err := app.parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if len(positional) == 0 {
+		fmt.Fprintf(app.out, "config file: %s\n", app.configPath)
+		fmt.Fprintf(app.out, "api_url:     %s\n", app.cfg.APIURL)
+		fmt.Fprintf(app.out, "token:       %s\n", maskToken(app.cfg.Token))
+		workspace := app.cfg.Workspace
+		if workspace == "" {
+			workspace = "personal"
+		}
+		fmt.Fprintf(app.out, "workspace:   %s\n", workspace)
+		fmt.Fprintf(app.out, "output:      %s\n", app.cfg.Output)
+		return nil
+	}
+
+	if positional[0] != "set" || len(positional) != 3 {
+		fs.Usage()
+		return errors.New("expected: config set <key> <value>")
+	}
+
+	// Only persist what is in the file, not env or flag overrides.
+	fileCfg, err := readConfigFile(app.configPath)
+	if err != nil {
+		return err
+	}
+	key, value := positional[1], positional[2]
+	switch key {
+	case "api_url":
+		fileCfg.APIURL = value
+	case "token":
+		fileCfg.Token = value
+	case "workspace":
+		fileCfg.Workspace = value
+	case "output":
+		if value != "table" && value != "json" {
+			return fmt.Errorf("invalid output format %q, want table or json", value)
+		}
+		fileCfg.Output = value
+	default:
+		return fmt.Errorf("unknown config key %q, want api_url, token, workspace or output", key)
+	}
+
+	if err := saveConfig(app.configPath, fileCfg); err != nil {
+		return err
+	}
+	fmt.Fprintf(app.out, "saved %s to %s\n", key, app.configPath)
+	return nil
+}
+
+// parseID returns the todo ID argument, the whole ID or the end of it as
+// list shows it.
+func parseID(args []string) (string, error) {
+	if len(args) != 1 {
+		return "", errors.New("exactly one todo id is required")
+	}
+	if args[0] == "" {
+		return "", fmt.Errorf("invalid todo id %q", args[0])
+	}
+	return args[0], nil
+}
+
+func maskToken(token string) string {
+	if token == "" {
+		return "(none)"
+	}
+	if len(token) <= 8 {
+		return "********"
+	}
+	return token[:4] + "…" + token[len(token)-4:]
+}
+
+// editInEditor opens title and description in $EDITOR. The first line of the
+// file is the title, everything after the first blank line is the description.
+func editInEditor(title, description string) (string, string, error) {
+	editor := os.Getenv("VISUAL")
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+	if editor == "" {
+		editor = "vi"
+	}
+
+	f, err := os.CreateTemp("", "mdo-*.md")
+	if err != nil {
+		return "", "", err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := fmt.Fprintf(f, "%s\n\n%s\n", title, description); err != nil {
+		f.Close()
+		return "", "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", "", err
+	}
+
+	// Let the shell split the editor command, e.g. EDITOR="code --wait".
+	cmd := exec.Command("sh", "-c", editor+` "$1"`, "sh", f.Name())
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", "", fmt.Errorf("run editor: %w", err)
+	}
+
+	data, err := os.ReadFile(f.Name())
+	if err != nil {
+		return "", "", err
+	}
+	newTitle, rest, _ := strings.Cut(string(data), "\n")
+	return strings.TrimSpace(newTitle), strings.TrimSpace(rest), nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+const bashCompletion = `# bash completion for mdo
+_mdo() {
+	local cur prev
+	cur="${COMP_WORDS[COMP_CWORD]}"
+	prev="${COMP_WORDS[COMP_CWORD-1]}"
+
+	if [ "$COMP_CWORD" -eq 1 ]; then
+		COMPREPLY=($(compgen -W "%[1]s" -- "$cur"))
+		return
+	fi
+
+	case "$prev" in
+	--range) COMPREPLY=($(compgen -W "day week month" -- "$cur")); return ;;
+	-o|--output) COMPREPLY=($(compgen -W "table json" -- "$cur")); return ;;
+	--config) COMPREPLY=($(compgen -f -- "$cur")); return ;;
+	esac
+
+	case "${COMP_WORDS[1]}" in
+	completion) COMPREPLY=($(compgen -W "bash zsh fish" -- "$cur")) ;;
+	config) COMPREPLY=($(compgen -W "set api_url token workspace output" -- "$cur")) ;;
+	ls) COMPREPLY=($(compgen -W "--range --date --pending %[2]s" -- "$cur")) ;;
+	tui) COMPREPLY=($(compgen -W "--range --date --refresh %[2]s" -- "$cur")) ;;
+	*) COMPREPLY=($(compgen -W "%[2]s" -- "$cur")) ;;
+	esac
+}
+complete -F _mdo mdo
+`
+
+const zshCompletion = `#compdef mdo
+# zsh completion for mdo
+_mdo() {
+	local -a commands
+	commands=(%[1]s)
+
+	if (( CURRENT == 2 )); then
+		_describe 'command' commands
+		return
+	fi
+
+	case "$words[2]" in
+	ls)
+		_arguments \
+			'--range[date range]:range:(day week month)' \
+			'--date[reference date]:date (YYYY-MM-DD):' \
+			'--pending[only open todos]' \
+			'(-o --output)'{-o,--output}'[output format]:format:(table json)' \
+			'--api-url[API base URL]:url:' \
+			'--token[API token]:token:' \
+			'--workspace[workspace id]:id:' \
+			'--config[config file]:file:_files'
+		;;
+	tui)
+		_arguments \
+			'--range[initial date range]:range:(day week month)' \
+			'--date[initial date]:date (YYYY-MM-DD):' \
+			'--refresh[live refresh interval]:duration:' \
+			'--api-url[API base URL]:url:' \
+			'--token[API token]:token:' \
+			'--workspace[workspace id]:id:' \
+			'--config[config file]:file:_files'
+		;;
+	completion)
+		_values 'shell' bash zsh fish
+		;;
+	config)
+		_values 'action' set api_url token workspace output
+		;;
+	*)
+		_arguments \
+			'(-o --output)'{-o,--output}'[output format]:format:(table json)' \
+			'--api-url[API base URL]:url:' \
+			'--token[API token]:token:' \
+			'--workspace[workspace id]:id:' \
+			'--config[config file]:file:_files'
+		;;
+	esac
+}
+compdef _mdo mdo
+`
+
+const fishCompletion = `# fish completion for mdo
+complete -c mdo -f
+complete -c mdo -n "__fish_use_subcommand" -a "%[1]s"
+complete -c mdo -l api-url -d "API base URL" -r
+complete -c mdo -l token -d "API token" -r
+complete -c mdo -l workspace -d "Workspace id" -x
+complete -c mdo -s o -l output -d "Output format" -xa "table json"
+complete -c mdo -l config -d "Config file" -rF
+complete -c mdo -n "__fish_seen_subcommand_from ls tui" -l range -d "Date range" -xa "day week month"
+complete -c mdo -n "__fish_seen_subcommand_from ls tui" -l date -d "Reference date (YYYY-MM-DD)" -x
+complete -c mdo -n "__fish_seen_subcommand_from tui" -l refresh -d "Live refresh interval" -x
+complete -c mdo -n "__fish_seen_subcommand_from ls" -l pending -d "Only open todos"
+complete -c mdo -n "__fish_seen_subcommand_from add edit" -s d -d "Description" -x
+complete -c mdo -n "__fish_seen_subcommand_from edit" -s t -d "Title" -x
+complete -c mdo -n "__fish_seen_subcommand_from done" -l undo -d "Reopen the todo"
+complete -c mdo -n "__fish_seen_subcommand_from completion" -xa "bash zsh fish"
+complete -c mdo -n "__fish_seen_subcommand_from config" -xa "set api_url token workspace output"
+`
+
+const globalFlagWords = "--api-url --token --workspace --output -o --config"
+
+func cmdCompletion(ctx context.Context, app *App, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: mdo completion bash|zsh|fish")
+	}
+
+	words := strings.Join(commands, " ")
+	switch args[0] {
+	case "bash":
+		fmt.Fprintf(app.out, bashCompletion, words, globalFlagWords)
+	case "zsh":
+		fmt.Fprintf(app.out, zshCompletion, words)
+	case "fish":
+		fmt.Fprintf(app.out, fishCompletion, words)
+	default:
+		return fmt.Errorf("unsupported shell %q, want bash, zsh or fish", args[0])
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+const defaultAPIURL = "http://localhost:8090/api"
+
+type Config struct {
+	APIURL string `json:"api_url"`
+	Token  string `json:"token,omitempty"`
+	// RefreshToken is rotated on every refresh, the file is rewritten each time.
+	RefreshToken string `json:"refresh_token,omitempty"`
+	Output       string `json:"output,omitempty"` // values: table, json
+	// Workspace is the id of the workspace to use, empty for the personal one.
+	Workspace string `json:"workspace,omitempty"`
+}
+
+func defaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return filepath.Join(".", "mdo.json")
+	}
+	return filepath.Join(dir, "mdo", "config.json")
+}
+
+// readConfigFile reads the config file as stored on disk. A missing file
+// yields an empty config.
+func readConfigFile(path string) (*Config, error) {
+	cfg := &Config{}
+
+	data, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		return nil, fmt.Errorf("read config: %w", err)
+	default:
+		if err := json.Unmarshal(data, cfg); err != nil {
+			return nil, fmt.Errorf("parse config %s: %w", path, err)
+		}
+	}
+	return cfg, nil
+}
+
+// loadConfig reads the config file, then lets MDO_API_URL, MDO_TOKEN and
+// MDO_WORKSPACE override it and fills in the defaults.
+func loadConfig(path string) (*Config, error) {
+	cfg, err := readConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if v := os.Getenv("MDO_API_URL"); v != "" {
+		cfg.APIURL = v
+	}
+	if v := os.Getenv("MDO_TOKEN"); v != "" {
+		cfg.Token = v
+	}
+	if v := os.Getenv("MDO_WORKSPACE"); v != "" {
+		cfg.Workspace = v
+	}
+	if cfg.APIURL == "" {
+		cfg.APIURL = defaultAPIURL
+	}
+	if cfg.Output == "" {
+		cfg.Output = "table"
+	}
+	return cfg, nil
+}
+
+func saveConfig(path string, cfg *Config) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return fmt.Errorf("create config dir: %w", err)
+	}
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	// The file may hold a token, keep it private.
+	return os.WriteFile(path, append(data, '\n'), 0o600)
+}
@@ -0,0 +1,197 @@
+// Command mdo is a terminal client for the MinimalDo REST API.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+
+	"github.com/thakurnishu/MinimalDo/client"
+	"github.com/thakurnishu/MinimalDo/model"
+)
+
+const usage = `mdo - MinimalDo from the terminal
+
+Usage:
+  mdo <command> [arguments] [flags]
+
+Commands:
+  add <title>       Create a todo (-d description)
+  ls                List todos (--range day|week|month, --date YYYY-MM-DD)
+  done <id>         Mark a todo as completed (--undo to reopen)
+  rm <id>           Delete a todo
+  edit <id>         Edit a todo (-t title, -d description, or $EDITOR)
+  tui               Full-screen terminal UI (--range, --date, --refresh)
+  login             Log in and save the session token (-u username)
+  register          Create an account and log in (-u username, -e email)
+  logout            Log out and forget the session token
+  whoami            Show the logged in user
+  workspaces        List your workspaces
+  token             Manage API tokens (token create <name> [-s scopes] [--expires 90d], token ls, token rm <id>)
+  config            Show or change the config file (config set <key> <value>)
+  completion <sh>   Print a shell completion script (bash, zsh, fish)
+
+Global flags:
+  --api-url URL     API base URL (env MDO_API_URL)
+  --token TOKEN     API token (env MDO_TOKEN)
+  --workspace ID    Workspace to use (env MDO_WORKSPACE, default: personal)
+  -o, --output FMT  Output format: table or json
+  --config PATH     Config file path
+`
+
+// commands lists every subcommand, it is also used by the completion scripts.
+var commands = []string{"add", "ls", "done", "rm", "edit", "tui", "login", "register", "logout", "whoami", "workspaces", "token", "config", "completion", "help"}
+
+type command func(ctx context.Context, app *App, args []string) error
+
+// App holds what every command needs once global flags and config are resolved.
+type App struct {
+	cfg        *Config
+	configPath string
+	client     *client.Client
+	out        io.Writer
+}
+
+// globalFlags are accepted by every subcommand.
+type globalFlags struct {
+	apiURL     string
+	token      string
+	workspace  string
+	output     string
+	configPath string
+}
+
+func (g *globalFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&g.apiURL, "api-url", "", "API base URL")
+	fs.StringVar(&g.token, "token", "", "API token")
+	fs.StringVar(&g.workspace, "workspace", "", "workspace id")
+	fs.StringVar(&g.output, "output", "", "output format: table or json")
+	fs.StringVar(&g.output, "o", "", "output format: table or json (shorthand)")
+	fs.StringVar(&g.configPath, "config", defaultConfigPath(), "config file path")
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if err := run(ctx, os.Args[1:], os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "mdo:", err)
+		if errors.Is(err, client.ErrUnauthorized) {
+			fmt.Fprintln(os.Stderr, "run 'mdo login' to get a new token")
+		}
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(2)
+		}
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, args []string, out io.Writer) error {
+	if len(args) == 0 || args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		fmt.Fprint(out, usage)
+		return nil
+	}
+
+	handlers := map[string]command{
+		"add":        cmdAdd,
+		"ls":         cmdList,
+		"done":       cmdDone,
+		"rm":         cmdRemove,
+		"edit":       cmdEdit,
+		"tui":        cmdTUI,
+		"login":      cmdLogin,
+		"register":   cmdRegister,
+		"logout":     cmdLogout,
+		"whoami":     cmdWhoami,
+		"workspaces": cmdWorkspaces,
+		"token":      cmdToken,
+		"config":     cmdConfig,
+		"completion": cmdCompletion,
+	}
+
+	name := args[0]
+	handler, ok := handlers[name]
+	if !ok {
+		return fmt.Errorf("unknown command %q, see 'mdo help'", name)
+	}
+
+	return handler(ctx, &App{out: out}, args[1:])
+}
+
+// parseFlags parses fs allowing flags and positional arguments to be mixed,
+// so `mdo add "title" -d desc` works. Global flags are registered on fs and
+// the app is configured from them before returning the positional arguments.
+func (app *App) parseFlags(fs *flag.FlagSet, args []string) ([]string, error) {
+	var g globalFlags
+	g.register(fs)
+
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			break
+		}
+		if args[0] == "--" {
+			positional = append(positional, args[1:]...)
+			break
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+
+	cfg, err := loadConfig(g.configPath)
+	if err != nil {
+		return nil, err
+	}
+	if g.apiURL != "" {
+		cfg.APIURL = g.apiURL
+	}
+	if g.token != "" {
+		cfg.Token = g.token
+	}
+	if g.workspace != "" {
+		cfg.Workspace = g.workspace
+	}
+	if g.output != "" {
+		cfg.Output = g.output
+	}
+	if cfg.Output != "table" && cfg.Output != "json" {
+		return nil, fmt.Errorf("invalid output format %q, want table or json", cfg.Output)
+	}
+
+	app.cfg = cfg
+	app.configPath = g.configPath
+	app.client = client.New(cfg.APIURL, cfg.Token)
+	app.client.SetWorkspace(cfg.Workspace)
+	// A token given on the command line or in MDO_TOKEN is used as is, only
+	// the logged in session from the config file is refreshed.
+	if g.token == "" && os.Getenv("MDO_TOKEN") == "" && cfg.RefreshToken != "" {
+		app.client.SetRefreshToken(cfg.RefreshToken, func(session model.Session) {
+			if err := app.storeTokens(session); err != nil {
+				fmt.Fprintln(os.Stderr, "mdo: saving refreshed token failed:", err)
+			}
+		})
+	}
+	return positional, nil
+}
+
+func newFlagSet(name, usageLine string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: mdo %s %s\n\nFlags:\n", name, usageLine)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+func joinArgs(args []string) string {
+	return strings.TrimSpace(strings.Join(args, " "))
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/thakurnishu/MinimalDo/client"
+	"github.com/thakurnishu/MinimalDo/model"
+)
+
+const maxDescriptionWidth = 40
+
+func (app *App) printJSON(v any) error {
+	enc := json.NewEncoder(app.out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func (app *App) printTodo(t model.Todo) error {
+	if app.cfg.Output == "json" {
+		return app.printJSON(t)
+	}
+	return app.printTodos([]model.Todo{t})
+}
+
+func (app *App) printTodos(todos []model.Todo) error {
+	if app.cfg.Output == "json" {
+		if todos == nil {
+			todos = []model.Todo{}
+		}
+		return app.printJSON(todos)
+	}
+	if len(todos) == 0 {
+		fmt.Fprintln(app.out, "no todos")
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(app.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tDONE\tTITLE\tDESCRIPTION\tCREATED")
+	for _, t := range todos {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n",
+			client.ShortID(t.ID),
+			checkbox(t.Completed),
+			t.Title,
+			truncate(t.Description, maxDescriptionWidth),
+			t.CreatedAt.Local().Format("2006-01-02 15:04"),
+		)
+	}
+	return tw.Flush()
+}
+
+func (app *App) printGroups(groups []model.GroupedTodos) error {
+	if app.cfg.Output == "json" {
+		if groups == nil {
+			groups = []model.GroupedTodos{}
+		}
+		return app.printJSON(groups)
+	}
+	if len(groups) == 0 {
+		fmt.Fprintln(app.out, "no todos")
+		return nil
+	}
+
+	for i, g := range groups {
+		if i > 0 {
+			fmt.Fprintln(app.out)
+		}
+		fmt.Fprintf(app.out, "== %s ==\n", g.Date)
+		if err := app.printTodos(g.Todos); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkbox(done bool) string {
+	if done {
+		return "[x]"
+	}
+	return "[ ]"
+}
+
+// truncate shortens s to width runes and keeps it on one line.
+func truncate(s string, width int) string {
+	s = strings.Join(strings.Fields(s), " ")
+	r := []rune(s)
+	if len(r) <= width {
+		return s
+	}
+	return string(r[:width-1]) + "…"
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/thakurnishu/MinimalDo/model"
+)
+
+const tokenUsage = "create <name> [-s scopes] [--expires 90d] | ls | rm <id>"
+
+// cmdToken manages personal access tokens for scripts and CI.
+func cmdToken(ctx context.Context, app *App, args []string) error {
+	fs := newFlagSet("token", tokenUsage)
+	scopes := fs.String("s", model.ScopeTodosRead+","+model.ScopeTodosWrite, "comma separated scopes")
+	expires := fs.String("expires", "", "lifetime, e.g. 720h or 90d (default: never expires)")
+
+	positional, err := app.parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) == 0 {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+
+	switch sub, rest := positional[0], positional[1:]; sub {
+	case "create":
+		return app.createToken(ctx, rest, *scopes, *expires)
+	case "ls":
+		return app.listTokens(ctx)
+	case "rm":
+		if len(rest) != 1 {
+			return errors.New("exactly one token id is required")
+		}
+		id, err := strconv.Atoi(rest[0])
+		if err != nil || id <= 0 {
+			return fmt.Errorf("invalid token id %q", rest[0])
+		}
+		if err := app.client.RevokeToken(ctx, id); err != nil {
+			return err
+		}
+		fmt.Fprintf(app.out, "revoked token %d\n", id)
+		return nil
+	default:
+		fs.Usage()
+		return fmt.Errorf("unknown token command %q", sub)
+	}
+}
+
+func (app *App) createToken(ctx context.Context, args []string, scopes, expires string) error {
+	name := joinArgs(args)
+	if name == "" {
+		return errors.New("a token name is required")
+	}
+	req := model.CreateTokenRequest{Name: name, Scopes: strings.Split(scopes, ",")}
+	if expires != "" {
+		ttl, err := parseLifetime(expires)
+		if err != nil {
+			return err
+		}
+		at := time.Now().Add(ttl)
+		req.ExpiresAt = &at
+	}
+
+	created, err := app.client.CreateToken(ctx, req)
+	if err != nil {
+		return err
+	}
+	if app.cfg.Output == "json" {
+		return app.printJSON(created)
+	}
+	fmt.Fprintln(app.out, created.Token)
+	fmt.Fprintln(app.out, "store it now, it can't be shown again")
+	return nil
+}
+
+func (app *App) listTokens(ctx context.Context) error {
+	tokens, err := app.client.ListTokens(ctx)
+	if err != nil {
+		return err
+	}
+	if app.cfg.Output == "json" {
+		if tokens == nil {
+			tokens = []model.APIToken{}
+		}
+		return app.printJSON(tokens)
+	}
+	if len(tokens) == 0 {
+		fmt.Fprintln(app.out, "no tokens")
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(app.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tPREFIX\tSCOPES\tEXPIRES\tLAST USED")
+	for _, t := range tokens {
+		fmt.Fprintf(tw, "%d\t%s\t%s…\t%s\t%s\t%s\n",
+			t.ID,
+			t.Name,
+			t.Prefix,
+			strings.Join(t.Scopes, ","),
+			formatOptionalTime(t.ExpiresAt, "never"),
+			formatOptionalTime(t.LastUsedAt, "never"),
+		)
+	}
+	return tw.Flush()
+}
+
+// parseLifetime accepts Go durations plus a "d" suffix for days.
+func parseLifetime(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid lifetime %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid lifetime %q", s)
+	}
+	return d, nil
+}
+
+func formatOptionalTime(t *time.Time, fallback string) string {
+	if t == nil {
+		return fallback
+	}
+	return t.Local().Format("2006-01-02 15:04")
+}
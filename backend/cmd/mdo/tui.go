@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/thakurnishu/MinimalDo/tui"
+)
+
+func cmdTUI(ctx context.Context, app *App, args []string) error {
+	fs := newFlagSet("tui", "[--range day|week|month] [--date YYYY-MM-DD] [--refresh 5s]")
+	rangeType := fs.String("range", "day", "initial date range: day, week or month")
+	dateStr := fs.String("date", "", "initial date (YYYY-MM-DD), defaults to today")
+	refresh := fs.Duration("refresh", 5*time.Second, "live refresh interval, 0 to disable")
+
+	if _, err := app.parseFlags(fs, args); err != nil {
+		return err
+	}
+	switch *rangeType {
+	case "day", "week", "month":
+	default:
+		return fmt.Errorf("invalid range %q, want day, week or month", *rangeType)
+	}
+
+	date := time.Now()
+	if *dateStr != "" {
+		parsed, err := time.Parse(dateLayout, *dateStr)
+		if err != nil {
+			return fmt.Errorf("invalid date %q, want YYYY-MM-DD", *dateStr)
+		}
+		date = parsed
+	}
+
+	return tui.Run(ctx, tui.Options{
+		Client:          app.client,
+		Range:           *rangeType,
+		Date:            date,
+		RefreshInterval: *refresh,
+	})
+}
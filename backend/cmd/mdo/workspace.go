@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/thakurnishu/MinimalDo/model"
+)
+
+func cmdWorkspaces(ctx context.Context, app *App, args []string) error {
+	fs := newFlagSet("workspaces", "")
+
+	if _, err := app.parseFlags(fs, args); err != nil {
+		return err
+	}
+	workspaces, err := app.client.Workspaces(ctx)
+	if err != nil {
+		return err
+	}
+	if app.cfg.Output == "json" {
+		if workspaces == nil {
+			workspaces = []model.Workspace{}
+		}
+		return app.printJSON(workspaces)
+	}
+
+	tw := tabwriter.NewWriter(app.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tROLE\t")
+	for _, w := range workspaces {
+		current := w.Personal && app.cfg.Workspace == "" || app.cfg.Workspace == strconv.Itoa(w.ID)
+		marker := ""
+		if current {
+			marker = "*"
+		}
+		name := w.Name
+		if w.Personal {
+			name += " (personal)"
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", w.ID, name, w.Role, marker)
+	}
+	return tw.Flush()
+}
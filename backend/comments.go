@@ -0,0 +1,559 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"github.com/thakurnishu/MinimalDo/model"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const maxCommentLength = 10000
+
+// commentCount is the select expression for Todo.CommentCount.
+const commentCount = `(SELECT COUNT(*) FROM todo_comments c WHERE c.todo_id = todos.id)`
+
+var (
+	// an @ that doesn't follow a word character, so email addresses aren't
+	// taken for mentions
+	mentionPattern = regexp.MustCompile(`(?:^|[^\w@.])@([a-zA-Z0-9_.-]{3,64})`)
+	// markdown code, where an @ is never a mention
+	codePattern = regexp.MustCompile("(?s)```.*?```|`[^`\n]*`")
+)
+
+// mentionedUsernames returns the distinct usernames @mentioned in a markdown
+// body, ignoring code spans and blocks.
+func mentionedUsernames(body string) []string {
+	body = codePattern.ReplaceAllString(body, " ")
+	var names []string
+	for _, m := range mentionPattern.FindAllStringSubmatch(body, -1) {
+		// "thanks @bob." ends a sentence, it doesn't mention "bob."
+		name := strings.TrimRight(m[1], ".-")
+		if usernamePattern.MatchString(name) && !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// saveMentions replaces the mentions of a comment with the users mentioned
+// in body. Only people who can see the todo are resolved, other names are
+// left as plain text.
+func saveMentions(ctx context.Context, tx *sql.Tx, commentID, todoID int, body string) error {
+	if _, err := tx.ExecContext(ctx, "DELETE FROM todo_comment_mentions WHERE comment_id = $1", commentID); err != nil {
+		return err
+	}
+	names := mentionedUsernames(body)
+	if len(names) == 0 {
+		return nil
+	}
+
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO todo_comment_mentions (comment_id, user_id)
+		SELECT $1, u.id
+		FROM users u, todos t
+		WHERE t.id = $2 AND u.username = ANY($3)
+		AND ((t.list_id IS NULL AND u.id = t.owner_id)
+			OR u.id IN (SELECT user_id FROM list_members WHERE list_id = t.list_id))
+	`, commentID, todoID, pq.Array(names))
+	return err
+}
+
+// loadMentions returns the mentioned users of each comment.
+func loadMentions(ctx context.Context, db dbtx, commentIDs []int64) (map[int][]model.User, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT m.comment_id, u.id, u.username, u.created_at
+		FROM todo_comment_mentions m
+		JOIN users u ON u.id = m.user_id
+		WHERE m.comment_id = ANY($1)
+		ORDER BY u.username
+	`, pq.Array(commentIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	mentions := make(map[int][]model.User)
+	for rows.Next() {
+		var commentID int
+		var u model.User
+		if err := rows.Scan(&commentID, &u.ID, &u.Username, &u.CreatedAt); err != nil {
+			return nil, err
+		}
+		mentions[commentID] = append(mentions[commentID], u)
+	}
+	return mentions, rows.Err()
+}
+
+// queryComments returns the comments of a todo, oldest first, or the single
+// comment commentID when it is not zero.
+func queryComments(ctx context.Context, db dbtx, todoID, commentID int) ([]model.Comment, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT c.id, todo_uuid(c.todo_id), c.body, c.created_at, c.updated_at,
+			EXISTS (SELECT 1 FROM todo_comment_revisions r WHERE r.comment_id = c.id),
+			u.id, u.username, u.created_at
+		FROM todo_comments c
+		LEFT JOIN users u ON u.id = c.author_id
+		WHERE c.todo_id = $1 AND ($2 = 0 OR c.id = $2)
+		ORDER BY c.created_at, c.id
+	`, todoID, commentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	comments := []model.Comment{}
+	var ids []int64
+	for rows.Next() {
+		var cm model.Comment
+		var authorID *int
+		var authorName *string
+		var authorCreated sql.NullTime
+		err := rows.Scan(&cm.ID, &cm.TodoID, &cm.Body, &cm.CreatedAt, &cm.UpdatedAt, &cm.Edited,
+			&authorID, &authorName, &authorCreated)
+		if err != nil {
+			return nil, err
+		}
+		if authorID != nil {
+			cm.Author = &model.User{ID: *authorID, Username: *authorName, CreatedAt: authorCreated.Time}
+		}
+		comments = append(comments, cm)
+		ids = append(ids, int64(cm.ID))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(comments) == 0 {
+		return comments, nil
+	}
+
+	mentions, err := loadMentions(ctx, db, ids)
+	if err != nil {
+		return nil, err
+	}
+	for i := range comments {
+		comments[i].Mentions = mentions[comments[i].ID]
+		if comments[i].Mentions == nil {
+			comments[i].Mentions = []model.User{}
+		}
+	}
+	return comments, nil
+}
+
+func validateCommentBody(body string) (string, error) {
+	body = strings.TrimSpace(body)
+	if body == "" {
+		return "", errors.New("comment body is required")
+	}
+	if utf8.RuneCountInString(body) > maxCommentLength {
+		return "", errors.New("comment body must be at most 10000 characters")
+	}
+	return body, nil
+}
+
+// commentParams parses the todo and comment ids of the single comment routes.
+func (s *Server) commentParams(c *gin.Context, ctx context.Context, span trace.Span) (todoID, commentID int, ok bool) {
+	if todoID, ok = s.todoParam(c, ctx, span); !ok {
+		return 0, 0, false
+	}
+	if commentID, ok = s.paramID(c, ctx, span, "comment_id"); !ok {
+		return 0, 0, false
+	}
+	span.SetAttributes(
+		attribute.Int("task.id", todoID),
+		attribute.Int("comment.id", commentID),
+	)
+	return todoID, commentID, true
+}
+
+// getComment loads a comment, answering 404 if the todo has no such comment.
+func (s *Server) getComment(c *gin.Context, ctx context.Context, span trace.Span, db dbtx, todoID, commentID int) (model.Comment, bool) {
+	comments, err := queryComments(ctx, db, todoID, commentID)
+	if err != nil {
+		logError("query failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return model.Comment{}, false
+	}
+	if len(comments) == 0 {
+		logError("comment not found", ctx, s.logger, span, sql.ErrNoRows,
+			slog.Int("task_id", todoID),
+			slog.Int("comment_id", commentID),
+		)
+		c.JSON(http.StatusNotFound, gin.H{"error": "Comment not found"})
+		return model.Comment{}, false
+	}
+	return comments[0], true
+}
+
+// denyComment answers 403 for a comment the caller didn't write.
+func (s *Server) denyComment(c *gin.Context, ctx context.Context, span trace.Span, commentID int, msg string) {
+	userID := currentUserID(c)
+	span.SetAttributes(
+		attribute.Int("user.id", userID),
+		attribute.String("authz.resource.type", "comment"),
+		attribute.Int("authz.resource.id", commentID),
+	)
+	logError("access denied", ctx, s.logger, span, errForbidden,
+		slog.Int("user_id", userID),
+		slog.String("resource_type", "comment"),
+		slog.Int("resource_id", commentID),
+	)
+	c.JSON(http.StatusForbidden, gin.H{"error": msg})
+}
+
+func (s *Server) getComments(c *gin.Context) {
+	ctx, span := s.tracer.Start(c.Request.Context(), "get_comments")
+	defer span.End()
+
+	todoID, ok := s.todoParam(c, ctx, span)
+	if !ok {
+		return
+	}
+	span.SetAttributes(attribute.Int("task.id", todoID))
+
+	tx, err := s.beginTenantTx(ctx, c)
+	if err != nil {
+		logError("begin transaction failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	if !s.authorizeTodo(c, ctx, span, tx, todoID, roleViewer) {
+		return
+	}
+
+	comments, err := queryComments(ctx, tx, todoID, 0)
+	if err != nil {
+		logError("query failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	span.SetAttributes(attribute.Int("comment.count", len(comments)))
+	c.JSON(http.StatusOK, comments)
+}
+
+// createComment adds a comment. Everyone who can see a todo can comment on
+// it, viewers included.
+func (s *Server) createComment(c *gin.Context) {
+	ctx, span := s.tracer.Start(c.Request.Context(), "create_comment")
+	defer span.End()
+
+	todoID, ok := s.todoParam(c, ctx, span)
+	if !ok {
+		return
+	}
+	userID := currentUserID(c)
+	span.SetAttributes(
+		attribute.Int("task.id", todoID),
+		attribute.Int("user.id", userID),
+	)
+
+	var req model.CommentRequest
+	if err := c.BindJSON(&req); err != nil {
+		logError("failed to parse json", ctx, s.logger, span, err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	body, err := validateCommentBody(req.Body)
+	if err != nil {
+		logError("invalid comment", ctx, s.logger, span, err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tx, err := s.beginTenantTx(ctx, c)
+	if err != nil {
+		logError("begin transaction failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	if !s.authorizeTodo(c, ctx, span, tx, todoID, roleViewer) {
+		return
+	}
+
+	var commentID int
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO todo_comments (todo_id, author_id, body) VALUES ($1, $2, $3) RETURNING id
+	`, todoID, userID, body).Scan(&commentID)
+	if err != nil {
+		logError("row scan failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := saveMentions(ctx, tx, commentID, todoID, body); err != nil {
+		logError("saving mentions failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	comment, ok := s.getComment(c, ctx, span, tx, todoID, commentID)
+	if !ok {
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		logError("commit failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	s.logger.InfoContext(ctx, "comment created",
+		slog.Int("task_id", todoID),
+		slog.Int("comment_id", commentID),
+		slog.Int("mention_count", len(comment.Mentions)),
+	)
+	span.SetAttributes(attribute.Int("comment.id", commentID))
+
+	c.JSON(http.StatusCreated, comment)
+}
+
+// updateComment edits a comment, keeping the previous body as a revision.
+// Only the author can edit their comment.
+func (s *Server) updateComment(c *gin.Context) {
+	ctx, span := s.tracer.Start(c.Request.Context(), "update_comment")
+	defer span.End()
+
+	todoID, commentID, ok := s.commentParams(c, ctx, span)
+	if !ok {
+		return
+	}
+	userID := currentUserID(c)
+
+	var req model.CommentRequest
+	if err := c.BindJSON(&req); err != nil {
+		logError("failed to parse json", ctx, s.logger, span, err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	body, err := validateCommentBody(req.Body)
+	if err != nil {
+		logError("invalid comment", ctx, s.logger, span, err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tx, err := s.beginTenantTx(ctx, c)
+	if err != nil {
+		logError("begin transaction failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	if !s.authorizeTodo(c, ctx, span, tx, todoID, roleViewer) {
+		return
+	}
+
+	var authorID sql.NullInt64
+	var oldBody string
+	err = tx.QueryRowContext(ctx, `
+		SELECT author_id, body FROM todo_comments WHERE id = $1 AND todo_id = $2 FOR UPDATE
+	`, commentID, todoID).Scan(&authorID, &oldBody)
+	if err == sql.ErrNoRows {
+		logError("comment not found", ctx, s.logger, span, err,
+			slog.Int("comment_id", commentID),
+		)
+		c.JSON(http.StatusNotFound, gin.H{"error": "Comment not found"})
+		return
+	}
+	if err != nil {
+		logError("comment lookup failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !authorID.Valid || int(authorID.Int64) != userID {
+		s.denyComment(c, ctx, span, commentID, "Only the author can edit this comment")
+		return
+	}
+
+	// saving the same text again isn't an edit
+	if body != oldBody {
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO todo_comment_revisions (comment_id, body, edited_by) VALUES ($1, $2, $3)
+		`, commentID, oldBody, userID)
+		if err == nil {
+			_, err = tx.ExecContext(ctx, "UPDATE todo_comments SET body = $2 WHERE id = $1", commentID, body)
+		}
+		if err == nil {
+			err = saveMentions(ctx, tx, commentID, todoID, body)
+		}
+		if err != nil {
+			logError("comment update failed", ctx, s.logger, span, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	comment, ok := s.getComment(c, ctx, span, tx, todoID, commentID)
+	if !ok {
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		logError("commit failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	s.logger.InfoContext(ctx, "comment updated",
+		slog.Int("task_id", todoID),
+		slog.Int("comment_id", commentID),
+		slog.Bool("changed", body != oldBody),
+	)
+	c.JSON(http.StatusOK, comment)
+}
+
+// deleteComment deletes a comment with its revisions. Authors can delete
+// their own comments, owners of the todo or its list can delete any.
+func (s *Server) deleteComment(c *gin.Context) {
+	ctx, span := s.tracer.Start(c.Request.Context(), "delete_comment")
+	defer span.End()
+
+	todoID, commentID, ok := s.commentParams(c, ctx, span)
+	if !ok {
+		return
+	}
+	userID := currentUserID(c)
+
+	tx, err := s.beginTenantTx(ctx, c)
+	if err != nil {
+		logError("begin transaction failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	if !s.authorizeTodo(c, ctx, span, tx, todoID, roleViewer) {
+		return
+	}
+	_, have, err := todoRole(ctx, tx, todoID, userID)
+	if err != nil {
+		logError("role lookup failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	result, err := tx.ExecContext(ctx, `
+		DELETE FROM todo_comments WHERE id = $1 AND todo_id = $2 AND (author_id = $3 OR $4)
+	`, commentID, todoID, userID, have >= roleOwner)
+	if err != nil {
+		logError("query execution failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		logError("affected rows check failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if rowsAffected == 0 {
+		// tell a missing comment from one the caller may not delete
+		var exists bool
+		err := tx.QueryRowContext(ctx, `
+			SELECT EXISTS (SELECT 1 FROM todo_comments WHERE id = $1 AND todo_id = $2)
+		`, commentID, todoID).Scan(&exists)
+		if err != nil {
+			logError("comment lookup failed", ctx, s.logger, span, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if exists {
+			s.denyComment(c, ctx, span, commentID, "Only the author or an owner can delete this comment")
+			return
+		}
+		logError("comment not found", ctx, s.logger, span, sql.ErrNoRows,
+			slog.Int("comment_id", commentID),
+		)
+		c.JSON(http.StatusNotFound, gin.H{"error": "Comment not found"})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		logError("commit failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	s.logger.InfoContext(ctx, "comment deleted",
+		slog.Int("task_id", todoID),
+		slog.Int("comment_id", commentID),
+	)
+	c.Status(http.StatusNoContent)
+}
+
+// getCommentRevisions returns the earlier bodies of a comment, newest first.
+func (s *Server) getCommentRevisions(c *gin.Context) {
+	ctx, span := s.tracer.Start(c.Request.Context(), "get_comment_revisions")
+	defer span.End()
+
+	todoID, commentID, ok := s.commentParams(c, ctx, span)
+	if !ok {
+		return
+	}
+
+	tx, err := s.beginTenantTx(ctx, c)
+	if err != nil {
+		logError("begin transaction failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	if !s.authorizeTodo(c, ctx, span, tx, todoID, roleViewer) {
+		return
+	}
+	if _, ok := s.getComment(c, ctx, span, tx, todoID, commentID); !ok {
+		return
+	}
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT r.body, r.edited_at, u.id, u.username, u.created_at
+		FROM todo_comment_revisions r
+		LEFT JOIN users u ON u.id = r.edited_by
+		WHERE r.comment_id = $1
+		ORDER BY r.edited_at DESC, r.id DESC
+	`, commentID)
+	if err != nil {
+		logError("query failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	revisions := []model.CommentRevision{}
+	for rows.Next() {
+		var r model.CommentRevision
+		var editorID *int
+		var editorName *string
+		var editorCreated sql.NullTime
+		if err := rows.Scan(&r.Body, &r.EditedAt, &editorID, &editorName, &editorCreated); err != nil {
+			logError("rows scan failed", ctx, s.logger, span, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if editorID != nil {
+			r.EditedBy = &model.User{ID: *editorID, Username: *editorName, CreatedAt: editorCreated.Time}
+		}
+		revisions = append(revisions, r)
+	}
+	if err := rows.Err(); err != nil {
+		logError("row iteration failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, revisions)
+}
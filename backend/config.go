@@ -2,6 +2,8 @@ package main
 
 import (
 	"log/slog"
+	"strings"
+	"time"
 )
 
 type Config struct {
@@ -15,6 +17,77 @@ type Config struct {
 	DBUser string
 	DBName string
 	DBPassword string
+
+	// Auth
+	JWTKeys string // kid:alg:base64key,... alg is HS256 or EdDSA
+	JWTSigningKID string
+	AccessTokenTTL time.Duration
+	RefreshTokenTTL time.Duration
+	AdoptTodosUser string // username that gets the todos from before accounts existed
+
+	// OIDC, disabled when OIDCIssuerURL is empty
+	OIDCIssuerURL string
+	OIDCClientID string
+	OIDCClientSecret string // empty for public clients, PKCE is always used
+	OIDCRedirectURL string // this backend's /api/auth/oidc/callback
+	OIDCScopes []string
+	OIDCProviderName string
+	OIDCUsernameClaim string
+	OIDCAutoProvision bool
+	OIDCLinkByEmail bool
+
+	// Attachments
+	BlobStore string // local or s3
+	BlobDir string // for local
+	S3Endpoint string // host[:port] of an S3 compatible store, e.g. MinIO
+	S3Region string
+	S3Bucket string
+	S3AccessKey string
+	S3SecretKey string
+	S3UseSSL bool
+	AttachmentMaxBytes int64
+	AttachmentTypes []string // allowed media types, as detected by http.DetectContentType
+
+	// Undo
+	UndoTTL time.Duration // how long the token returned by a todo change can undo it
+
+	// Event stream
+	EventsHeartbeat time.Duration // keeps idle streams open through proxies
+
+	// Webhooks
+	WebhookPollInterval time.Duration // how often the worker looks for due deliveries
+	WebhookTimeout time.Duration
+	WebhookMaxAttempts int64 // a delivery is failed after this many attempts
+	WebhookRetryBase time.Duration // the wait after the first failed attempt, doubled after each one
+	WebhookAllowPrivate bool // allow loopback and private addresses, for development
+
+	// Outbox
+	OutboxSinks []string // where else todo events are published: log, nats
+	OutboxPollInterval time.Duration
+	OutboxRetryBase time.Duration // the wait after the first failed publish, doubled after each one
+	OutboxRetention time.Duration // how long published events are kept
+	NATSURL string
+	NATSSubjectPrefix string
+	NATSJetStream bool // publish to a JetStream stream and wait for it to store the event
+	NATSStream string
+	NATSStreamMaxAge time.Duration
+	NATSEmbedded bool // run a NATS server in the backend
+	NATSEmbeddedHost string
+	NATSEmbeddedPort int64 // -1 to only accept in process connections
+	NATSStoreDir string // where the embedded server keeps JetStream data
+
+	// Rules
+	RulesMaxDepth int64 // how many rules may run in a row, each on the change of the one before
+	RulesDueSoonWindow time.Duration // how long before its due date a todo is due soon
+	RulesDueSoonInterval time.Duration // how often due soon todos are looked for
+	RulesPollInterval time.Duration // how often the worker looks for queued runs
+	ScriptTimeout time.Duration // how long a script action may run
+	ScriptMaxMemory int64 // bytes a script action may allocate
+
+	// Plugins
+	PluginsDir string // where the *.wasm plugins are, empty for none
+	PluginTimeout time.Duration // how long a plugin may take for a request
+	PluginMaxMemory int64 // bytes of memory a plugin instance may use
 	
 	// otel
 	ServiceName string
@@ -36,6 +109,69 @@ func loadConfig() *Config {
 		DBUser: GetEnv("DB_USER"),
 		DBName: GetEnv("DB_NAME"),
 		DBPassword: GetEnv("DB_PASSWORD"),
+		// Auth
+		JWTKeys: GetEnvOrDefault("JWT_KEYS", ""),
+		JWTSigningKID: GetEnvOrDefault("JWT_SIGNING_KID", ""),
+		AccessTokenTTL: GetEnvDuration("ACCESS_TOKEN_TTL", 15*time.Minute),
+		RefreshTokenTTL: GetEnvDuration("REFRESH_TOKEN_TTL", 30*24*time.Hour),
+		AdoptTodosUser: GetEnvOrDefault("ADOPT_TODOS_USER", ""),
+		// OIDC
+		OIDCIssuerURL: GetEnvOrDefault("OIDC_ISSUER_URL", ""),
+		OIDCClientID: GetEnvOrDefault("OIDC_CLIENT_ID", ""),
+		OIDCClientSecret: GetEnvOrDefault("OIDC_CLIENT_SECRET", ""),
+		OIDCRedirectURL: GetEnvOrDefault("OIDC_REDIRECT_URL", ""),
+		OIDCScopes: strings.Fields(GetEnvOrDefault("OIDC_SCOPES", "openid profile email")),
+		OIDCProviderName: GetEnvOrDefault("OIDC_PROVIDER_NAME", "SSO"),
+		OIDCUsernameClaim: GetEnvOrDefault("OIDC_USERNAME_CLAIM", "preferred_username"),
+		OIDCAutoProvision: GetEnvOrDefault("OIDC_AUTO_PROVISION", "true") == "true",
+		OIDCLinkByEmail: GetEnvOrDefault("OIDC_LINK_BY_EMAIL", "false") == "true",
+		// Attachments
+		BlobStore: GetEnvOrDefault("BLOB_STORE", "local"),
+		BlobDir: GetEnvOrDefault("BLOB_DIR", "./data/attachments"),
+		S3Endpoint: GetEnvOrDefault("S3_ENDPOINT", ""),
+		S3Region: GetEnvOrDefault("S3_REGION", "us-east-1"),
+		S3Bucket: GetEnvOrDefault("S3_BUCKET", "minimaldo-attachments"),
+		S3AccessKey: GetEnvOrDefault("S3_ACCESS_KEY", ""),
+		S3SecretKey: GetEnvOrDefault("S3_SECRET_KEY", ""),
+		S3UseSSL: GetEnvOrDefault("S3_USE_SSL", "false") == "true",
+		AttachmentMaxBytes: GetEnvInt64("ATTACHMENT_MAX_BYTES", 10<<20),
+		AttachmentTypes: strings.Split(GetEnvOrDefault("ATTACHMENT_TYPES",
+			"image/png,image/jpeg,image/gif,image/webp,text/plain,application/pdf,application/zip,application/x-gzip"), ","),
+		// Undo
+		UndoTTL: GetEnvDuration("UNDO_TTL", time.Minute),
+		// Event stream
+		EventsHeartbeat: GetEnvDuration("EVENTS_HEARTBEAT", 15*time.Second),
+		// Webhooks
+		WebhookPollInterval: GetEnvDuration("WEBHOOK_POLL_INTERVAL", time.Second),
+		WebhookTimeout: GetEnvDuration("WEBHOOK_TIMEOUT", 10*time.Second),
+		WebhookMaxAttempts: GetEnvInt64("WEBHOOK_MAX_ATTEMPTS", 10),
+		WebhookRetryBase: GetEnvDuration("WEBHOOK_RETRY_BASE", 30*time.Second),
+		WebhookAllowPrivate: GetEnvOrDefault("WEBHOOK_ALLOW_PRIVATE", "false") == "true",
+		// Outbox
+		OutboxSinks: strings.Split(GetEnvOrDefault("OUTBOX_SINKS", ""), ","),
+		OutboxPollInterval: GetEnvDuration("OUTBOX_POLL_INTERVAL", time.Second),
+		OutboxRetryBase: GetEnvDuration("OUTBOX_RETRY_BASE", 5*time.Second),
+		OutboxRetention: GetEnvDuration("OUTBOX_RETENTION", 24*time.Hour),
+		NATSURL: GetEnvOrDefault("NATS_URL", "nats://localhost:4222"),
+		NATSSubjectPrefix: GetEnvOrDefault("NATS_SUBJECT_PREFIX", "minimaldo"),
+		NATSJetStream: GetEnvOrDefault("NATS_JETSTREAM", "false") == "true",
+		NATSStream: GetEnvOrDefault("NATS_STREAM", "MINIMALDO"),
+		NATSStreamMaxAge: GetEnvDuration("NATS_STREAM_MAX_AGE", 7*24*time.Hour),
+		NATSEmbedded: GetEnvOrDefault("NATS_EMBEDDED", "false") == "true",
+		NATSEmbeddedHost: GetEnvOrDefault("NATS_EMBEDDED_HOST", "127.0.0.1"),
+		NATSEmbeddedPort: GetEnvInt64("NATS_EMBEDDED_PORT", 4222),
+		NATSStoreDir: GetEnvOrDefault("NATS_STORE_DIR", "./data/nats"),
+		// Rules
+		RulesMaxDepth: GetEnvInt64("RULES_MAX_DEPTH", 3),
+		RulesDueSoonWindow: GetEnvDuration("RULES_DUE_SOON_WINDOW", 24*time.Hour),
+		RulesDueSoonInterval: GetEnvDuration("RULES_DUE_SOON_INTERVAL", time.Minute),
+		RulesPollInterval: GetEnvDuration("RULES_POLL_INTERVAL", time.Second),
+		ScriptTimeout: GetEnvDuration("SCRIPT_TIMEOUT", 250*time.Millisecond),
+		ScriptMaxMemory: GetEnvInt64("SCRIPT_MAX_MEMORY", 32<<20),
+		// Plugins
+		PluginsDir: GetEnvOrDefault("PLUGINS_DIR", "./plugins"),
+		PluginTimeout: GetEnvDuration("PLUGIN_TIMEOUT", 2*time.Second),
+		PluginMaxMemory: GetEnvInt64("PLUGIN_MAX_MEMORY", 16<<20),
 		// Otel
 		ServiceName: GetEnv("APP_NAME"),
 		OtelExporterOtlpEndpointGRPC: GetEnv("OTEL_EXPORTER_OTLP_ENDPOINT_GRPC"),
@@ -0,0 +1,205 @@
+// Package crdt holds the conflict-free replicated state of a todo, so edits
+// made offline on several devices merge to the same result wherever and in
+// whatever order they are merged. Scalar fields are last-writer-wins
+// registers, the description is a sequence CRDT (RGA) that keeps concurrent
+// insertions and deletions of both sides.
+//
+// Every replica has a node ID of its own choosing, unique among the
+// replicas of a user, e.g. a random ID generated on install. The server is
+// ServerNode.
+package crdt
+
+import (
+	"cmp"
+	"errors"
+	"time"
+)
+
+// ServerNode is the node ID of edits made by the server, for clients that
+// send plain values instead of CRDT state.
+const ServerNode = "server"
+
+// ErrInvalid is returned for state that can't have come from this package.
+var ErrInvalid = errors.New("invalid crdt state")
+
+// ErrTooLarge is returned for a text with more than MaxElems characters,
+// tombstones included, or a merge that would make one.
+var ErrTooLarge = errors.New("crdt state too large")
+
+// MaxElems is how many characters a Text may hold, deleted ones included.
+const MaxElems = 20000
+
+// Stamp orders the writes of a register. It is a hybrid logical clock: Wall
+// is in milliseconds and Counter orders writes within one, so a write made
+// after seeing another always has a larger stamp, even if the clocks of the
+// two nodes disagree. Node breaks ties between concurrent writes.
+type Stamp struct {
+	Wall    int64  `json:"wall"`
+	Counter uint32 `json:"counter"`
+	Node    string `json:"node"`
+}
+
+// Compare returns -1, 0 or +1 as s is before, equal to or after o.
+func (s Stamp) Compare(o Stamp) int {
+	if c := cmp.Compare(s.Wall, o.Wall); c != 0 {
+		return c
+	}
+	if c := cmp.Compare(s.Counter, o.Counter); c != 0 {
+		return c
+	}
+	return cmp.Compare(s.Node, o.Node)
+}
+
+// Next returns a stamp for a write by node at wall time now that comes after
+// last.
+func Next(last Stamp, node string, now int64) Stamp {
+	if now > last.Wall {
+		return Stamp{Wall: now, Node: node}
+	}
+	return Stamp{Wall: last.Wall, Counter: last.Counter + 1, Node: node}
+}
+
+// Register is a last-writer-wins register: of two writes the one with the
+// larger stamp is kept.
+type Register[T comparable] struct {
+	Value T     `json:"value"`
+	Stamp Stamp `json:"stamp"`
+}
+
+// Set writes v with stamp s, unless a later write was already merged in.
+func (r *Register[T]) Set(v T, s Stamp) {
+	if r.Stamp.Compare(s) < 0 {
+		r.Value, r.Stamp = v, s
+	}
+}
+
+// Merge keeps the later of r and o.
+func (r *Register[T]) Merge(o Register[T]) {
+	r.Set(o.Value, o.Stamp)
+}
+
+// Todo is the replicated state of a todo's editable fields. DueAt is in
+// RFC 3339 in UTC, empty for none.
+type Todo struct {
+	Title       Register[string] `json:"title"`
+	Completed   Register[bool]   `json:"completed"`
+	Priority    Register[string] `json:"priority"`
+	DueAt       Register[string] `json:"due_at"`
+	Description Text             `json:"description"`
+}
+
+// Values are the field values of a todo.
+type Values struct {
+	Title       string
+	Description string
+	Completed   bool
+	Priority    string
+	DueAt       *time.Time
+}
+
+// NewTodo is the state of a todo that has no history of edits yet. It only
+// depends on the values, so any replica that starts from the same values
+// gets the same state.
+func NewTodo(v Values) *Todo {
+	t := &Todo{}
+	t.Fill(v)
+	t.Description.Insert(ServerNode, 0, v.Description)
+	return t
+}
+
+// Fill sets the registers that were never written to the values of v, the
+// same way NewTodo does. State made before a register existed doesn't have
+// it.
+func (t *Todo) Fill(v Values) {
+	initial := Stamp{Node: ServerNode}
+	if t.Title.Stamp == (Stamp{}) {
+		t.Title = Register[string]{Value: v.Title, Stamp: initial}
+	}
+	if t.Completed.Stamp == (Stamp{}) {
+		t.Completed = Register[bool]{Value: v.Completed, Stamp: initial}
+	}
+	if t.Priority.Stamp == (Stamp{}) {
+		t.Priority = Register[string]{Value: v.Priority, Stamp: initial}
+	}
+	if t.DueAt.Stamp == (Stamp{}) {
+		t.DueAt = Register[string]{Value: formatTime(v.DueAt), Stamp: initial}
+	}
+}
+
+// Values returns the current field values.
+func (t *Todo) Values() Values {
+	v := Values{
+		Title:       t.Title.Value,
+		Description: t.Description.String(),
+		Completed:   t.Completed.Value,
+		Priority:    t.Priority.Value,
+	}
+	// Validate checked it
+	if d, err := time.Parse(time.RFC3339, t.DueAt.Value); err == nil {
+		v.DueAt = &d
+	}
+	return v
+}
+
+// Clock is the latest stamp of any write to the registers.
+func (t *Todo) Clock() Stamp {
+	clock := t.Title.Stamp
+	for _, s := range []Stamp{t.Completed.Stamp, t.Priority.Stamp, t.DueAt.Stamp} {
+		if s.Compare(clock) > 0 {
+			clock = s
+		}
+	}
+	return clock
+}
+
+// Set is a local edit by node at wall time now (in milliseconds) that
+// changes the fields to the given values. Fields that already have the value
+// are left alone, so their concurrent edits elsewhere still count.
+func (t *Todo) Set(node string, now int64, v Values) {
+	if t.Title.Value != v.Title {
+		t.Title.Set(v.Title, Next(t.Clock(), node, now))
+	}
+	if t.Completed.Value != v.Completed {
+		t.Completed.Set(v.Completed, Next(t.Clock(), node, now))
+	}
+	if t.Priority.Value != v.Priority {
+		t.Priority.Set(v.Priority, Next(t.Clock(), node, now))
+	}
+	if due := formatTime(v.DueAt); t.DueAt.Value != due {
+		t.DueAt.Set(due, Next(t.Clock(), node, now))
+	}
+	t.Description.SetString(node, v.Description)
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.UTC().Truncate(time.Second).Format(time.RFC3339)
+}
+
+// Merge merges o into t. Merging is commutative, associative and
+// idempotent, so replicas that have merged the same states agree.
+func (t *Todo) Merge(o *Todo) error {
+	if err := o.Validate(); err != nil {
+		return err
+	}
+	if err := t.Description.Merge(&o.Description); err != nil {
+		return err
+	}
+	t.Title.Merge(o.Title)
+	t.Completed.Merge(o.Completed)
+	t.Priority.Merge(o.Priority)
+	t.DueAt.Merge(o.DueAt)
+	return nil
+}
+
+// Validate checks state that came from outside, e.g. from a client.
+func (t *Todo) Validate() error {
+	if t.DueAt.Value != "" {
+		if _, err := time.Parse(time.RFC3339, t.DueAt.Value); err != nil {
+			return ErrInvalid
+		}
+	}
+	return t.Description.Validate()
+}
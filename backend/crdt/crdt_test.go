@@ -0,0 +1,243 @@
+package crdt
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/quick"
+	"time"
+)
+
+var quickConfig = &quick.Config{MaxCount: 300}
+
+// register returns the register a write with stamp s leaves. Every write has
+// its own stamp, so the value is derived from it.
+func register(s Stamp) Register[string] {
+	return Register[string]{Value: fmt.Sprint(s.Wall, s.Counter, s.Node), Stamp: s}
+}
+
+func mergeRegisters(rs ...Register[string]) Register[string] {
+	var out Register[string]
+	for _, r := range rs {
+		out.Merge(r)
+	}
+	return out
+}
+
+func TestRegisterMergeCommutative(t *testing.T) {
+	f := func(a, b Stamp) bool {
+		return mergeRegisters(register(a), register(b)) == mergeRegisters(register(b), register(a))
+	}
+	if err := quick.Check(f, quickConfig); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRegisterMergeAssociative(t *testing.T) {
+	f := func(a, b, c Stamp) bool {
+		ab := mergeRegisters(register(a), register(b))
+		bc := mergeRegisters(register(b), register(c))
+		return mergeRegisters(ab, register(c)) == mergeRegisters(register(a), bc)
+	}
+	if err := quick.Check(f, quickConfig); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRegisterMergeIdempotent(t *testing.T) {
+	f := func(a Stamp) bool {
+		r := register(a)
+		r.Merge(r)
+		return r == register(a)
+	}
+	if err := quick.Check(f, quickConfig); err != nil {
+		t.Error(err)
+	}
+}
+
+// replica is one node editing a todo, with its own clock.
+type replica struct {
+	node string
+	now  int64
+	todo *Todo
+}
+
+func newReplicas(rng *rand.Rand, n int) []*replica {
+	base := NewTodo(Values{Title: "title", Description: "some text", Priority: "low"})
+	replicas := make([]*replica, n)
+	for i := range replicas {
+		// the clocks of the nodes disagree
+		replicas[i] = &replica{node: fmt.Sprint("node", i), now: rng.Int63n(1000), todo: clone(base)}
+	}
+	return replicas
+}
+
+// edit makes a random local edit.
+func (r *replica) edit(rng *rand.Rand) {
+	r.now += rng.Int63n(3)
+	v := r.todo.Values()
+	text := &r.todo.Description
+	length := len([]rune(v.Description))
+	switch rng.Intn(7) {
+	case 0:
+		v.Title = fmt.Sprint("title ", rng.Intn(10))
+		r.todo.Set(r.node, r.now, v)
+	case 1:
+		v.Completed = !v.Completed
+		r.todo.Set(r.node, r.now, v)
+	case 2:
+		words := []string{"a", "bc", "déf", "ghij", " "}
+		text.Insert(r.node, rng.Intn(length+1), words[rng.Intn(len(words))])
+	case 3:
+		if length > 0 {
+			pos := rng.Intn(length)
+			text.Delete(pos, 1+rng.Intn(length-pos))
+		}
+	case 4:
+		v.Description = fmt.Sprint("new ", string([]rune(v.Description)[:length/2]))
+		r.todo.Set(r.node, r.now, v)
+	case 5:
+		v.Priority = []string{"", "low", "high"}[rng.Intn(3)]
+		r.todo.Set(r.node, r.now, v)
+	case 6:
+		v.DueAt = nil
+		if rng.Intn(3) > 0 {
+			d := time.Unix(rng.Int63n(1e9), 0)
+			v.DueAt = &d
+		}
+		r.todo.Set(r.node, r.now, v)
+	}
+}
+
+// simulate has the replicas edit concurrently, sometimes merging the state of
+// another one, and returns their states.
+func simulate(rng *rand.Rand, replicas []*replica, steps int) []*Todo {
+	for range steps {
+		r := replicas[rng.Intn(len(replicas))]
+		if rng.Intn(4) == 0 {
+			o := replicas[rng.Intn(len(replicas))]
+			if err := r.todo.Merge(clone(o.todo)); err != nil {
+				panic(err)
+			}
+			continue
+		}
+		r.edit(rng)
+	}
+	states := make([]*Todo, len(replicas))
+	for i, r := range replicas {
+		states[i] = r.todo
+	}
+	return states
+}
+
+func clone(t *Todo) *Todo {
+	c := *t
+	c.Description.Elems = make([]Elem, len(t.Description.Elems))
+	for i, e := range t.Description.Elems {
+		if e.Origin != nil {
+			e.Origin = ptr(*e.Origin)
+		}
+		c.Description.Elems[i] = e
+	}
+	return &c
+}
+
+func merged(t *testing.T, states ...*Todo) *Todo {
+	t.Helper()
+	out := clone(states[0])
+	for _, s := range states[1:] {
+		if err := out.Merge(clone(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return out
+}
+
+func same(a, b *Todo) bool {
+	return a.Title == b.Title && a.Completed == b.Completed &&
+		a.Priority == b.Priority && a.DueAt == b.DueAt &&
+		reflect.DeepEqual(a.Description.Elems, b.Description.Elems)
+}
+
+func TestMergeCommutative(t *testing.T) {
+	f := func(seed int64) bool {
+		rng := rand.New(rand.NewSource(seed))
+		s := simulate(rng, newReplicas(rng, 2), 40)
+		return same(merged(t, s[0], s[1]), merged(t, s[1], s[0]))
+	}
+	if err := quick.Check(f, quickConfig); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMergeAssociative(t *testing.T) {
+	f := func(seed int64) bool {
+		rng := rand.New(rand.NewSource(seed))
+		s := simulate(rng, newReplicas(rng, 3), 60)
+		ab := merged(t, s[0], s[1])
+		bc := merged(t, s[1], s[2])
+		return same(merged(t, ab, s[2]), merged(t, s[0], bc))
+	}
+	if err := quick.Check(f, quickConfig); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMergeIdempotent(t *testing.T) {
+	f := func(seed int64) bool {
+		rng := rand.New(rand.NewSource(seed))
+		s := simulate(rng, newReplicas(rng, 2), 40)
+		return same(merged(t, s[0], s[0]), s[0]) && same(merged(t, s[0], s[1], s[1]), merged(t, s[0], s[1]))
+	}
+	if err := quick.Check(f, quickConfig); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestConvergence has several replicas edit concurrently, then each merges
+// the others' states in its own order. They must all end up the same.
+func TestConvergence(t *testing.T) {
+	f := func(seed int64) bool {
+		rng := rand.New(rand.NewSource(seed))
+		states := simulate(rng, newReplicas(rng, 2+rng.Intn(3)), 80)
+
+		var first *Todo
+		for i := range states {
+			order := append([]*Todo{states[i]}, states[:i]...)
+			order = append(order, states[i+1:]...)
+			rest := order[1:]
+			rng.Shuffle(len(rest), func(a, b int) { rest[a], rest[b] = rest[b], rest[a] })
+
+			got := merged(t, order...)
+			if first == nil {
+				first = got
+				continue
+			}
+			if !same(got, first) {
+				t.Logf("seed %d: replica %d has %q, replica 0 has %q",
+					seed, i, got.Description.String(), first.Description.String())
+				return false
+			}
+		}
+		return true
+	}
+	if err := quick.Check(f, quickConfig); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMergeTooLarge(t *testing.T) {
+	a := NewTodo(Values{Title: "title"})
+	b := clone(a)
+	a.Description.Insert("a", 0, strings.Repeat("x", MaxElems/2+1))
+	b.Description.Insert("b", 0, strings.Repeat("y", MaxElems/2+1))
+	if err := a.Merge(clone(b)); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("merge = %v, want ErrTooLarge", err)
+	}
+	if got := a.Description.String(); got != strings.Repeat("x", MaxElems/2+1) {
+		t.Errorf("failed merge changed the text to %d characters", len(got))
+	}
+}
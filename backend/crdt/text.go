@@ -0,0 +1,233 @@
+package crdt
+
+import (
+	"cmp"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+// ID identifies a character of a Text. Counter is a Lamport clock: a
+// character inserted after seeing another has a larger Counter.
+type ID struct {
+	Counter uint64 `json:"c"`
+	Node    string `json:"n"`
+}
+
+// Compare returns -1, 0 or +1 as id is before, equal to or after o.
+func (id ID) Compare(o ID) int {
+	if c := cmp.Compare(id.Counter, o.Counter); c != 0 {
+		return c
+	}
+	return cmp.Compare(id.Node, o.Node)
+}
+
+// Elem is one character of a Text. Deleted characters stay as tombstones,
+// a concurrent insertion may still refer to them.
+type Elem struct {
+	ID      ID     `json:"id"`
+	Origin  *ID    `json:"origin,omitempty"` // inserted after, nil at the start
+	Char    string `json:"ch"`
+	Deleted bool   `json:"del,omitempty"`
+}
+
+// Text is a replicated growable array (RGA). Every character is inserted
+// after an origin, characters with the same origin are ordered by ID, later
+// first. The order therefore only depends on the set of characters, not on
+// the order they arrived in.
+type Text struct {
+	Elems []Elem `json:"elems"` // in document order, tombstones included
+}
+
+// String returns the text without its tombstones.
+func (t *Text) String() string {
+	var b strings.Builder
+	for _, e := range t.Elems {
+		if !e.Deleted {
+			b.WriteString(e.Char)
+		}
+	}
+	return b.String()
+}
+
+// visible returns the index in Elems of the pos-th visible character, or
+// len(Elems) past the last one.
+func (t *Text) visible(pos int) int {
+	for i, e := range t.Elems {
+		if e.Deleted {
+			continue
+		}
+		if pos == 0 {
+			return i
+		}
+		pos--
+	}
+	return len(t.Elems)
+}
+
+func (t *Text) maxCounter() uint64 {
+	var n uint64
+	for _, e := range t.Elems {
+		n = max(n, e.ID.Counter)
+	}
+	return n
+}
+
+// Insert inserts s by node before the pos-th visible character, pos is at
+// most the length of the text.
+func (t *Text) Insert(node string, pos int, s string) {
+	if s == "" {
+		return
+	}
+	// insert right after the character before pos. The new characters have
+	// the largest IDs, so they come first among its successors.
+	var origin *ID
+	at := 0
+	if pos > 0 {
+		i := t.visible(pos - 1)
+		origin = ptr(t.Elems[i].ID)
+		at = i + 1
+	}
+
+	counter := t.maxCounter()
+	elems := make([]Elem, 0, utf8.RuneCountInString(s))
+	for _, r := range s {
+		counter++
+		id := ID{Counter: counter, Node: node}
+		elems = append(elems, Elem{ID: id, Origin: origin, Char: string(r)})
+		origin = ptr(id)
+	}
+	t.Elems = slices.Insert(t.Elems, at, elems...)
+}
+
+// Delete deletes n visible characters from pos on.
+func (t *Text) Delete(pos, n int) {
+	for i := t.visible(pos); i < len(t.Elems) && n > 0; i++ {
+		if !t.Elems[i].Deleted {
+			t.Elems[i].Deleted = true
+			n--
+		}
+	}
+}
+
+// SetString is a local edit by node that changes the text to s. Only what
+// is between the common prefix and suffix of the old and new text is
+// replaced, so concurrent edits elsewhere in the text survive.
+func (t *Text) SetString(node, s string) {
+	old, new := []rune(t.String()), []rune(s)
+	prefix := 0
+	for prefix < len(old) && prefix < len(new) && old[prefix] == new[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(old)-prefix && suffix < len(new)-prefix &&
+		old[len(old)-1-suffix] == new[len(new)-1-suffix] {
+		suffix++
+	}
+	t.Delete(prefix, len(old)-prefix-suffix)
+	t.Insert(node, prefix, string(new[prefix:len(new)-suffix]))
+}
+
+// Merge adds the characters and deletions of o to t. o must be valid.
+func (t *Text) Merge(o *Text) error {
+	index := make(map[ID]int, len(t.Elems))
+	for i, e := range t.Elems {
+		index[e.ID] = i
+	}
+	// the same ID must be the same character everywhere, check before
+	// changing anything
+	added := 0
+	for _, e := range o.Elems {
+		i, ok := index[e.ID]
+		if !ok {
+			added++
+			continue
+		}
+		mine := t.Elems[i]
+		if mine.Char != e.Char || !sameOrigin(mine.Origin, e.Origin) {
+			return ErrInvalid
+		}
+	}
+	if len(t.Elems)+added > MaxElems {
+		return ErrTooLarge
+	}
+	for _, e := range o.Elems {
+		if i, ok := index[e.ID]; ok {
+			t.Elems[i].Deleted = t.Elems[i].Deleted || e.Deleted
+			continue
+		}
+		if e.Origin != nil {
+			e.Origin = ptr(*e.Origin)
+		}
+		index[e.ID] = len(t.Elems)
+		t.Elems = append(t.Elems, e)
+	}
+	t.Elems = linearize(t.Elems)
+	return nil
+}
+
+// ptr returns a pointer to a copy of id, never one into Elems, which moves.
+func ptr(id ID) *ID {
+	return &id
+}
+
+func sameOrigin(a, b *ID) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// linearize puts elems in document order: depth first through the tree of
+// origins, later siblings first.
+func linearize(elems []Elem) []Elem {
+	children := map[ID][]Elem{}
+	var roots []Elem
+	for _, e := range elems {
+		if e.Origin == nil {
+			roots = append(roots, e)
+		} else {
+			children[*e.Origin] = append(children[*e.Origin], e)
+		}
+	}
+	laterFirst := func(a, b Elem) int { return b.ID.Compare(a.ID) }
+
+	ordered := make([]Elem, 0, len(elems))
+	slices.SortFunc(roots, laterFirst)
+	stack := slices.Clone(roots)
+	slices.Reverse(stack)
+	for len(stack) > 0 {
+		e := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		ordered = append(ordered, e)
+
+		next := children[e.ID]
+		slices.SortFunc(next, laterFirst)
+		for i := len(next) - 1; i >= 0; i-- {
+			stack = append(stack, next[i])
+		}
+	}
+	return ordered
+}
+
+// Validate checks that every character is a single rune with a unique ID,
+// inserted after a character of the same text that it has seen, and that
+// there are at most MaxElems of them.
+func (t *Text) Validate() error {
+	if len(t.Elems) > MaxElems {
+		return ErrTooLarge
+	}
+	ids := make(map[ID]bool, len(t.Elems))
+	for _, e := range t.Elems {
+		if ids[e.ID] || e.ID.Node == "" || utf8.RuneCountInString(e.Char) != 1 {
+			return ErrInvalid
+		}
+		ids[e.ID] = true
+	}
+	for _, e := range t.Elems {
+		if e.Origin != nil && (!ids[*e.Origin] || e.Origin.Compare(e.ID) >= 0) {
+			return ErrInvalid
+		}
+	}
+	return nil
+}
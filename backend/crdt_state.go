@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/thakurnishu/MinimalDo/crdt"
+	"github.com/thakurnishu/MinimalDo/model"
+)
+
+// loadCRDT reads the replicated state of a todo. A todo that has none yet
+// gets the state of its values, current must be what the row holds.
+func loadCRDT(ctx context.Context, tx *sql.Tx, todoID int, current model.TodoSnapshot) (*crdt.Todo, error) {
+	var raw []byte
+	err := tx.QueryRowContext(ctx, "SELECT crdt_state FROM todos WHERE id = $1", todoID).Scan(&raw)
+	if err != nil {
+		return nil, err
+	}
+	if raw == nil {
+		return crdt.NewTodo(crdtValues(current)), nil
+	}
+	var state crdt.Todo
+	if err := json.Unmarshal(raw, &state); err != nil {
+		return nil, err
+	}
+	state.Fill(crdtValues(current))
+	return &state, nil
+}
+
+func crdtValues(t model.TodoSnapshot) crdt.Values {
+	return crdt.Values{
+		Title:       t.Title,
+		Description: t.Description,
+		Completed:   t.Completed,
+		Priority:    t.Priority,
+		DueAt:       t.DueAt,
+	}
+}
+
+// setCRDTValues sets the fields of t that the state holds.
+func setCRDTValues(t *model.TodoSnapshot, v crdt.Values) {
+	t.Title, t.Description, t.Completed = v.Title, v.Description, v.Completed
+	t.Priority, t.DueAt = v.Priority, v.DueAt
+}
+
+func saveCRDT(ctx context.Context, tx *sql.Tx, todoID int, state *crdt.Todo) error {
+	raw, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE todos SET crdt_state = $2 WHERE id = $1", todoID, raw)
+	return err
+}
+
+// stepCRDT brings the replicated state of a todo in step with a write that
+// didn't come as CRDT state, as an edit by the server. Without it the next
+// merge with a client would bring back the values it overwrote.
+func stepCRDT(ctx context.Context, tx *sql.Tx, ch todoChange) error {
+	base := ch.before
+	if base == nil {
+		base = ch.after
+	}
+	state, err := loadCRDT(ctx, tx, ch.todoID, *base)
+	if err != nil {
+		return err
+	}
+	var values model.TodoSnapshot
+	setCRDTValues(&values, state.Values())
+	if len(diffTodo(&values, ch.after)) == 0 {
+		return nil
+	}
+	state.Set(crdt.ServerNode, time.Now().UnixMilli(), crdtValues(*ch.after))
+	return saveCRDT(ctx, tx, ch.todoID, state)
+}
@@ -1,17 +1,29 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"log/slog"
 	"os"
 )
 
-func setupDB(cfg *Config) (db *sql.DB) {
-	connStr := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
+// dbtx is satisfied by both *sql.DB and *sql.Tx, so helpers can run inside
+// or outside a transaction.
+type dbtx interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// connString is the lib/pq connection string of the database.
+func connString(cfg *Config) string {
+	return fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
 		cfg.DBHost, cfg.DBPort, cfg.DBUser, cfg.DBPassword, cfg.DBName)
-	
-	db, err := sql.Open("postgres", connStr)
+}
+
+func setupDB(cfg *Config) (db *sql.DB) {
+	db, err := sql.Open("postgres", connString(cfg))
 	if err != nil {
 		slog.Error("Failed to connect to database", "error", err)
 		os.Exit(1)
@@ -33,6 +45,92 @@ func setupDB(cfg *Config) (db *sql.DB) {
 
 func initDB(db *sql.DB) error {
 	query := `
+	CREATE TABLE IF NOT EXISTS users (
+		id SERIAL PRIMARY KEY,
+		username VARCHAR(64) NOT NULL UNIQUE,
+		email VARCHAR(255) UNIQUE,
+		password_hash TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+
+	-- users created through OIDC have no password
+	ALTER TABLE users ALTER COLUMN password_hash DROP NOT NULL;
+
+	-- external identities (OIDC issuer + subject) linked to a user
+	CREATE TABLE IF NOT EXISTS user_identities (
+		id SERIAL PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		issuer TEXT NOT NULL,
+		subject TEXT NOT NULL,
+		email VARCHAR(255),
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		last_login_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE (issuer, subject)
+	);
+
+	-- pending OIDC authorization requests, keyed by the state parameter
+	CREATE TABLE IF NOT EXISTS oidc_states (
+		state_hash BYTEA PRIMARY KEY,
+		code_verifier TEXT NOT NULL,
+		nonce TEXT NOT NULL,
+		return_to TEXT NOT NULL DEFAULT '/',
+		expires_at TIMESTAMP NOT NULL
+	);
+
+	-- one-time codes handed to the frontend after an OIDC login, exchanged
+	-- for a session so tokens never appear in a URL
+	CREATE TABLE IF NOT EXISTS login_codes (
+		code_hash BYTEA PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		expires_at TIMESTAMP NOT NULL
+	);
+
+	-- opaque session tokens were replaced by JWT access + refresh tokens
+	DROP TABLE IF EXISTS sessions;
+
+	-- a token family is one login, every refresh token rotated from it
+	-- belongs to the same family
+	CREATE TABLE IF NOT EXISTS token_families (
+		id TEXT PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		revoked_at TIMESTAMP,
+		revoke_reason TEXT
+	);
+
+	CREATE TABLE IF NOT EXISTS refresh_tokens (
+		id SERIAL PRIMARY KEY,
+		family_id TEXT NOT NULL REFERENCES token_families(id) ON DELETE CASCADE,
+		token_hash BYTEA NOT NULL UNIQUE,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		expires_at TIMESTAMP NOT NULL,
+		used_at TIMESTAMP
+	);
+
+	-- access tokens revoked before they expire, keyed by jti
+	CREATE TABLE IF NOT EXISTS revoked_tokens (
+		jti TEXT PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		revoked_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		expires_at TIMESTAMP NOT NULL
+	);
+
+	-- personal access tokens for scripts, shown once and stored hashed
+	CREATE TABLE IF NOT EXISTS api_tokens (
+		id SERIAL PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		name VARCHAR(100) NOT NULL,
+		token_hash BYTEA NOT NULL UNIQUE,
+		token_prefix VARCHAR(20) NOT NULL,
+		scopes TEXT[] NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		expires_at TIMESTAMP,
+		last_used_at TIMESTAMP,
+		revoked_at TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_api_tokens_user_id ON api_tokens (user_id);
+
 	CREATE TABLE IF NOT EXISTS todos (
 		id SERIAL PRIMARY KEY,
 		title VARCHAR(255) NOT NULL,
@@ -42,6 +140,394 @@ func initDB(db *sql.DB) error {
 		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 	);
 
+	-- todos created before accounts existed have no owner, they are handed
+	-- to the ADOPT_TODOS_USER account, at startup or when it registers (see
+	-- adoptTodos)
+	ALTER TABLE todos ADD COLUMN IF NOT EXISTS owner_id INTEGER REFERENCES users(id) ON DELETE CASCADE;
+	CREATE INDEX IF NOT EXISTS idx_todos_owner_created_at ON todos (owner_id, created_at DESC);
+
+	-- shared lists, todos with a list_id belong to the list and are visible
+	-- to its members, todos without one are personal to owner_id
+	CREATE TABLE IF NOT EXISTS lists (
+		id SERIAL PRIMARY KEY,
+		name VARCHAR(100) NOT NULL,
+		created_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS list_members (
+		list_id INTEGER NOT NULL REFERENCES lists(id) ON DELETE CASCADE,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		role TEXT NOT NULL CHECK (role IN ('viewer', 'editor', 'owner')),
+		added_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (list_id, user_id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_list_members_user_id ON list_members (user_id);
+
+	CREATE TABLE IF NOT EXISTS list_invitations (
+		id SERIAL PRIMARY KEY,
+		list_id INTEGER NOT NULL REFERENCES lists(id) ON DELETE CASCADE,
+		invitee_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		invited_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+		role TEXT NOT NULL CHECK (role IN ('viewer', 'editor', 'owner')),
+		status TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'accepted', 'declined')),
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		responded_at TIMESTAMP
+	);
+	-- one open invitation per user and list
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_list_invitations_pending
+		ON list_invitations (list_id, invitee_id) WHERE status = 'pending';
+
+	ALTER TABLE todos ADD COLUMN IF NOT EXISTS list_id INTEGER REFERENCES lists(id) ON DELETE CASCADE;
+	CREATE INDEX IF NOT EXISTS idx_todos_list_created_at ON todos (list_id, created_at DESC);
+
+	-- workspaces are the tenant boundary, every user has a personal one and
+	-- todos and lists belong to exactly one
+	CREATE TABLE IF NOT EXISTS workspaces (
+		id SERIAL PRIMARY KEY,
+		name VARCHAR(100) NOT NULL,
+		personal_user_id INTEGER UNIQUE REFERENCES users(id) ON DELETE CASCADE,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS workspace_members (
+		workspace_id INTEGER NOT NULL REFERENCES workspaces(id) ON DELETE CASCADE,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		role TEXT NOT NULL CHECK (role IN ('member', 'admin')),
+		added_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (workspace_id, user_id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_workspace_members_user_id ON workspace_members (user_id);
+
+	ALTER TABLE todos ADD COLUMN IF NOT EXISTS workspace_id INTEGER REFERENCES workspaces(id) ON DELETE CASCADE;
+	CREATE INDEX IF NOT EXISTS idx_todos_workspace_id ON todos (workspace_id);
+	ALTER TABLE lists ADD COLUMN IF NOT EXISTS workspace_id INTEGER REFERENCES workspaces(id) ON DELETE CASCADE;
+	CREATE INDEX IF NOT EXISTS idx_lists_workspace_id ON lists (workspace_id);
+
+	CREATE OR REPLACE FUNCTION create_personal_workspace()
+	RETURNS TRIGGER AS $$
+	DECLARE
+		ws_id INTEGER;
+	BEGIN
+		INSERT INTO workspaces (name, personal_user_id) VALUES (NEW.username, NEW.id) RETURNING id INTO ws_id;
+		INSERT INTO workspace_members (workspace_id, user_id, role) VALUES (ws_id, NEW.id, 'admin');
+		RETURN NEW;
+	END;
+	$$ language 'plpgsql';
+
+	DROP TRIGGER IF EXISTS create_users_personal_workspace ON users;
+	CREATE TRIGGER create_users_personal_workspace
+		AFTER INSERT ON users
+		FOR EACH ROW
+		EXECUTE FUNCTION create_personal_workspace();
+
+	-- backfill for data from before workspaces, each is a no-op afterwards
+	INSERT INTO workspaces (name, personal_user_id)
+		SELECT u.username, u.id FROM users u
+		WHERE NOT EXISTS (SELECT 1 FROM workspaces w WHERE w.personal_user_id = u.id);
+	INSERT INTO workspace_members (workspace_id, user_id, role)
+		SELECT id, personal_user_id, 'admin' FROM workspaces WHERE personal_user_id IS NOT NULL
+		ON CONFLICT DO NOTHING;
+	-- a shared list moves to the personal workspace of an owner, and its
+	-- other members join that workspace so they keep access
+	WITH moved AS (
+		UPDATE lists l SET workspace_id = w.id
+		FROM list_members m JOIN workspaces w ON w.personal_user_id = m.user_id
+		WHERE l.workspace_id IS NULL AND m.list_id = l.id AND m.role = 'owner'
+		RETURNING l.id, l.workspace_id
+	)
+	INSERT INTO workspace_members (workspace_id, user_id, role)
+		SELECT moved.workspace_id, m.user_id, 'member'
+		FROM moved JOIN list_members m ON m.list_id = moved.id
+		ON CONFLICT DO NOTHING;
+	UPDATE todos t SET workspace_id = l.workspace_id
+		FROM lists l
+		WHERE t.workspace_id IS NULL AND t.list_id = l.id;
+	UPDATE todos t SET workspace_id = w.id
+		FROM workspaces w
+		WHERE t.workspace_id IS NULL AND t.list_id IS NULL AND w.personal_user_id = t.owner_id;
+
+	CREATE TABLE IF NOT EXISTS todo_assignees (
+		todo_id INTEGER NOT NULL REFERENCES todos(id) ON DELETE CASCADE,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		assigned_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+		assigned_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (todo_id, user_id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_todo_assignees_user_id ON todo_assignees (user_id);
+
+	-- every assignment change, who made it and when
+	CREATE TABLE IF NOT EXISTS todo_assignment_log (
+		id SERIAL PRIMARY KEY,
+		todo_id INTEGER NOT NULL REFERENCES todos(id) ON DELETE CASCADE,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		action TEXT NOT NULL CHECK (action IN ('assigned', 'unassigned')),
+		changed_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+		changed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_todo_assignment_log_todo_id ON todo_assignment_log (todo_id, changed_at);
+
+	-- discussion on a todo, bodies are markdown and rendered by the clients
+	CREATE TABLE IF NOT EXISTS todo_comments (
+		id SERIAL PRIMARY KEY,
+		todo_id INTEGER NOT NULL REFERENCES todos(id) ON DELETE CASCADE,
+		author_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+		body TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_todo_comments_todo_id ON todo_comments (todo_id, created_at);
+
+	-- the body of a comment before each edit
+	CREATE TABLE IF NOT EXISTS todo_comment_revisions (
+		id SERIAL PRIMARY KEY,
+		comment_id INTEGER NOT NULL REFERENCES todo_comments(id) ON DELETE CASCADE,
+		body TEXT NOT NULL,
+		edited_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+		edited_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_todo_comment_revisions_comment_id ON todo_comment_revisions (comment_id, edited_at);
+
+	-- users @mentioned in the current body of a comment
+	CREATE TABLE IF NOT EXISTS todo_comment_mentions (
+		comment_id INTEGER NOT NULL REFERENCES todo_comments(id) ON DELETE CASCADE,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		PRIMARY KEY (comment_id, user_id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_todo_comment_mentions_user_id ON todo_comment_mentions (user_id);
+
+	-- files attached to a todo, the bytes live in the blob store under storage_key
+	CREATE TABLE IF NOT EXISTS todo_attachments (
+		id SERIAL PRIMARY KEY,
+		todo_id INTEGER NOT NULL REFERENCES todos(id) ON DELETE CASCADE,
+		uploaded_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+		filename TEXT NOT NULL,
+		content_type TEXT NOT NULL,
+		size_bytes BIGINT NOT NULL,
+		storage_key TEXT NOT NULL UNIQUE,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_todo_attachments_todo_id ON todo_attachments (todo_id, created_at);
+
+	-- every change to a todo, written in the same transaction as the change.
+	-- There is no foreign key on todo_id so the history outlives the todo,
+	-- and none on changed_by because the rows are never updated.
+	CREATE TABLE IF NOT EXISTS todo_history (
+		id BIGSERIAL PRIMARY KEY,
+		todo_id INTEGER NOT NULL,
+		version INTEGER NOT NULL,
+		workspace_id INTEGER NOT NULL REFERENCES workspaces(id) ON DELETE CASCADE,
+		list_id INTEGER,
+		owner_id INTEGER,
+		action TEXT NOT NULL CHECK (action IN ('create', 'update', 'delete', 'revert', 'restore')),
+		changes JSONB NOT NULL,
+		snapshot JSONB NOT NULL,
+		reverted_to INTEGER,
+		changed_by INTEGER,
+		changed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE (todo_id, version)
+	);
+	CREATE INDEX IF NOT EXISTS idx_todo_history_workspace_id ON todo_history (workspace_id, id DESC);
+	-- the transaction that wrote each version. Sync tokens are snapshots of
+	-- the running transactions, so a change that commits late is not skipped.
+	ALTER TABLE todo_history ADD COLUMN IF NOT EXISTS tx_id xid8 NOT NULL DEFAULT pg_current_xact_id();
+	CREATE INDEX IF NOT EXISTS idx_todo_history_tx_id ON todo_history (workspace_id, tx_id);
+	-- the xmin of the snapshot each version was written in. Any transaction
+	-- that commits after the row has a tx_id at least as large, so event
+	-- streams resume from it instead of the id, which is taken before commit.
+	ALTER TABLE todo_history ADD COLUMN IF NOT EXISTS snapshot_xmin xid8 NOT NULL DEFAULT pg_snapshot_xmin(pg_current_snapshot());
+
+	-- a version 7 UUID: the milliseconds of ts, then random bits
+	CREATE OR REPLACE FUNCTION uuid_v7(ts TIMESTAMP DEFAULT clock_timestamp())
+	RETURNS UUID AS $$
+		SELECT encode(set_bit(set_bit(overlay(uuid_send(gen_random_uuid())
+			PLACING substring(int8send(floor(extract(epoch FROM ts) * 1000)::BIGINT) FROM 3)
+			FROM 1 FOR 6), 52, 1), 53, 1), 'hex')::UUID
+	$$ LANGUAGE sql VOLATILE;
+
+	-- public IDs of todos, the integer IDs stay internal. Clients may
+	-- generate them to create todos offline. They outlive their todo, so a
+	-- deleted todo keeps its ID in history and sync, and replaying a create
+	-- after a delete doesn't bring it back.
+	CREATE TABLE IF NOT EXISTS todo_ids (
+		uuid UUID PRIMARY KEY,
+		todo_id INTEGER NOT NULL UNIQUE,
+		workspace_id INTEGER NOT NULL REFERENCES workspaces(id) ON DELETE CASCADE
+	);
+	INSERT INTO todo_ids (uuid, todo_id, workspace_id)
+	SELECT uuid_v7(COALESCE(created_at, CURRENT_TIMESTAMP)), id, workspace_id
+	FROM todos t
+	-- todos from before accounts get theirs when they are claimed
+	WHERE workspace_id IS NOT NULL
+	AND NOT EXISTS (SELECT 1 FROM todo_ids k WHERE k.todo_id = t.id);
+	INSERT INTO todo_ids (uuid, todo_id, workspace_id)
+	SELECT DISTINCT ON (todo_id) uuid_v7(COALESCE(changed_at, CURRENT_TIMESTAMP)), todo_id, workspace_id
+	FROM todo_history h
+	WHERE NOT EXISTS (SELECT 1 FROM todo_ids k WHERE k.todo_id = h.todo_id)
+	ORDER BY todo_id, version;
+
+	CREATE OR REPLACE FUNCTION todo_uuid(todo_id INTEGER)
+	RETURNS UUID AS $$
+		SELECT uuid FROM todo_ids k WHERE k.todo_id = $1
+	$$ LANGUAGE sql STABLE;
+	-- replicated state of the editable fields, so offline edits merge. NULL
+	-- until the first edit, it is then derived from the values.
+	ALTER TABLE todos ADD COLUMN IF NOT EXISTS crdt_state JSONB;
+
+	-- priority is empty for none, due_at is UTC
+	ALTER TABLE todos ADD COLUMN IF NOT EXISTS priority TEXT NOT NULL DEFAULT ''
+		CHECK (priority IN ('', 'low', 'medium', 'high', 'urgent'));
+	ALTER TABLE todos ADD COLUMN IF NOT EXISTS due_at TIMESTAMP;
+	CREATE INDEX IF NOT EXISTS idx_todos_due_at ON todos (due_at) WHERE due_at IS NOT NULL AND NOT completed;
+
+	-- how far each user has read the activity feed of a workspace
+	CREATE TABLE IF NOT EXISTS activity_read_markers (
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		workspace_id INTEGER NOT NULL REFERENCES workspaces(id) ON DELETE CASCADE,
+		last_read_id BIGINT NOT NULL,
+		read_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (user_id, workspace_id)
+	);
+
+	-- short lived tokens that undo one todo change, see undo.go
+	CREATE TABLE IF NOT EXISTS undo_tokens (
+		token_hash BYTEA PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		workspace_id INTEGER NOT NULL REFERENCES workspaces(id) ON DELETE CASCADE,
+		todo_id INTEGER NOT NULL,
+		version INTEGER NOT NULL,
+		expires_at TIMESTAMP NOT NULL,
+		used_at TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_undo_tokens_user_id ON undo_tokens(user_id);
+
+	-- what deleting a todo cascades to, kept until its delete can't be
+	-- undone anymore. The blobs of its attachments are deleted with the row.
+	CREATE TABLE IF NOT EXISTS deleted_todos (
+		todo_id INTEGER PRIMARY KEY,
+		workspace_id INTEGER NOT NULL REFERENCES workspaces(id) ON DELETE CASCADE,
+		children JSONB NOT NULL,
+		blob_keys TEXT[] NOT NULL,
+		expires_at TIMESTAMP NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_deleted_todos_expires_at ON deleted_todos (expires_at);
+
+	-- outbound webhooks, see webhooks.go. The secret signs deliveries, so it
+	-- is kept as is.
+	CREATE TABLE IF NOT EXISTS webhooks (
+		id SERIAL PRIMARY KEY,
+		workspace_id INTEGER NOT NULL REFERENCES workspaces(id) ON DELETE CASCADE,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		url TEXT NOT NULL,
+		secret TEXT NOT NULL,
+		event_types TEXT[] NOT NULL,
+		active BOOLEAN NOT NULL DEFAULT TRUE,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_webhooks_workspace_id ON webhooks (workspace_id);
+
+	-- one event for one webhook, written with the change it is about.
+	-- trace_context is the W3C trace context of the request that made it.
+	CREATE TABLE IF NOT EXISTS webhook_deliveries (
+		id BIGSERIAL PRIMARY KEY,
+		webhook_id INTEGER NOT NULL REFERENCES webhooks(id) ON DELETE CASCADE,
+		workspace_id INTEGER NOT NULL REFERENCES workspaces(id) ON DELETE CASCADE,
+		event_type TEXT NOT NULL,
+		payload JSONB NOT NULL,
+		trace_context JSONB NOT NULL DEFAULT '{}',
+		status TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'succeeded', 'failed')),
+		attempts INTEGER NOT NULL DEFAULT 0,
+		next_attempt_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_due ON webhook_deliveries (next_attempt_at) WHERE status = 'pending';
+	CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_webhook_id ON webhook_deliveries (webhook_id, id DESC);
+
+	CREATE TABLE IF NOT EXISTS webhook_attempts (
+		id BIGSERIAL PRIMARY KEY,
+		delivery_id BIGINT NOT NULL REFERENCES webhook_deliveries(id) ON DELETE CASCADE,
+		response_status INTEGER,
+		error TEXT,
+		duration_ms INTEGER NOT NULL,
+		attempted_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_webhook_attempts_delivery_id ON webhook_attempts (delivery_id);
+
+	-- transactional outbox, see outbox.go. A row is written with every todo
+	-- change, in its transaction, and published to the event sinks once it
+	-- committed. todo_id has no foreign key, the events of a deleted todo
+	-- are still published.
+	CREATE TABLE IF NOT EXISTS outbox (
+		id BIGSERIAL PRIMARY KEY,
+		workspace_id INTEGER NOT NULL REFERENCES workspaces(id) ON DELETE CASCADE,
+		todo_id INTEGER NOT NULL,
+		owner_id INTEGER,
+		event_type TEXT NOT NULL,
+		payload JSONB NOT NULL,
+		trace_context JSONB NOT NULL DEFAULT '{}',
+		attempts INTEGER NOT NULL DEFAULT 0,
+		next_attempt_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		last_error TEXT,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		published_at TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_outbox_pending ON outbox (todo_id, id) WHERE published_at IS NULL;
+	CREATE INDEX IF NOT EXISTS idx_outbox_published_at ON outbox (published_at) WHERE published_at IS NOT NULL;
+	-- the rule whose action made the change, and how many rules led to it
+	ALTER TABLE outbox ADD COLUMN IF NOT EXISTS rule_id INTEGER;
+	ALTER TABLE outbox ADD COLUMN IF NOT EXISTS rule_depth INTEGER NOT NULL DEFAULT 0;
+
+	-- automation rules, see rules.go. conditions and actions are the JSON of
+	-- model.RuleCondition and model.RuleAction.
+	CREATE TABLE IF NOT EXISTS rules (
+		id SERIAL PRIMARY KEY,
+		workspace_id INTEGER NOT NULL REFERENCES workspaces(id) ON DELETE CASCADE,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		name VARCHAR(100) NOT NULL,
+		trigger TEXT NOT NULL,
+		conditions JSONB NOT NULL DEFAULT '[]',
+		actions JSONB NOT NULL,
+		enabled BOOLEAN NOT NULL DEFAULT TRUE,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_rules_workspace_trigger ON rules (workspace_id, trigger) WHERE enabled;
+
+	-- the execution log. dedupe_key names what fired the rule, a rule runs
+	-- once for it even if the outbox publishes the event again.
+	CREATE TABLE IF NOT EXISTS rule_runs (
+		id BIGSERIAL PRIMARY KEY,
+		rule_id INTEGER NOT NULL REFERENCES rules(id) ON DELETE CASCADE,
+		workspace_id INTEGER NOT NULL REFERENCES workspaces(id) ON DELETE CASCADE,
+		todo_id INTEGER NOT NULL,
+		trigger TEXT NOT NULL,
+		dedupe_key TEXT NOT NULL,
+		status TEXT NOT NULL CHECK (status IN ('pending', 'running', 'succeeded', 'failed', 'skipped')),
+		actions INTEGER NOT NULL DEFAULT 0,
+		error TEXT,
+		depth INTEGER NOT NULL DEFAULT 0,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE (rule_id, dedupe_key)
+	);
+	CREATE INDEX IF NOT EXISTS idx_rule_runs_rule_id ON rule_runs (rule_id, id DESC);
+	-- runs are queued as pending with what fired them, and run by runRules
+	ALTER TABLE rule_runs DROP CONSTRAINT IF EXISTS rule_runs_status_check;
+	ALTER TABLE rule_runs ADD CONSTRAINT rule_runs_status_check
+		CHECK (status IN ('pending', 'running', 'succeeded', 'failed', 'skipped'));
+	ALTER TABLE rule_runs ADD COLUMN IF NOT EXISTS todo_uuid TEXT NOT NULL DEFAULT '';
+	ALTER TABLE rule_runs ADD COLUMN IF NOT EXISTS owner_id INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE rule_runs ADD COLUMN IF NOT EXISTS todo JSONB;
+	ALTER TABLE rule_runs ADD COLUMN IF NOT EXISTS caused_by INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE rule_runs ADD COLUMN IF NOT EXISTS started_at TIMESTAMP;
+	CREATE INDEX IF NOT EXISTS idx_rule_runs_pending ON rule_runs (id) WHERE status IN ('pending', 'running');
+
+	-- the webhook sink may see an event more than once
+	ALTER TABLE webhook_deliveries ADD COLUMN IF NOT EXISTS outbox_id BIGINT;
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_webhook_deliveries_outbox_id
+		ON webhook_deliveries (outbox_id, webhook_id, event_type);
+
 	CREATE OR REPLACE FUNCTION update_updated_at_column()
 	RETURNS TRIGGER AS $$
 	BEGIN
@@ -55,6 +541,213 @@ func initDB(db *sql.DB) error {
 		BEFORE UPDATE ON todos
 		FOR EACH ROW
 		EXECUTE FUNCTION update_updated_at_column();
+
+	DROP TRIGGER IF EXISTS update_users_updated_at ON users;
+	CREATE TRIGGER update_users_updated_at
+		BEFORE UPDATE ON users
+		FOR EACH ROW
+		EXECUTE FUNCTION update_updated_at_column();
+
+	DROP TRIGGER IF EXISTS update_lists_updated_at ON lists;
+	CREATE TRIGGER update_lists_updated_at
+		BEFORE UPDATE ON lists
+		FOR EACH ROW
+		EXECUTE FUNCTION update_updated_at_column();
+
+	-- history rows are immutable, they only go away with their workspace
+	CREATE OR REPLACE FUNCTION prevent_history_changes()
+	RETURNS TRIGGER AS $$
+	BEGIN
+		IF TG_OP = 'DELETE' AND NOT EXISTS (SELECT 1 FROM workspaces WHERE id = OLD.workspace_id) THEN
+			RETURN OLD;
+		END IF;
+		RAISE EXCEPTION 'todo_history is append-only';
+	END;
+	$$ language 'plpgsql';
+
+	DROP TRIGGER IF EXISTS todo_history_append_only ON todo_history;
+	CREATE TRIGGER todo_history_append_only
+		BEFORE UPDATE OR DELETE ON todo_history
+		FOR EACH ROW
+		EXECUTE FUNCTION prevent_history_changes();
+
+	-- wakes the event streams of every replica, see events.go. The payload
+	-- only says which history row to read, the streams read it themselves.
+	CREATE OR REPLACE FUNCTION notify_todo_event()
+	RETURNS TRIGGER AS $$
+	BEGIN
+		PERFORM pg_notify('todo_events', json_build_object('id', NEW.id, 'workspace_id', NEW.workspace_id)::text);
+		RETURN NULL;
+	END;
+	$$ language 'plpgsql';
+
+	DROP TRIGGER IF EXISTS notify_todo_event ON todo_history;
+	CREATE TRIGGER notify_todo_event
+		AFTER INSERT ON todo_history
+		FOR EACH ROW
+		EXECUTE FUNCTION notify_todo_event();
+
+	DROP TRIGGER IF EXISTS update_todo_comments_updated_at ON todo_comments;
+	CREATE TRIGGER update_todo_comments_updated_at
+		BEFORE UPDATE ON todo_comments
+		FOR EACH ROW
+		EXECUTE FUNCTION update_updated_at_column();
+
+	DROP TRIGGER IF EXISTS update_rules_updated_at ON rules;
+	CREATE TRIGGER update_rules_updated_at
+		BEFORE UPDATE ON rules
+		FOR EACH ROW
+		EXECUTE FUNCTION update_updated_at_column();
+
+	DROP TRIGGER IF EXISTS update_webhooks_updated_at ON webhooks;
+	CREATE TRIGGER update_webhooks_updated_at
+		BEFORE UPDATE ON webhooks
+		FOR EACH ROW
+		EXECUTE FUNCTION update_updated_at_column();
+
+	-- Row level security. Request transactions run as minimaldo_app with
+	-- app.workspace_id set (see beginTenantTx), so a query that forgets to
+	-- filter by workspace still only sees the current one. The connecting
+	-- role owns the tables and is not restricted, it is used for migrations
+	-- and for work that is not tied to a workspace.
+	DO $$
+	BEGIN
+		IF NOT EXISTS (SELECT 1 FROM pg_roles WHERE rolname = 'minimaldo_app') THEN
+			CREATE ROLE minimaldo_app NOLOGIN;
+		END IF;
+	END
+	$$;
+	GRANT minimaldo_app TO CURRENT_USER;
+	GRANT SELECT, INSERT, UPDATE, DELETE ON ALL TABLES IN SCHEMA public TO minimaldo_app;
+	GRANT USAGE, SELECT ON ALL SEQUENCES IN SCHEMA public TO minimaldo_app;
+	REVOKE UPDATE, DELETE ON todo_history FROM minimaldo_app;
+
+	CREATE OR REPLACE FUNCTION app_workspace_id()
+	RETURNS INTEGER AS $$
+		SELECT NULLIF(current_setting('app.workspace_id', true), '')::INTEGER
+	$$ LANGUAGE sql STABLE;
+
+	ALTER TABLE todos ENABLE ROW LEVEL SECURITY;
+	DROP POLICY IF EXISTS workspace_isolation ON todos;
+	CREATE POLICY workspace_isolation ON todos
+		USING (workspace_id = app_workspace_id())
+		WITH CHECK (workspace_id = app_workspace_id());
+
+	ALTER TABLE lists ENABLE ROW LEVEL SECURITY;
+	DROP POLICY IF EXISTS workspace_isolation ON lists;
+	CREATE POLICY workspace_isolation ON lists
+		USING (workspace_id = app_workspace_id())
+		WITH CHECK (workspace_id = app_workspace_id());
+
+	-- members and invitations follow their list, the subquery is itself
+	-- filtered by the lists policy
+	ALTER TABLE list_members ENABLE ROW LEVEL SECURITY;
+	DROP POLICY IF EXISTS workspace_isolation ON list_members;
+	CREATE POLICY workspace_isolation ON list_members
+		USING (EXISTS (SELECT 1 FROM lists l WHERE l.id = list_members.list_id));
+
+	ALTER TABLE list_invitations ENABLE ROW LEVEL SECURITY;
+	DROP POLICY IF EXISTS workspace_isolation ON list_invitations;
+	CREATE POLICY workspace_isolation ON list_invitations
+		USING (EXISTS (SELECT 1 FROM lists l WHERE l.id = list_invitations.list_id));
+
+	-- per-todo tables follow their todo the same way
+	ALTER TABLE todo_assignees ENABLE ROW LEVEL SECURITY;
+	DROP POLICY IF EXISTS workspace_isolation ON todo_assignees;
+	CREATE POLICY workspace_isolation ON todo_assignees
+		USING (EXISTS (SELECT 1 FROM todos t WHERE t.id = todo_assignees.todo_id));
+
+	ALTER TABLE todo_assignment_log ENABLE ROW LEVEL SECURITY;
+	DROP POLICY IF EXISTS workspace_isolation ON todo_assignment_log;
+	CREATE POLICY workspace_isolation ON todo_assignment_log
+		USING (EXISTS (SELECT 1 FROM todos t WHERE t.id = todo_assignment_log.todo_id));
+
+	ALTER TABLE todo_comments ENABLE ROW LEVEL SECURITY;
+	DROP POLICY IF EXISTS workspace_isolation ON todo_comments;
+	CREATE POLICY workspace_isolation ON todo_comments
+		USING (EXISTS (SELECT 1 FROM todos t WHERE t.id = todo_comments.todo_id));
+
+	-- history outlives its todo, so it carries its own workspace
+	ALTER TABLE todo_history ENABLE ROW LEVEL SECURITY;
+	DROP POLICY IF EXISTS workspace_isolation ON todo_history;
+	CREATE POLICY workspace_isolation ON todo_history
+		USING (workspace_id = app_workspace_id())
+		WITH CHECK (workspace_id = app_workspace_id());
+
+	ALTER TABLE activity_read_markers ENABLE ROW LEVEL SECURITY;
+	DROP POLICY IF EXISTS workspace_isolation ON activity_read_markers;
+	CREATE POLICY workspace_isolation ON activity_read_markers
+		USING (workspace_id = app_workspace_id())
+		WITH CHECK (workspace_id = app_workspace_id());
+
+	ALTER TABLE todo_ids ENABLE ROW LEVEL SECURITY;
+	DROP POLICY IF EXISTS workspace_isolation ON todo_ids;
+	CREATE POLICY workspace_isolation ON todo_ids
+		USING (workspace_id = app_workspace_id())
+		WITH CHECK (workspace_id = app_workspace_id());
+
+	ALTER TABLE webhooks ENABLE ROW LEVEL SECURITY;
+	DROP POLICY IF EXISTS workspace_isolation ON webhooks;
+	CREATE POLICY workspace_isolation ON webhooks
+		USING (workspace_id = app_workspace_id())
+		WITH CHECK (workspace_id = app_workspace_id());
+
+	ALTER TABLE webhook_deliveries ENABLE ROW LEVEL SECURITY;
+	DROP POLICY IF EXISTS workspace_isolation ON webhook_deliveries;
+	CREATE POLICY workspace_isolation ON webhook_deliveries
+		USING (workspace_id = app_workspace_id())
+		WITH CHECK (workspace_id = app_workspace_id());
+
+	ALTER TABLE webhook_attempts ENABLE ROW LEVEL SECURITY;
+	DROP POLICY IF EXISTS workspace_isolation ON webhook_attempts;
+	CREATE POLICY workspace_isolation ON webhook_attempts
+		USING (EXISTS (SELECT 1 FROM webhook_deliveries d WHERE d.id = webhook_attempts.delivery_id));
+
+	ALTER TABLE rules ENABLE ROW LEVEL SECURITY;
+	DROP POLICY IF EXISTS workspace_isolation ON rules;
+	CREATE POLICY workspace_isolation ON rules
+		USING (workspace_id = app_workspace_id())
+		WITH CHECK (workspace_id = app_workspace_id());
+
+	ALTER TABLE rule_runs ENABLE ROW LEVEL SECURITY;
+	DROP POLICY IF EXISTS workspace_isolation ON rule_runs;
+	CREATE POLICY workspace_isolation ON rule_runs
+		USING (workspace_id = app_workspace_id())
+		WITH CHECK (workspace_id = app_workspace_id());
+
+	ALTER TABLE outbox ENABLE ROW LEVEL SECURITY;
+	DROP POLICY IF EXISTS workspace_isolation ON outbox;
+	CREATE POLICY workspace_isolation ON outbox
+		USING (workspace_id = app_workspace_id())
+		WITH CHECK (workspace_id = app_workspace_id());
+
+	ALTER TABLE undo_tokens ENABLE ROW LEVEL SECURITY;
+	DROP POLICY IF EXISTS workspace_isolation ON undo_tokens;
+	CREATE POLICY workspace_isolation ON undo_tokens
+		USING (workspace_id = app_workspace_id())
+		WITH CHECK (workspace_id = app_workspace_id());
+
+	ALTER TABLE deleted_todos ENABLE ROW LEVEL SECURITY;
+	DROP POLICY IF EXISTS workspace_isolation ON deleted_todos;
+	CREATE POLICY workspace_isolation ON deleted_todos
+		USING (workspace_id = app_workspace_id())
+		WITH CHECK (workspace_id = app_workspace_id());
+
+	ALTER TABLE todo_attachments ENABLE ROW LEVEL SECURITY;
+	DROP POLICY IF EXISTS workspace_isolation ON todo_attachments;
+	CREATE POLICY workspace_isolation ON todo_attachments
+		USING (EXISTS (SELECT 1 FROM todos t WHERE t.id = todo_attachments.todo_id));
+
+	-- and per-comment tables follow their comment
+	ALTER TABLE todo_comment_revisions ENABLE ROW LEVEL SECURITY;
+	DROP POLICY IF EXISTS workspace_isolation ON todo_comment_revisions;
+	CREATE POLICY workspace_isolation ON todo_comment_revisions
+		USING (EXISTS (SELECT 1 FROM todo_comments c WHERE c.id = todo_comment_revisions.comment_id));
+
+	ALTER TABLE todo_comment_mentions ENABLE ROW LEVEL SECURITY;
+	DROP POLICY IF EXISTS workspace_isolation ON todo_comment_mentions;
+	CREATE POLICY workspace_isolation ON todo_comment_mentions
+		USING (EXISTS (SELECT 1 FROM todo_comments c WHERE c.id = todo_comment_mentions.comment_id));
 	`
 
 	_, err := db.Exec(query)
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"github.com/thakurnishu/MinimalDo/model"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	// the channel notify_todo_event() notifies on
+	todoEventsChannel = "todo_events"
+
+	// how many events a stream replays on resume, or holds back when it
+	// can't keep up. Past that the client is sent a reset and reloads.
+	maxEventBacklog = 500
+)
+
+var errNotMember = errors.New("no longer a member of the workspace")
+
+// eventHub fans the todo_events notifications out to the event streams open
+// on this replica. Every replica listens, so a change written through any of
+// them reaches every stream.
+type eventHub struct {
+	logger *slog.Logger
+
+	mu   sync.Mutex
+	subs map[int]map[*eventSub]struct{} // by workspace
+}
+
+// eventSub is one open stream. The hub only passes it history IDs, the
+// stream reads the events itself in a tenant transaction, so what it sends is
+// checked against what its user can see at that moment.
+type eventSub struct {
+	wake chan struct{}
+
+	mu      sync.Mutex
+	pending []int64
+	resync  bool // notifications may have been missed, read everything after the last event
+}
+
+func (sub *eventSub) push(id int64) {
+	sub.mu.Lock()
+	if len(sub.pending) < maxEventBacklog {
+		sub.pending = append(sub.pending, id)
+	} else {
+		sub.pending, sub.resync = nil, true
+	}
+	sub.mu.Unlock()
+	sub.signal()
+}
+
+func (sub *eventSub) requestResync() {
+	sub.mu.Lock()
+	sub.pending, sub.resync = nil, true
+	sub.mu.Unlock()
+	sub.signal()
+}
+
+func (sub *eventSub) signal() {
+	select {
+	case sub.wake <- struct{}{}:
+	default:
+	}
+}
+
+// take returns and clears what arrived since the last call.
+func (sub *eventSub) take() (ids []int64, resync bool) {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	ids, resync = sub.pending, sub.resync
+	sub.pending, sub.resync = nil, false
+	return ids, resync
+}
+
+// listenEvents starts listening for todo_events on its own connection.
+func listenEvents(cfg *Config, logger *slog.Logger) (*eventHub, error) {
+	hub := &eventHub{logger: logger, subs: map[int]map[*eventSub]struct{}{}}
+	l := pq.NewListener(connString(cfg), 10*time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			logger.Warn("event listener connection problem", "event", ev, "error", err)
+		}
+	})
+	if err := l.Listen(todoEventsChannel); err != nil {
+		l.Close()
+		return nil, err
+	}
+	go hub.run(l)
+	return hub, nil
+}
+
+func (h *eventHub) run(l *pq.Listener) {
+	for {
+		select {
+		case n := <-l.Notify:
+			// nil after a reconnect, notifications sent meanwhile are lost
+			if n == nil {
+				h.resyncAll()
+				continue
+			}
+			var payload struct {
+				ID          int64 `json:"id"`
+				WorkspaceID int   `json:"workspace_id"`
+			}
+			if err := json.Unmarshal([]byte(n.Extra), &payload); err != nil {
+				h.logger.Error("invalid event notification", "payload", n.Extra, "error", err)
+				continue
+			}
+			h.dispatch(payload.WorkspaceID, payload.ID)
+		case <-time.After(90 * time.Second):
+			// a dead connection is only noticed when it is used
+			go l.Ping()
+		}
+	}
+}
+
+func (h *eventHub) subscribe(workspaceID int) *eventSub {
+	sub := &eventSub{wake: make(chan struct{}, 1)}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subs[workspaceID] == nil {
+		h.subs[workspaceID] = map[*eventSub]struct{}{}
+	}
+	h.subs[workspaceID][sub] = struct{}{}
+	return sub
+}
+
+func (h *eventHub) unsubscribe(workspaceID int, sub *eventSub) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subs[workspaceID], sub)
+	if len(h.subs[workspaceID]) == 0 {
+		delete(h.subs, workspaceID)
+	}
+}
+
+func (h *eventHub) dispatch(workspaceID int, id int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for sub := range h.subs[workspaceID] {
+		sub.push(id)
+	}
+}
+
+func (h *eventHub) resyncAll() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, subs := range h.subs {
+		for sub := range subs {
+			sub.requestResync()
+		}
+	}
+}
+
+// eventType maps a history action to the event the stream sends for it.
+func eventType(action string) string {
+	switch action {
+	case model.HistoryCreate, model.HistoryRestore:
+		return model.EventTodoCreated
+	case model.HistoryDelete:
+		return model.EventTodoDeleted
+	default:
+		return model.EventTodoUpdated
+	}
+}
+
+// streamEvents streams the changes to the todos the caller can see in the
+// current workspace as server-sent events. A client that reconnects with
+// Last-Event-ID gets what it missed first. The stream ends when the access
+// token expires, the client then reconnects with a fresh one.
+func (s *Server) streamEvents(c *gin.Context) {
+	ctx, span := s.tracer.Start(c.Request.Context(), "stream_events")
+	defer span.End()
+
+	userID := currentUserID(c)
+	workspaceID := currentWorkspaceID(c)
+	span.SetAttributes(attribute.Int("user.id", userID))
+
+	var lastID int64
+	resume := c.GetHeader("Last-Event-ID")
+	if resume != "" {
+		id, err := strconv.ParseInt(resume, 10, 64)
+		if err != nil {
+			logError("invalid last event id", ctx, s.logger, span, err,
+				slog.String("last_event_id", resume),
+			)
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid Last-Event-ID"})
+			return
+		}
+		lastID = id
+	}
+
+	// subscribe before reading the starting point, so nothing written in
+	// between is lost
+	sub := s.events.subscribe(workspaceID)
+	defer s.events.unsubscribe(workspaceID, sub)
+	if resume != "" {
+		sub.requestResync()
+	} else {
+		id, err := s.latestEventID(ctx, workspaceID)
+		if err != nil {
+			logError("query failed", ctx, s.logger, span, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		lastID = id
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no") // don't let nginx buffer the stream
+	c.Status(http.StatusOK)
+	fmt.Fprint(c.Writer, ": connected\n\n")
+	c.Writer.Flush()
+
+	s.logger.InfoContext(ctx, "event stream opened",
+		slog.Int("user_id", userID),
+		slog.Int("workspace_id", workspaceID),
+		slog.Int64("last_event_id", lastID),
+	)
+
+	heartbeat := time.NewTicker(s.cfg.EventsHeartbeat)
+	defer heartbeat.Stop()
+	var expired <-chan time.Time
+	if exp := c.GetTime(ctxTokenExp); !exp.IsZero() {
+		timer := time.NewTimer(time.Until(exp))
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	sent := newRecentIDs(maxEventBacklog)
+	sentCount := 0
+	defer func() {
+		span.SetAttributes(attribute.Int("events.sent", sentCount))
+	}()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-expired:
+			s.logger.InfoContext(ctx, "event stream closed, access token expired",
+				slog.Int("user_id", userID),
+			)
+			return
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(c.Writer, ": ping\n\n"); err != nil {
+				return
+			}
+			c.Writer.Flush()
+		case <-sub.wake:
+			ids, resync := sub.take()
+			events, reset, err := s.loadEvents(ctx, workspaceID, userID, lastID, ids, resync)
+			if err == errNotMember {
+				s.logger.InfoContext(ctx, "event stream closed, user left the workspace",
+					slog.Int("user_id", userID),
+				)
+				return
+			}
+			if err != nil {
+				// the client reconnects and resumes from its last event
+				logError("loading events failed", ctx, s.logger, span, err)
+				return
+			}
+			if reset {
+				id, err := s.latestEventID(ctx, workspaceID)
+				if err != nil {
+					logError("query failed", ctx, s.logger, span, err)
+					return
+				}
+				lastID = id
+				fmt.Fprintf(c.Writer, "id: %d\nevent: %s\ndata: {}\n\n", lastID, model.EventReset)
+			}
+			for _, e := range events {
+				if sent.contains(e.ID) {
+					continue
+				}
+				data, err := json.Marshal(e)
+				if err != nil {
+					logError("encoding event failed", ctx, s.logger, span, err)
+					return
+				}
+				fmt.Fprintf(c.Writer, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+				sent.add(e.ID)
+				sentCount++
+				lastID = max(lastID, e.ID)
+			}
+			c.Writer.Flush()
+		}
+	}
+}
+
+// latestEventID returns the id of the newest history row of a workspace.
+func (s *Server) latestEventID(ctx context.Context, workspaceID int) (int64, error) {
+	tx, err := s.beginWorkspaceTx(ctx, workspaceID)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var id sql.NullInt64
+	err = tx.QueryRowContext(ctx, "SELECT MAX(id) FROM todo_history").Scan(&id)
+	return id.Int64, err
+}
+
+// loadEvents reads the events for the history rows in ids, or every event
+// after lastID when catchUp is set. reset is true when there are more than a
+// stream replays.
+//
+// History IDs are taken at insert, not at commit, so a row with a lower ID can
+// commit after lastID was sent. Catching up also reads every row whose
+// transaction was still running when lastID was written, which can repeat a
+// few events the stream already sent; callers skip those with recentIDs.
+func (s *Server) loadEvents(ctx context.Context, workspaceID, userID int, lastID int64, ids []int64, catchUp bool) (events []model.TodoEvent, reset bool, err error) {
+	if !catchUp && len(ids) == 0 {
+		return nil, false, nil
+	}
+	// membership is checked again on every read, a removed member stops
+	// getting events right away
+	if _, err := workspaceRole(ctx, s.db, workspaceID, userID); err == sql.ErrNoRows {
+		return nil, false, errNotMember
+	} else if err != nil {
+		return nil, false, err
+	}
+
+	tx, err := s.beginWorkspaceTx(ctx, workspaceID)
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback()
+
+	where, arg := "id = ANY($2)", any(pq.Array(ids))
+	if catchUp {
+		where, arg = `(id > $2 OR tx_id >= (SELECT snapshot_xmin FROM todo_history WHERE id = $2))`, lastID
+	}
+	rows, err := tx.QueryContext(ctx, `
+		SELECT id, action, todo_uuid(todo_id), version, snapshot, changes, changed_by, changed_at
+		FROM todo_history
+		WHERE `+visibleTodos+` AND `+where+`
+		ORDER BY id
+		LIMIT $3
+	`, userID, arg, maxEventBacklog+1)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var e model.TodoEvent
+		var action string
+		var snapshot, changes []byte
+		if err := rows.Scan(&e.ID, &action, &e.TodoID, &e.Version, &snapshot, &changes, &e.ChangedBy, &e.ChangedAt); err != nil {
+			return nil, false, err
+		}
+		if err := json.Unmarshal(snapshot, &e.Todo); err != nil {
+			return nil, false, err
+		}
+		if err := json.Unmarshal(changes, &e.Changes); err != nil {
+			return nil, false, err
+		}
+		e.Type = eventType(action)
+		events = append(events, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+	if len(events) > maxEventBacklog {
+		return nil, true, nil
+	}
+	return events, false, nil
+}
+
+// recentIDs remembers the last n event IDs a stream sent. A notification can
+// arrive for an event the stream already sent while catching up.
+type recentIDs struct {
+	order []int64
+	set   map[int64]struct{}
+	n     int
+}
+
+func newRecentIDs(n int) *recentIDs {
+	return &recentIDs{set: make(map[int64]struct{}, n), n: n}
+}
+
+func (r *recentIDs) contains(id int64) bool {
+	_, ok := r.set[id]
+	return ok
+}
+
+func (r *recentIDs) add(id int64) {
+	if len(r.order) == r.n {
+		delete(r.set, r.order[0])
+		r.order = r.order[1:]
+	}
+	r.order = append(r.order, id)
+	r.set[id] = struct{}{}
+}
@@ -2,13 +2,14 @@ package main
 
 import (
 	"context"
-	"database/sql"
+	"errors"
 	"log/slog"
 	"net/http"
-	"strconv"
+	"slices"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/thakurnishu/MinimalDo/model"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/codes"
 	"go.opentelemetry.io/otel/trace"
@@ -18,11 +19,33 @@ func (s *Server) getTodos(c *gin.Context) {
 	ctx, span := s.tracer.Start(c.Request.Context(), "get_tasks")
 	defer span.End()
 
-	rows, err := s.db.Query(`
-		SELECT id, title, description, completed, created_at, updated_at 
+	userID := currentUserID(c)
+	span.SetAttributes(attribute.Int("user.id", userID))
+
+	tx, err := s.beginTenantTx(ctx, c)
+	if err != nil {
+		logError("begin transaction failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	listID, ok := s.listFilter(c, ctx, span, tx)
+	if !ok {
+		return
+	}
+	assignee, unassigned, ok := s.assigneeFilter(c, ctx, span)
+	if !ok {
+		return
+	}
+
+	rows, err := tx.Query(`
+		SELECT todo_uuid(id), title, description, completed, list_id, priority, due_at, `+commentCount+`, created_at, updated_at 
 		FROM todos 
+		WHERE `+visibleTodos+` AND ($2::int IS NULL OR list_id = $2)
+		AND `+assigneeClause(3, 4)+`
 		ORDER BY created_at DESC
-	`)
+	`, userID, listID, assignee, unassigned)
 	if err != nil {
 		logError("query failed", ctx, s.logger, span, err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -30,14 +53,18 @@ func (s *Server) getTodos(c *gin.Context) {
 	}
 	defer rows.Close()
 
-	var todos []Todo
+	var todos []model.Todo
 	for rows.Next() {
-		var t Todo
+		var t model.Todo
 		err := rows.Scan(
 			&t.ID,
 			&t.Title,
 			&t.Description,
 			&t.Completed,
+			&t.ListID,
+			&t.Priority,
+			&t.DueAt,
+			&t.CommentCount,
 			&t.CreatedAt,
 			&t.UpdatedAt,
 		)
@@ -48,6 +75,11 @@ func (s *Server) getTodos(c *gin.Context) {
 		}
 		todos = append(todos, t)
 	}
+	if err := loadAssignees(ctx, tx, todos); err != nil {
+		logError("assignee lookup failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
 
 	s.logger.InfoContext(ctx, "Fetching all tasks",
 		slog.Int("total_tasks", len(todos)),
@@ -63,159 +95,53 @@ func (s *Server) createTodo(c *gin.Context) {
 	ctx, span := s.tracer.Start(c.Request.Context(), "create_task")
 	defer span.End()
 
-	var t Todo
-	if err := c.BindJSON(&t); err != nil {
-		logError("failed to parse json", ctx, s.logger, span, err)
+	body, err := c.GetRawData()
+	if err != nil {
+		logError("failed to read body", ctx, s.logger, span, err)
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-
-	query := `
-		INSERT INTO todos (title, description, completed) 
-		VALUES ($1, $2, $3) 
-		RETURNING id, created_at, updated_at
-	`
-
-	err := s.db.QueryRow(
-		query,
-		t.Title,
-		t.Description,
-		t.Completed,
-	).Scan(&t.ID, &t.CreatedAt, &t.UpdatedAt)
+	w, err := s.addTodo(ctx, span, c, body)
 	if err != nil {
-		logError("row scan failed", ctx, s.logger, span, err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		writeError(c, err)
 		return
 	}
 
-	s.logger.InfoContext(ctx, "created task",
-		slog.String("task_title", t.Title),
-		slog.Bool("task_creation_completed", true),
-	)
-	span.SetAttributes(
-		attribute.String("task.title", t.Title),
-		attribute.Bool("task.creation_completed", true),
-	)
-
-	c.JSON(http.StatusOK, t)
+	c.Header(undoHeader, w.undoToken)
+	c.JSON(http.StatusOK, w.todo)
 }
 
 func (s *Server) updateTodo(c *gin.Context) {
 	ctx, span := s.tracer.Start(c.Request.Context(), "update_todo")
 	defer span.End()
 
-	idStr := c.Param("id")
-	id, err := strconv.Atoi(idStr)
+	body, err := c.GetRawData()
 	if err != nil {
-		logError("invalid id", ctx, s.logger, span,err, 
-			slog.String("task_id", idStr),
-		)
-
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invaild ID"})
-		return
-	}
-
-	s.logger.InfoContext(ctx, "todo to update", 
-		slog.String("todo_id", idStr),
-	)
-	span.SetAttributes(
-		attribute.String("todo.id", idStr),
-	)
-
-	var t Todo
-	if err := c.BindJSON(&t); err != nil {
-		logError("failed to parse json", ctx, s.logger, span, err)
+		logError("failed to read body", ctx, s.logger, span, err)
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
-
-	query := `
-		UPDATE todos 
-		SET title = $1, description = $2, completed = $3
-		WHERE id = $4
-		RETURNING id, title, description, completed, created_at, updated_at
-	`
-
-	err = s.db.QueryRow(
-		query,
-		t.Title,
-		t.Description,
-		t.Completed,
-		id,
-	).Scan(&t.ID, &t.Title, &t.Description, &t.Completed, &t.CreatedAt, &t.UpdatedAt)
+	w, err := s.editTodo(ctx, span, c, c.Param("id"), body)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			logError("task not found", ctx, s.logger, span, err, 
-				slog.Int("task_id", id),
-			)
-			c.JSON(http.StatusNotFound, gin.H{"error": "Task not found"})
-			return
-		}
-		logError("row scan failed", ctx, s.logger, span, err)
-
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		writeError(c, err)
 		return
 	}
-	s.logger.InfoContext(ctx, "task updated",
-		slog.Int("task_id", id),
-		slog.String("task_title", t.Title),
-		slog.Bool("task_updation_completed", true),
-	)
-	span.SetAttributes(
-		attribute.Int("task.id", id),
-		attribute.String("task.title", t.Title),
-		attribute.Bool("task.updation_completed", true),
-	)
 
-	c.JSON(http.StatusOK, t)
+	c.Header(undoHeader, w.undoToken)
+	c.JSON(http.StatusOK, w.todo)
 }
 
 func (s *Server) deleteTodo(c *gin.Context) {
 	ctx, span := s.tracer.Start(c.Request.Context(), "delete_task")
 	defer span.End()
 
-	idStr := c.Param("id")
-	id, err := strconv.Atoi(idStr)
+	w, err := s.removeTodo(ctx, span, c, c.Param("id"))
 	if err != nil {
-		logError("invalid id", ctx, s.logger, span, err,
-			slog.String("task_id", idStr),
-		)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invaild ID"})
-		return
-	}
-
-	result, err := s.db.Exec("DELETE FROM todos WHERE id = $1", id)
-	if err != nil {
-		logError("query execution failed", ctx, s.logger, span, err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
-
-	rowsAffected, err := result.RowsAffected()
-	if err != nil {
-		logError("affected rows check failed", ctx, s.logger, span, err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
-
-	if rowsAffected == 0 {
-		s.logger.WarnContext(ctx, "task not found",
-			slog.Int("task_id", id),
-		)
-		span.SetStatus(codes.Error, "task not found")
-
-		c.JSON(http.StatusNotFound, gin.H{"error": "Task not found"})
+		writeError(c, err)
 		return
 	}
 
-	s.logger.InfoContext(ctx, "task delete",
-		slog.Int("task_id", id),
-		slog.Bool("task_deletion_completed", true),
-	)
-	span.SetAttributes(
-		attribute.Int("task.id", id),
-		attribute.Bool("task.deletion_completed", true),
-	)
-
+	c.Header(undoHeader, w.undoToken)
 	c.Status(http.StatusNoContent)
 }
 
@@ -234,6 +160,7 @@ func (s *Server) getTodosByDate(c *gin.Context) {
 
 	rangeType := c.Query("range") // day/week/month
 	dateStr := c.Query("date")    // YYYY-MM-DD format
+	userID := currentUserID(c)
 
 	s.logger.InfoContext(ctx, "getting tasks by date range",
 		slog.String("range_type", rangeType),
@@ -243,8 +170,26 @@ func (s *Server) getTodosByDate(c *gin.Context) {
 	span.SetAttributes(
 		attribute.String("request.range_type", rangeType),
 		attribute.String("request.date", dateStr),
+		attribute.Int("user.id", userID),
 	)
 
+	tx, err := s.beginTenantTx(ctx, c)
+	if err != nil {
+		logError("begin transaction failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	listID, ok := s.listFilter(c, ctx, span, tx)
+	if !ok {
+		return
+	}
+	assignee, unassigned, ok := s.assigneeFilter(c, ctx, span)
+	if !ok {
+		return
+	}
+
 	dataLayout := "2006-01-02"
 	// Parse and validate date
 	baseDate, err := time.Parse(dataLayout, dateStr)
@@ -317,12 +262,14 @@ func (s *Server) getTodosByDate(c *gin.Context) {
 	)
 
 	// Query todos within date range
-	rows, err := s.db.Query(`
-			SELECT id, title, description, completed, created_at, updated_at 
+	rows, err := tx.Query(`
+			SELECT todo_uuid(id), title, description, completed, list_id, priority, due_at, `+commentCount+`, created_at, updated_at 
 			FROM todos 
-			WHERE created_at >= $1 AND created_at < $2
+			WHERE `+visibleTodos+` AND created_at >= $2 AND created_at < $3
+			AND ($4::int IS NULL OR list_id = $4)
+			AND `+assigneeClause(5, 6)+`
 			ORDER BY created_at DESC
-	`, start, end)
+	`, userID, start, end, listID, assignee, unassigned)
 
 	if err != nil {
 		logError("database query failed", ctx, s.logger, querySpan, err,
@@ -338,15 +285,19 @@ func (s *Server) getTodosByDate(c *gin.Context) {
 
 	// Scan results
 	ctx, scanSpan := s.tracer.Start(ctx, "scan_tasks_results")
-	var todos []Todo
+	var todos []model.Todo
 	var todoCount int
 	for rows.Next() {
-		var t Todo
+		var t model.Todo
 		err := rows.Scan(
 			&t.ID,
 			&t.Title,
 			&t.Description,
 			&t.Completed,
+			&t.ListID,
+			&t.Priority,
+			&t.DueAt,
+			&t.CommentCount,
 			&t.CreatedAt,
 			&t.UpdatedAt,
 		)
@@ -366,6 +317,14 @@ func (s *Server) getTodosByDate(c *gin.Context) {
 		todoCount++
 	}
 
+	if err := loadAssignees(ctx, tx, todos); err != nil {
+		logError("assignee lookup failed", ctx, s.logger, scanSpan, err)
+		scanSpan.End()
+		querySpan.End()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
 	scanSpan.SetAttributes(
 		attribute.Int("todos.count", todoCount),
 		attribute.String("scan.status", "completed"),
@@ -391,15 +350,15 @@ func (s *Server) getTodosByDate(c *gin.Context) {
 			attribute.Int("grouping.input_count", len(todos)),
 		)
 
-		grouped := make(map[string][]Todo)
+		grouped := make(map[string][]model.Todo)
 		for _, todo := range todos {
 			dateKey := todo.CreatedAt.Format(dataLayout)
 			grouped[dateKey] = append(grouped[dateKey], todo)
 		}
 
-		var result []GroupedTodos
+		var result []model.GroupedTodos
 		for date, items := range grouped {
-			result = append(result, GroupedTodos{
+			result = append(result, model.GroupedTodos{
 				Date:  date,
 				Todos: items,
 			})
@@ -452,3 +411,16 @@ func logError(msg string, ctx context.Context, logger *slog.Logger, span trace.S
 	span.RecordError(err)
 	span.SetStatus(codes.Error, msg)
 }
+
+// normalizeTodoFields checks the priority of a todo and stores its due date
+// in UTC, to the second.
+func normalizeTodoFields(t *model.Todo) error {
+	if !slices.Contains(model.Priorities, t.Priority) {
+		return errors.New("priority must be low, medium, high, urgent or empty")
+	}
+	if t.DueAt != nil {
+		d := t.DueAt.UTC().Truncate(time.Second)
+		t.DueAt = &d
+	}
+	return nil
+}
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/thakurnishu/MinimalDo/model"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// lockTodo reads the current state of a todo and locks it until tx ends, so
+// the change recorded for it matches what was overwritten.
+func lockTodo(ctx context.Context, tx *sql.Tx, todoID int) (model.TodoSnapshot, int, error) {
+	var t model.TodoSnapshot
+	var ownerID sql.NullInt64
+	err := tx.QueryRowContext(ctx, `
+		SELECT title, description, completed, list_id, priority, due_at, owner_id FROM todos WHERE id = $1 FOR UPDATE
+	`, todoID).Scan(&t.Title, &t.Description, &t.Completed, &t.ListID, &t.Priority, &t.DueAt, &ownerID)
+	return t, int(ownerID.Int64), err
+}
+
+func snapshotOf(t model.Todo) model.TodoSnapshot {
+	return model.TodoSnapshot{
+		Title:       t.Title,
+		Description: t.Description,
+		Completed:   t.Completed,
+		ListID:      t.ListID,
+		Priority:    t.Priority,
+		DueAt:       t.DueAt,
+	}
+}
+
+// diffTodo returns the fields that differ between before and after. A nil
+// before is a create and a nil after a delete, every field is then changed.
+func diffTodo(before, after *model.TodoSnapshot) map[string]model.FieldChange {
+	changes := map[string]model.FieldChange{}
+	field := func(name string, get func(model.TodoSnapshot) any) {
+		var old, new any
+		if before != nil {
+			old = get(*before)
+		}
+		if after != nil {
+			new = get(*after)
+		}
+		if before == nil || after == nil || old != new {
+			changes[name] = model.FieldChange{Old: old, New: new}
+		}
+	}
+	field("title", func(t model.TodoSnapshot) any { return t.Title })
+	field("description", func(t model.TodoSnapshot) any { return t.Description })
+	field("completed", func(t model.TodoSnapshot) any { return t.Completed })
+	field("priority", func(t model.TodoSnapshot) any { return t.Priority })
+	field("due_at", func(t model.TodoSnapshot) any {
+		if t.DueAt == nil {
+			return nil
+		}
+		return t.DueAt.UTC().Format(time.RFC3339)
+	})
+	return changes
+}
+
+// todoChange is one write to a todo, for recordChange.
+type todoChange struct {
+	todoID      int
+	workspaceID int
+	ownerID     int
+	action      string
+	before      *model.TodoSnapshot // nil for create
+	after       *model.TodoSnapshot // nil for delete
+	revertedTo  *int
+	changedBy   int
+	ruleID      int // the rule that made the change, 0 for a user
+	ruleDepth   int // how many rules led to the change, see rules.go
+}
+
+// recordChange appends a version to the todo's history. It must run in the
+// transaction that made the change, so the history can't miss a write or
+// record one that was rolled back. Updates that changed nothing are not
+// recorded, the returned version and event ID are then 0. The todo's CRDT
+// state is brought in step with the write, which must already be in the row,
+// and the change is written to the outbox.
+func recordChange(ctx context.Context, tx *sql.Tx, ch todoChange) (version int, eventID int64, err error) {
+	changes := diffTodo(ch.before, ch.after)
+	if len(changes) == 0 {
+		return 0, 0, nil
+	}
+	if ch.after != nil {
+		if err := stepCRDT(ctx, tx, ch); err != nil {
+			return 0, 0, err
+		}
+	}
+	snapshot := ch.after
+	if snapshot == nil {
+		snapshot = ch.before
+	}
+	changesJSON, err := json.Marshal(changes)
+	if err != nil {
+		return 0, 0, err
+	}
+	snapshotJSON, err := json.Marshal(snapshot)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// the todo row is locked by the write, so versions can't collide
+	e := model.TodoEvent{Type: eventType(ch.action), Todo: *snapshot, Changes: changes}
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO todo_history
+			(todo_id, version, workspace_id, list_id, owner_id, action, changes, snapshot, reverted_to, changed_by)
+		SELECT $1, COALESCE(MAX(version), 0) + 1, $2, $3, $4, $5, $6, $7, $8, $9
+		FROM todo_history WHERE todo_id = $1
+		RETURNING id, version, todo_uuid(todo_id), changed_by, changed_at
+	`, ch.todoID, ch.workspaceID, snapshot.ListID, ch.ownerID, ch.action, changesJSON, snapshotJSON,
+		ch.revertedTo, ch.changedBy).Scan(&e.ID, &e.Version, &e.TodoID, &e.ChangedBy, &e.ChangedAt)
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := writeOutbox(ctx, tx, ch, e); err != nil {
+		return 0, 0, err
+	}
+	return e.Version, e.ID, nil
+}
+
+// recordListDeletion records the deletion of every todo in a list that is
+// about to be deleted with it.
+func recordListDeletion(ctx context.Context, tx *sql.Tx, listID, workspaceID, userID int) error {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT id, title, description, completed, list_id, priority, due_at, owner_id FROM todos WHERE list_id = $1 FOR UPDATE
+	`, listID)
+	if err != nil {
+		return err
+	}
+	var deleted []todoChange
+	for rows.Next() {
+		var t model.TodoSnapshot
+		var ownerID sql.NullInt64
+		ch := todoChange{workspaceID: workspaceID, action: model.HistoryDelete, changedBy: userID, before: &t}
+		if err := rows.Scan(&ch.todoID, &t.Title, &t.Description, &t.Completed, &t.ListID, &t.Priority, &t.DueAt, &ownerID); err != nil {
+			rows.Close()
+			return err
+		}
+		ch.ownerID = int(ownerID.Int64)
+		deleted = append(deleted, ch)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, ch := range deleted {
+		if _, _, err := recordChange(ctx, tx, ch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// historyRole is todoRole for todos that may have been deleted. The role on a
+// deleted todo comes from its last version: the owner of a personal todo, or
+// the caller's role on the list it was in. exists tells whether the todo is
+// still there.
+func historyRole(ctx context.Context, db dbtx, todoID, userID int) (exists bool, r role, err error) {
+	_, r, err = todoRole(ctx, db, todoID, userID)
+	if err != sql.ErrNoRows {
+		return err == nil, r, err
+	}
+
+	var listID *int
+	var ownerID sql.NullInt64
+	err = db.QueryRowContext(ctx, `
+		SELECT list_id, owner_id FROM todo_history WHERE todo_id = $1 ORDER BY version DESC LIMIT 1
+	`, todoID).Scan(&listID, &ownerID)
+	if err != nil {
+		return false, roleNone, err
+	}
+	if listID == nil {
+		if ownerID.Valid && int(ownerID.Int64) == userID {
+			return false, roleOwner, nil
+		}
+		return false, roleNone, nil
+	}
+	r, err = listRole(ctx, db, *listID, userID)
+	return false, r, err
+}
+
+// authorizeHistory is authorizeTodo for the history endpoints, which also
+// work on deleted todos.
+func (s *Server) authorizeHistory(c *gin.Context, ctx context.Context, span trace.Span, db dbtx, todoID int, need role) (exists bool, ok bool) {
+	exists, have, err := historyRole(ctx, db, todoID, currentUserID(c))
+	if err == sql.ErrNoRows {
+		logError("task not found", ctx, s.logger, span, err,
+			slog.Int("task_id", todoID),
+		)
+		c.JSON(http.StatusNotFound, gin.H{"error": "Task not found"})
+		return false, false
+	}
+	if err != nil {
+		logError("role lookup failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return false, false
+	}
+	return exists, s.authorize(c, ctx, span, "task", todoID, have, need)
+}
+
+// queryHistory returns the versions of a todo, newest first, or the single
+// version when it is not zero.
+func queryHistory(ctx context.Context, db dbtx, todoID, version int) ([]model.TodoVersion, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT h.version, h.action, h.changes, h.snapshot, h.reverted_to, h.changed_at,
+			u.id, u.username, u.created_at
+		FROM todo_history h
+		LEFT JOIN users u ON u.id = h.changed_by
+		WHERE h.todo_id = $1 AND ($2 = 0 OR h.version = $2)
+		ORDER BY h.version DESC
+	`, todoID, version)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	versions := []model.TodoVersion{}
+	for rows.Next() {
+		var v model.TodoVersion
+		var changes, snapshot []byte
+		var userID *int
+		var username *string
+		var userCreated sql.NullTime
+		err := rows.Scan(&v.Version, &v.Action, &changes, &snapshot, &v.RevertedTo, &v.ChangedAt,
+			&userID, &username, &userCreated)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(changes, &v.Changes); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(snapshot, &v.Todo); err != nil {
+			return nil, err
+		}
+		if userID != nil {
+			v.ChangedBy = &model.User{ID: *userID, Username: *username, CreatedAt: userCreated.Time}
+		}
+		versions = append(versions, v)
+	}
+	return versions, rows.Err()
+}
+
+func (s *Server) getTodoHistory(c *gin.Context) {
+	ctx, span := s.tracer.Start(c.Request.Context(), "get_task_history")
+	defer span.End()
+
+	todoID, ok := s.todoParam(c, ctx, span)
+	if !ok {
+		return
+	}
+	span.SetAttributes(attribute.Int("task.id", todoID))
+
+	tx, err := s.beginTenantTx(ctx, c)
+	if err != nil {
+		logError("begin transaction failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	if _, ok := s.authorizeHistory(c, ctx, span, tx, todoID, roleViewer); !ok {
+		return
+	}
+
+	versions, err := queryHistory(ctx, tx, todoID, 0)
+	if err != nil {
+		logError("query failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	span.SetAttributes(attribute.Int("task.version_count", len(versions)))
+	c.JSON(http.StatusOK, versions)
+}
+
+// revertTodo sets a todo back to the state of one of its versions. A deleted
+// todo is restored under its old ID, with its comments, attachments and
+// assignees while they are still kept, for UNDO_TTL after the delete.
+func (s *Server) revertTodo(c *gin.Context) {
+	ctx, span := s.tracer.Start(c.Request.Context(), "revert_task")
+	defer span.End()
+
+	todoID, ok := s.todoParam(c, ctx, span)
+	if !ok {
+		return
+	}
+	version, ok := s.paramID(c, ctx, span, "version")
+	if !ok {
+		return
+	}
+	userID := currentUserID(c)
+	span.SetAttributes(
+		attribute.Int("task.id", todoID),
+		attribute.Int("task.version", version),
+		attribute.Int("user.id", userID),
+	)
+
+	tx, err := s.beginTenantTx(ctx, c)
+	if err != nil {
+		logError("begin transaction failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	t, newVersion, ok := s.revertInTx(c, ctx, span, tx, todoID, version)
+	if !ok {
+		return
+	}
+	undoToken, err := s.issueUndo(c, ctx, tx, todoID, newVersion)
+	if err != nil {
+		logError("issuing undo token failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Header(undoHeader, undoToken)
+
+	if err := tx.Commit(); err != nil {
+		logError("commit failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	s.logger.InfoContext(ctx, "task reverted",
+		slog.Int("task_id", todoID),
+		slog.Int("reverted_to", version),
+		slog.Int("new_version", newVersion),
+	)
+	span.SetAttributes(attribute.Int("task.new_version", newVersion))
+
+	c.JSON(http.StatusOK, t)
+}
+
+// revertInTx does the work of revertTodo in tx, writing the response when
+// the request can't go on. newVersion is 0 when the todo already matched.
+func (s *Server) revertInTx(c *gin.Context, ctx context.Context, span trace.Span, tx *sql.Tx, todoID, version int) (t model.Todo, newVersion int, ok bool) {
+	userID := currentUserID(c)
+	exists, ok := s.authorizeHistory(c, ctx, span, tx, todoID, roleEditor)
+	if !ok {
+		return t, 0, false
+	}
+
+	versions, err := queryHistory(ctx, tx, todoID, version)
+	if err != nil {
+		logError("query failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return t, 0, false
+	}
+	if len(versions) == 0 {
+		logError("version not found", ctx, s.logger, span, sql.ErrNoRows,
+			slog.Int("task_id", todoID),
+			slog.Int("version", version),
+		)
+		c.JSON(http.StatusNotFound, gin.H{"error": "Version not found"})
+		return t, 0, false
+	}
+	target := versions[0].Todo
+
+	ch := todoChange{
+		todoID:      todoID,
+		workspaceID: currentWorkspaceID(c),
+		action:      model.HistoryRevert,
+		after:       &target,
+		revertedTo:  &version,
+		changedBy:   userID,
+	}
+	if exists {
+		before, ownerID, err := lockTodo(ctx, tx, todoID)
+		if err != nil {
+			logError("task lookup failed", ctx, s.logger, span, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return t, 0, false
+		}
+		ch.before, ch.ownerID = &before, ownerID
+
+		// the list isn't reverted, todos stay in the list they were created in
+		err = tx.QueryRowContext(ctx, `
+			UPDATE todos SET title = $2, description = $3, completed = $4, priority = $5, due_at = $6
+			WHERE id = $1
+			RETURNING todo_uuid(id), title, description, completed, list_id, priority, due_at, `+commentCount+`, created_at, updated_at
+		`, todoID, target.Title, target.Description, target.Completed, target.Priority, target.DueAt).Scan(
+			&t.ID, &t.Title, &t.Description, &t.Completed, &t.ListID, &t.Priority, &t.DueAt, &t.CommentCount, &t.CreatedAt, &t.UpdatedAt)
+	} else {
+		ch.action = model.HistoryRestore
+		err = tx.QueryRowContext(ctx, `
+			SELECT owner_id FROM todo_history WHERE todo_id = $1 ORDER BY version DESC LIMIT 1
+		`, todoID).Scan(&ch.ownerID)
+		if err == nil {
+			// the todo keeps its ID and creation time
+			err = tx.QueryRowContext(ctx, `
+				INSERT INTO todos (id, title, description, completed, owner_id, list_id, workspace_id, priority, due_at, created_at)
+				VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, COALESCE(
+					(SELECT changed_at FROM todo_history WHERE todo_id = $1 AND action = 'create'),
+					CURRENT_TIMESTAMP))
+				RETURNING todo_uuid(id), title, description, completed, list_id, priority, due_at, created_at, updated_at
+			`, todoID, target.Title, target.Description, target.Completed, ch.ownerID, target.ListID,
+				currentWorkspaceID(c), target.Priority, target.DueAt).Scan(
+				&t.ID, &t.Title, &t.Description, &t.Completed, &t.ListID, &t.Priority, &t.DueAt, &t.CreatedAt, &t.UpdatedAt)
+		}
+		// and gets its comments, attachments and assignees back while they
+		// are kept
+		if err == nil {
+			err = restoreTodoChildren(ctx, tx, todoID)
+		}
+		if err == nil {
+			err = tx.QueryRowContext(ctx, "SELECT "+commentCount+" FROM todos WHERE id = $1", todoID).Scan(&t.CommentCount)
+		}
+	}
+	if err != nil {
+		logError("revert failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return t, 0, false
+	}
+	todos := []model.Todo{t}
+	if err := loadAssignees(ctx, tx, todos); err != nil {
+		logError("assignee lookup failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return t, 0, false
+	}
+	t = todos[0]
+
+	newVersion, _, err = recordChange(ctx, tx, ch)
+	if err != nil {
+		logError("recording history failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return t, 0, false
+	}
+	return t, newVersion, true
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Todos are known to clients by a UUID from todo_ids, the integer IDs stay
+// internal. Queries return it with todo_uuid(id).
+
+var errInvalidTodoID = errors.New("todo id must be a UUID")
+
+// newTodoID returns the canonical form of an ID a client sent for a new
+// todo, or a new version 7 UUID when it sent none.
+func newTodoID(id string) (string, error) {
+	if id == "" {
+		u, err := uuid.NewV7()
+		return u.String(), err
+	}
+	u, err := uuid.Parse(id)
+	if err != nil || u == uuid.Nil {
+		return "", errInvalidTodoID
+	}
+	return u.String(), nil
+}
+
+// insertTodoID gives a new todo its public ID. It reports false when the ID
+// is taken, by any todo of any workspace, deleted ones included.
+func insertTodoID(ctx context.Context, tx *sql.Tx, id string, todoID, workspaceID int) (bool, error) {
+	res, err := tx.ExecContext(ctx, `
+		INSERT INTO todo_ids (uuid, todo_id, workspace_id) VALUES ($1, $2, $3)
+		ON CONFLICT (uuid) DO NOTHING
+	`, id, todoID, workspaceID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// lookupTodoID returns the internal ID of the todo with a public ID, 0 when
+// there is none. Deleted todos are found too, for their history. It doesn't
+// check the workspace, access is checked on the internal ID.
+func (s *Server) lookupTodoID(ctx context.Context, id string) (int, error) {
+	u, err := uuid.Parse(id)
+	if err != nil {
+		return 0, errInvalidTodoID
+	}
+	var todoID int
+	err = s.db.QueryRowContext(ctx, "SELECT todo_id FROM todo_ids WHERE uuid = $1", u.String()).Scan(&todoID)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return todoID, err
+}
+
+// resolveTodo looks up the todo ID of a todo UUID from a request.
+func (s *Server) resolveTodo(ctx context.Context, span trace.Span, idStr string) (int, error) {
+	span.SetAttributes(attribute.String("task.uuid", idStr))
+
+	todoID, err := s.lookupTodoID(ctx, idStr)
+	if err == errInvalidTodoID {
+		logError("invalid id", ctx, s.logger, span, err,
+			slog.String("task_id", idStr),
+		)
+		return 0, &apiError{http.StatusBadRequest, "Invaild ID"}
+	}
+	if err != nil {
+		logError("task lookup failed", ctx, s.logger, span, err)
+		return 0, err
+	}
+	if todoID == 0 {
+		logError("task not found", ctx, s.logger, span, sql.ErrNoRows,
+			slog.String("task_id", idStr),
+		)
+		return 0, &apiError{http.StatusNotFound, "Task not found"}
+	}
+	return todoID, nil
+}
+
+// todoParam resolves the todo ID of the :id path parameter, writing the
+// error response when it can't.
+func (s *Server) todoParam(c *gin.Context, ctx context.Context, span trace.Span) (int, bool) {
+	todoID, err := s.resolveTodo(ctx, span, c.Param("id"))
+	if err != nil {
+		writeError(c, err)
+		return 0, false
+	}
+	return todoID, true
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const jwtIssuer = "minimaldo"
+
+// signingKey is one entry of JWT_KEYS. Every key can verify tokens, only the
+// key named by JWT_SIGNING_KID signs new ones, so keys can be rotated by
+// adding the new key, switching JWT_SIGNING_KID, and dropping the old key once
+// its tokens have expired.
+type signingKey struct {
+	kid       string
+	method    jwt.SigningMethod
+	signKey   any
+	verifyKey any
+}
+
+type keySet struct {
+	signing *signingKey
+	byKID   map[string]*signingKey
+}
+
+// accessClaims are the claims of an access token. SessionID is the refresh
+// token family the access token was issued from.
+type accessClaims struct {
+	SessionID string `json:"sid"`
+	jwt.RegisteredClaims
+}
+
+// loadKeySet parses JWT_KEYS, a comma separated list of kid:alg:key where alg
+// is HS256 (key is a base64 secret) or EdDSA (key is a base64 ed25519 seed).
+func loadKeySet(cfg *Config) (*keySet, error) {
+	if cfg.JWTKeys == "" {
+		// Fine for a laptop, but tokens die with the process and can't be
+		// shared between replicas.
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+		slog.Warn("JWT_KEYS not set, using an ephemeral HS256 key")
+		key := &signingKey{kid: "ephemeral", method: jwt.SigningMethodHS256, signKey: secret, verifyKey: secret}
+		return &keySet{signing: key, byKID: map[string]*signingKey{key.kid: key}}, nil
+	}
+
+	ks := &keySet{byKID: map[string]*signingKey{}}
+	for _, entry := range strings.Split(cfg.JWTKeys, ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), ":", 3)
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("invalid JWT_KEYS entry %q, want kid:alg:base64key", entry)
+		}
+		kid, alg, encoded := parts[0], parts[1], parts[2]
+
+		raw, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: invalid base64: %w", kid, err)
+		}
+
+		key := &signingKey{kid: kid}
+		switch alg {
+		case "HS256":
+			if len(raw) < 32 {
+				return nil, fmt.Errorf("key %q: HS256 secret must be at least 32 bytes", kid)
+			}
+			key.method, key.signKey, key.verifyKey = jwt.SigningMethodHS256, raw, raw
+		case "EdDSA":
+			if len(raw) != ed25519.SeedSize {
+				return nil, fmt.Errorf("key %q: EdDSA key must be a %d byte ed25519 seed", kid, ed25519.SeedSize)
+			}
+			private := ed25519.NewKeyFromSeed(raw)
+			key.method, key.signKey, key.verifyKey = jwt.SigningMethodEdDSA, private, private.Public()
+		default:
+			return nil, fmt.Errorf("key %q: unsupported algorithm %q, want HS256 or EdDSA", kid, alg)
+		}
+
+		if _, dup := ks.byKID[kid]; dup {
+			return nil, fmt.Errorf("duplicate JWT key id %q", kid)
+		}
+		ks.byKID[kid] = key
+	}
+
+	signingKID := cfg.JWTSigningKID
+	if signingKID == "" {
+		signingKID = strings.SplitN(strings.TrimSpace(cfg.JWTKeys), ":", 2)[0]
+	}
+	ks.signing = ks.byKID[signingKID]
+	if ks.signing == nil {
+		return nil, fmt.Errorf("JWT_SIGNING_KID %q is not in JWT_KEYS", signingKID)
+	}
+	return ks, nil
+}
+
+// sign issues an access token for userID with the current signing key.
+func (ks *keySet) sign(userID int, sessionID string, ttl time.Duration) (string, time.Time, error) {
+	jti, err := newToken()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	now := time.Now()
+	expiresAt := now.Add(ttl)
+
+	token := jwt.NewWithClaims(ks.signing.method, accessClaims{
+		SessionID: sessionID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    jwtIssuer,
+			Subject:   strconv.Itoa(userID),
+			ID:        jti,
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	})
+	token.Header["kid"] = ks.signing.kid
+
+	signed, err := token.SignedString(ks.signing.signKey)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return signed, expiresAt, nil
+}
+
+// verify checks the signature and registered claims of an access token. The
+// algorithm must match the one configured for the token's kid, so a token
+// can't pick its own algorithm.
+func (ks *keySet) verify(tokenString string) (*accessClaims, error) {
+	claims := &accessClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims,
+		func(t *jwt.Token) (any, error) {
+			kid, _ := t.Header["kid"].(string)
+			key := ks.byKID[kid]
+			if key == nil {
+				return nil, fmt.Errorf("unknown key id %q", kid)
+			}
+			if t.Method.Alg() != key.method.Alg() {
+				return nil, fmt.Errorf("unexpected signing method %q for key %q", t.Method.Alg(), kid)
+			}
+			return key.verifyKey, nil
+		},
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg(), jwt.SigningMethodEdDSA.Alg()}),
+		jwt.WithIssuer(jwtIssuer),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(30*time.Second),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if claims.ID == "" || claims.SessionID == "" {
+		return nil, errors.New("token is missing jti or sid")
+	}
+	return claims, nil
+}
@@ -0,0 +1,824 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"github.com/thakurnishu/MinimalDo/model"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var errLastOwner = errors.New("a list needs at least one owner")
+
+func (s *Server) getLists(c *gin.Context) {
+	ctx, span := s.tracer.Start(c.Request.Context(), "get_lists")
+	defer span.End()
+
+	userID := currentUserID(c)
+	span.SetAttributes(attribute.Int("user.id", userID))
+
+	tx, err := s.beginTenantTx(ctx, c)
+	if err != nil {
+		logError("begin transaction failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT l.id, l.name, m.role,
+			(SELECT COUNT(*) FROM list_members WHERE list_id = l.id),
+			l.created_at, l.updated_at
+		FROM lists l
+		JOIN list_members m ON m.list_id = l.id AND m.user_id = $1
+		ORDER BY l.name
+	`, userID)
+	if err != nil {
+		logError("query failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	lists := []model.List{}
+	for rows.Next() {
+		var l model.List
+		if err := rows.Scan(&l.ID, &l.Name, &l.Role, &l.MemberCount, &l.CreatedAt, &l.UpdatedAt); err != nil {
+			logError("rows scan failed", ctx, s.logger, span, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		lists = append(lists, l)
+	}
+	if err := rows.Err(); err != nil {
+		logError("row iteration failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	span.SetAttributes(attribute.Int("list.count", len(lists)))
+	c.JSON(http.StatusOK, lists)
+}
+
+func (s *Server) createList(c *gin.Context) {
+	ctx, span := s.tracer.Start(c.Request.Context(), "create_list")
+	defer span.End()
+
+	var req model.ListRequest
+	if err := c.BindJSON(&req); err != nil {
+		logError("failed to parse json", ctx, s.logger, span, err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	name, err := validateListName(req.Name)
+	if err != nil {
+		logError("invalid list name", ctx, s.logger, span, err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userID := currentUserID(c)
+	span.SetAttributes(attribute.Int("user.id", userID))
+
+	tx, err := s.beginTenantTx(ctx, c)
+	if err != nil {
+		logError("begin transaction failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	l := model.List{Name: name, Role: model.RoleOwner, MemberCount: 1}
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO lists (name, created_by, workspace_id) VALUES ($1, $2, $3)
+		RETURNING id, created_at, updated_at
+	`, name, userID, currentWorkspaceID(c)).Scan(&l.ID, &l.CreatedAt, &l.UpdatedAt)
+	if err != nil {
+		logError("row scan failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO list_members (list_id, user_id, role) VALUES ($1, $2, 'owner')
+	`, l.ID, userID)
+	if err != nil {
+		logError("query execution failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		logError("commit failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	s.logger.InfoContext(ctx, "created list",
+		slog.Int("list_id", l.ID),
+		slog.Int("user_id", userID),
+	)
+	span.SetAttributes(attribute.Int("list.id", l.ID))
+
+	c.JSON(http.StatusCreated, l)
+}
+
+func (s *Server) updateList(c *gin.Context) {
+	ctx, span := s.tracer.Start(c.Request.Context(), "update_list")
+	defer span.End()
+
+	listID, ok := s.paramID(c, ctx, span, "id")
+	if !ok {
+		return
+	}
+
+	var req model.ListRequest
+	if err := c.BindJSON(&req); err != nil {
+		logError("failed to parse json", ctx, s.logger, span, err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	name, err := validateListName(req.Name)
+	if err != nil {
+		logError("invalid list name", ctx, s.logger, span, err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tx, err := s.beginTenantTx(ctx, c)
+	if err != nil {
+		logError("begin transaction failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	if !s.authorizeList(c, ctx, span, tx, listID, roleOwner) {
+		return
+	}
+
+	l := model.List{Role: model.RoleOwner}
+	err = tx.QueryRowContext(ctx, `
+		UPDATE lists SET name = $2 WHERE id = $1
+		RETURNING id, name, (SELECT COUNT(*) FROM list_members WHERE list_id = $1), created_at, updated_at
+	`, listID, name).Scan(&l.ID, &l.Name, &l.MemberCount, &l.CreatedAt, &l.UpdatedAt)
+	if err != nil {
+		logError("row scan failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		logError("commit failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	s.logger.InfoContext(ctx, "list renamed",
+		slog.Int("list_id", listID),
+	)
+	c.JSON(http.StatusOK, l)
+}
+
+// deleteList deletes the list together with its todos.
+func (s *Server) deleteList(c *gin.Context) {
+	ctx, span := s.tracer.Start(c.Request.Context(), "delete_list")
+	defer span.End()
+
+	listID, ok := s.paramID(c, ctx, span, "id")
+	if !ok {
+		return
+	}
+	tx, err := s.beginTenantTx(ctx, c)
+	if err != nil {
+		logError("begin transaction failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	if !s.authorizeList(c, ctx, span, tx, listID, roleOwner) {
+		return
+	}
+
+	blobKeys, err := attachmentKeys(ctx, tx, "todo_id IN (SELECT id FROM todos WHERE list_id = $1)", listID)
+	if err != nil {
+		logError("query execution failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := recordListDeletion(ctx, tx, listID, currentWorkspaceID(c), currentUserID(c)); err != nil {
+		logError("recording history failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM lists WHERE id = $1", listID); err != nil {
+		logError("query execution failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		logError("commit failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	s.deleteBlobs(ctx, blobKeys)
+
+	s.logger.InfoContext(ctx, "list deleted",
+		slog.Int("list_id", listID),
+		slog.Int("user_id", currentUserID(c)),
+	)
+	c.Status(http.StatusNoContent)
+}
+
+func (s *Server) getListMembers(c *gin.Context) {
+	ctx, span := s.tracer.Start(c.Request.Context(), "get_list_members")
+	defer span.End()
+
+	listID, ok := s.paramID(c, ctx, span, "id")
+	if !ok {
+		return
+	}
+	tx, err := s.beginTenantTx(ctx, c)
+	if err != nil {
+		logError("begin transaction failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	if !s.authorizeList(c, ctx, span, tx, listID, roleViewer) {
+		return
+	}
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT u.id, u.username, COALESCE(u.email, ''), u.created_at, m.role, m.added_at
+		FROM list_members m
+		JOIN users u ON u.id = m.user_id
+		WHERE m.list_id = $1
+		ORDER BY m.added_at
+	`, listID)
+	if err != nil {
+		logError("query failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	members := []model.ListMember{}
+	for rows.Next() {
+		var m model.ListMember
+		if err := rows.Scan(&m.User.ID, &m.User.Username, &m.User.Email, &m.User.CreatedAt, &m.Role, &m.AddedAt); err != nil {
+			logError("rows scan failed", ctx, s.logger, span, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		members = append(members, m)
+	}
+	if err := rows.Err(); err != nil {
+		logError("row iteration failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, members)
+}
+
+func (s *Server) updateListMember(c *gin.Context) {
+	ctx, span := s.tracer.Start(c.Request.Context(), "update_list_member")
+	defer span.End()
+
+	listID, ok := s.paramID(c, ctx, span, "id")
+	if !ok {
+		return
+	}
+	memberID, ok := s.paramID(c, ctx, span, "user_id")
+	if !ok {
+		return
+	}
+
+	var req model.MemberRoleRequest
+	if err := c.BindJSON(&req); err != nil {
+		logError("failed to parse json", ctx, s.logger, span, err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	newRole, valid := parseRole(req.Role)
+	if !valid {
+		logError("invalid role", ctx, s.logger, span, errors.New("invalid role"),
+			slog.String("role", req.Role),
+		)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Role must be viewer, editor or owner"})
+		return
+	}
+
+	tx, err := s.beginTenantTx(ctx, c)
+	if err != nil {
+		logError("begin transaction failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	if !s.authorizeList(c, ctx, span, tx, listID, roleOwner) {
+		return
+	}
+	span.SetAttributes(attribute.Int("member.id", memberID))
+
+	err = changeMembership(ctx, tx, listID, func() (sql.Result, error) {
+		return tx.ExecContext(ctx, `
+			UPDATE list_members SET role = $3 WHERE list_id = $1 AND user_id = $2
+		`, listID, memberID, newRole.String())
+	})
+	if !s.membershipResponse(c, ctx, span, err) {
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		logError("commit failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	s.logger.InfoContext(ctx, "list member role changed",
+		slog.Int("list_id", listID),
+		slog.Int("member_id", memberID),
+		slog.String("role", newRole.String()),
+	)
+	c.Status(http.StatusNoContent)
+}
+
+// removeListMember removes a member. Owners can remove anyone, every member
+// can remove themselves to leave the list.
+func (s *Server) removeListMember(c *gin.Context) {
+	ctx, span := s.tracer.Start(c.Request.Context(), "remove_list_member")
+	defer span.End()
+
+	listID, ok := s.paramID(c, ctx, span, "id")
+	if !ok {
+		return
+	}
+	memberID, ok := s.paramID(c, ctx, span, "user_id")
+	if !ok {
+		return
+	}
+
+	need := roleOwner
+	if memberID == currentUserID(c) {
+		need = roleViewer
+	}
+	tx, err := s.beginTenantTx(ctx, c)
+	if err != nil {
+		logError("begin transaction failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	if !s.authorizeList(c, ctx, span, tx, listID, need) {
+		return
+	}
+	span.SetAttributes(attribute.Int("member.id", memberID))
+
+	err = changeMembership(ctx, tx, listID, func() (sql.Result, error) {
+		return tx.ExecContext(ctx, `
+			DELETE FROM list_members WHERE list_id = $1 AND user_id = $2
+		`, listID, memberID)
+	})
+	if !s.membershipResponse(c, ctx, span, err) {
+		return
+	}
+
+	// former members can't see the list's todos, so they can't work on them
+	_, err = tx.ExecContext(ctx, `
+		WITH removed AS (
+			DELETE FROM todo_assignees
+			WHERE user_id = $2 AND todo_id IN (SELECT id FROM todos WHERE list_id = $1)
+			RETURNING todo_id, user_id
+		)
+		INSERT INTO todo_assignment_log (todo_id, user_id, action, changed_by)
+		SELECT todo_id, user_id, 'unassigned', $3 FROM removed
+	`, listID, memberID, currentUserID(c))
+	if err != nil {
+		logError("unassigning removed member failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		logError("commit failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	s.logger.InfoContext(ctx, "list member removed",
+		slog.Int("list_id", listID),
+		slog.Int("member_id", memberID),
+	)
+	c.Status(http.StatusNoContent)
+}
+
+// changeMembership runs change with the list locked and fails if it would
+// leave the list without an owner. The caller commits tx.
+func changeMembership(ctx context.Context, tx *sql.Tx, listID int, change func() (sql.Result, error)) error {
+	if _, err := tx.ExecContext(ctx, "SELECT id FROM lists WHERE id = $1 FOR UPDATE", listID); err != nil {
+		return err
+	}
+	result, err := change()
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	var owners int
+	err = tx.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM list_members WHERE list_id = $1 AND role = 'owner'
+	`, listID).Scan(&owners)
+	if err != nil {
+		return err
+	}
+	if owners == 0 {
+		return errLastOwner
+	}
+	return nil
+}
+
+func (s *Server) membershipResponse(c *gin.Context, ctx context.Context, span trace.Span, err error) bool {
+	switch {
+	case err == nil:
+		return true
+	case err == sql.ErrNoRows:
+		s.logger.WarnContext(ctx, "list member not found")
+		span.SetStatus(codes.Error, "list member not found")
+		c.JSON(http.StatusNotFound, gin.H{"error": "Member not found"})
+	case errors.Is(err, errLastOwner):
+		logError("last owner of list", ctx, s.logger, span, err)
+		c.JSON(http.StatusConflict, gin.H{"error": "A list needs at least one owner, promote someone else or delete the list"})
+	default:
+		logError("membership change failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+	return false
+}
+
+func (s *Server) inviteToList(c *gin.Context) {
+	ctx, span := s.tracer.Start(c.Request.Context(), "invite_to_list")
+	defer span.End()
+
+	listID, ok := s.paramID(c, ctx, span, "id")
+	if !ok {
+		return
+	}
+
+	var req model.InviteRequest
+	if err := c.BindJSON(&req); err != nil {
+		logError("failed to parse json", ctx, s.logger, span, err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.Username = strings.TrimSpace(req.Username)
+	req.Email = strings.TrimSpace(req.Email)
+	r, valid := parseRole(req.Role)
+	if !valid || (req.Username == "") == (req.Email == "") {
+		logError("invalid invitation", ctx, s.logger, span, errors.New("invalid invitation"))
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Give either username or email, and a role of viewer, editor or owner"})
+		return
+	}
+
+	tx, err := s.beginTenantTx(ctx, c)
+	if err != nil {
+		logError("begin transaction failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	if !s.authorizeList(c, ctx, span, tx, listID, roleOwner) {
+		return
+	}
+	userID := currentUserID(c)
+
+	// only members of the workspace can be invited to its lists
+	var inv model.Invitation
+	err = tx.QueryRowContext(ctx, `
+		WITH invitee AS (
+			SELECT u.id FROM users u
+			JOIN workspace_members wm ON wm.user_id = u.id AND wm.workspace_id = app_workspace_id()
+			WHERE ($1 <> '' AND u.username = $1) OR ($2 <> '' AND u.email = $2)
+			LIMIT 1
+		)
+		INSERT INTO list_invitations (list_id, invitee_id, invited_by, role)
+		SELECT $3, invitee.id, $4, $5 FROM invitee
+		WHERE NOT EXISTS (
+			SELECT 1 FROM list_members WHERE list_id = $3 AND user_id = invitee.id
+		)
+		RETURNING id
+	`, req.Username, req.Email, listID, userID, r.String()).Scan(&inv.ID)
+	if err == sql.ErrNoRows {
+		// The user doesn't exist, is not in the workspace or is already a
+		// member.
+		logError("invitation not created", ctx, s.logger, span, err,
+			slog.Int("list_id", listID),
+		)
+		c.JSON(http.StatusNotFound, gin.H{"error": "No such user in this workspace, or they are already a member"})
+		return
+	}
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			logError("invitation already pending", ctx, s.logger, span, err,
+				slog.Int("list_id", listID),
+			)
+			c.JSON(http.StatusConflict, gin.H{"error": "User already has a pending invitation"})
+			return
+		}
+		logError("row scan failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	inv, err = getInvitation(ctx, tx, inv.ID)
+	if err != nil {
+		logError("row scan failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		logError("commit failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	s.logger.InfoContext(ctx, "user invited to list",
+		slog.Int("list_id", listID),
+		slog.Int("invitee_id", inv.Invitee.ID),
+		slog.String("role", inv.Role),
+	)
+	span.SetAttributes(
+		attribute.Int("invitation.id", inv.ID),
+		attribute.Int("invitee.id", inv.Invitee.ID),
+	)
+
+	c.JSON(http.StatusCreated, inv)
+}
+
+func (s *Server) getListInvitations(c *gin.Context) {
+	ctx, span := s.tracer.Start(c.Request.Context(), "get_list_invitations")
+	defer span.End()
+
+	listID, ok := s.paramID(c, ctx, span, "id")
+	if !ok {
+		return
+	}
+	tx, err := s.beginTenantTx(ctx, c)
+	if err != nil {
+		logError("begin transaction failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	if !s.authorizeList(c, ctx, span, tx, listID, roleOwner) {
+		return
+	}
+
+	invitations, err := queryInvitations(ctx, tx, "i.list_id = $1 AND i.status = 'pending'", listID)
+	if err != nil {
+		logError("query failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, invitations)
+}
+
+func (s *Server) cancelInvitation(c *gin.Context) {
+	ctx, span := s.tracer.Start(c.Request.Context(), "cancel_invitation")
+	defer span.End()
+
+	listID, ok := s.paramID(c, ctx, span, "id")
+	if !ok {
+		return
+	}
+	invitationID, ok := s.paramID(c, ctx, span, "invitation_id")
+	if !ok {
+		return
+	}
+	tx, err := s.beginTenantTx(ctx, c)
+	if err != nil {
+		logError("begin transaction failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	if !s.authorizeList(c, ctx, span, tx, listID, roleOwner) {
+		return
+	}
+
+	result, err := tx.ExecContext(ctx, `
+		DELETE FROM list_invitations WHERE id = $1 AND list_id = $2 AND status = 'pending'
+	`, invitationID, listID)
+	if err != nil {
+		logError("query execution failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		s.logger.WarnContext(ctx, "invitation not found",
+			slog.Int("invitation_id", invitationID),
+		)
+		span.SetStatus(codes.Error, "invitation not found")
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invitation not found"})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		logError("commit failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// getMyInvitations lists the pending invitations of the current user.
+func (s *Server) getMyInvitations(c *gin.Context) {
+	ctx, span := s.tracer.Start(c.Request.Context(), "get_my_invitations")
+	defer span.End()
+
+	userID := currentUserID(c)
+	span.SetAttributes(attribute.Int("user.id", userID))
+
+	tx, err := s.beginTenantTx(ctx, c)
+	if err != nil {
+		logError("begin transaction failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	invitations, err := queryInvitations(ctx, tx, "i.invitee_id = $1 AND i.status = 'pending'", userID)
+	if err != nil {
+		logError("query failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, invitations)
+}
+
+func (s *Server) acceptInvitation(c *gin.Context) {
+	s.respondToInvitation(c, model.InvitationAccepted)
+}
+
+func (s *Server) declineInvitation(c *gin.Context) {
+	s.respondToInvitation(c, model.InvitationDeclined)
+}
+
+func (s *Server) respondToInvitation(c *gin.Context, status string) {
+	ctx, span := s.tracer.Start(c.Request.Context(), "respond_to_invitation")
+	defer span.End()
+
+	invitationID, ok := s.paramID(c, ctx, span, "id")
+	if !ok {
+		return
+	}
+	userID := currentUserID(c)
+	span.SetAttributes(
+		attribute.Int("user.id", userID),
+		attribute.Int("invitation.id", invitationID),
+		attribute.String("invitation.status", status),
+	)
+
+	tx, err := s.beginTenantTx(ctx, c)
+	if err != nil {
+		logError("begin transaction failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	var listID int
+	var invitedRole string
+	err = tx.QueryRowContext(ctx, `
+		UPDATE list_invitations SET status = $3, responded_at = NOW()
+		WHERE id = $1 AND invitee_id = $2 AND status = 'pending'
+		RETURNING list_id, role
+	`, invitationID, userID, status).Scan(&listID, &invitedRole)
+	if err == sql.ErrNoRows {
+		logError("invitation not found", ctx, s.logger, span, err,
+			slog.Int("invitation_id", invitationID),
+		)
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invitation not found"})
+		return
+	}
+	if err != nil {
+		logError("row scan failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if status == model.InvitationAccepted {
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO list_members (list_id, user_id, role) VALUES ($1, $2, $3)
+			ON CONFLICT (list_id, user_id) DO NOTHING
+		`, listID, userID, invitedRole)
+		if err != nil {
+			logError("query execution failed", ctx, s.logger, span, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		logError("commit failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	s.logger.InfoContext(ctx, "invitation "+status,
+		slog.Int("invitation_id", invitationID),
+		slog.Int("list_id", listID),
+		slog.Int("user_id", userID),
+	)
+	span.SetAttributes(attribute.Int("list.id", listID))
+	c.Status(http.StatusNoContent)
+}
+
+func getInvitation(ctx context.Context, db dbtx, id int) (model.Invitation, error) {
+	invitations, err := queryInvitations(ctx, db, "i.id = $1", id)
+	if err != nil {
+		return model.Invitation{}, err
+	}
+	if len(invitations) == 0 {
+		return model.Invitation{}, sql.ErrNoRows
+	}
+	return invitations[0], nil
+}
+
+func queryInvitations(ctx context.Context, db dbtx, where string, arg any) ([]model.Invitation, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT i.id, i.list_id, l.name, i.role, i.status, i.created_at,
+			invitee.id, invitee.username, invitee.created_at,
+			COALESCE(inviter.id, 0), COALESCE(inviter.username, ''), COALESCE(inviter.created_at, i.created_at)
+		FROM list_invitations i
+		JOIN lists l ON l.id = i.list_id
+		JOIN users invitee ON invitee.id = i.invitee_id
+		LEFT JOIN users inviter ON inviter.id = i.invited_by
+		WHERE `+where+`
+		ORDER BY i.created_at DESC
+	`, arg)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invitations := []model.Invitation{}
+	for rows.Next() {
+		var inv model.Invitation
+		err := rows.Scan(&inv.ID, &inv.ListID, &inv.ListName, &inv.Role, &inv.Status, &inv.CreatedAt,
+			&inv.Invitee.ID, &inv.Invitee.Username, &inv.Invitee.CreatedAt,
+			&inv.InvitedBy.ID, &inv.InvitedBy.Username, &inv.InvitedBy.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		invitations = append(invitations, inv)
+	}
+	return invitations, rows.Err()
+}
+
+// paramID parses a numeric path parameter, answering 400 if it isn't one.
+func (s *Server) paramID(c *gin.Context, ctx context.Context, span trace.Span, name string) (int, bool) {
+	idStr := c.Param(name)
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		logError("invalid id", ctx, s.logger, span, err,
+			slog.String(name, idStr),
+		)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invaild ID"})
+		return 0, false
+	}
+	return id, true
+}
+
+func validateListName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > 100 {
+		return "", errors.New("list name must be 1-100 characters")
+	}
+	return name, nil
+}
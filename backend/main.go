@@ -2,6 +2,7 @@ package main
 
 import (
 	"log/slog"
+	"os"
 
 	_ "github.com/lib/pq"
 
@@ -21,22 +22,68 @@ func main() {
 
 	defer cleanup()
 
+	keys, err := loadKeySet(cfg)
+	if err != nil {
+		slog.Error("Failed to load JWT keys", "error", err)
+		os.Exit(1)
+	}
+
+	blobs, err := setupBlobStore(cfg)
+	if err != nil {
+		slog.Error("Failed to set up attachment storage", "error", err)
+		os.Exit(1)
+	}
+
 	db := setupDB(cfg)
 	defer db.Close()
+
+	events, err := listenEvents(cfg, logger)
+	if err != nil {
+		slog.Error("Failed to listen for todo events", "error", err)
+		os.Exit(1)
+	}
 	server := &Server{
+		cfg: cfg,
 		db: db,
+		keys: keys,
+		oidc: newOIDCProvider(cfg),
+		blobs: blobs,
+		events: events,
 		logger: logger,
 		tracer: tracer,
 	}
 
+	if err := server.adoptTodosOnStartup(); err != nil {
+		slog.Error("Failed to adopt unowned todos", "error", err)
+		os.Exit(1)
+	}
+
+	sinks, err := server.eventSinks()
+	if err != nil {
+		slog.Error("Failed to set up event sinks", "error", err)
+		os.Exit(1)
+	}
+	plugins, err := server.loadPlugins()
+	if err != nil {
+		slog.Error("Failed to load plugins", "error", err)
+		os.Exit(1)
+	}
+	server.plugins = plugins
+
+	go server.runOutbox(sinks)
+	go server.runWebhooks()
+	go server.runDueSoon()
+	go server.runRules()
+	go server.runPurgeDeletedTodos()
+
 	router := gin.Default()
 
 	// CORS setup
 	router.Use(cors.New(cors.Config{
 		AllowOrigins: []string{cfg.FrontendURL},
-		AllowHeaders: []string{"X-Requested-With", "Content-Type", "Authorization"},
-		AllowMethods: []string{"GET", "HEAD", "POST", "PUT", "DELETE", "OPTIONS"},
-		ExposeHeaders: []string{"Content-Length"},
+		AllowHeaders: []string{"X-Requested-With", "Content-Type", "Authorization", workspaceHeader, "Last-Event-ID"},
+		AllowMethods: []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		ExposeHeaders: []string{"Content-Length", "Content-Disposition", undoHeader},
 	}))
 	router.Use(TracingMiddleware(cfg.ServiceName))
 	router.Use(LoggingMiddleware(logger))
@@ -44,14 +91,120 @@ func main() {
 	// Setup routes
 	api := router.Group("/api")
 	{
-		api.GET("/todos", server.getTodos)
-		api.POST("/todos", server.createTodo)
-		api.PUT("/todos/:id", server.updateTodo)
-		api.DELETE("/todos/:id", server.deleteTodo)
 		api.GET("/health", server.healthCheck)
-		api.GET("/todos/by-date", server.getTodosByDate)
+		api.POST("/auth/register", server.registerUser)
+		api.POST("/auth/login", server.loginUser)
+		api.POST("/auth/refresh", server.refreshSession)
+		api.POST("/auth/revoke", server.revokeToken)
+		api.GET("/auth/providers", server.authProviders)
+		api.GET("/auth/oidc/login", server.oidcLogin)
+		api.GET("/auth/oidc/callback", server.oidcCallback)
+		api.POST("/auth/oidc/exchange", server.exchangeLoginCode)
+	}
+
+	read := server.readScope()
+	session := server.requireSession()
+
+	authed := api.Group("", server.AuthMiddleware())
+	{
+		authed.GET("/auth/me", server.currentUser)
+		authed.POST("/auth/logout", server.requireSession(), server.logoutUser)
+
+		authed.GET("/workspaces", read, server.getWorkspaces)
+		authed.POST("/workspaces", session, server.createWorkspace)
+		authed.GET("/workspaces/:id/members", read, server.getWorkspaceMembers)
+		authed.POST("/workspaces/:id/members", session, server.addWorkspaceMember)
+		authed.DELETE("/workspaces/:id/members/:user_id", session, server.removeWorkspaceMember)
+
+		authed.GET("/my/tasks", read, server.getMyTasks)
+	}
+
+	// Workspace scoped routes, the workspace comes from the X-Workspace-ID
+	// header or the /api/w/:workspace prefix and defaults to the user's
+	// personal workspace.
+	server.workspaceRoutes(authed.Group("", server.WorkspaceMiddleware()))
+	server.workspaceRoutes(authed.Group("/w/:workspace", server.WorkspaceMiddleware()))
+
+	tokens := authed.Group("/tokens", server.requireSession())
+	{
+		tokens.GET("", server.listAPITokens)
+		tokens.POST("", server.createAPIToken)
+		tokens.DELETE("/:id", server.revokeAPIToken)
 	}
 
 	slog.Info("server is listening", "port", cfg.Port)
 	router.Run(":"+cfg.Port)
 }
+
+func (s *Server) workspaceRoutes(g *gin.RouterGroup) {
+	read, write := s.readScope(), s.writeScope()
+	// webhooks and rules send todos out of the workspace, tokens can't set
+	// them up
+	session := s.requireSession()
+
+	g.GET("/todos", read, s.getTodos)
+	g.POST("/todos", write, s.createTodo)
+	g.PUT("/todos/:id", write, s.updateTodo)
+	g.DELETE("/todos/:id", write, s.deleteTodo)
+	g.GET("/todos/by-date", read, s.getTodosByDate)
+	g.PUT("/todos/:id/assignees", write, s.setAssignees)
+	g.GET("/todos/:id/assignments", read, s.getAssignments)
+	g.GET("/todos/:id/comments", read, s.getComments)
+	g.POST("/todos/:id/comments", write, s.createComment)
+	g.PUT("/todos/:id/comments/:comment_id", write, s.updateComment)
+	g.DELETE("/todos/:id/comments/:comment_id", write, s.deleteComment)
+	g.GET("/todos/:id/comments/:comment_id/revisions", read, s.getCommentRevisions)
+	g.GET("/todos/:id/history", read, s.getTodoHistory)
+	g.POST("/todos/:id/history/:version/revert", write, s.revertTodo)
+	g.GET("/todos/:id/attachments", read, s.getAttachments)
+	g.POST("/todos/:id/attachments", write, s.uploadAttachment)
+	g.GET("/todos/:id/attachments/:attachment_id", read, s.downloadAttachment)
+	g.DELETE("/todos/:id/attachments/:attachment_id", write, s.deleteAttachment)
+
+	g.GET("/lists", read, s.getLists)
+	g.POST("/lists", write, s.createList)
+	g.PUT("/lists/:id", write, s.updateList)
+	g.DELETE("/lists/:id", write, s.deleteList)
+	g.GET("/lists/:id/members", read, s.getListMembers)
+	g.PUT("/lists/:id/members/:user_id", write, s.updateListMember)
+	g.DELETE("/lists/:id/members/:user_id", write, s.removeListMember)
+	g.GET("/lists/:id/invitations", read, s.getListInvitations)
+	g.POST("/lists/:id/invitations", write, s.inviteToList)
+	g.DELETE("/lists/:id/invitations/:invitation_id", write, s.cancelInvitation)
+	g.GET("/invitations", read, s.getMyInvitations)
+	g.POST("/invitations/:id/accept", write, s.acceptInvitation)
+	g.POST("/invitations/:id/decline", write, s.declineInvitation)
+
+	g.GET("/activity", read, s.getActivity)
+	g.POST("/activity/read", read, s.markActivityRead)
+
+	g.POST("/undo/:token", write, s.undo)
+
+	g.GET("/events", read, s.streamEvents)
+	g.GET("/ws", read, s.serveWS)
+
+	g.GET("/sync", read, s.getSync)
+	g.POST("/sync", write, s.postSync)
+
+	g.GET("/webhooks", read, s.getWebhooks)
+	g.POST("/webhooks", session, s.createWebhook)
+	g.GET("/webhooks/:id", read, s.getWebhook)
+	g.PUT("/webhooks/:id", session, s.updateWebhook)
+	g.DELETE("/webhooks/:id", session, s.deleteWebhook)
+	g.POST("/webhooks/:id/test", session, s.testWebhook)
+	g.GET("/webhooks/:id/deliveries", read, s.getWebhookDeliveries)
+
+	g.GET("/rules", read, s.getRules)
+	g.POST("/rules", session, s.createRule)
+	g.GET("/rules/:id", read, s.getRule)
+	g.PUT("/rules/:id", session, s.updateRule)
+	g.DELETE("/rules/:id", session, s.deleteRule)
+	g.GET("/rules/:id/runs", read, s.getRuleRuns)
+
+	g.GET("/plugins", read, s.getPlugins)
+	g.GET("/plugins/:name/*path", read, s.servePlugin)
+	g.POST("/plugins/:name/*path", write, s.servePlugin)
+	g.PUT("/plugins/:name/*path", write, s.servePlugin)
+	g.PATCH("/plugins/:name/*path", write, s.servePlugin)
+	g.DELETE("/plugins/:name/*path", write, s.servePlugin)
+}
@@ -0,0 +1,41 @@
+package model
+
+import "time"
+
+// Activity event types.
+const (
+	ActivityCreated   = "created"
+	ActivityUpdated   = "updated"
+	ActivityCompleted = "completed"
+	ActivityDeleted   = "deleted"
+	ActivityRestored  = "restored"
+)
+
+// ActivityEvent is a change to a todo as shown in the activity feed. Actor is
+// nil once that account is deleted. Unread is false for the caller's own
+// changes.
+type ActivityEvent struct {
+	ID      int64                  `json:"id"`
+	Type    string                 `json:"type"`
+	TodoID  string                 `json:"todo_id"`
+	ListID  *int                   `json:"list_id,omitempty"`
+	Title   string                 `json:"title"`
+	Changes map[string]FieldChange `json:"changes"`
+	Actor   *User                  `json:"actor"`
+	At      time.Time              `json:"at"`
+	Unread  bool                   `json:"unread"`
+}
+
+// ActivityPage is one page of the activity feed. NextCursor is passed back
+// as cursor for the next, older page and is empty on the last one.
+type ActivityPage struct {
+	Events      []ActivityEvent `json:"events"`
+	NextCursor  string          `json:"next_cursor,omitempty"`
+	UnreadCount int             `json:"unread_count"`
+}
+
+// ActivityReadRequest marks the feed read up to an event, or all of it when
+// UpTo is nil.
+type ActivityReadRequest struct {
+	UpTo *int64 `json:"up_to"`
+}
@@ -0,0 +1,15 @@
+package model
+
+import "time"
+
+// Attachment is the metadata of a file attached to a todo. UploadedBy is nil
+// once the uploader's account is deleted.
+type Attachment struct {
+	ID          int       `json:"id"`
+	TodoID      string    `json:"todo_id"`
+	Filename    string    `json:"filename"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	UploadedBy  *User     `json:"uploaded_by"`
+	CreatedAt   time.Time `json:"created_at"`
+}
@@ -0,0 +1,27 @@
+package model
+
+import "time"
+
+// Comment is a markdown comment on a todo. Author is nil once the author's
+// account is deleted.
+type Comment struct {
+	ID        int       `json:"id"`
+	TodoID    string    `json:"todo_id"`
+	Author    *User     `json:"author"`
+	Body      string    `json:"body"`
+	Mentions  []User    `json:"mentions"`
+	Edited    bool      `json:"edited"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type CommentRequest struct {
+	Body string `json:"body"`
+}
+
+// CommentRevision is the body of a comment before one of its edits.
+type CommentRevision struct {
+	Body     string    `json:"body"`
+	EditedBy *User     `json:"edited_by"`
+	EditedAt time.Time `json:"edited_at"`
+}
@@ -0,0 +1,27 @@
+package model
+
+import "time"
+
+// Event stream event types.
+const (
+	EventTodoCreated = "todo.created"
+	EventTodoUpdated = "todo.updated"
+	EventTodoDeleted = "todo.deleted"
+	// EventReset tells the client it missed events and should reload.
+	EventReset = "reset"
+)
+
+// TodoEvent is a todo change sent on the event stream. ID is the id of the
+// history row and what a client resumes from. Todo is the state after the
+// change, or before it for a delete. ChangedBy is nil once that account is
+// deleted.
+type TodoEvent struct {
+	ID        int64                  `json:"id"`
+	Type      string                 `json:"type"`
+	TodoID    string                 `json:"todo_id"`
+	Version   int                    `json:"version"`
+	Todo      TodoSnapshot           `json:"todo"`
+	Changes   map[string]FieldChange `json:"changes"`
+	ChangedBy *int                   `json:"changed_by"`
+	ChangedAt time.Time              `json:"changed_at"`
+}
@@ -0,0 +1,42 @@
+package model
+
+import "time"
+
+// History actions.
+const (
+	HistoryCreate  = "create"
+	HistoryUpdate  = "update"
+	HistoryDelete  = "delete"
+	HistoryRevert  = "revert"
+	HistoryRestore = "restore"
+)
+
+// TodoSnapshot is the state of a todo's own fields at one version.
+type TodoSnapshot struct {
+	Title       string     `json:"title"`
+	Description string     `json:"description"`
+	Completed   bool       `json:"completed"`
+	ListID      *int       `json:"list_id,omitempty"`
+	Priority    string     `json:"priority,omitempty"`
+	DueAt       *time.Time `json:"due_at,omitempty"`
+}
+
+// FieldChange is the old and new value of one changed field. Old is null on
+// create and New is null on delete.
+type FieldChange struct {
+	Old any `json:"old"`
+	New any `json:"new"`
+}
+
+// TodoVersion is one entry of a todo's history. Todo is the state after the
+// change, or before it for a delete. RevertedTo is set for reverts and
+// restores. ChangedBy is nil once that account is deleted.
+type TodoVersion struct {
+	Version    int                    `json:"version"`
+	Action     string                 `json:"action"`
+	Changes    map[string]FieldChange `json:"changes"`
+	Todo       TodoSnapshot           `json:"todo"`
+	RevertedTo *int                   `json:"reverted_to,omitempty"`
+	ChangedBy  *User                  `json:"changed_by"`
+	ChangedAt  time.Time              `json:"changed_at"`
+}
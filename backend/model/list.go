@@ -0,0 +1,59 @@
+package model
+
+import "time"
+
+// Roles a user can have on a shared list, each includes the ones before it.
+const (
+	RoleViewer = "viewer"
+	RoleEditor = "editor"
+	RoleOwner  = "owner"
+)
+
+// List is a named, shareable list of todos. Role is the caller's role on it.
+type List struct {
+	ID          int       `json:"id"`
+	Name        string    `json:"name"`
+	Role        string    `json:"role"`
+	MemberCount int       `json:"member_count"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+type ListRequest struct {
+	Name string `json:"name"`
+}
+
+type ListMember struct {
+	User    User      `json:"user"`
+	Role    string    `json:"role"`
+	AddedAt time.Time `json:"added_at"`
+}
+
+type MemberRoleRequest struct {
+	Role string `json:"role"`
+}
+
+// InviteRequest invites an existing user by username or email.
+type InviteRequest struct {
+	Username string `json:"username,omitempty"`
+	Email    string `json:"email,omitempty"`
+	Role     string `json:"role"`
+}
+
+// Invitation statuses.
+const (
+	InvitationPending  = "pending"
+	InvitationAccepted = "accepted"
+	InvitationDeclined = "declined"
+)
+
+type Invitation struct {
+	ID        int       `json:"id"`
+	ListID    int       `json:"list_id"`
+	ListName  string    `json:"list_name"`
+	Invitee   User      `json:"invitee"`
+	InvitedBy User      `json:"invited_by"`
+	Role      string    `json:"role"`
+	Status    string    `json:"status"`
+	CreatedAt time.Time `json:"created_at"`
+}
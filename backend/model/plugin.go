@@ -0,0 +1,50 @@
+package model
+
+// Plugin is a loaded WebAssembly plugin and the routes it serves under
+// /api/plugins/<name>.
+type Plugin struct {
+	Name   string        `json:"name"`
+	Routes []PluginRoute `json:"routes"`
+}
+
+// PluginRoute is a route a plugin registered. Path segments starting with a
+// colon are parameters, e.g. /reports/:list.
+type PluginRoute struct {
+	Method  string `json:"method"`
+	Path    string `json:"path"`
+	Handler string `json:"handler"` // the exported function serving it
+}
+
+// PluginRequest is the request a plugin handler gets, as JSON.
+type PluginRequest struct {
+	Method      string              `json:"method"`
+	Path        string              `json:"path"` // below /api/plugins/<name>
+	Params      map[string]string   `json:"params"`
+	Query       map[string][]string `json:"query"`
+	Body        string              `json:"body"`
+	UserID      int                 `json:"user_id"`
+	WorkspaceID int                 `json:"workspace_id"`
+}
+
+// PluginResponse is what a plugin handler returns, as JSON. Status defaults
+// to 200. Of the headers only Content-Type, Cache-Control, ETag,
+// Last-Modified, Content-Language and X-Plugin-* are sent.
+type PluginResponse struct {
+	Status  int               `json:"status"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    string            `json:"body"`
+}
+
+// PluginResult is what a host function returns to a plugin: Data, or Error
+// when the call failed.
+type PluginResult struct {
+	Data  any    `json:"data,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// PluginTodoFilter selects the todos the todos host function returns.
+type PluginTodoFilter struct {
+	ListID    *int  `json:"list_id"`
+	Completed *bool `json:"completed"`
+	Limit     int   `json:"limit"` // defaults to 100, at most 500
+}
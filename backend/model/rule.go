@@ -0,0 +1,119 @@
+package model
+
+import "time"
+
+// Rule triggers. A completed todo fires todo.updated and todo.completed.
+const (
+	TriggerCreated   = "todo.created"
+	TriggerUpdated   = "todo.updated"
+	TriggerCompleted = "todo.completed"
+	TriggerDueSoon   = "todo.due_soon"
+)
+
+// Rule condition operators. The string operators ignore case. set and
+// unset test for an empty value and take none.
+const (
+	OpEquals     = "equals"
+	OpNotEquals  = "not_equals"
+	OpContains   = "contains"
+	OpStartsWith = "starts_with"
+	OpEndsWith   = "ends_with"
+	OpSet        = "set"
+	OpUnset      = "unset"
+)
+
+// Rule action types.
+const (
+	ActionSetField   = "set_field"
+	ActionCreateTodo = "create_todo"
+	ActionHTTP       = "http"
+	ActionScript     = "script"
+)
+
+// Rule run statuses.
+const (
+	RunPending   = "pending" // queued, runs soon
+	RunRunning   = "running"
+	RunSucceeded = "succeeded"
+	RunFailed    = "failed"  // an action failed, the actions after it didn't run
+	RunSkipped   = "skipped" // stopped by the loop protection
+)
+
+// Rule runs its actions, as its creator, when a todo it can see fires the
+// trigger and matches every condition.
+type Rule struct {
+	ID         int             `json:"id"`
+	Name       string          `json:"name"`
+	Trigger    string          `json:"trigger"`
+	Conditions []RuleCondition `json:"conditions"`
+	Actions    []RuleAction    `json:"actions"`
+	Enabled    bool            `json:"enabled"`
+	CreatedAt  time.Time       `json:"created_at"`
+	UpdatedAt  time.Time       `json:"updated_at"`
+}
+
+// RuleRequest creates or replaces a rule. Enabled defaults to true.
+type RuleRequest struct {
+	Name       string          `json:"name"`
+	Trigger    string          `json:"trigger"`
+	Conditions []RuleCondition `json:"conditions"`
+	Actions    []RuleAction    `json:"actions"`
+	Enabled    *bool           `json:"enabled"`
+}
+
+// RuleCondition compares a field of the todo, after the change, with Value:
+// title, description, completed, priority, list_id or due_at.
+type RuleCondition struct {
+	Field string `json:"field"`
+	Op    string `json:"op"`
+	Value any    `json:"value,omitempty"`
+}
+
+// RuleAction is one thing a rule does.
+//
+//   - set_field sets Field of the todo to Value: title, description,
+//     completed, priority or due_at.
+//   - create_todo creates Todo, in the list of the todo if the rule's
+//     creator can edit it, else as a personal todo.
+//   - http POSTs the run to URL.
+//   - script runs Script, Lua code that can read and change the todo.
+type RuleAction struct {
+	Type   string        `json:"type"`
+	Field  string        `json:"field,omitempty"`
+	Value  any           `json:"value,omitempty"`
+	Todo   *RuleTodoSpec `json:"todo,omitempty"`
+	URL    string        `json:"url,omitempty"`
+	Script string        `json:"script,omitempty"`
+}
+
+// RuleTodoSpec is the todo a create_todo action creates. {{title}} in Title
+// and Description is the title of the todo that fired the rule. DueIn is a
+// duration from now, e.g. "72h".
+type RuleTodoSpec struct {
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	Priority    string `json:"priority,omitempty"`
+	DueIn       string `json:"due_in,omitempty"`
+}
+
+// RuleRun is one entry of a rule's execution log. Depth counts the rules
+// that led to it, 0 for a change made by a user.
+type RuleRun struct {
+	ID        int64     `json:"id"`
+	TodoID    string    `json:"todo_id"`
+	Trigger   string    `json:"trigger"`
+	Status    string    `json:"status"`
+	Actions   int       `json:"actions"` // how many ran
+	Error     string    `json:"error,omitempty"`
+	Depth     int       `json:"depth"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// RuleHTTPPayload is the body of an http action.
+type RuleHTTPPayload struct {
+	RuleID   int          `json:"rule_id"`
+	RuleName string       `json:"rule_name"`
+	Trigger  string       `json:"trigger"`
+	TodoID   string       `json:"todo_id"`
+	Todo     TodoSnapshot `json:"todo"`
+}
@@ -0,0 +1,83 @@
+package model
+
+import (
+	"time"
+
+	"github.com/thakurnishu/MinimalDo/crdt"
+)
+
+// Sync mutation operations.
+const (
+	SyncCreate = "create"
+	SyncUpdate = "update"
+	SyncDelete = "delete"
+)
+
+// Sync mutation results.
+const (
+	// SyncApplied means the mutation was applied as sent.
+	SyncApplied = "applied"
+	// SyncMerged means some fields were not applied because the server
+	// changed them since the base version, they are listed in Conflicts.
+	SyncMerged = "merged"
+	// SyncDuplicate means the mutation had already been applied, a create
+	// with a known ID or a delete of a deleted todo.
+	SyncDuplicate = "duplicate"
+	// SyncConflict means the todo was deleted, deletes win over updates.
+	SyncConflict = "conflict"
+	// SyncRejected means the mutation was invalid or not allowed, see Error.
+	SyncRejected = "rejected"
+)
+
+// SyncTodo is a todo as sync returns it, with the version to send as
+// BaseVersion and its CRDT state for clients that merge.
+type SyncTodo struct {
+	Todo
+	Version int        `json:"version"`
+	CRDT    *crdt.Todo `json:"crdt"`
+}
+
+// SyncTombstone is a todo deleted since the sync token.
+type SyncTombstone struct {
+	ID        string    `json:"id"`
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+// SyncMutation is one offline change to the todo with ID. A create brings
+// the ID the client generated for it, so it can be retried safely.
+// BaseVersion is the version the client last saw, fields the server changed
+// since then are not overwritten. Clients that keep CRDT
+// state send it in CRDT as well, it is merged with the server's and its
+// values win over Todo's. Only state without priority and due_at registers
+// conflicts, when Todo has other values for them.
+type SyncMutation struct {
+	Op          string        `json:"op"`
+	ID          string        `json:"id"`
+	BaseVersion int           `json:"base_version,omitempty"`
+	Todo        *TodoSnapshot `json:"todo,omitempty"`
+	CRDT        *crdt.Todo    `json:"crdt,omitempty"`
+}
+
+// SyncRequest pushes a batch of mutations, applied in order, and pulls the
+// changes since Since like GET /sync.
+type SyncRequest struct {
+	Since     string         `json:"since"`
+	Mutations []SyncMutation `json:"mutations"`
+}
+
+// SyncResult is the outcome of one mutation.
+type SyncResult struct {
+	ID        string   `json:"id"`
+	Status    string   `json:"status"`
+	Conflicts []string `json:"conflicts,omitempty"`
+	Error     string   `json:"error,omitempty"`
+}
+
+// SyncResponse is the todos changed and deleted since the request's token,
+// all todos when it had none, and the token to send next time.
+type SyncResponse struct {
+	Todos   []SyncTodo      `json:"todos"`
+	Deleted []SyncTombstone `json:"deleted"`
+	Token   string          `json:"token"`
+	Results []SyncResult    `json:"results,omitempty"`
+}
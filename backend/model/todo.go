@@ -0,0 +1,61 @@
+// Package model holds the API types shared by the backend and its clients.
+package model
+
+import (
+	"time"
+)
+
+// Todo priorities, besides none.
+const (
+	PriorityLow    = "low"
+	PriorityMedium = "medium"
+	PriorityHigh   = "high"
+	PriorityUrgent = "urgent"
+)
+
+var Priorities = []string{"", PriorityLow, PriorityMedium, PriorityHigh, PriorityUrgent}
+
+// Todo is a todo. ID is a UUID, version 7 when the server generates it;
+// clients may send their own on create.
+type Todo struct {
+	ID           string     `json:"id"`
+	Title        string     `json:"title"`
+	Description  string     `json:"description"`
+	Completed    bool       `json:"completed"`
+	ListID       *int       `json:"list_id,omitempty"` // nil for personal todos
+	Priority     string     `json:"priority"`          // empty for none
+	DueAt        *time.Time `json:"due_at"`
+	Assignees    []User     `json:"assignees"`
+	CommentCount int        `json:"comment_count"`
+	CreatedAt    time.Time  `json:"created_at"`
+	UpdatedAt    time.Time  `json:"updated_at"`
+}
+
+type DateRange struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+type GroupedTodos struct {
+	Date  string `json:"date"`
+	Todos []Todo `json:"todos"`
+}
+
+// AssigneesRequest replaces the assignees of a todo.
+type AssigneesRequest struct {
+	UserIDs []int `json:"user_ids"`
+}
+
+// Assignment is one entry of a todo's assignment log.
+type Assignment struct {
+	User      User      `json:"user"`
+	Action    string    `json:"action"` // assigned or unassigned
+	ChangedBy *User     `json:"changed_by"`
+	ChangedAt time.Time `json:"changed_at"`
+}
+
+// WorkspaceTasks are the todos assigned to the caller in one workspace.
+type WorkspaceTasks struct {
+	Workspace Workspace `json:"workspace"`
+	Todos     []Todo    `json:"todos"`
+}
@@ -0,0 +1,34 @@
+package model
+
+import "time"
+
+// Scopes a personal access token can be given.
+const (
+	ScopeTodosRead  = "todos:read"
+	ScopeTodosWrite = "todos:write"
+)
+
+// APIToken is a personal access token as listed by /api/tokens. The token
+// itself is only returned once, when it is created.
+type APIToken struct {
+	ID         int        `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+// CreateTokenRequest creates a personal access token. A nil ExpiresAt means
+// the token never expires.
+type CreateTokenRequest struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+type CreatedToken struct {
+	APIToken
+	Token string `json:"token"`
+}
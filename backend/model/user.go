@@ -0,0 +1,55 @@
+package model
+
+import (
+	"time"
+)
+
+type User struct {
+	ID        int       `json:"id"`
+	Username  string    `json:"username"`
+	Email     string    `json:"email,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type RegisterRequest struct {
+	Username string `json:"username"`
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+type LoginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// Session is returned by register, login and refresh. AccessToken is sent as
+// `Authorization: Bearer <token>` on every other request, RefreshToken is
+// exchanged for a new pair at /auth/refresh once the access token expires.
+// Each refresh token can be used once.
+type Session struct {
+	AccessToken      string    `json:"access_token"`
+	TokenType        string    `json:"token_type"`
+	ExpiresAt        time.Time `json:"expires_at"`
+	RefreshToken     string    `json:"refresh_token"`
+	RefreshExpiresAt time.Time `json:"refresh_expires_at"`
+	User             User      `json:"user"`
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// AuthProviders tells clients which login methods are available.
+type AuthProviders struct {
+	Password bool          `json:"password"`
+	OIDC     *OIDCProvider `json:"oidc,omitempty"`
+}
+
+type OIDCProvider struct {
+	Name     string `json:"name"`
+	LoginURL string `json:"login_url"`
+}
+
+type LoginCodeRequest struct {
+	Code string `json:"code"`
+}
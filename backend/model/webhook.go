@@ -0,0 +1,70 @@
+package model
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Webhook event types besides the todo event types. A completed todo sends
+// both todo.updated and todo.completed, to the webhooks that want them.
+const (
+	WebhookTodoCompleted = "todo.completed"
+	WebhookTest          = "webhook.test"
+)
+
+// Webhook delivery statuses.
+const (
+	DeliveryPending   = "pending"
+	DeliverySucceeded = "succeeded"
+	DeliveryFailed    = "failed" // gave up after the last retry
+)
+
+// Webhook is a subscription to the todo events of a workspace that its
+// creator can see. Secret signs the deliveries, it is only returned when
+// the webhook is created.
+type Webhook struct {
+	ID         int       `json:"id"`
+	URL        string    `json:"url"`
+	EventTypes []string  `json:"event_types"`
+	Active     bool      `json:"active"`
+	Secret     string    `json:"secret,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// WebhookRequest creates or updates a webhook. Active defaults to true.
+type WebhookRequest struct {
+	URL        string   `json:"url"`
+	EventTypes []string `json:"event_types"`
+	Active     *bool    `json:"active"`
+}
+
+// WebhookPayload is the body of a delivery. Data is a TodoEvent, or for a
+// test event the ID of the webhook.
+type WebhookPayload struct {
+	Type      string    `json:"type"`
+	CreatedAt time.Time `json:"created_at"`
+	Data      any       `json:"data"`
+}
+
+// WebhookDelivery is one event sent to a webhook, with its attempts newest
+// first. NextAttemptAt is set while it is pending.
+type WebhookDelivery struct {
+	ID            int64            `json:"id"`
+	EventType     string           `json:"event_type"`
+	Status        string           `json:"status"`
+	Payload       json.RawMessage  `json:"payload"`
+	AttemptCount  int              `json:"attempt_count"`
+	NextAttemptAt *time.Time       `json:"next_attempt_at,omitempty"`
+	CreatedAt     time.Time        `json:"created_at"`
+	Attempts      []WebhookAttempt `json:"attempts"`
+}
+
+// WebhookAttempt is one try at a delivery. ResponseStatus is nil when no
+// response came, Error says why.
+type WebhookAttempt struct {
+	ResponseStatus *int      `json:"response_status"`
+	Error          string    `json:"error,omitempty"`
+	DurationMS     int       `json:"duration_ms"`
+	AttemptedAt    time.Time `json:"attempted_at"`
+}
@@ -0,0 +1,37 @@
+package model
+
+import "time"
+
+// Workspace roles. Admins can add and remove members.
+const (
+	WorkspaceRoleMember = "member"
+	WorkspaceRoleAdmin  = "admin"
+)
+
+// Workspace is a tenant: todos and lists belong to exactly one. Personal is
+// set for the workspace every user gets on sign up, it is used when a
+// request doesn't name a workspace. Role is the caller's role.
+type Workspace struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	Role      string    `json:"role"`
+	Personal  bool      `json:"personal"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type WorkspaceRequest struct {
+	Name string `json:"name"`
+}
+
+type WorkspaceMember struct {
+	User    User      `json:"user"`
+	Role    string    `json:"role"`
+	AddedAt time.Time `json:"added_at"`
+}
+
+// AddWorkspaceMemberRequest adds an existing user by username or email.
+type AddWorkspaceMemberRequest struct {
+	Username string `json:"username,omitempty"`
+	Email    string `json:"email,omitempty"`
+	Role     string `json:"role"`
+}
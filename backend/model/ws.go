@@ -0,0 +1,49 @@
+package model
+
+import "encoding/json"
+
+// WebSocket command types, sent by the client.
+const (
+	WSSubscribe   = "subscribe"
+	WSUnsubscribe = "unsubscribe"
+	WSCreate      = "create"
+	WSUpdate      = "update"
+	WSDelete      = "delete"
+)
+
+// WebSocket message types, sent by the server.
+const (
+	WSAck   = "ack"
+	WSError = "error"
+	WSEvent = "event"
+	WSReset = "reset"
+)
+
+// WSCommand is a message from a client of the WebSocket API. ID is chosen by
+// the client and echoed in the ack or error. ListIDs and Personal select the
+// lists, and the caller's personal todos, a subscribe or unsubscribe is for.
+// Since resumes a subscription after the event with that ID.
+type WSCommand struct {
+	ID       string          `json:"id"`
+	Type     string          `json:"type"`
+	TodoID   string          `json:"todo_id,omitempty"`
+	Todo     json.RawMessage `json:"todo,omitempty"` // read as sent, so omitted fields stay omitted
+	ListIDs  []int           `json:"list_ids,omitempty"`
+	Personal bool            `json:"personal,omitempty"`
+	Since    *int64          `json:"since,omitempty"`
+}
+
+// WSMessage is a message from the server. Seq numbers the messages of a
+// connection from 1. It never skips, a client too slow to keep up is
+// disconnected instead. Status is the HTTP status the equivalent REST
+// request would have had.
+type WSMessage struct {
+	Seq       int64      `json:"seq"`
+	Type      string     `json:"type"`
+	ID        string     `json:"id,omitempty"`
+	Status    int        `json:"status,omitempty"`
+	Error     string     `json:"error,omitempty"`
+	Todo      *Todo      `json:"todo,omitempty"`
+	UndoToken string     `json:"undo_token,omitempty"`
+	Event     *TodoEvent `json:"event,omitempty"`
+}
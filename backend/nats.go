@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The nats sink publishes todo events to NATS as <prefix>.<event type>,
+// e.g. minimaldo.todo.completed, with the event as JSON. The headers carry
+// the trace context and Nats-Msg-Id, which JetStream deduplicates the
+// redeliveries of the outbox with. NATS can run embedded in the backend, for
+// deployments that are a single binary.
+
+const natsSetupTimeout = 10 * time.Second
+
+type natsSink struct {
+	nc     *nats.Conn
+	js     jetstream.JetStream // nil without NATS_JETSTREAM
+	prefix string
+	tracer trace.Tracer
+}
+
+// newNATSSink connects to NATS, or starts the embedded server, and creates
+// the JetStream stream of the events when JetStream is on.
+func (s *Server) newNATSSink() (natsSink, error) {
+	sink := natsSink{prefix: s.cfg.NATSSubjectPrefix, tracer: s.tracer}
+	opts := []nats.Option{nats.Name(s.cfg.ServiceName)}
+	if s.cfg.NATSEmbedded {
+		ns, err := startEmbeddedNATS(s.cfg)
+		if err != nil {
+			return sink, fmt.Errorf("start embedded nats: %w", err)
+		}
+		opts = append(opts, nats.InProcessServer(ns))
+	}
+	nc, err := nats.Connect(s.cfg.NATSURL, opts...)
+	if err != nil {
+		return sink, fmt.Errorf("connect to nats: %w", err)
+	}
+	sink.nc = nc
+
+	if !s.cfg.NATSJetStream {
+		return sink, nil
+	}
+	js, err := jetstream.New(nc)
+	if err != nil {
+		return sink, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), natsSetupTimeout)
+	defer cancel()
+	_, err = js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+		Name:       s.cfg.NATSStream,
+		Subjects:   []string{s.cfg.NATSSubjectPrefix + ".>"},
+		Storage:    jetstream.FileStorage,
+		MaxAge:     s.cfg.NATSStreamMaxAge,
+		Duplicates: 2 * time.Minute,
+	})
+	if err != nil {
+		return sink, fmt.Errorf("create stream %s: %w", s.cfg.NATSStream, err)
+	}
+	sink.js = js
+	return sink, nil
+}
+
+// startEmbeddedNATS runs a NATS server with JetStream in the process. It
+// listens on NATS_EMBEDDED_PORT for other services, or only in process when
+// the port is -1.
+func startEmbeddedNATS(cfg *Config) (*server.Server, error) {
+	opts := &server.Options{
+		ServerName: cfg.ServiceName,
+		Host:       cfg.NATSEmbeddedHost,
+		Port:       int(cfg.NATSEmbeddedPort),
+		DontListen: cfg.NATSEmbeddedPort < 0,
+		JetStream:  true,
+		StoreDir:   cfg.NATSStoreDir,
+		NoSigs:     true,
+		NoLog:      true,
+	}
+	ns, err := server.NewServer(opts)
+	if err != nil {
+		return nil, err
+	}
+	ns.Start()
+	if !ns.ReadyForConnections(natsSetupTimeout) {
+		ns.Shutdown()
+		return nil, errors.New("embedded nats server not ready")
+	}
+	return ns, nil
+}
+
+func (natsSink) Name() string { return "nats" }
+
+func (n natsSink) Publish(ctx context.Context, e outboxEvent) error {
+	data, err := json.Marshal(e.event)
+	if err != nil {
+		return err
+	}
+	for _, t := range eventTypes(e.event) {
+		if err := n.publish(ctx, n.prefix+"."+t, strconv.FormatInt(e.id, 10)+"."+t, data); err != nil {
+			return err
+		}
+	}
+	if n.js != nil {
+		return nil
+	}
+	// core NATS publishes are buffered, only a flush says they arrived
+	return n.nc.FlushWithContext(ctx)
+}
+
+// publish sends one message in a producer span, whose context goes with it.
+// With JetStream it waits for the stream to store the message.
+func (n natsSink) publish(ctx context.Context, subject, msgID string, data []byte) error {
+	ctx, span := n.tracer.Start(ctx, "publish "+subject, trace.WithSpanKind(trace.SpanKindProducer))
+	defer span.End()
+	span.SetAttributes(
+		attribute.String("messaging.system", "nats"),
+		attribute.String("messaging.destination.name", subject),
+		attribute.String("messaging.message.id", msgID),
+	)
+
+	msg := nats.NewMsg(subject)
+	msg.Data = data
+	msg.Header.Set(nats.MsgIdHdr, msgID)
+	otel.GetTextMapPropagator().Inject(ctx, natsHeaderCarrier(msg.Header))
+
+	var err error
+	if n.js != nil {
+		_, err = n.js.PublishMsg(ctx, msg)
+	} else {
+		err = n.nc.PublishMsg(msg)
+	}
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
+}
+
+// natsHeaderCarrier carries the trace context in NATS headers. Unlike HTTP
+// headers their names are case sensitive, so traceparent stays lower case.
+type natsHeaderCarrier nats.Header
+
+func (h natsHeaderCarrier) Get(key string) string { return nats.Header(h).Get(key) }
+
+func (h natsHeaderCarrier) Set(key, value string) { nats.Header(h).Set(key, value) }
+
+func (h natsHeaderCarrier) Keys() []string {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	return keys
+}
@@ -0,0 +1,481 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"github.com/thakurnishu/MinimalDo/model"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/oauth2"
+)
+
+const (
+	oidcStateTTL = 10 * time.Minute
+	loginCodeTTL = time.Minute
+)
+
+var (
+	errOIDCNotProvisioned = errors.New("no account is linked to this identity")
+	errOIDCEmailTaken     = errors.New("email belongs to an existing account")
+
+	invalidUsernameChars = regexp.MustCompile(`[^a-zA-Z0-9_.-]+`)
+)
+
+// oidcProvider lazily runs discovery against the issuer and keeps the result,
+// so the backend can start before the identity provider is reachable. The
+// ID token verifier caches the issuer's JWKS and refetches it when it sees an
+// unknown key id.
+type oidcProvider struct {
+	cfg *Config
+
+	mu       sync.Mutex
+	oauth2   *oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+// idClaims are the ID token claims used to find or create the user.
+type idClaims struct {
+	Subject       string `json:"sub"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	Name          string `json:"name"`
+	Nonce         string `json:"nonce"`
+}
+
+func newOIDCProvider(cfg *Config) *oidcProvider {
+	if cfg.OIDCIssuerURL == "" {
+		return nil
+	}
+	return &oidcProvider{cfg: cfg}
+}
+
+func (p *oidcProvider) init(ctx context.Context) (*oauth2.Config, *oidc.IDTokenVerifier, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.oauth2 != nil {
+		return p.oauth2, p.verifier, nil
+	}
+
+	// Discovery must not be tied to the request, the provider keeps using
+	// the context for background JWKS refreshes.
+	discoveryCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+	defer cancel()
+	provider, err := oidc.NewProvider(discoveryCtx, p.cfg.OIDCIssuerURL)
+	if err != nil {
+		return nil, nil, fmt.Errorf("oidc discovery: %w", err)
+	}
+
+	p.oauth2 = &oauth2.Config{
+		ClientID:     p.cfg.OIDCClientID,
+		ClientSecret: p.cfg.OIDCClientSecret,
+		RedirectURL:  p.cfg.OIDCRedirectURL,
+		Endpoint:     provider.Endpoint(),
+		Scopes:       p.cfg.OIDCScopes,
+	}
+	p.verifier = provider.Verifier(&oidc.Config{ClientID: p.cfg.OIDCClientID})
+	return p.oauth2, p.verifier, nil
+}
+
+func (s *Server) authProviders(c *gin.Context) {
+	providers := model.AuthProviders{Password: true}
+	if s.oidc != nil {
+		providers.OIDC = &model.OIDCProvider{
+			Name:     s.cfg.OIDCProviderName,
+			LoginURL: "/auth/oidc/login",
+		}
+	}
+	c.JSON(http.StatusOK, providers)
+}
+
+// oidcLogin starts the authorization code flow with PKCE and redirects the
+// browser to the identity provider.
+func (s *Server) oidcLogin(c *gin.Context) {
+	ctx, span := s.tracer.Start(c.Request.Context(), "oidc_login")
+	defer span.End()
+
+	if s.oidc == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "OIDC login is not configured"})
+		return
+	}
+
+	oauthCfg, _, err := s.oidc.init(ctx)
+	if err != nil {
+		logError("oidc provider unavailable", ctx, s.logger, span, err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Identity provider unavailable"})
+		return
+	}
+
+	state, err := newToken()
+	if err != nil {
+		logError("state generation failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	nonce, err := newToken()
+	if err != nil {
+		logError("nonce generation failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO oidc_states (state_hash, code_verifier, nonce, return_to, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+	`, hashToken(state), verifier, nonce, safeReturnTo(c.Query("return_to")), time.Now().Add(oidcStateTTL).UTC())
+	if err != nil {
+		logError("query execution failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Housekeeping, abandoned logins never reach the callback.
+	if _, err := s.db.ExecContext(ctx, "DELETE FROM oidc_states WHERE expires_at < NOW()"); err != nil {
+		s.logger.WarnContext(ctx, "purging expired oidc states failed", slog.String("error", err.Error()))
+	}
+
+	c.Redirect(http.StatusFound, oauthCfg.AuthCodeURL(state,
+		oidc.Nonce(nonce),
+		oauth2.S256ChallengeOption(verifier),
+	))
+}
+
+// oidcCallback finishes the flow: it exchanges the code, verifies the ID
+// token, maps it to a user and sends the browser back to the frontend with a
+// one-time login code.
+func (s *Server) oidcCallback(c *gin.Context) {
+	ctx, span := s.tracer.Start(c.Request.Context(), "oidc_callback")
+	defer span.End()
+
+	if s.oidc == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "OIDC login is not configured"})
+		return
+	}
+
+	var verifier, nonce, returnTo string
+	err := s.db.QueryRowContext(ctx, `
+		DELETE FROM oidc_states
+		WHERE state_hash = $1 AND expires_at > NOW()
+		RETURNING code_verifier, nonce, return_to
+	`, hashToken(c.Query("state"))).Scan(&verifier, &nonce, &returnTo)
+	if err == sql.ErrNoRows {
+		logError("unknown or expired oidc state", ctx, s.logger, span, errors.New("invalid state"))
+		s.redirectLoginError(c, "/", "login expired, please try again")
+		return
+	}
+	if err != nil {
+		logError("row scan failed", ctx, s.logger, span, err)
+		s.redirectLoginError(c, "/", "login failed")
+		return
+	}
+
+	if providerErr := c.Query("error"); providerErr != "" {
+		logError("identity provider returned an error", ctx, s.logger, span, errors.New(providerErr),
+			slog.String("error_description", c.Query("error_description")),
+		)
+		s.redirectLoginError(c, returnTo, "login was cancelled or denied")
+		return
+	}
+
+	oauthCfg, idVerifier, err := s.oidc.init(ctx)
+	if err != nil {
+		logError("oidc provider unavailable", ctx, s.logger, span, err)
+		s.redirectLoginError(c, returnTo, "identity provider unavailable")
+		return
+	}
+
+	token, err := oauthCfg.Exchange(ctx, c.Query("code"), oauth2.VerifierOption(verifier))
+	if err != nil {
+		logError("code exchange failed", ctx, s.logger, span, err)
+		s.redirectLoginError(c, returnTo, "login failed")
+		return
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		logError("token response without id_token", ctx, s.logger, span, errors.New("missing id_token"))
+		s.redirectLoginError(c, returnTo, "login failed")
+		return
+	}
+	idToken, err := idVerifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		logError("id token verification failed", ctx, s.logger, span, err)
+		s.redirectLoginError(c, returnTo, "login failed")
+		return
+	}
+
+	// The configured username claim is read separately since its name varies.
+	var claims idClaims
+	var rawClaims map[string]any
+	if err := idToken.Claims(&claims); err == nil {
+		err = idToken.Claims(&rawClaims)
+	}
+	if err != nil {
+		logError("id token claims invalid", ctx, s.logger, span, err)
+		s.redirectLoginError(c, returnTo, "login failed")
+		return
+	}
+	if claims.Nonce != nonce {
+		logError("id token nonce mismatch", ctx, s.logger, span, errors.New("nonce mismatch"))
+		s.redirectLoginError(c, returnTo, "login failed")
+		return
+	}
+	preferredUsername, _ := rawClaims[s.cfg.OIDCUsernameClaim].(string)
+
+	span.SetAttributes(
+		attribute.String("oidc.issuer", idToken.Issuer),
+		attribute.String("oidc.subject", idToken.Subject),
+	)
+
+	u, created, err := s.userForIdentity(ctx, idToken.Issuer, claims, preferredUsername)
+	if err != nil {
+		logError("mapping identity to user failed", ctx, s.logger, span, err,
+			slog.String("oidc_issuer", idToken.Issuer),
+			slog.String("oidc_subject", idToken.Subject),
+		)
+		msg := "login failed"
+		if errors.Is(err, errOIDCNotProvisioned) || errors.Is(err, errOIDCEmailTaken) {
+			msg = err.Error()
+		}
+		s.redirectLoginError(c, returnTo, msg)
+		return
+	}
+
+	code, err := newToken()
+	if err != nil {
+		logError("login code generation failed", ctx, s.logger, span, err)
+		s.redirectLoginError(c, returnTo, "login failed")
+		return
+	}
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO login_codes (code_hash, user_id, expires_at) VALUES ($1, $2, $3)
+	`, hashToken(code), u.ID, time.Now().Add(loginCodeTTL).UTC())
+	if err != nil {
+		logError("query execution failed", ctx, s.logger, span, err)
+		s.redirectLoginError(c, returnTo, "login failed")
+		return
+	}
+
+	s.logger.InfoContext(ctx, "oidc login",
+		slog.Int("user_id", u.ID),
+		slog.String("oidc_issuer", idToken.Issuer),
+		slog.Bool("user_created", created),
+	)
+	span.SetAttributes(
+		attribute.Int("user.id", u.ID),
+		attribute.Bool("user.created", created),
+	)
+
+	c.Redirect(http.StatusFound, s.frontendRedirect(returnTo, url.Values{"login_code": {code}}))
+}
+
+// exchangeLoginCode turns the one-time code from the OIDC callback into a
+// regular session.
+func (s *Server) exchangeLoginCode(c *gin.Context) {
+	ctx, span := s.tracer.Start(c.Request.Context(), "exchange_login_code")
+	defer span.End()
+
+	var req model.LoginCodeRequest
+	if err := c.BindJSON(&req); err != nil {
+		logError("failed to parse json", ctx, s.logger, span, err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		logError("begin transaction failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	var u model.User
+	err = tx.QueryRowContext(ctx, `
+		WITH used AS (
+			DELETE FROM login_codes
+			WHERE code_hash = $1 AND expires_at > NOW()
+			RETURNING user_id
+		)
+		SELECT u.id, u.username, COALESCE(u.email, ''), u.created_at
+		FROM used JOIN users u ON u.id = used.user_id
+	`, hashToken(req.Code)).Scan(&u.ID, &u.Username, &u.Email, &u.CreatedAt)
+	if err == sql.ErrNoRows {
+		logError("invalid login code", ctx, s.logger, span, errors.New("invalid or expired login code"))
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired login code"})
+		return
+	}
+	if err != nil {
+		logError("row scan failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	session, err := s.issueSession(ctx, tx, u, "")
+	if err != nil {
+		logError("session creation failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		logError("commit failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	span.SetAttributes(attribute.Int("user.id", u.ID))
+	c.JSON(http.StatusOK, session)
+}
+
+// userForIdentity maps an OIDC identity to a user: an already linked identity
+// wins, then (if enabled) an existing account with the same verified email,
+// and finally a new account is provisioned (if enabled).
+func (s *Server) userForIdentity(ctx context.Context, issuer string, claims idClaims, preferredUsername string) (model.User, bool, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return model.User{}, false, err
+	}
+	defer tx.Rollback()
+
+	email := ""
+	if claims.EmailVerified {
+		email = strings.TrimSpace(claims.Email)
+	}
+
+	var u model.User
+	err = tx.QueryRowContext(ctx, `
+		UPDATE user_identities SET last_login_at = NOW(), email = COALESCE(NULLIF($3, ''), email)
+		FROM users u
+		WHERE u.id = user_identities.user_id AND issuer = $1 AND subject = $2
+		RETURNING u.id, u.username, COALESCE(u.email, ''), u.created_at
+	`, issuer, claims.Subject, email).Scan(&u.ID, &u.Username, &u.Email, &u.CreatedAt)
+	if err == nil {
+		return u, false, tx.Commit()
+	}
+	if err != sql.ErrNoRows {
+		return model.User{}, false, err
+	}
+
+	created := false
+	if email != "" && s.cfg.OIDCLinkByEmail {
+		err = tx.QueryRowContext(ctx, `
+			SELECT id, username, COALESCE(email, ''), created_at FROM users WHERE email = $1
+		`, email).Scan(&u.ID, &u.Username, &u.Email, &u.CreatedAt)
+		if err != nil && err != sql.ErrNoRows {
+			return model.User{}, false, err
+		}
+	}
+
+	if u.ID == 0 {
+		if !s.cfg.OIDCAutoProvision {
+			return model.User{}, false, errOIDCNotProvisioned
+		}
+		u, err = provisionUser(ctx, tx, usernameCandidate(preferredUsername, claims), email)
+		if err != nil {
+			return model.User{}, false, err
+		}
+		created = true
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO user_identities (user_id, issuer, subject, email)
+		VALUES ($1, $2, $3, NULLIF($4, ''))
+	`, u.ID, issuer, claims.Subject, email)
+	if err != nil {
+		return model.User{}, false, err
+	}
+
+	return u, created, tx.Commit()
+}
+
+// provisionUser creates a password-less user, appending a number to the
+// username until it is free.
+func provisionUser(ctx context.Context, tx *sql.Tx, username, email string) (model.User, error) {
+	var u model.User
+	for i := 1; i <= 50; i++ {
+		candidate := username
+		if i > 1 {
+			suffix := strconv.Itoa(i)
+			if len(candidate)+len(suffix) > 64 {
+				candidate = candidate[:64-len(suffix)]
+			}
+			candidate += suffix
+		}
+
+		// A savepoint keeps the transaction usable after a unique violation.
+		if _, err := tx.ExecContext(ctx, "SAVEPOINT provision_user"); err != nil {
+			return model.User{}, err
+		}
+		err := tx.QueryRowContext(ctx, `
+			INSERT INTO users (username, email) VALUES ($1, NULLIF($2, ''))
+			RETURNING id, username, COALESCE(email, ''), created_at
+		`, candidate, email).Scan(&u.ID, &u.Username, &u.Email, &u.CreatedAt)
+		if err == nil {
+			return u, nil
+		}
+
+		var pqErr *pq.Error
+		if !errors.As(err, &pqErr) || pqErr.Code != "23505" {
+			return model.User{}, err
+		}
+		if _, err := tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT provision_user"); err != nil {
+			return model.User{}, err
+		}
+		if pqErr.Constraint == "users_email_key" {
+			return model.User{}, errOIDCEmailTaken
+		}
+	}
+	return model.User{}, fmt.Errorf("no free username for %q", username)
+}
+
+// usernameCandidate derives a valid username from the identity's claims.
+func usernameCandidate(preferred string, claims idClaims) string {
+	for _, candidate := range []string{preferred, strings.Split(claims.Email, "@")[0], claims.Name} {
+		candidate = invalidUsernameChars.ReplaceAllString(candidate, "-")
+		candidate = strings.Trim(candidate, "-.")
+		if len(candidate) > 64 {
+			candidate = candidate[:64]
+		}
+		if usernamePattern.MatchString(candidate) {
+			return candidate
+		}
+	}
+	return "user"
+}
+
+// safeReturnTo only allows paths on the frontend, never another host.
+func safeReturnTo(returnTo string) string {
+	if !strings.HasPrefix(returnTo, "/") || strings.HasPrefix(returnTo, "//") || strings.Contains(returnTo, `\`) {
+		return "/"
+	}
+	return returnTo
+}
+
+func (s *Server) frontendRedirect(returnTo string, params url.Values) string {
+	target, err := url.Parse(strings.TrimRight(s.cfg.FrontendURL, "/") + safeReturnTo(returnTo))
+	if err != nil {
+		return s.cfg.FrontendURL
+	}
+	q := target.Query()
+	for k, v := range params {
+		q[k] = v
+	}
+	target.RawQuery = q.Encode()
+	return target.String()
+}
+
+func (s *Server) redirectLoginError(c *gin.Context, returnTo, msg string) {
+	c.Redirect(http.StatusFound, s.frontendRedirect(returnTo, url.Values{"login_error": {msg}}))
+}
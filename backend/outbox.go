@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/thakurnishu/MinimalDo/model"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Todo events leave the backend through a transactional outbox: recordChange
+// writes the event in the transaction of the change, so an event is never
+// lost or sent for a write that was rolled back. runOutbox publishes the
+// committed events to the configured sinks. Delivery is at least once, a
+// sink may see an event again after a failure. The events of one todo are
+// published in order, an event waits until the one before it is published.
+
+const (
+	outboxBatch          = 100 // events published per transaction
+	outboxPublishTimeout = 10 * time.Second
+)
+
+// eventSink is somewhere the outbox publishes todo events to.
+type eventSink interface {
+	Name() string
+	// Publish sends an event. It is called again for the same event when
+	// publishing failed, with this or another sink.
+	Publish(ctx context.Context, e outboxEvent) error
+}
+
+// outboxEvent is a todo event read from the outbox.
+type outboxEvent struct {
+	id           int64
+	workspaceID  int
+	todoID       int
+	ownerID      int
+	event        model.TodoEvent
+	traceContext propagation.MapCarrier
+	attempt      int
+	ruleID       int
+	ruleDepth    int
+}
+
+// eventTypes returns the types an event is published as. Completing a todo
+// is also a todo.completed event.
+func eventTypes(e model.TodoEvent) []string {
+	types := []string{e.Type}
+	if c, ok := e.Changes["completed"]; ok && c.New == true {
+		types = append(types, model.WebhookTodoCompleted)
+	}
+	return types
+}
+
+// writeOutbox adds a change to the outbox, in the transaction that made it.
+func writeOutbox(ctx context.Context, tx *sql.Tx, ch todoChange, e model.TodoEvent) error {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	traceContext, err := traceCarrier(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO outbox (workspace_id, todo_id, owner_id, event_type, payload, trace_context, rule_id, rule_depth)
+		VALUES ($1, $2, NULLIF($3, 0), $4, $5, $6, NULLIF($7, 0), $8)
+	`, ch.workspaceID, ch.todoID, ch.ownerID, e.Type, payload, traceContext, ch.ruleID, ch.ruleDepth)
+	return err
+}
+
+// eventSinks returns the webhook and rules sinks, which always run, and the
+// transports named by OUTBOX_SINKS.
+func (s *Server) eventSinks() ([]eventSink, error) {
+	sinks := []eventSink{
+		webhookSink{db: s.db},
+		rulesSink{s: s},
+	}
+	for _, name := range s.cfg.OutboxSinks {
+		switch strings.TrimSpace(name) {
+		case "", "webhook", "rules": // always on, accepted for older configs
+		case "log":
+			sinks = append(sinks, logSink{logger: s.logger})
+		case "nats":
+			sink, err := s.newNATSSink()
+			if err != nil {
+				return nil, err
+			}
+			sinks = append(sinks, sink)
+		default:
+			return nil, fmt.Errorf("unknown event sink %q, want log or nats", name)
+		}
+	}
+	return sinks, nil
+}
+
+// runOutbox publishes the outbox, forever. Events are claimed with SKIP
+// LOCKED, so several servers can run it. Published events are kept for
+// OUTBOX_RETENTION.
+func (s *Server) runOutbox(sinks []eventSink) {
+	ticker := time.NewTicker(s.cfg.OutboxPollInterval)
+	defer ticker.Stop()
+	var pruned time.Time
+	for range ticker.C {
+		for {
+			n, err := s.relayOutbox(sinks)
+			if err != nil {
+				s.logger.Error("relaying outbox failed", slog.String("error", err.Error()))
+				break
+			}
+			if n < outboxBatch {
+				break
+			}
+		}
+		if time.Since(pruned) > time.Minute {
+			_, err := s.db.Exec(`
+				DELETE FROM outbox WHERE published_at < NOW() - make_interval(secs => $1)
+			`, s.cfg.OutboxRetention.Seconds())
+			if err != nil {
+				s.logger.Error("pruning outbox failed", slog.String("error", err.Error()))
+			}
+			pruned = time.Now()
+		}
+	}
+}
+
+// relayOutbox publishes a batch of due events and returns how many it
+// claimed. Only the oldest unpublished event of each todo is due, and it
+// stays locked until it is published or rescheduled.
+func (s *Server) relayOutbox(sinks []eventSink) (int, error) {
+	ctx := context.Background()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT id, workspace_id, todo_id, COALESCE(owner_id, 0), payload, trace_context, attempts,
+			COALESCE(rule_id, 0), rule_depth
+		FROM outbox o
+		WHERE o.published_at IS NULL AND o.next_attempt_at <= NOW()
+		AND NOT EXISTS (
+			SELECT 1 FROM outbox p WHERE p.todo_id = o.todo_id AND p.published_at IS NULL AND p.id < o.id
+		)
+		ORDER BY o.id
+		LIMIT $1
+		FOR UPDATE SKIP LOCKED
+	`, outboxBatch)
+	if err != nil {
+		return 0, err
+	}
+	var events []outboxEvent
+	for rows.Next() {
+		var e outboxEvent
+		var payload, traceContext []byte
+		if err := rows.Scan(&e.id, &e.workspaceID, &e.todoID, &e.ownerID, &payload, &traceContext, &e.attempt,
+			&e.ruleID, &e.ruleDepth); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if err := json.Unmarshal(payload, &e.event); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if err := json.Unmarshal(traceContext, &e.traceContext); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		e.attempt++
+		events = append(events, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, e := range events {
+		if err := s.publishEvent(sinks, e); err != nil {
+			_, err = tx.ExecContext(ctx, `
+				UPDATE outbox SET attempts = $2, next_attempt_at = NOW() + make_interval(secs => $3), last_error = $4
+				WHERE id = $1
+			`, e.id, e.attempt, retryBackoff(s.cfg.OutboxRetryBase, e.attempt).Seconds(), err.Error())
+		} else {
+			_, err = tx.ExecContext(ctx, `
+				UPDATE outbox SET attempts = $2, published_at = NOW(), last_error = NULL WHERE id = $1
+			`, e.id, e.attempt)
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(events), tx.Commit()
+}
+
+// publishEvent sends an event to every sink, in a span that is a child of the
+// one that made the change.
+func (s *Server) publishEvent(sinks []eventSink, e outboxEvent) error {
+	parent := otel.GetTextMapPropagator().Extract(context.Background(), e.traceContext)
+	ctx, span := s.tracer.Start(parent, "publish_event", trace.WithSpanKind(trace.SpanKindProducer))
+	defer span.End()
+	span.SetAttributes(
+		attribute.Int64("outbox.id", e.id),
+		attribute.String("event.type", e.event.Type),
+		attribute.String("task.uuid", e.event.TodoID),
+		attribute.Int("outbox.attempt", e.attempt),
+	)
+	ctx, cancel := context.WithTimeout(ctx, outboxPublishTimeout)
+	defer cancel()
+
+	for _, sink := range sinks {
+		if err := sink.Publish(ctx, e); err != nil {
+			s.logger.WarnContext(ctx, "publishing event failed",
+				slog.String("sink", sink.Name()),
+				slog.Int64("outbox_id", e.id),
+				slog.Int("attempt", e.attempt),
+				slog.String("error", err.Error()),
+			)
+			span.SetStatus(codes.Error, err.Error())
+			return fmt.Errorf("%s: %w", sink.Name(), err)
+		}
+	}
+	return nil
+}
+
+// logSink writes events to the log, for development.
+type logSink struct {
+	logger *slog.Logger
+}
+
+func (logSink) Name() string { return "log" }
+
+func (l logSink) Publish(ctx context.Context, e outboxEvent) error {
+	l.logger.InfoContext(ctx, "todo event",
+		slog.Int64("event_id", e.event.ID),
+		slog.String("type", strings.Join(eventTypes(e.event), ",")),
+		slog.String("task_id", e.event.TodoID),
+		slog.Int("version", e.event.Version),
+		slog.Int("workspace_id", e.workspaceID),
+	)
+	return nil
+}
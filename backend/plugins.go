@@ -0,0 +1,601 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+	"github.com/thakurnishu/MinimalDo/model"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// Plugins are WebAssembly modules in PLUGINS_DIR, named after their file.
+// Each runs in its own wazero runtime, with its memory capped at
+// PLUGIN_MAX_MEMORY, and every request gets a fresh instance that is closed
+// after PLUGIN_TIMEOUT at the latest, so plugins share nothing and keep no
+// state between requests. They get WASI without files, environment or
+// sockets, and the host functions of the minimaldo module below.
+//
+// The ABI passes JSON through the plugin's memory. A plugin exports:
+//
+//	alloc(size u32) -> ptr u32          memory the host writes input to
+//	register()                          called once on load to add routes
+//	<handler>(ptr u32, len u32) -> u64  serves a route, see PluginRequest
+//
+// and can import from minimaldo:
+//
+//	route(method, path, handler)        register a route, only in register()
+//	log(msg)
+//	todos(filter) -> u64                the caller's todos, see PluginTodoFilter
+//	create_todo(todo) -> u64            create a todo as the caller
+//
+// Strings are (ptr u32, len u32) pairs. A u64 result is ptr<<32 | len of JSON
+// in the plugin's memory: a PluginResponse from handlers, a PluginResult from
+// the host. The todos a plugin reads and writes are those of the caller, in
+// one transaction that is committed when the response status is below 400.
+
+const (
+	pluginHostModule  = "minimaldo"
+	maxPluginRoutes   = 50
+	maxPluginBody     = 1 << 20
+	maxPluginTodos    = 500
+	defaultPluginList = 100
+	wasmPageSize      = 64 << 10
+)
+
+var (
+	pluginNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+	pluginMethods     = []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete}
+	// the response headers a plugin may set besides Content-Type and
+	// X-Plugin-*, the others, like Set-Cookie or CORS, are the API's
+	pluginHeaders = []string{"Cache-Control", "Etag", "Last-Modified", "Content-Language"}
+)
+
+type plugin struct {
+	name    string
+	runtime wazero.Runtime
+	module  wazero.CompiledModule
+	routes  []model.PluginRoute
+}
+
+// pluginCall is the state of one call into a plugin, which the host
+// functions find in its context.
+type pluginCall struct {
+	s      *Server
+	plugin *plugin
+	c      *gin.Context // nil while registering
+	tx     *sql.Tx      // begun by the first host function that needs it
+}
+
+type pluginCallKey struct{}
+
+// loadPlugins loads the *.wasm files of PLUGINS_DIR. A missing directory
+// means no plugins.
+func (s *Server) loadPlugins() (map[string]*plugin, error) {
+	plugins := map[string]*plugin{}
+	if s.cfg.PluginsDir == "" {
+		return plugins, nil
+	}
+	entries, err := os.ReadDir(s.cfg.PluginsDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return plugins, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), ".wasm")
+		if !ok || e.IsDir() {
+			continue
+		}
+		if !pluginNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("plugin %s: name must be lower case letters, digits, - and _", e.Name())
+		}
+		p, err := s.loadPlugin(name, filepath.Join(s.cfg.PluginsDir, e.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("plugin %s: %w", name, err)
+		}
+		plugins[name] = p
+		s.logger.Info("plugin loaded",
+			slog.String("plugin", name),
+			slog.Int("routes", len(p.routes)),
+		)
+	}
+	return plugins, nil
+}
+
+// loadPlugin compiles a plugin in its own runtime and registers its routes.
+func (s *Server) loadPlugin(name, path string) (*plugin, error) {
+	code, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pages := uint32(max(s.cfg.PluginMaxMemory/wasmPageSize, 1))
+	rt := wazero.NewRuntimeWithConfig(context.Background(), wazero.NewRuntimeConfig().
+		WithMemoryLimitPages(pages).
+		WithCloseOnContextDone(true))
+	p := &plugin{name: name, runtime: rt}
+	if err := p.setup(s, code); err != nil {
+		rt.Close(context.Background())
+		return nil, err
+	}
+	return p, nil
+}
+
+// setup adds the host modules to the runtime, compiles the plugin and calls
+// its register function, which gets PLUGIN_TIMEOUT like a request.
+func (p *plugin) setup(s *Server, code []byte) error {
+	ctx := context.Background()
+	if _, err := wasi_snapshot_preview1.Instantiate(ctx, p.runtime); err != nil {
+		return err
+	}
+	_, err := p.runtime.NewHostModuleBuilder(pluginHostModule).
+		NewFunctionBuilder().WithFunc(hostRoute).Export("route").
+		NewFunctionBuilder().WithFunc(hostLog).Export("log").
+		NewFunctionBuilder().WithFunc(hostTodos).Export("todos").
+		NewFunctionBuilder().WithFunc(hostCreateTodo).Export("create_todo").
+		Instantiate(ctx)
+	if err != nil {
+		return err
+	}
+	p.module, err = p.runtime.CompileModule(ctx, code)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithValue(ctx, pluginCallKey{}, &pluginCall{s: s, plugin: p}), s.cfg.PluginTimeout)
+	defer cancel()
+	mod, err := p.instantiate(ctx)
+	if err != nil {
+		return err
+	}
+	defer mod.Close(context.Background())
+	register := mod.ExportedFunction("register")
+	if register == nil {
+		return errors.New("no register function exported")
+	}
+	if _, err := register.Call(ctx); err != nil {
+		return fmt.Errorf("register: %w", err)
+	}
+	exports := p.module.ExportedFunctions()
+	for _, r := range p.routes {
+		if _, ok := exports[r.Handler]; !ok {
+			return fmt.Errorf("route %s %s: no function %q exported", r.Method, r.Path, r.Handler)
+		}
+	}
+	return nil
+}
+
+// instantiate starts a fresh instance of the plugin. ctx carries the
+// pluginCall of its host functions.
+func (p *plugin) instantiate(ctx context.Context) (api.Module, error) {
+	return p.runtime.InstantiateModule(ctx, p.module, wazero.NewModuleConfig().
+		WithName("").
+		WithStartFunctions("_initialize").
+		WithSysWalltime().
+		WithSysNanotime().
+		WithRandSource(rand.Reader))
+}
+
+// match finds the route of a request and its path parameters.
+func (p *plugin) match(method, path string) (model.PluginRoute, map[string]string, bool) {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	for _, r := range p.routes {
+		if r.Method != method {
+			continue
+		}
+		pattern := strings.Split(strings.Trim(r.Path, "/"), "/")
+		if len(pattern) != len(segments) {
+			continue
+		}
+		params := map[string]string{}
+		ok := true
+		for i, seg := range pattern {
+			if name, isParam := strings.CutPrefix(seg, ":"); isParam && segments[i] != "" {
+				params[name] = segments[i]
+			} else if seg != segments[i] {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return r, params, true
+		}
+	}
+	return model.PluginRoute{}, nil, false
+}
+
+func (s *Server) getPlugins(c *gin.Context) {
+	plugins := []model.Plugin{}
+	for _, p := range s.plugins {
+		plugins = append(plugins, model.Plugin{Name: p.name, Routes: p.routes})
+	}
+	sort.Slice(plugins, func(i, j int) bool { return plugins[i].Name < plugins[j].Name })
+	c.JSON(http.StatusOK, plugins)
+}
+
+// servePlugin serves /api/plugins/:name/*path with the plugin's handler for
+// the route, in a fresh instance.
+func (s *Server) servePlugin(c *gin.Context) {
+	ctx, span := s.tracer.Start(c.Request.Context(), "serve_plugin")
+	defer span.End()
+
+	name, path := c.Param("name"), c.Param("path")
+	span.SetAttributes(
+		attribute.String("plugin.name", name),
+		attribute.String("plugin.path", path),
+	)
+	p, ok := s.plugins[name]
+	if !ok {
+		logError("plugin not found", ctx, s.logger, span, errors.New("no plugin "+name))
+		c.JSON(http.StatusNotFound, gin.H{"error": "Plugin not found"})
+		return
+	}
+	route, params, ok := p.match(c.Request.Method, path)
+	if !ok {
+		logError("plugin route not found", ctx, s.logger, span, errors.New("no route "+c.Request.Method+" "+path),
+			slog.String("plugin", name),
+		)
+		c.JSON(http.StatusNotFound, gin.H{"error": "Route not found"})
+		return
+	}
+	span.SetAttributes(attribute.String("plugin.handler", route.Handler))
+
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxPluginBody+1))
+	if err != nil {
+		logError("failed to read body", ctx, s.logger, span, err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(body) > maxPluginBody {
+		logError("plugin request too large", ctx, s.logger, span, errors.New("body too large"))
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Request body is too large"})
+		return
+	}
+	req, err := json.Marshal(model.PluginRequest{
+		Method:      c.Request.Method,
+		Path:        path,
+		Params:      params,
+		Query:       c.Request.URL.Query(),
+		Body:        string(body),
+		UserID:      currentUserID(c),
+		WorkspaceID: currentWorkspaceID(c),
+	})
+	if err != nil {
+		logError("plugin request encoding failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	call := &pluginCall{s: s, plugin: p, c: c}
+	callCtx, cancel := context.WithTimeout(context.WithValue(ctx, pluginCallKey{}, call), s.cfg.PluginTimeout)
+	defer cancel()
+	defer func() {
+		if call.tx != nil {
+			call.tx.Rollback()
+		}
+	}()
+
+	out, err := p.handle(callCtx, route.Handler, req)
+	if err != nil {
+		status, msg := http.StatusBadGateway, "Plugin failed"
+		if callCtx.Err() != nil {
+			status, msg = http.StatusGatewayTimeout, "Plugin timed out"
+		}
+		logError("plugin failed", ctx, s.logger, span, err,
+			slog.String("plugin", name),
+			slog.String("handler", route.Handler),
+		)
+		c.JSON(status, gin.H{"error": msg})
+		return
+	}
+	var resp model.PluginResponse
+	if err := json.Unmarshal(out, &resp); err != nil {
+		logError("invalid plugin response", ctx, s.logger, span, err,
+			slog.String("plugin", name),
+		)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Plugin failed"})
+		return
+	}
+	if resp.Status == 0 {
+		resp.Status = http.StatusOK
+	}
+	if resp.Status < 100 || resp.Status > 599 {
+		logError("invalid plugin response", ctx, s.logger, span, fmt.Errorf("status %d", resp.Status),
+			slog.String("plugin", name),
+		)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Plugin failed"})
+		return
+	}
+	if call.tx != nil && resp.Status < 400 {
+		if err := call.tx.Commit(); err != nil {
+			logError("commit failed", ctx, s.logger, span, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	contentType := "text/plain; charset=utf-8"
+	for k, v := range resp.Headers {
+		k = http.CanonicalHeaderKey(k)
+		switch {
+		case k == "Content-Type":
+			contentType = v
+		case slices.Contains(pluginHeaders, k) || strings.HasPrefix(k, "X-Plugin-"):
+			c.Header(k, v)
+		}
+	}
+	s.logger.InfoContext(ctx, "plugin request served",
+		slog.String("plugin", name),
+		slog.String("handler", route.Handler),
+		slog.Int("status", resp.Status),
+	)
+	span.SetAttributes(attribute.Int("plugin.status", resp.Status))
+	c.Data(resp.Status, contentType, []byte(resp.Body))
+}
+
+// handle calls a handler of the plugin with a request and returns its
+// response.
+func (p *plugin) handle(ctx context.Context, handler string, req []byte) ([]byte, error) {
+	mod, err := p.instantiate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer mod.Close(context.Background())
+
+	ptr, err := writeGuest(ctx, mod, req)
+	if err != nil {
+		return nil, err
+	}
+	res, err := mod.ExportedFunction(handler).Call(ctx, uint64(ptr), uint64(len(req)))
+	if err != nil {
+		return nil, err
+	}
+	if len(res) != 1 {
+		return nil, fmt.Errorf("%s returned %d values, want 1", handler, len(res))
+	}
+	return readGuest(mod, uint32(res[0]>>32), uint32(res[0]))
+}
+
+// writeGuest copies data into memory the plugin allocates for it.
+func writeGuest(ctx context.Context, mod api.Module, data []byte) (uint32, error) {
+	alloc := mod.ExportedFunction("alloc")
+	if alloc == nil {
+		return 0, errors.New("no alloc function exported")
+	}
+	res, err := alloc.Call(ctx, uint64(len(data)))
+	if err != nil {
+		return 0, fmt.Errorf("alloc: %w", err)
+	}
+	ptr := uint32(res[0])
+	if !mod.Memory().Write(ptr, data) {
+		return 0, errors.New("alloc returned memory out of range")
+	}
+	return ptr, nil
+}
+
+// readGuest copies memory of the plugin.
+func readGuest(mod api.Module, ptr, size uint32) ([]byte, error) {
+	b, ok := mod.Memory().Read(ptr, size)
+	if !ok {
+		return nil, fmt.Errorf("memory %d+%d out of range", ptr, size)
+	}
+	return bytes.Clone(b), nil
+}
+
+// readString reads a string argument of a host function. Out of range
+// memory traps the plugin.
+func readString(mod api.Module, ptr, size uint32) string {
+	b, ok := mod.Memory().Read(ptr, size)
+	if !ok {
+		panic(fmt.Errorf("memory %d+%d out of range", ptr, size))
+	}
+	return string(b)
+}
+
+// hostResult returns data, or err, to the plugin as a PluginResult.
+func hostResult(ctx context.Context, mod api.Module, data any, err error) uint64 {
+	result := model.PluginResult{Data: data}
+	if err != nil {
+		result = model.PluginResult{Error: err.Error()}
+	}
+	out, err := json.Marshal(result)
+	if err != nil {
+		panic(err)
+	}
+	ptr, err := writeGuest(ctx, mod, out)
+	if err != nil {
+		panic(err)
+	}
+	return uint64(ptr)<<32 | uint64(len(out))
+}
+
+func callOf(ctx context.Context) *pluginCall {
+	return ctx.Value(pluginCallKey{}).(*pluginCall)
+}
+
+// begin returns the transaction of the call, as the caller.
+func (call *pluginCall) begin(ctx context.Context) (*sql.Tx, error) {
+	if call.c == nil {
+		return nil, errors.New("todos are only available while serving a request")
+	}
+	if call.tx == nil {
+		tx, err := call.s.beginTenantTx(ctx, call.c)
+		if err != nil {
+			return nil, err
+		}
+		call.tx = tx
+	}
+	return call.tx, nil
+}
+
+func hostRoute(ctx context.Context, mod api.Module, methodPtr, methodLen, pathPtr, pathLen, handlerPtr, handlerLen uint32) {
+	call := callOf(ctx)
+	if call.c != nil {
+		panic(errors.New("routes can only be registered in register"))
+	}
+	p := call.plugin
+	r := model.PluginRoute{
+		Method:  strings.ToUpper(readString(mod, methodPtr, methodLen)),
+		Path:    readString(mod, pathPtr, pathLen),
+		Handler: readString(mod, handlerPtr, handlerLen),
+	}
+	switch {
+	case len(p.routes) >= maxPluginRoutes:
+		panic(fmt.Errorf("more than %d routes", maxPluginRoutes))
+	case !slices.Contains(pluginMethods, r.Method):
+		panic(fmt.Errorf("route %s %s: unsupported method", r.Method, r.Path))
+	case !strings.HasPrefix(r.Path, "/"):
+		panic(fmt.Errorf("route %s %s: path must start with /", r.Method, r.Path))
+	}
+	p.routes = append(p.routes, r)
+}
+
+func hostLog(ctx context.Context, mod api.Module, ptr, size uint32) {
+	call := callOf(ctx)
+	msg := readString(mod, ptr, min(size, maxScriptLogLine))
+	call.s.logger.InfoContext(ctx, "plugin log",
+		slog.String("plugin", call.plugin.name),
+		slog.String("message", msg),
+	)
+}
+
+func hostTodos(ctx context.Context, mod api.Module, ptr, size uint32) uint64 {
+	var filter model.PluginTodoFilter
+	if size > 0 {
+		if err := json.Unmarshal([]byte(readString(mod, ptr, size)), &filter); err != nil {
+			return hostResult(ctx, mod, nil, err)
+		}
+	}
+	todos, err := pluginTodos(ctx, callOf(ctx), filter)
+	return hostResult(ctx, mod, todos, err)
+}
+
+func pluginTodos(ctx context.Context, call *pluginCall, filter model.PluginTodoFilter) ([]model.Todo, error) {
+	ctx, span := call.s.tracer.Start(ctx, "plugin_todos")
+	defer span.End()
+
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = defaultPluginList
+	}
+	limit = min(limit, maxPluginTodos)
+	tx, err := call.begin(ctx)
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+	rows, err := tx.QueryContext(ctx, `
+		SELECT todo_uuid(id), title, description, completed, list_id, priority, due_at, created_at, updated_at
+		FROM todos
+		WHERE `+visibleTodos+` AND ($2::int IS NULL OR list_id = $2) AND ($3::bool IS NULL OR completed = $3)
+		ORDER BY created_at DESC
+		LIMIT $4
+	`, currentUserID(call.c), filter.ListID, filter.Completed, limit)
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+	defer rows.Close()
+
+	todos := []model.Todo{}
+	for rows.Next() {
+		var t model.Todo
+		if err := rows.Scan(&t.ID, &t.Title, &t.Description, &t.Completed, &t.ListID, &t.Priority, &t.DueAt, &t.CreatedAt, &t.UpdatedAt); err != nil {
+			span.SetStatus(codes.Error, err.Error())
+			return nil, err
+		}
+		todos = append(todos, t)
+	}
+	span.SetAttributes(attribute.Int("todos.count", len(todos)))
+	return todos, rows.Err()
+}
+
+func hostCreateTodo(ctx context.Context, mod api.Module, ptr, size uint32) uint64 {
+	var t model.Todo
+	if err := json.Unmarshal([]byte(readString(mod, ptr, size)), &t); err != nil {
+		return hostResult(ctx, mod, nil, err)
+	}
+	created, err := pluginCreateTodo(ctx, callOf(ctx), t)
+	return hostResult(ctx, mod, created, err)
+}
+
+// pluginCreateTodo creates a todo as the caller, who needs the write scope and
+// edit access to the list, if there is one.
+func pluginCreateTodo(ctx context.Context, call *pluginCall, t model.Todo) (*model.Todo, error) {
+	ctx, span := call.s.tracer.Start(ctx, "plugin_create_todo")
+	defer span.End()
+
+	err := func() error {
+		if call.c == nil {
+			return errors.New("todos are only available while serving a request")
+		}
+		if !hasScope(call.c, model.ScopeTodosWrite) {
+			return errors.New("token is missing the " + model.ScopeTodosWrite + " scope")
+		}
+		if !validTitle(t.Title) {
+			return errors.New("title must be 1 to 255 characters")
+		}
+		return normalizeTodoFields(&t)
+	}()
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+	tx, err := call.begin(ctx)
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+	userID := currentUserID(call.c)
+	if t.ListID != nil {
+		have, err := listRole(ctx, tx, *t.ListID, userID)
+		if err != nil && err != sql.ErrNoRows {
+			span.SetStatus(codes.Error, err.Error())
+			return nil, err
+		}
+		if have < roleEditor {
+			return nil, errors.New("list not found or not editable")
+		}
+	}
+
+	snapshot := model.TodoSnapshot{
+		Title:       t.Title,
+		Description: t.Description,
+		ListID:      t.ListID,
+		Priority:    t.Priority,
+		DueAt:       t.DueAt,
+	}
+	ch := todoChange{workspaceID: currentWorkspaceID(call.c), ownerID: userID}
+	id, err := insertTodo(ctx, tx, ch, &snapshot)
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+	span.SetAttributes(attribute.String("task.uuid", id))
+	t.ID = id
+	t.Completed = false
+	t.CreatedAt = time.Now().UTC()
+	t.UpdatedAt = t.CreatedAt
+	return &t, nil
+}
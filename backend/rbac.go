@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/thakurnishu/MinimalDo/model"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// role is a user's role on a list. Roles are ordered, each one can do
+// everything the roles below it can.
+type role int
+
+const (
+	roleNone role = iota
+	roleViewer
+	roleEditor
+	roleOwner
+)
+
+var errForbidden = errors.New("forbidden")
+
+func parseRole(s string) (role, bool) {
+	switch s {
+	case model.RoleViewer:
+		return roleViewer, true
+	case model.RoleEditor:
+		return roleEditor, true
+	case model.RoleOwner:
+		return roleOwner, true
+	}
+	return roleNone, false
+}
+
+func (r role) String() string {
+	switch r {
+	case roleViewer:
+		return model.RoleViewer
+	case roleEditor:
+		return model.RoleEditor
+	case roleOwner:
+		return model.RoleOwner
+	}
+	return "none"
+}
+
+// listRole returns userID's role on a list, roleNone if they are not a
+// member, and sql.ErrNoRows if the list does not exist.
+func listRole(ctx context.Context, db dbtx, listID, userID int) (role, error) {
+	var name sql.NullString
+	err := db.QueryRowContext(ctx, `
+		SELECT m.role
+		FROM lists l
+		LEFT JOIN list_members m ON m.list_id = l.id AND m.user_id = $2
+		WHERE l.id = $1
+	`, listID, userID).Scan(&name)
+	if err != nil {
+		return roleNone, err
+	}
+	r, _ := parseRole(name.String)
+	return r, nil
+}
+
+// todoRole returns userID's role on a todo and the list it belongs to. A
+// personal todo is owned by its creator and invisible to everyone else.
+// sql.ErrNoRows means the todo does not exist.
+func todoRole(ctx context.Context, db dbtx, todoID, userID int) (*int, role, error) {
+	var listID *int
+	var ownerID sql.NullInt64
+	var name sql.NullString
+	err := db.QueryRowContext(ctx, `
+		SELECT t.list_id, t.owner_id, m.role
+		FROM todos t
+		LEFT JOIN list_members m ON m.list_id = t.list_id AND m.user_id = $2
+		WHERE t.id = $1
+	`, todoID, userID).Scan(&listID, &ownerID, &name)
+	if err != nil {
+		return nil, roleNone, err
+	}
+	if listID == nil {
+		if ownerID.Valid && int(ownerID.Int64) == userID {
+			return nil, roleOwner, nil
+		}
+		return nil, roleNone, nil
+	}
+	r, _ := parseRole(name.String)
+	return listID, r, nil
+}
+
+// apiError is a request the caller got wrong, answered with status and msg.
+// Whoever returns one has already logged it.
+type apiError struct {
+	status int
+	msg    string
+}
+
+func (e *apiError) Error() string { return e.msg }
+
+// writeError answers a request with err, a 500 unless it is an apiError.
+func writeError(c *gin.Context, err error) {
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		c.JSON(apiErr.status, gin.H{"error": apiErr.msg})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+}
+
+// checkRole returns a 403 apiError unless have is at least need. The denial
+// is logged and recorded on the span with the user and the resource.
+func (s *Server) checkRole(c *gin.Context, ctx context.Context, span trace.Span, resource string, resourceID int, have, need role) error {
+	if have >= need {
+		return nil
+	}
+
+	userID := currentUserID(c)
+	span.SetAttributes(
+		attribute.Int("user.id", userID),
+		attribute.String("authz.resource.type", resource),
+		attribute.Int("authz.resource.id", resourceID),
+		attribute.String("authz.role", have.String()),
+		attribute.String("authz.required_role", need.String()),
+	)
+	logError("access denied", ctx, s.logger, span, errForbidden,
+		slog.Int("user_id", userID),
+		slog.String("resource_type", resource),
+		slog.Int("resource_id", resourceID),
+		slog.String("role", have.String()),
+		slog.String("required_role", need.String()),
+	)
+	return &apiError{http.StatusForbidden, "You need the " + need.String() + " role on this " + resource}
+}
+
+// authorize answers 403 unless have is at least need, see checkRole.
+func (s *Server) authorize(c *gin.Context, ctx context.Context, span trace.Span, resource string, resourceID int, have, need role) bool {
+	if err := s.checkRole(c, ctx, span, resource, resourceID, have, need); err != nil {
+		writeError(c, err)
+		return false
+	}
+	return true
+}
+
+// checkList loads the caller's role on the list and checks it against need.
+func (s *Server) checkList(c *gin.Context, ctx context.Context, span trace.Span, db dbtx, listID int, need role) error {
+	userID := currentUserID(c)
+	span.SetAttributes(
+		attribute.Int("user.id", userID),
+		attribute.Int("list.id", listID),
+	)
+
+	have, err := listRole(ctx, db, listID, userID)
+	if err == sql.ErrNoRows {
+		logError("list not found", ctx, s.logger, span, err,
+			slog.Int("list_id", listID),
+		)
+		return &apiError{http.StatusNotFound, "List not found"}
+	}
+	if err != nil {
+		logError("role lookup failed", ctx, s.logger, span, err)
+		return err
+	}
+	return s.checkRole(c, ctx, span, "list", listID, have, need)
+}
+
+// checkTodo is checkList for a single todo.
+func (s *Server) checkTodo(c *gin.Context, ctx context.Context, span trace.Span, db dbtx, todoID int, need role) error {
+	userID := currentUserID(c)
+	listID, have, err := todoRole(ctx, db, todoID, userID)
+	if err == sql.ErrNoRows {
+		logError("task not found", ctx, s.logger, span, err,
+			slog.Int("task_id", todoID),
+		)
+		return &apiError{http.StatusNotFound, "Task not found"}
+	}
+	if err != nil {
+		logError("role lookup failed", ctx, s.logger, span, err)
+		return err
+	}
+	if listID != nil {
+		span.SetAttributes(attribute.Int("list.id", *listID))
+	}
+	return s.checkRole(c, ctx, span, "task", todoID, have, need)
+}
+
+// authorizeList is checkList, writing the response when the request can't
+// go on.
+func (s *Server) authorizeList(c *gin.Context, ctx context.Context, span trace.Span, db dbtx, listID int, need role) bool {
+	if err := s.checkList(c, ctx, span, db, listID, need); err != nil {
+		writeError(c, err)
+		return false
+	}
+	return true
+}
+
+// authorizeTodo is authorizeList for a single todo.
+func (s *Server) authorizeTodo(c *gin.Context, ctx context.Context, span trace.Span, db dbtx, todoID int, need role) bool {
+	if err := s.checkTodo(c, ctx, span, db, todoID, need); err != nil {
+		writeError(c, err)
+		return false
+	}
+	return true
+}
+
+// listFilter reads the optional list_id query parameter of the todo list
+// endpoints. ok is false when the response has already been written.
+func (s *Server) listFilter(c *gin.Context, ctx context.Context, span trace.Span, db dbtx) (listID *int, ok bool) {
+	idStr := c.Query("list_id")
+	if idStr == "" {
+		return nil, true
+	}
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		logError("invalid list id", ctx, s.logger, span, err,
+			slog.String("list_id", idStr),
+		)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid list ID"})
+		return nil, false
+	}
+	if !s.authorizeList(c, ctx, span, db, id, roleViewer) {
+		return nil, false
+	}
+	return &id, true
+}
+
+// visibleTodos matches the todos user $1 may read: their personal todos and
+// the todos of every list they are a member of.
+const visibleTodos = `((list_id IS NULL AND owner_id = $1) OR list_id IN (SELECT list_id FROM list_members WHERE user_id = $1))`
@@ -0,0 +1,1202 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"github.com/thakurnishu/MinimalDo/model"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Rules are evaluated by the rules sink of the outbox, after the change
+// committed, and for due soon todos by runDueSoon. They only queue a run,
+// runRules runs the actions, so slow actions don't hold up the outbox. A
+// rule acts as its
+// creator, on the todos they can see. The changes its actions make are todo
+// changes like any other and can fire rules in turn. Loop protection: a rule
+// doesn't act on a change it made itself, and after RULES_MAX_DEPTH rules in
+// a row the next one is skipped.
+
+const (
+	maxRuleConditions = 20
+	maxRuleActions    = 10
+	maxTitleLength    = 255
+	dueSoonBatch      = 100
+	ruleRunBatch      = 50 // queued runs claimed per poll
+
+	defaultRunLimit = 50
+	maxRunLimit     = 200
+)
+
+var ruleTriggers = []string{
+	model.TriggerCreated,
+	model.TriggerUpdated,
+	model.TriggerCompleted,
+	model.TriggerDueSoon,
+}
+
+var (
+	stringOps = []string{
+		model.OpEquals, model.OpNotEquals, model.OpContains, model.OpStartsWith, model.OpEndsWith,
+		model.OpSet, model.OpUnset,
+	}
+	// the operators each field can be compared with
+	ruleConditionOps = map[string][]string{
+		"title":       stringOps,
+		"description": stringOps,
+		"priority":    {model.OpEquals, model.OpNotEquals, model.OpSet, model.OpUnset},
+		"completed":   {model.OpEquals, model.OpNotEquals},
+		"list_id":     {model.OpEquals, model.OpNotEquals, model.OpSet, model.OpUnset},
+		"due_at":      {model.OpSet, model.OpUnset},
+	}
+	ruleSetFields = []string{"title", "description", "completed", "priority", "due_at"}
+)
+
+// storedRule is a rule with its creator, who its actions run as.
+type storedRule struct {
+	model.Rule
+	userID int
+}
+
+// ruleInput is what fired a rule. dedupeKey names it, a rule runs once for
+// each key.
+type ruleInput struct {
+	workspaceID int
+	todoID      int
+	todoUUID    string
+	ownerID     int
+	todo        model.TodoSnapshot
+	trigger     string
+	dedupeKey   string
+	depth       int
+	causedBy    int // the rule that made the change, 0 for a user
+}
+
+func (s *Server) getRules(c *gin.Context) {
+	ctx, span := s.tracer.Start(c.Request.Context(), "get_rules")
+	defer span.End()
+
+	userID := currentUserID(c)
+	span.SetAttributes(attribute.Int("user.id", userID))
+
+	tx, err := s.beginTenantTx(ctx, c)
+	if err != nil {
+		logError("begin transaction failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT `+ruleColumns+` FROM rules WHERE user_id = $1 ORDER BY id
+	`, userID)
+	if err != nil {
+		logError("query execution failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	rules := []model.Rule{}
+	for rows.Next() {
+		r, err := scanRule(rows)
+		if err != nil {
+			logError("row scan failed", ctx, s.logger, span, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		rules = append(rules, r.Rule)
+	}
+	if err := rows.Err(); err != nil {
+		logError("row iteration failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, rules)
+}
+
+func (s *Server) createRule(c *gin.Context) {
+	ctx, span := s.tracer.Start(c.Request.Context(), "create_rule")
+	defer span.End()
+
+	req, conditions, actions, ok := s.bindRuleRequest(c, ctx, span)
+	if !ok {
+		return
+	}
+	enabled := req.Enabled == nil || *req.Enabled
+
+	userID := currentUserID(c)
+	workspaceID := currentWorkspaceID(c)
+	span.SetAttributes(attribute.Int("user.id", userID))
+
+	tx, err := s.beginTenantTx(ctx, c)
+	if err != nil {
+		logError("begin transaction failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	r, err := scanRule(tx.QueryRowContext(ctx, `
+		INSERT INTO rules (workspace_id, user_id, name, trigger, conditions, actions, enabled)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING `+ruleColumns+`
+	`, workspaceID, userID, req.Name, req.Trigger, conditions, actions, enabled))
+	if err != nil {
+		logError("row scan failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		logError("commit failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	s.logger.InfoContext(ctx, "rule created",
+		slog.Int("user_id", userID),
+		slog.Int("workspace_id", workspaceID),
+		slog.Int("rule_id", r.ID),
+		slog.String("trigger", r.Trigger),
+	)
+	span.SetAttributes(attribute.Int("rule.id", r.ID))
+
+	c.JSON(http.StatusCreated, r.Rule)
+}
+
+func (s *Server) getRule(c *gin.Context) {
+	ctx, span := s.tracer.Start(c.Request.Context(), "get_rule")
+	defer span.End()
+
+	id, ok := s.ruleParam(c, ctx, span)
+	if !ok {
+		return
+	}
+
+	tx, err := s.beginTenantTx(ctx, c)
+	if err != nil {
+		logError("begin transaction failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	r, ok := s.findRule(c, ctx, span, tx, id)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, r.Rule)
+}
+
+// updateRule replaces a rule. Enabled is left as it is when the request
+// doesn't have it.
+func (s *Server) updateRule(c *gin.Context) {
+	ctx, span := s.tracer.Start(c.Request.Context(), "update_rule")
+	defer span.End()
+
+	id, ok := s.ruleParam(c, ctx, span)
+	if !ok {
+		return
+	}
+	req, conditions, actions, ok := s.bindRuleRequest(c, ctx, span)
+	if !ok {
+		return
+	}
+	userID := currentUserID(c)
+
+	tx, err := s.beginTenantTx(ctx, c)
+	if err != nil {
+		logError("begin transaction failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	r, err := scanRule(tx.QueryRowContext(ctx, `
+		UPDATE rules SET name = $3, trigger = $4, conditions = $5, actions = $6, enabled = COALESCE($7, enabled)
+		WHERE id = $1 AND user_id = $2
+		RETURNING `+ruleColumns+`
+	`, id, userID, req.Name, req.Trigger, conditions, actions, req.Enabled))
+	if err == sql.ErrNoRows {
+		logError("rule not found", ctx, s.logger, span, err,
+			slog.Int("rule_id", id),
+		)
+		c.JSON(http.StatusNotFound, gin.H{"error": "Rule not found"})
+		return
+	}
+	if err != nil {
+		logError("row scan failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		logError("commit failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	s.logger.InfoContext(ctx, "rule updated",
+		slog.Int("user_id", userID),
+		slog.Int("rule_id", id),
+		slog.Bool("enabled", r.Enabled),
+	)
+	c.JSON(http.StatusOK, r.Rule)
+}
+
+func (s *Server) deleteRule(c *gin.Context) {
+	ctx, span := s.tracer.Start(c.Request.Context(), "delete_rule")
+	defer span.End()
+
+	id, ok := s.ruleParam(c, ctx, span)
+	if !ok {
+		return
+	}
+	userID := currentUserID(c)
+
+	tx, err := s.beginTenantTx(ctx, c)
+	if err != nil {
+		logError("begin transaction failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, "DELETE FROM rules WHERE id = $1 AND user_id = $2", id, userID)
+	if err != nil {
+		logError("query execution failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		logError("affected rows check failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if rowsAffected == 0 {
+		logError("rule not found", ctx, s.logger, span, sql.ErrNoRows,
+			slog.Int("rule_id", id),
+		)
+		c.JSON(http.StatusNotFound, gin.H{"error": "Rule not found"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		logError("commit failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	s.logger.InfoContext(ctx, "rule deleted",
+		slog.Int("user_id", userID),
+		slog.Int("rule_id", id),
+	)
+	c.Status(http.StatusNoContent)
+}
+
+// getRuleRuns returns the execution log of a rule, newest first.
+func (s *Server) getRuleRuns(c *gin.Context) {
+	ctx, span := s.tracer.Start(c.Request.Context(), "get_rule_runs")
+	defer span.End()
+
+	id, ok := s.ruleParam(c, ctx, span)
+	if !ok {
+		return
+	}
+	limit := defaultRunLimit
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxRunLimit {
+			if err == nil {
+				err = errors.New("limit out of range")
+			}
+			logError("invalid limit", ctx, s.logger, span, err,
+				slog.String("limit", v),
+			)
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and " + strconv.Itoa(maxRunLimit)})
+			return
+		}
+		limit = n
+	}
+
+	tx, err := s.beginTenantTx(ctx, c)
+	if err != nil {
+		logError("begin transaction failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	if _, ok := s.findRule(c, ctx, span, tx, id); !ok {
+		return
+	}
+	rows, err := tx.QueryContext(ctx, `
+		SELECT id, todo_uuid(todo_id), trigger, status, actions, COALESCE(error, ''), depth, created_at
+		FROM rule_runs
+		WHERE rule_id = $1
+		ORDER BY id DESC
+		LIMIT $2
+	`, id, limit)
+	if err != nil {
+		logError("query execution failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	runs := []model.RuleRun{}
+	for rows.Next() {
+		var r model.RuleRun
+		if err := rows.Scan(&r.ID, &r.TodoID, &r.Trigger, &r.Status, &r.Actions, &r.Error, &r.Depth, &r.CreatedAt); err != nil {
+			logError("row scan failed", ctx, s.logger, span, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		runs = append(runs, r)
+	}
+	if err := rows.Err(); err != nil {
+		logError("row iteration failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, runs)
+}
+
+const ruleColumns = `id, user_id, name, trigger, conditions, actions, enabled, created_at, updated_at`
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+// scanRule reads the ruleColumns of a row.
+func scanRule(row scanner) (storedRule, error) {
+	var r storedRule
+	var conditions, actions []byte
+	err := row.Scan(&r.ID, &r.userID, &r.Name, &r.Trigger, &conditions, &actions, &r.Enabled, &r.CreatedAt, &r.UpdatedAt)
+	if err != nil {
+		return r, err
+	}
+	if err := json.Unmarshal(conditions, &r.Conditions); err != nil {
+		return r, err
+	}
+	return r, json.Unmarshal(actions, &r.Actions)
+}
+
+// ruleParam parses the :id path parameter, writing the error response when
+// it can't.
+func (s *Server) ruleParam(c *gin.Context, ctx context.Context, span trace.Span) (int, bool) {
+	idStr := c.Param("id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		logError("invalid id", ctx, s.logger, span, err,
+			slog.String("rule_id", idStr),
+		)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invaild ID"})
+		return 0, false
+	}
+	span.SetAttributes(attribute.Int("rule.id", id))
+	return id, true
+}
+
+// findRule reads a rule of the caller, writing the error response when there
+// is none.
+func (s *Server) findRule(c *gin.Context, ctx context.Context, span trace.Span, tx *sql.Tx, id int) (storedRule, bool) {
+	r, err := scanRule(tx.QueryRowContext(ctx, `
+		SELECT `+ruleColumns+` FROM rules WHERE id = $1 AND user_id = $2
+	`, id, currentUserID(c)))
+	if err == sql.ErrNoRows {
+		logError("rule not found", ctx, s.logger, span, err,
+			slog.Int("rule_id", id),
+		)
+		c.JSON(http.StatusNotFound, gin.H{"error": "Rule not found"})
+		return r, false
+	}
+	if err != nil {
+		logError("rule lookup failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return r, false
+	}
+	return r, true
+}
+
+// bindRuleRequest reads and checks a rule, and returns its conditions and
+// actions as JSON for the database.
+func (s *Server) bindRuleRequest(c *gin.Context, ctx context.Context, span trace.Span) (model.RuleRequest, []byte, []byte, bool) {
+	var req model.RuleRequest
+	if err := c.BindJSON(&req); err != nil {
+		logError("failed to parse json", ctx, s.logger, span, err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return req, nil, nil, false
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Conditions == nil {
+		req.Conditions = []model.RuleCondition{}
+	}
+
+	err := validateRule(req)
+	if err != nil {
+		logError("invalid rule", ctx, s.logger, span, err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return req, nil, nil, false
+	}
+	conditions, err := json.Marshal(req.Conditions)
+	if err != nil {
+		logError("rule encoding failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return req, nil, nil, false
+	}
+	actions, err := json.Marshal(req.Actions)
+	if err != nil {
+		logError("rule encoding failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return req, nil, nil, false
+	}
+	return req, conditions, actions, true
+}
+
+func validateRule(req model.RuleRequest) error {
+	if req.Name == "" || len(req.Name) > 100 {
+		return errors.New("name must be 1 to 100 characters")
+	}
+	if !slices.Contains(ruleTriggers, req.Trigger) {
+		return fmt.Errorf("unknown trigger %q", req.Trigger)
+	}
+	if len(req.Conditions) > maxRuleConditions {
+		return fmt.Errorf("at most %d conditions are allowed", maxRuleConditions)
+	}
+	if len(req.Actions) == 0 || len(req.Actions) > maxRuleActions {
+		return fmt.Errorf("a rule needs 1 to %d actions", maxRuleActions)
+	}
+	for _, cond := range req.Conditions {
+		if err := validateCondition(cond); err != nil {
+			return err
+		}
+	}
+	for _, a := range req.Actions {
+		if err := validateAction(a); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateCondition(cond model.RuleCondition) error {
+	ops, ok := ruleConditionOps[cond.Field]
+	if !ok {
+		return fmt.Errorf("unknown condition field %q", cond.Field)
+	}
+	if !slices.Contains(ops, cond.Op) {
+		return fmt.Errorf("%s can't be compared with %q", cond.Field, cond.Op)
+	}
+	if cond.Op == model.OpSet || cond.Op == model.OpUnset {
+		if cond.Value != nil {
+			return fmt.Errorf("%s takes no value", cond.Op)
+		}
+		return nil
+	}
+	var typeOK bool
+	switch cond.Field {
+	case "completed":
+		_, typeOK = cond.Value.(bool)
+	case "list_id":
+		_, typeOK = cond.Value.(float64)
+	default:
+		_, typeOK = cond.Value.(string)
+	}
+	if !typeOK {
+		return fmt.Errorf("wrong type of value for %s", cond.Field)
+	}
+	return nil
+}
+
+func validateAction(a model.RuleAction) error {
+	switch a.Type {
+	case model.ActionSetField:
+		if !slices.Contains(ruleSetFields, a.Field) {
+			return fmt.Errorf("set_field can't set %q", a.Field)
+		}
+		var t model.TodoSnapshot
+		return setRuleField(&t, a.Field, a.Value, time.Now())
+	case model.ActionCreateTodo:
+		spec := a.Todo
+		if spec == nil || strings.TrimSpace(spec.Title) == "" {
+			return errors.New("create_todo needs a todo with a title")
+		}
+		if !slices.Contains(model.Priorities, spec.Priority) {
+			return fmt.Errorf("unknown priority %q", spec.Priority)
+		}
+		if spec.DueIn != "" {
+			if _, err := time.ParseDuration(spec.DueIn); err != nil {
+				return fmt.Errorf("due_in: %w", err)
+			}
+		}
+		return nil
+	case model.ActionHTTP:
+		return validateHTTPURL(a.URL)
+	case model.ActionScript:
+		return compileScript(a.Script)
+	}
+	return fmt.Errorf("unknown action type %q", a.Type)
+}
+
+// setRuleField sets a field of t to a value of a set_field action. due_at is
+// a time, a duration from now, e.g. "24h", or null.
+func setRuleField(t *model.TodoSnapshot, field string, value any, now time.Time) error {
+	wrongType := fmt.Errorf("wrong type of value for %s", field)
+	switch field {
+	case "title":
+		v, ok := value.(string)
+		if !ok || !validTitle(v) {
+			return errors.New("title must be 1 to 255 characters")
+		}
+		t.Title = v
+	case "description":
+		v, ok := value.(string)
+		if !ok {
+			return wrongType
+		}
+		t.Description = v
+	case "completed":
+		v, ok := value.(bool)
+		if !ok {
+			return wrongType
+		}
+		t.Completed = v
+	case "priority":
+		v, ok := value.(string)
+		if !ok || !slices.Contains(model.Priorities, v) {
+			return fmt.Errorf("unknown priority %v", value)
+		}
+		t.Priority = v
+	case "due_at":
+		if value == nil {
+			t.DueAt = nil
+			return nil
+		}
+		v, ok := value.(string)
+		if !ok {
+			return wrongType
+		}
+		due, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			d, derr := time.ParseDuration(v)
+			if derr != nil {
+				return errors.New("due_at must be a time, a duration or null")
+			}
+			due = now.Add(d)
+		}
+		due = due.UTC().Truncate(time.Second)
+		t.DueAt = &due
+	default:
+		return fmt.Errorf("set_field can't set %q", field)
+	}
+	return nil
+}
+
+// validTitle tells whether a title fits the todos table: 1 to 255
+// characters, not only spaces.
+func validTitle(title string) bool {
+	return strings.TrimSpace(title) != "" && utf8.RuneCountInString(title) <= maxTitleLength
+}
+
+// matchCondition tells whether a todo meets a condition.
+func matchCondition(cond model.RuleCondition, t model.TodoSnapshot) bool {
+	var v any
+	switch cond.Field {
+	case "title":
+		v = t.Title
+	case "description":
+		v = t.Description
+	case "priority":
+		v = t.Priority
+	case "completed":
+		v = t.Completed
+	case "list_id":
+		if t.ListID != nil {
+			v = float64(*t.ListID)
+		}
+	case "due_at":
+		if t.DueAt != nil {
+			v = t.DueAt.Format(time.RFC3339)
+		}
+	}
+
+	switch cond.Op {
+	case model.OpSet:
+		return v != nil && v != ""
+	case model.OpUnset:
+		return v == nil || v == ""
+	case model.OpEquals, model.OpNotEquals:
+		equal := v == cond.Value
+		if s, ok := v.(string); ok {
+			want, _ := cond.Value.(string)
+			equal = strings.EqualFold(s, want)
+		}
+		return equal == (cond.Op == model.OpEquals)
+	}
+	s, _ := v.(string)
+	want, _ := cond.Value.(string)
+	s, want = strings.ToLower(s), strings.ToLower(want)
+	switch cond.Op {
+	case model.OpContains:
+		return strings.Contains(s, want)
+	case model.OpStartsWith:
+		return strings.HasPrefix(s, want)
+	case model.OpEndsWith:
+		return strings.HasSuffix(s, want)
+	}
+	return false
+}
+
+// rulesSink queues the rules a todo event fires.
+type rulesSink struct {
+	s *Server
+}
+
+func (rulesSink) Name() string { return "rules" }
+
+func (r rulesSink) Publish(ctx context.Context, e outboxEvent) error {
+	var triggers []string
+	for _, t := range eventTypes(e.event) {
+		if slices.Contains(ruleTriggers, t) {
+			triggers = append(triggers, t)
+		}
+	}
+	if len(triggers) == 0 {
+		return nil
+	}
+
+	rows, err := r.s.db.QueryContext(ctx, `
+		SELECT `+ruleColumns+`
+		FROM rules
+		WHERE workspace_id = $1 AND enabled AND trigger = ANY($2)
+		AND EXISTS (
+			SELECT 1 FROM workspace_members m WHERE m.workspace_id = rules.workspace_id AND m.user_id = rules.user_id
+		)
+		AND (
+			($3::INTEGER IS NULL AND user_id = $4)
+			OR EXISTS (SELECT 1 FROM list_members lm WHERE lm.list_id = $3 AND lm.user_id = rules.user_id)
+		)
+		ORDER BY id
+	`, e.workspaceID, pq.Array(triggers), e.event.Todo.ListID, e.ownerID)
+	if err != nil {
+		return err
+	}
+	var rules []storedRule
+	for rows.Next() {
+		rule, err := scanRule(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		rules = append(rules, rule)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, rule := range rules {
+		in := ruleInput{
+			workspaceID: e.workspaceID,
+			todoID:      e.todoID,
+			todoUUID:    e.event.TodoID,
+			ownerID:     e.ownerID,
+			todo:        e.event.Todo,
+			trigger:     rule.Trigger,
+			dedupeKey:   "event:" + strconv.FormatInt(e.event.ID, 10),
+			depth:       e.ruleDepth,
+			causedBy:    e.ruleID,
+		}
+		if err := r.s.queueRule(ctx, rule, in); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runDueSoon fires the todo.due_soon rules, forever. A todo is due soon once
+// for each due date it gets, when it is within RULES_DUE_SOON_WINDOW of it
+// and not completed.
+func (s *Server) runDueSoon() {
+	ticker := time.NewTicker(s.cfg.RulesDueSoonInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := s.fireDueSoon(); err != nil {
+			s.logger.Error("running due soon rules failed", slog.String("error", err.Error()))
+		}
+	}
+}
+
+func (s *Server) fireDueSoon() error {
+	ctx, span := s.tracer.Start(context.Background(), "fire_due_soon_rules")
+	defer span.End()
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT r.id, r.user_id, r.name, r.trigger, r.conditions, r.actions, r.enabled, r.created_at, r.updated_at,
+			t.id, todo_uuid(t.id), t.workspace_id, COALESCE(t.owner_id, 0),
+			t.title, COALESCE(t.description, ''), t.completed, t.list_id, t.priority, t.due_at,
+			'due:' || t.id || ':' || EXTRACT(EPOCH FROM t.due_at)::BIGINT
+		FROM rules r
+		JOIN todos t ON t.workspace_id = r.workspace_id
+		WHERE r.enabled AND r.trigger = $1
+		AND NOT t.completed AND t.due_at > NOW() AND t.due_at <= NOW() + make_interval(secs => $2)
+		AND EXISTS (
+			SELECT 1 FROM workspace_members m WHERE m.workspace_id = r.workspace_id AND m.user_id = r.user_id
+		)
+		AND (
+			(t.list_id IS NULL AND t.owner_id = r.user_id)
+			OR EXISTS (SELECT 1 FROM list_members lm WHERE lm.list_id = t.list_id AND lm.user_id = r.user_id)
+		)
+		AND NOT EXISTS (
+			SELECT 1 FROM rule_runs rr
+			WHERE rr.rule_id = r.id AND rr.dedupe_key = 'due:' || t.id || ':' || EXTRACT(EPOCH FROM t.due_at)::BIGINT
+		)
+		ORDER BY t.due_at
+		LIMIT $3
+	`, model.TriggerDueSoon, s.cfg.RulesDueSoonWindow.Seconds(), dueSoonBatch)
+	if err != nil {
+		return err
+	}
+	type due struct {
+		rule storedRule
+		in   ruleInput
+	}
+	var fired []due
+	for rows.Next() {
+		var d due
+		var conditions, actions []byte
+		r, in := &d.rule, &d.in
+		err := rows.Scan(&r.ID, &r.userID, &r.Name, &r.Trigger, &conditions, &actions, &r.Enabled, &r.CreatedAt, &r.UpdatedAt,
+			&in.todoID, &in.todoUUID, &in.workspaceID, &in.ownerID,
+			&in.todo.Title, &in.todo.Description, &in.todo.Completed, &in.todo.ListID, &in.todo.Priority, &in.todo.DueAt,
+			&in.dedupeKey)
+		if err == nil {
+			err = json.Unmarshal(conditions, &r.Conditions)
+		}
+		if err == nil {
+			err = json.Unmarshal(actions, &r.Actions)
+		}
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		in.trigger = model.TriggerDueSoon
+		fired = append(fired, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	span.SetAttributes(attribute.Int("rule.fired", len(fired)))
+
+	for _, d := range fired {
+		if err := s.queueRule(ctx, d.rule, d.in); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// queueRule queues a run of a rule if the todo meets its conditions, or
+// logs it as skipped by the loop protection.
+func (s *Server) queueRule(ctx context.Context, r storedRule, in ruleInput) error {
+	for _, cond := range r.Conditions {
+		if !matchCondition(cond, in.todo) {
+			return nil
+		}
+	}
+
+	status, reason := model.RunPending, ""
+	switch {
+	case in.causedBy == r.ID:
+		status, reason = model.RunSkipped, "the change was made by this rule"
+	case int64(in.depth) >= s.cfg.RulesMaxDepth:
+		status, reason = model.RunSkipped, "too many rules in a row"
+	}
+	todo, err := json.Marshal(in.todo)
+	if err != nil {
+		return err
+	}
+	var runID int64
+	err = s.db.QueryRowContext(ctx, `
+		INSERT INTO rule_runs (rule_id, workspace_id, todo_id, trigger, dedupe_key, status, error, depth,
+			todo_uuid, owner_id, todo, caused_by)
+		VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''), $8, $9, $10, $11, $12)
+		ON CONFLICT (rule_id, dedupe_key) DO NOTHING
+		RETURNING id
+	`, r.ID, in.workspaceID, in.todoID, in.trigger, in.dedupeKey, status, reason, in.depth,
+		in.todoUUID, in.ownerID, todo, in.causedBy).Scan(&runID)
+	if err == sql.ErrNoRows {
+		// it was queued already
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if status == model.RunSkipped {
+		s.logger.WarnContext(ctx, "rule skipped",
+			slog.Int("rule_id", r.ID),
+			slog.Int64("rule_run_id", runID),
+			slog.String("task_id", in.todoUUID),
+			slog.String("trigger", in.trigger),
+			slog.Int("depth", in.depth),
+			slog.String("reason", reason),
+		)
+	}
+	return nil
+}
+
+// queuedRun is a claimed run with its rule as it is now.
+type queuedRun struct {
+	id   int64
+	rule storedRule
+	in   ruleInput
+}
+
+// runRules runs the queued rules, forever. The runs of one todo run one
+// after the other, in the order they were queued, so each sees the changes
+// of the ones before.
+func (s *Server) runRules() {
+	client := newWebhookClient(s.cfg)
+	ticker := time.NewTicker(s.cfg.RulesPollInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		runs, err := s.claimRuleRuns()
+		if err != nil {
+			s.logger.Error("claiming rule runs failed", slog.String("error", err.Error()))
+			continue
+		}
+		byTodo := map[int][]queuedRun{}
+		for _, q := range runs {
+			byTodo[q.in.todoID] = append(byTodo[q.in.todoID], q)
+		}
+		var wg sync.WaitGroup
+		for _, todoRuns := range byTodo {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for _, q := range todoRuns {
+					s.runQueuedRule(client, q)
+				}
+			}()
+		}
+		wg.Wait()
+	}
+}
+
+// claimRuleRuns takes the oldest queued runs, with SKIP LOCKED so several
+// servers can run them. A run still running after the lease was cut short,
+// by a restart, and is failed rather than run twice.
+func (s *Server) claimRuleRuns() ([]queuedRun, error) {
+	lease := time.Duration(maxRuleActions)*(s.cfg.WebhookTimeout+s.cfg.ScriptTimeout) + time.Minute
+	_, err := s.db.Exec(`
+		UPDATE rule_runs SET status = $2, error = 'the run was interrupted'
+		WHERE status = $1 AND COALESCE(started_at, created_at) < NOW() - make_interval(secs => $3)
+	`, model.RunRunning, model.RunFailed, lease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.Query(`
+		UPDATE rule_runs rr
+		SET status = $2, started_at = NOW()
+		FROM rules r
+		WHERE r.id = rr.rule_id
+		AND rr.id IN (
+			SELECT id FROM rule_runs
+			WHERE status = $1
+			ORDER BY id
+			LIMIT $3
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING rr.id, r.id, r.user_id, r.name, r.trigger, r.conditions, r.actions, r.enabled, r.created_at, r.updated_at,
+			rr.workspace_id, rr.todo_id, rr.todo_uuid, rr.owner_id, rr.todo, rr.trigger, rr.dedupe_key, rr.depth, rr.caused_by
+	`, model.RunPending, model.RunRunning, ruleRunBatch)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var runs []queuedRun
+	for rows.Next() {
+		var q queuedRun
+		var conditions, actions, todo []byte
+		r, in := &q.rule, &q.in
+		err := rows.Scan(&q.id, &r.ID, &r.userID, &r.Name, &r.Trigger, &conditions, &actions, &r.Enabled, &r.CreatedAt, &r.UpdatedAt,
+			&in.workspaceID, &in.todoID, &in.todoUUID, &in.ownerID, &todo, &in.trigger, &in.dedupeKey, &in.depth, &in.causedBy)
+		if err == nil {
+			err = json.Unmarshal(conditions, &r.Conditions)
+		}
+		if err == nil {
+			err = json.Unmarshal(actions, &r.Actions)
+		}
+		if err == nil {
+			err = json.Unmarshal(todo, &in.todo)
+		}
+		if err != nil {
+			return nil, err
+		}
+		runs = append(runs, q)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	// RETURNING has no order
+	slices.SortFunc(runs, func(a, b queuedRun) int { return cmp.Compare(a.id, b.id) })
+	return runs, nil
+}
+
+// runQueuedRule runs the actions of a claimed run and logs the outcome.
+// Failed actions are only logged.
+func (s *Server) runQueuedRule(client *http.Client, q queuedRun) {
+	r, in := q.rule, q.in
+	ctx, span := s.tracer.Start(context.Background(), "run_rule")
+	defer span.End()
+	span.SetAttributes(
+		attribute.Int("rule.id", r.ID),
+		attribute.Int64("rule.run.id", q.id),
+		attribute.String("rule.trigger", in.trigger),
+		attribute.String("task.uuid", in.todoUUID),
+		attribute.Int("rule.depth", in.depth),
+	)
+	attrs := []any{
+		slog.Int("rule_id", r.ID),
+		slog.Int64("rule_run_id", q.id),
+		slog.String("task_id", in.todoUUID),
+		slog.String("trigger", in.trigger),
+		slog.Int("depth", in.depth),
+	}
+
+	status, ran, reason := model.RunSucceeded, 0, ""
+	var actionErr error
+	if !r.Enabled {
+		status, reason = model.RunSkipped, "the rule was disabled"
+	} else {
+		for _, a := range r.Actions {
+			if actionErr = s.runRuleAction(ctx, client, r, in, a); actionErr != nil {
+				status, reason = model.RunFailed, a.Type+": "+actionErr.Error()
+				break
+			}
+			ran++
+		}
+	}
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE rule_runs SET status = $2, actions = $3, error = NULLIF($4, '') WHERE id = $1
+	`, q.id, status, ran, reason)
+	if err != nil {
+		logError("recording rule run failed", ctx, s.logger, span, err,
+			slog.Int64("rule_run_id", q.id),
+		)
+	}
+
+	switch {
+	case status == model.RunSkipped:
+		s.logger.WarnContext(ctx, "rule skipped", append(attrs, slog.String("reason", reason))...)
+	case actionErr != nil:
+		s.logger.WarnContext(ctx, "rule failed", append(attrs, slog.String("error", reason))...)
+		span.SetStatus(codes.Error, reason)
+	default:
+		s.logger.InfoContext(ctx, "rule ran", append(attrs, slog.Int("actions", ran))...)
+	}
+}
+
+func (s *Server) runRuleAction(ctx context.Context, client *http.Client, r storedRule, in ruleInput, a model.RuleAction) error {
+	switch a.Type {
+	case model.ActionSetField:
+		return s.ruleUpdateTodo(ctx, r, in, func(t *model.TodoSnapshot) error {
+			return setRuleField(t, a.Field, a.Value, time.Now())
+		})
+	case model.ActionScript:
+		return s.ruleUpdateTodo(ctx, r, in, func(t *model.TodoSnapshot) error {
+			return s.runScript(ctx, r, in, a.Script, t)
+		})
+	case model.ActionCreateTodo:
+		return s.ruleCreateTodo(ctx, r, in, a.Todo)
+	case model.ActionHTTP:
+		return ruleHTTP(ctx, client, r, in, a.URL)
+	}
+	return fmt.Errorf("unknown action type %q", a.Type)
+}
+
+// ruleUpdateTodo changes the todo with apply, as the rule's creator, who
+// must be allowed to edit it when apply changes anything.
+func (s *Server) ruleUpdateTodo(ctx context.Context, r storedRule, in ruleInput, apply func(t *model.TodoSnapshot) error) error {
+	tx, err := s.beginWorkspaceTx(ctx, in.workspaceID)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, have, err := todoRole(ctx, tx, in.todoID, r.userID)
+	if err == sql.ErrNoRows {
+		return errors.New("the todo was deleted")
+	}
+	if err != nil {
+		return err
+	}
+	before, ownerID, err := lockTodo(ctx, tx, in.todoID)
+	if err != nil {
+		return err
+	}
+	after := before
+	if err := apply(&after); err != nil {
+		return err
+	}
+	if len(diffTodo(&before, &after)) == 0 {
+		return nil
+	}
+	if have < roleEditor {
+		return errors.New("the rule's creator can't edit the todo")
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE todos SET title = $2, description = $3, completed = $4, priority = $5, due_at = $6 WHERE id = $1
+	`, in.todoID, after.Title, after.Description, after.Completed, after.Priority, after.DueAt)
+	if err != nil {
+		return err
+	}
+	_, _, err = recordChange(ctx, tx, todoChange{
+		todoID:      in.todoID,
+		workspaceID: in.workspaceID,
+		ownerID:     ownerID,
+		action:      model.HistoryUpdate,
+		before:      &before,
+		after:       &after,
+		changedBy:   r.userID,
+		ruleID:      r.ID,
+		ruleDepth:   in.depth + 1,
+	})
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ruleCreateTodo creates a todo as the rule's creator, in the list of the
+// todo that fired the rule if they can edit it.
+func (s *Server) ruleCreateTodo(ctx context.Context, r storedRule, in ruleInput, spec *model.RuleTodoSpec) error {
+	tx, err := s.beginWorkspaceTx(ctx, in.workspaceID)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	listID := in.todo.ListID
+	if listID != nil {
+		have, err := listRole(ctx, tx, *listID, r.userID)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		if err == sql.ErrNoRows || have < roleEditor {
+			listID = nil
+		}
+	}
+
+	expand := strings.NewReplacer("{{title}}", in.todo.Title)
+	t := model.TodoSnapshot{
+		Title:       expand.Replace(spec.Title),
+		Description: expand.Replace(spec.Description),
+		ListID:      listID,
+		Priority:    spec.Priority,
+	}
+	if utf8.RuneCountInString(t.Title) > maxTitleLength {
+		t.Title = string([]rune(t.Title)[:maxTitleLength])
+	}
+	if spec.DueIn != "" {
+		d, err := time.ParseDuration(spec.DueIn)
+		if err != nil {
+			return err
+		}
+		due := time.Now().UTC().Add(d).Truncate(time.Second)
+		t.DueAt = &due
+	}
+
+	ch := todoChange{workspaceID: in.workspaceID, ownerID: r.userID, ruleID: r.ID, ruleDepth: in.depth + 1}
+	if _, err := insertTodo(ctx, tx, ch, &t); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// insertTodo creates an open todo owned by ch.ownerID, with a new ID, and
+// records it in the history. ch.ruleID and ch.ruleDepth say which rule
+// created it, if any.
+func insertTodo(ctx context.Context, tx *sql.Tx, ch todoChange, t *model.TodoSnapshot) (string, error) {
+	err := tx.QueryRowContext(ctx, `
+		INSERT INTO todos (title, description, completed, owner_id, list_id, workspace_id, priority, due_at)
+		VALUES ($1, $2, FALSE, $3, $4, $5, $6, $7)
+		RETURNING id
+	`, t.Title, t.Description, ch.ownerID, t.ListID, ch.workspaceID, t.Priority, t.DueAt).Scan(&ch.todoID)
+	if err != nil {
+		return "", err
+	}
+	id, err := newTodoID("")
+	if err != nil {
+		return "", err
+	}
+	if _, err := insertTodoID(ctx, tx, id, ch.todoID, ch.workspaceID); err != nil {
+		return "", err
+	}
+	ch.action = model.HistoryCreate
+	ch.after = t
+	ch.changedBy = ch.ownerID
+	if _, _, err := recordChange(ctx, tx, ch); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// ruleHTTP POSTs the run to a URL, with the trace context. Anything but a
+// 2xx response fails the action.
+func ruleHTTP(ctx context.Context, client *http.Client, r storedRule, in ruleInput, url string) error {
+	body, err := json.Marshal(model.RuleHTTPPayload{
+		RuleID:   r.ID,
+		RuleName: r.Name,
+		Trigger:  in.trigger,
+		TodoID:   in.todoUUID,
+		Todo:     in.todo,
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "MinimalDo-Rules")
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected response status %d", resp.StatusCode)
+	}
+	return nil
+}
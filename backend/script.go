@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/thakurnishu/MinimalDo/model"
+	lua "github.com/yuin/gopher-lua"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Script actions run Lua in a sandbox: only the base, string, table and math
+// libraries, without loading code or files, so a script has no network or
+// file access. The global todo table holds the todo; what the script leaves
+// in it is saved, checked like a set_field action. log(...) writes to the
+// server log and the span of the script.
+//
+// A script runs for at most SCRIPT_TIMEOUT and may allocate SCRIPT_MAX_MEMORY,
+// see script_memory.go. Its state has a small call stack and data stack.
+
+const (
+	maxScriptSize     = 64 << 10
+	maxScriptString   = 1 << 20 // longest string a script can build
+	maxScriptLogLines = 100
+	maxScriptLogLine  = 1000
+)
+
+var errScriptTimeout = errors.New("script ran out of time")
+
+// the fields of the todo table a script can change
+var scriptFields = ruleSetFields
+
+// compileScript checks that a script is valid Lua.
+func compileScript(src string) error {
+	if strings.TrimSpace(src) == "" || len(src) > maxScriptSize {
+		return fmt.Errorf("script must be 1 to %d bytes", maxScriptSize)
+	}
+	// as it will run
+	if _, err := compileLimitedScript(src); err != nil {
+		return fmt.Errorf("script: %w", err)
+	}
+	return nil
+}
+
+// runScript runs a script action on t, in its own span.
+func (s *Server) runScript(ctx context.Context, r storedRule, in ruleInput, src string, t *model.TodoSnapshot) error {
+	ctx, span := s.tracer.Start(ctx, "run_script")
+	defer span.End()
+	span.SetAttributes(
+		attribute.Int("rule.id", r.ID),
+		attribute.String("task.uuid", in.todoUUID),
+	)
+
+	err := s.execScript(ctx, span, r, in, src, t)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
+}
+
+func (s *Server) execScript(ctx context.Context, span trace.Span, r storedRule, in ruleInput, src string, t *model.TodoSnapshot) error {
+	ctx, cancelTimeout := context.WithTimeoutCause(ctx, s.cfg.ScriptTimeout, errScriptTimeout)
+	defer cancelTimeout()
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	L := newScriptState()
+	defer L.Close()
+	L.SetContext(ctx)
+	mem := &scriptMemory{limit: s.cfg.ScriptMaxMemory, cancel: cancel}
+	helpers := mem.install(L)
+
+	todo := L.NewTable()
+	todo.RawSetString("id", lua.LString(in.todoUUID))
+	todo.RawSetString("title", lua.LString(t.Title))
+	todo.RawSetString("description", lua.LString(t.Description))
+	todo.RawSetString("completed", lua.LBool(t.Completed))
+	todo.RawSetString("priority", lua.LString(t.Priority))
+	todo.RawSetString("due_at", lua.LNil)
+	if t.DueAt != nil {
+		todo.RawSetString("due_at", lua.LString(t.DueAt.Format(time.RFC3339)))
+	}
+	if t.ListID != nil {
+		todo.RawSetString("list_id", lua.LNumber(*t.ListID))
+	}
+	before := map[string]lua.LValue{}
+	for _, f := range scriptFields {
+		before[f] = todo.RawGetString(f)
+	}
+	L.SetGlobal("todo", todo)
+
+	event := L.NewTable()
+	event.RawSetString("trigger", lua.LString(in.trigger))
+	event.RawSetString("rule", lua.LString(r.Name))
+	L.SetGlobal("event", event)
+
+	lines := 0
+	L.SetGlobal("log", L.NewFunction(func(L *lua.LState) int {
+		if lines++; lines > maxScriptLogLines {
+			return 0
+		}
+		parts := make([]string, L.GetTop())
+		for i := range parts {
+			parts[i] = L.ToStringMeta(L.Get(i + 1)).String()
+		}
+		msg := strings.Join(parts, " ")
+		if len(msg) > maxScriptLogLine {
+			msg = msg[:maxScriptLogLine]
+		}
+		s.logger.InfoContext(ctx, "script log",
+			slog.Int("rule_id", r.ID),
+			slog.String("task_id", in.todoUUID),
+			slog.String("message", msg),
+		)
+		span.AddEvent("log", trace.WithAttributes(attribute.String("message", msg)))
+		return 0
+	}))
+
+	proto, err := compileLimitedScript(src)
+	if err == nil {
+		L.Push(L.NewFunctionFromProto(proto))
+		for _, h := range helpers {
+			L.Push(h)
+		}
+		err = L.PCall(len(helpers), 0, nil)
+	}
+	if err != nil {
+		if cause := context.Cause(ctx); cause != nil {
+			return cause
+		}
+		var apiErr *lua.ApiError
+		if errors.As(err, &apiErr) {
+			return errors.New(apiErr.Object.String())
+		}
+		return err
+	}
+
+	now := time.Now()
+	for _, f := range scriptFields {
+		v := todo.RawGetString(f)
+		if v == before[f] {
+			continue
+		}
+		if err := setRuleField(t, f, fromLua(v), now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newScriptState returns a Lua state with only the sandboxed libraries.
+func newScriptState() *lua.LState {
+	L := lua.NewState(lua.Options{
+		SkipOpenLibs:        true,
+		CallStackSize:       64,
+		RegistrySize:        1024,
+		RegistryMaxSize:     16 * 1024,
+		MinimizeStackMemory: true,
+	})
+	libs := []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	}
+	for _, lib := range libs {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	for _, name := range []string{
+		"dofile", "loadfile", "load", "loadstring", "require", "module",
+		"collectgarbage", "getfenv", "setfenv", "print", "_printregs", "newproxy",
+	} {
+		L.SetGlobal(name, lua.LNil)
+	}
+	return L
+}
+
+// fromLua converts a value of the todo table for setRuleField.
+func fromLua(v lua.LValue) any {
+	switch v := v.(type) {
+	case lua.LString:
+		return string(v)
+	case lua.LBool:
+		return bool(v)
+	case lua.LNumber:
+		return float64(v)
+	}
+	return nil
+}
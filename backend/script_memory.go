@@ -0,0 +1,499 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/ast"
+	"github.com/yuin/gopher-lua/parse"
+	"github.com/yuin/gopher-lua/pm"
+)
+
+// gopher-lua allocates through the Go heap and can't count what a state
+// uses, and some operations, like .., are a single VM instruction however
+// much they copy. So scripts are rewritten before they are compiled: every
+// .., table constructor, function and assignment to a table field becomes a
+// call of a helper, and the library functions that build strings or grow
+// tables are wrapped. The helpers charge what they allocate to the run,
+// roughly, and fail it once SCRIPT_MAX_MEMORY is used up or a string would
+// be longer than maxScriptString. What the VM allocates besides, registers
+// and call frames, is bounded by the state's stack sizes.
+
+const (
+	scriptTableCost   = 128 // an empty table
+	scriptFieldCost   = 64  // a table entry, with what growing the table copies
+	scriptClosureCost = 128 // a function value
+)
+
+var errScriptMemory = errors.New("script ran out of memory")
+
+// the helpers, locals of the chunk with names scripts can't write
+var scriptHelpers = []string{"$concat", "$table", "$closure", "$set"}
+
+// scriptMemory is the allocation budget of one run.
+type scriptMemory struct {
+	used, limit int64
+	cancel      context.CancelCauseFunc
+}
+
+// fail stops the run with err, even if the script catches the error.
+func (m *scriptMemory) fail(L *lua.LState, err error) {
+	m.cancel(err)
+	L.RaiseError("%s", err.Error())
+}
+
+func (m *scriptMemory) charge(L *lua.LState, n int) {
+	m.used += int64(n)
+	if m.used > m.limit {
+		m.fail(L, errScriptMemory)
+	}
+}
+
+// checkString fails the run if a string of n bytes is too long, and
+// charges it otherwise.
+func (m *scriptMemory) checkString(L *lua.LState, n int) {
+	if n > maxScriptString {
+		m.fail(L, fmt.Errorf("%w: string longer than %d bytes", errScriptMemory, maxScriptString))
+	}
+	m.charge(L, n)
+}
+
+// compileLimitedScript compiles a script rewritten to call the helpers. The
+// chunk takes them as arguments, in the order of scriptHelpers.
+func compileLimitedScript(src string) (*lua.FunctionProto, error) {
+	chunk, err := parse.Parse(strings.NewReader(src), "script")
+	if err != nil {
+		return nil, err
+	}
+	names := &ast.LocalAssignStmt{Names: scriptHelpers, Exprs: []ast.Expr{&ast.Comma3Expr{}}}
+	return lua.Compile(append([]ast.Stmt{names}, rewriteStmts(chunk)...), "script")
+}
+
+// install replaces the library functions that allocate with checked ones,
+// and returns the helpers.
+func (m *scriptMemory) install(L *lua.LState) []lua.LValue {
+	str := L.GetGlobal("string").(*lua.LTable)
+	tab := L.GetGlobal("table").(*lua.LTable)
+	wrap := func(t *lua.LTable, name string, check func(L *lua.LState, orig lua.LGFunction) int) {
+		orig := t.RawGetString(name).(*lua.LFunction).GFunction
+		t.RawSetString(name, L.NewFunction(func(L *lua.LState) int { return check(L, orig) }))
+	}
+
+	str.RawSetString("rep", L.NewFunction(m.rep))
+	for _, name := range []string{"upper", "lower", "reverse"} {
+		wrap(str, name, func(L *lua.LState, orig lua.LGFunction) int {
+			m.charge(L, len(L.CheckString(1)))
+			return orig(L)
+		})
+	}
+	wrap(str, "format", m.format)
+	wrap(str, "gsub", m.gsub)
+	wrap(tab, "concat", m.tableConcat)
+	wrap(tab, "insert", func(L *lua.LState, orig lua.LGFunction) int {
+		m.charge(L, scriptFieldCost)
+		return orig(L)
+	})
+	wrap(L.G.Global, "rawset", func(L *lua.LState, orig lua.LGFunction) int {
+		if L.CheckTable(1).RawGet(L.CheckAny(2)) == lua.LNil {
+			m.charge(L, scriptFieldCost)
+		}
+		return orig(L)
+	})
+
+	return []lua.LValue{
+		L.NewFunction(m.concat),
+		L.NewFunction(m.table),
+		L.NewFunction(m.closure),
+		L.NewFunction(m.set),
+	}
+}
+
+// concat is lhs .. rhs.
+func (m *scriptMemory) concat(L *lua.LState) int {
+	lhs, rhs := L.Get(1), L.Get(2)
+	if lua.LVCanConvToString(lhs) && lua.LVCanConvToString(rhs) {
+		l, r := lua.LVAsString(lhs), lua.LVAsString(rhs)
+		m.checkString(L, len(l)+len(r))
+		L.Push(lua.LString(l + r))
+		return 1
+	}
+	op := L.GetMetaField(lhs, "__concat")
+	if op == lua.LNil {
+		op = L.GetMetaField(rhs, "__concat")
+	}
+	if op.Type() != lua.LTFunction {
+		L.RaiseError("cannot perform concat operation between %v and %v", lhs.Type().String(), rhs.Type().String())
+	}
+	L.Push(op)
+	L.Push(lhs)
+	L.Push(rhs)
+	L.Call(2, 1)
+	return 1
+}
+
+// table charges a table made by a constructor.
+func (m *scriptMemory) table(L *lua.LState) int {
+	t := L.CheckTable(1)
+	n := 0
+	t.ForEach(func(lua.LValue, lua.LValue) { n++ })
+	m.charge(L, scriptTableCost+n*scriptFieldCost)
+	return 1
+}
+
+// closure charges a function value.
+func (m *scriptMemory) closure(L *lua.LState) int {
+	m.charge(L, scriptClosureCost)
+	return 1
+}
+
+// set is t[k] = v.
+func (m *scriptMemory) set(L *lua.LState) int {
+	t, k, v := L.Get(1), L.Get(2), L.Get(3)
+	if tb, ok := t.(*lua.LTable); ok && tb.RawGet(k) == lua.LNil && v != lua.LNil {
+		m.charge(L, scriptFieldCost)
+	}
+	L.SetTable(t, k, v)
+	return 0
+}
+
+// rep is string.rep, which could otherwise allocate gigabytes in one call.
+func (m *scriptMemory) rep(L *lua.LState) int {
+	str := L.CheckString(1)
+	n := L.CheckInt(2)
+	sep := L.OptString(3, "")
+	if n <= 0 {
+		L.Push(lua.LString(""))
+		return 1
+	}
+	if n > maxScriptString || len(str)+len(sep) > maxScriptString/n {
+		m.fail(L, fmt.Errorf("%w: string.rep result longer than %d bytes", errScriptMemory, maxScriptString))
+	}
+	m.charge(L, n*(len(str)+len(sep)))
+	parts := make([]string, n)
+	for i := range parts {
+		parts[i] = str
+	}
+	L.Push(lua.LString(strings.Join(parts, sep)))
+	return 1
+}
+
+// format is string.format. Widths and precisions have at most two digits,
+// as in Lua 5.1, so the result is at most the format, the arguments and 100
+// bytes per conversion.
+func (m *scriptMemory) format(L *lua.LState, orig lua.LGFunction) int {
+	f := L.CheckString(1)
+	size := len(f)
+	for i := 0; i < len(f); i++ {
+		if f[i] != '%' {
+			continue
+		}
+		if i++; i < len(f) && f[i] == '%' {
+			continue
+		}
+		for i < len(f) && strings.IndexByte("-+ #0", f[i]) >= 0 {
+			i++
+		}
+		for _, part := range []string{"width", "precision"} {
+			if part == "precision" {
+				if i >= len(f) || f[i] != '.' {
+					break
+				}
+				i++
+			}
+			digits := 0
+			for i < len(f) && f[i] >= '0' && f[i] <= '9' {
+				i++
+				digits++
+			}
+			if digits > 2 {
+				L.RaiseError("invalid format (width or precision too long)")
+			}
+		}
+		size += 100
+	}
+	for i := 2; i <= L.GetTop(); i++ {
+		if s, ok := L.Get(i).(lua.LString); ok {
+			// %q escapes
+			size += 2 * len(s)
+		}
+	}
+	if size > maxScriptString {
+		m.fail(L, fmt.Errorf("%w: string.format result could be longer than %d bytes", errScriptMemory, maxScriptString))
+	}
+	n := orig(L)
+	m.charge(L, len(lua.LVAsString(L.Get(-n))))
+	return n
+}
+
+// tableConcat is table.concat, with the length of the result checked
+// before it is built.
+func (m *scriptMemory) tableConcat(L *lua.LState, orig lua.LGFunction) int {
+	t := L.CheckTable(1)
+	sep := L.OptString(2, "")
+	i, j := L.OptInt(3, 1), L.OptInt(4, t.Len())
+	size := 0
+	for k := i; k <= j; k++ {
+		v := t.RawGetInt(k)
+		if !lua.LVCanConvToString(v) {
+			// table.concat reports it
+			break
+		}
+		size += len(lua.LVAsString(v))
+		if k > i {
+			size += len(sep)
+		}
+		if size > maxScriptString {
+			break
+		}
+	}
+	m.checkString(L, size)
+	return orig(L)
+}
+
+// gsub is string.gsub with the length of the result checked. For a string
+// replacement it is worked out from the matches first, functions and tables
+// are checked as they return.
+func (m *scriptMemory) gsub(L *lua.LState, orig lua.LGFunction) int {
+	str := L.CheckString(1)
+	pat := L.CheckString(2)
+	repl := L.CheckAny(3)
+	limit := L.OptInt(4, -1)
+
+	switch repl := repl.(type) {
+	case lua.LString:
+		mds, err := pm.Find(pat, []byte(str), 0, limit)
+		if err != nil {
+			L.RaiseError(err.Error())
+		}
+		size := len(str)
+		for _, md := range mds {
+			size += gsubLength(md, string(repl)) - (md.Capture(1) - md.Capture(0))
+		}
+		m.checkString(L, size)
+	case *lua.LTable, *lua.LFunction:
+		size := len(str)
+		L.Replace(3, L.NewFunction(func(L *lua.LState) int {
+			var v lua.LValue
+			if t, ok := repl.(*lua.LTable); ok {
+				v = L.GetTable(t, L.Get(1))
+			} else {
+				args := make([]lua.LValue, L.GetTop())
+				for i := range args {
+					args[i] = L.Get(i + 1)
+				}
+				L.Push(repl)
+				for _, a := range args {
+					L.Push(a)
+				}
+				L.Call(len(args), 1)
+				v = L.Get(-1)
+			}
+			if lua.LVCanConvToString(v) {
+				size += len(lua.LVAsString(v))
+				m.checkString(L, size)
+			}
+			L.Push(v)
+			return 1
+		}))
+	}
+	return orig(L)
+}
+
+// gsubLength is how long repl is once its captures are filled in.
+func gsubLength(md *pm.MatchData, repl string) int {
+	n := 0
+	for i := 0; i < len(repl); i++ {
+		if repl[i] != '%' || i+1 == len(repl) {
+			n++
+			continue
+		}
+		i++
+		c := repl[i]
+		if c < '0' || c > '9' {
+			n++
+			continue
+		}
+		idx := 2 * int(c-'0')
+		if idx >= md.CaptureLength() && idx == 2 {
+			// %1 without captures is the whole match
+			idx = 0
+		}
+		switch {
+		case idx >= md.CaptureLength():
+			// gsub reports it
+		case md.IsPosCapture(idx):
+			n += len(fmt.Sprint(md.Capture(idx)))
+		default:
+			n += md.Capture(idx+1) - md.Capture(idx)
+		}
+	}
+	return n
+}
+
+// rewriteStmts returns stmts with the operations that allocate replaced by
+// calls of the helpers.
+func rewriteStmts(stmts []ast.Stmt) []ast.Stmt {
+	out := make([]ast.Stmt, 0, len(stmts))
+	for _, s := range stmts {
+		out = append(out, rewriteStmt(s)...)
+	}
+	return out
+}
+
+func rewriteStmt(s ast.Stmt) []ast.Stmt {
+	switch s := s.(type) {
+	case *ast.AssignStmt:
+		return []ast.Stmt{rewriteAssign(s)}
+	case *ast.LocalAssignStmt:
+		if len(s.Names) == 1 && len(s.Exprs) == 1 {
+			if _, ok := s.Exprs[0].(*ast.FunctionExpr); ok {
+				// declared first, so that the function can call itself
+				assign := &ast.AssignStmt{Lhs: []ast.Expr{identAt(s.Names[0], s)}, Rhs: s.Exprs}
+				copyPosition(assign, s)
+				local := &ast.LocalAssignStmt{Names: s.Names, Exprs: []ast.Expr{}}
+				copyPosition(local, s)
+				return []ast.Stmt{local, rewriteAssign(assign)}
+			}
+		}
+		s.Exprs = rewriteExprs(s.Exprs)
+	case *ast.FuncDefStmt:
+		target := s.Name.Func
+		if target == nil {
+			key := &ast.StringExpr{Value: s.Name.Method}
+			copyPosition(key, s)
+			target = &ast.AttrGetExpr{Object: s.Name.Receiver, Key: key}
+			copyPosition(target, s)
+			s.Func.ParList.Names = append([]string{"self"}, s.Func.ParList.Names...)
+		}
+		assign := &ast.AssignStmt{Lhs: []ast.Expr{target}, Rhs: []ast.Expr{s.Func}}
+		copyPosition(assign, s)
+		return []ast.Stmt{rewriteAssign(assign)}
+	case *ast.FuncCallStmt:
+		s.Expr = rewriteExpr(s.Expr)
+	case *ast.DoBlockStmt:
+		s.Stmts = rewriteStmts(s.Stmts)
+	case *ast.WhileStmt:
+		s.Condition = rewriteExpr(s.Condition)
+		s.Stmts = rewriteStmts(s.Stmts)
+	case *ast.RepeatStmt:
+		s.Condition = rewriteExpr(s.Condition)
+		s.Stmts = rewriteStmts(s.Stmts)
+	case *ast.IfStmt:
+		s.Condition = rewriteExpr(s.Condition)
+		s.Then = rewriteStmts(s.Then)
+		s.Else = rewriteStmts(s.Else)
+	case *ast.NumberForStmt:
+		s.Init = rewriteExpr(s.Init)
+		s.Limit = rewriteExpr(s.Limit)
+		s.Step = rewriteExpr(s.Step)
+		s.Stmts = rewriteStmts(s.Stmts)
+	case *ast.GenericForStmt:
+		s.Exprs = rewriteExprs(s.Exprs)
+		s.Stmts = rewriteStmts(s.Stmts)
+	case *ast.ReturnStmt:
+		s.Exprs = rewriteExprs(s.Exprs)
+	}
+	return []ast.Stmt{s}
+}
+
+// rewriteAssign turns assignments to table fields into calls of $set. The
+// values are put in locals first, so they are all evaluated before any is
+// assigned, as in Lua.
+func rewriteAssign(s *ast.AssignStmt) ast.Stmt {
+	s.Rhs = rewriteExprs(s.Rhs)
+	fields := false
+	for _, lhs := range s.Lhs {
+		_, ok := lhs.(*ast.AttrGetExpr)
+		fields = fields || ok
+	}
+	if !fields {
+		return s
+	}
+
+	values := make([]string, len(s.Lhs))
+	for i := range values {
+		values[i] = fmt.Sprint("$", i)
+	}
+	local := &ast.LocalAssignStmt{Names: values, Exprs: s.Rhs}
+	copyPosition(local, s)
+	block := &ast.DoBlockStmt{Stmts: []ast.Stmt{local}}
+	copyPosition(block, s)
+	for i, lhs := range s.Lhs {
+		var set ast.Stmt
+		if attr, ok := lhs.(*ast.AttrGetExpr); ok {
+			set = &ast.FuncCallStmt{Expr: helperCall("$set", s,
+				rewriteExpr(attr.Object), rewriteExpr(attr.Key), identAt(values[i], s))}
+		} else {
+			set = &ast.AssignStmt{Lhs: []ast.Expr{lhs}, Rhs: []ast.Expr{identAt(values[i], s)}}
+		}
+		copyPosition(set, s)
+		block.Stmts = append(block.Stmts, set)
+	}
+	return block
+}
+
+func rewriteExprs(exprs []ast.Expr) []ast.Expr {
+	for i, e := range exprs {
+		exprs[i] = rewriteExpr(e)
+	}
+	return exprs
+}
+
+func rewriteExpr(e ast.Expr) ast.Expr {
+	switch e := e.(type) {
+	case *ast.StringConcatOpExpr:
+		return helperCall("$concat", e, rewriteExpr(e.Lhs), rewriteExpr(e.Rhs))
+	case *ast.TableExpr:
+		for _, f := range e.Fields {
+			f.Key = rewriteExpr(f.Key)
+			f.Value = rewriteExpr(f.Value)
+		}
+		return helperCall("$table", e, e)
+	case *ast.FunctionExpr:
+		e.Stmts = rewriteStmts(e.Stmts)
+		return helperCall("$closure", e, e)
+	case *ast.AttrGetExpr:
+		e.Object = rewriteExpr(e.Object)
+		e.Key = rewriteExpr(e.Key)
+	case *ast.FuncCallExpr:
+		e.Func = rewriteExpr(e.Func)
+		e.Receiver = rewriteExpr(e.Receiver)
+		e.Args = rewriteExprs(e.Args)
+	case *ast.LogicalOpExpr:
+		e.Lhs = rewriteExpr(e.Lhs)
+		e.Rhs = rewriteExpr(e.Rhs)
+	case *ast.RelationalOpExpr:
+		e.Lhs = rewriteExpr(e.Lhs)
+		e.Rhs = rewriteExpr(e.Rhs)
+	case *ast.ArithmeticOpExpr:
+		e.Lhs = rewriteExpr(e.Lhs)
+		e.Rhs = rewriteExpr(e.Rhs)
+	case *ast.UnaryMinusOpExpr:
+		e.Expr = rewriteExpr(e.Expr)
+	case *ast.UnaryNotOpExpr:
+		e.Expr = rewriteExpr(e.Expr)
+	case *ast.UnaryLenOpExpr:
+		e.Expr = rewriteExpr(e.Expr)
+	}
+	return e
+}
+
+func helperCall(name string, at ast.PositionHolder, args ...ast.Expr) *ast.FuncCallExpr {
+	call := &ast.FuncCallExpr{Func: identAt(name, at), Args: args}
+	copyPosition(call, at)
+	return call
+}
+
+func identAt(name string, at ast.PositionHolder) *ast.IdentExpr {
+	ident := &ast.IdentExpr{Value: name}
+	copyPosition(ident, at)
+	return ident
+}
+
+func copyPosition(to, from ast.PositionHolder) {
+	to.SetLine(from.Line())
+	to.SetLastLine(from.LastLine())
+}
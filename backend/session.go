@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/thakurnishu/MinimalDo/model"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	errInvalidRefreshToken = errors.New("invalid or expired refresh token")
+	errRefreshTokenReused  = errors.New("refresh token reused")
+)
+
+// issueSession signs an access token and creates a refresh token for u. An
+// empty familyID starts a new token family (a new login).
+func (s *Server) issueSession(ctx context.Context, db dbtx, u model.User, familyID string) (model.Session, error) {
+	if familyID == "" {
+		id, err := newToken()
+		if err != nil {
+			return model.Session{}, err
+		}
+		familyID = id
+
+		// Housekeeping, expired families are useless.
+		_, err = db.ExecContext(ctx, `
+			DELETE FROM token_families f
+			WHERE f.user_id = $1
+			AND NOT EXISTS (
+				SELECT 1 FROM refresh_tokens rt
+				WHERE rt.family_id = f.id AND rt.expires_at > NOW()
+			)
+		`, u.ID)
+		if err != nil {
+			return model.Session{}, err
+		}
+
+		_, err = db.ExecContext(ctx, "INSERT INTO token_families (id, user_id) VALUES ($1, $2)", familyID, u.ID)
+		if err != nil {
+			return model.Session{}, err
+		}
+	}
+
+	refreshToken, err := newToken()
+	if err != nil {
+		return model.Session{}, err
+	}
+	refreshExpiresAt := time.Now().Add(s.cfg.RefreshTokenTTL).UTC()
+	_, err = db.ExecContext(ctx, `
+		INSERT INTO refresh_tokens (family_id, token_hash, expires_at)
+		VALUES ($1, $2, $3)
+	`, familyID, hashToken(refreshToken), refreshExpiresAt)
+	if err != nil {
+		return model.Session{}, err
+	}
+
+	accessToken, expiresAt, err := s.keys.sign(u.ID, familyID, s.cfg.AccessTokenTTL)
+	if err != nil {
+		return model.Session{}, err
+	}
+
+	return model.Session{
+		AccessToken:      accessToken,
+		TokenType:        "Bearer",
+		ExpiresAt:        expiresAt.UTC(),
+		RefreshToken:     refreshToken,
+		RefreshExpiresAt: refreshExpiresAt,
+		User:             u,
+	}, nil
+}
+
+// refreshSession rotates a refresh token: the presented token is marked used
+// and a new access/refresh pair in the same family is returned. Presenting a
+// token that was already used means it was copied, so the whole family is
+// revoked and both parties have to log in again.
+func (s *Server) refreshSession(c *gin.Context) {
+	ctx, span := s.tracer.Start(c.Request.Context(), "refresh_session")
+	defer span.End()
+
+	var req model.RefreshRequest
+	if err := c.BindJSON(&req); err != nil {
+		logError("failed to parse json", ctx, s.logger, span, err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		logError("begin transaction failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	var (
+		tokenID   int
+		familyID  string
+		expiresAt time.Time
+		usedAt    sql.NullTime
+		revokedAt sql.NullTime
+		u         model.User
+	)
+	err = tx.QueryRowContext(ctx, `
+		SELECT rt.id, rt.family_id, rt.expires_at, rt.used_at, f.revoked_at,
+			u.id, u.username, COALESCE(u.email, ''), u.created_at
+		FROM refresh_tokens rt
+		JOIN token_families f ON f.id = rt.family_id
+		JOIN users u ON u.id = f.user_id
+		WHERE rt.token_hash = $1
+		FOR UPDATE OF rt, f
+	`, hashToken(req.RefreshToken)).Scan(
+		&tokenID, &familyID, &expiresAt, &usedAt, &revokedAt,
+		&u.ID, &u.Username, &u.Email, &u.CreatedAt,
+	)
+	if err == sql.ErrNoRows {
+		logError("refresh failed", ctx, s.logger, span, errInvalidRefreshToken)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": errInvalidRefreshToken.Error()})
+		return
+	}
+	if err != nil {
+		logError("row scan failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	span.SetAttributes(attribute.Int("user.id", u.ID))
+
+	if usedAt.Valid && !revokedAt.Valid {
+		if err := revokeFamily(ctx, tx, familyID, "refresh token reuse"); err != nil {
+			logError("revoking token family failed", ctx, s.logger, span, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			logError("commit failed", ctx, s.logger, span, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		logError("refresh token reuse detected, session revoked", ctx, s.logger, span, errRefreshTokenReused,
+			slog.Int("user_id", u.ID),
+			slog.Time("token_used_at", usedAt.Time),
+		)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": errInvalidRefreshToken.Error()})
+		return
+	}
+	if usedAt.Valid || revokedAt.Valid || time.Now().After(expiresAt) {
+		logError("refresh failed", ctx, s.logger, span, errInvalidRefreshToken,
+			slog.Int("user_id", u.ID),
+			slog.Bool("revoked", revokedAt.Valid),
+		)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": errInvalidRefreshToken.Error()})
+		return
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE refresh_tokens SET used_at = NOW() WHERE id = $1", tokenID); err != nil {
+		logError("query execution failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	session, err := s.issueSession(ctx, tx, u, familyID)
+	if err != nil {
+		logError("session creation failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		logError("commit failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	s.logger.InfoContext(ctx, "session refreshed",
+		slog.Int("user_id", u.ID),
+	)
+
+	c.JSON(http.StatusOK, session)
+}
+
+// revokeToken revokes the session a refresh token belongs to. Like RFC 7009
+// it answers 200 for unknown tokens, so it can't be used to probe them.
+func (s *Server) revokeToken(c *gin.Context) {
+	ctx, span := s.tracer.Start(c.Request.Context(), "revoke_token")
+	defer span.End()
+
+	var req model.RefreshRequest
+	if err := c.BindJSON(&req); err != nil {
+		logError("failed to parse json", ctx, s.logger, span, err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var familyID string
+	err := s.db.QueryRowContext(ctx,
+		"SELECT family_id FROM refresh_tokens WHERE token_hash = $1",
+		hashToken(req.RefreshToken),
+	).Scan(&familyID)
+	if err != nil && err != sql.ErrNoRows {
+		logError("row scan failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err == nil {
+		if err := revokeFamily(ctx, s.db, familyID, "revoked"); err != nil {
+			logError("revoking token family failed", ctx, s.logger, span, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		s.logger.InfoContext(ctx, "session revoked")
+	}
+	span.SetAttributes(attribute.Bool("token.found", err == nil))
+
+	c.Status(http.StatusOK)
+}
+
+// logoutUser revokes the access token used for the request and its session,
+// so neither the access token nor any refresh token of that login work
+// afterwards.
+func (s *Server) logoutUser(c *gin.Context) {
+	ctx, span := s.tracer.Start(c.Request.Context(), "logout_user")
+	defer span.End()
+
+	userID := currentUserID(c)
+	span.SetAttributes(attribute.Int("user.id", userID))
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		logError("begin transaction failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	if jti := c.GetString(ctxTokenID); jti != "" {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO revoked_tokens (jti, user_id, expires_at)
+			VALUES ($1, $2, $3)
+			ON CONFLICT (jti) DO NOTHING
+		`, jti, userID, c.GetTime(ctxTokenExp))
+		if err != nil {
+			logError("query execution failed", ctx, s.logger, span, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if sid := c.GetString(ctxSessionID); sid != "" {
+		if err := revokeFamily(ctx, tx, sid, "logout"); err != nil {
+			logError("revoking token family failed", ctx, s.logger, span, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	// Housekeeping, an expired token is rejected anyway.
+	if _, err := tx.ExecContext(ctx, "DELETE FROM revoked_tokens WHERE expires_at < NOW()"); err != nil {
+		logError("query execution failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		logError("commit failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	s.logger.InfoContext(ctx, "user logged out",
+		slog.Int("user_id", userID),
+	)
+
+	c.Status(http.StatusNoContent)
+}
+
+// AuthMiddleware rejects requests without a valid, unrevoked access token and
+// stores the authenticated user in the gin context.
+func (s *Server) AuthMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		span := trace.SpanFromContext(ctx)
+
+		token, ok := bearerToken(c)
+		if !ok {
+			s.logger.WarnContext(ctx, "missing bearer token",
+				slog.String("path", c.Request.URL.Path),
+			)
+			span.SetStatus(codes.Error, "missing bearer token")
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+			return
+		}
+		if strings.HasPrefix(token, apiTokenPrefix) {
+			s.authenticateAPIToken(c, token)
+			return
+		}
+
+		claims, err := s.keys.verify(token)
+		if err != nil {
+			s.logger.WarnContext(ctx, "invalid access token",
+				slog.String("path", c.Request.URL.Path),
+				slog.String("error", err.Error()),
+			)
+			span.SetStatus(codes.Error, "invalid access token")
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired token"})
+			return
+		}
+		userID, err := strconv.Atoi(claims.Subject)
+		if err != nil {
+			logError("invalid token subject", ctx, s.logger, span, err)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired token"})
+			return
+		}
+
+		var revoked bool
+		err = s.db.QueryRowContext(ctx, `
+			SELECT EXISTS (SELECT 1 FROM revoked_tokens WHERE jti = $1)
+				OR EXISTS (SELECT 1 FROM token_families WHERE id = $2 AND revoked_at IS NOT NULL)
+		`, claims.ID, claims.SessionID).Scan(&revoked)
+		if err != nil {
+			logError("revocation lookup failed", ctx, s.logger, span, err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if revoked {
+			s.logger.WarnContext(ctx, "revoked access token",
+				slog.Int("user_id", userID),
+				slog.String("path", c.Request.URL.Path),
+			)
+			span.SetStatus(codes.Error, "revoked access token")
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired token"})
+			return
+		}
+
+		span.SetAttributes(attribute.Int("enduser.id", userID))
+		c.Set(ctxUserID, userID)
+		c.Set(ctxTokenID, claims.ID)
+		c.Set(ctxSessionID, claims.SessionID)
+		c.Set(ctxTokenExp, claims.ExpiresAt.Time)
+		c.Next()
+	}
+}
+
+func revokeFamily(ctx context.Context, db dbtx, familyID, reason string) error {
+	_, err := db.ExecContext(ctx, `
+		UPDATE token_families SET revoked_at = NOW(), revoke_reason = $2
+		WHERE id = $1 AND revoked_at IS NULL
+	`, familyID, reason)
+	return err
+}
@@ -3,32 +3,19 @@ package main
 import (
 	"database/sql"
 	"log/slog"
-	"time"
 
+	"github.com/thakurnishu/MinimalDo/blobstore"
 	"go.opentelemetry.io/otel/trace"
 )
 
-type Todo struct {
-	ID          int       `json:"id"`
-	Title       string    `json:"title"`
-	Description string    `json:"description"`
-	Completed   bool      `json:"completed"`
-	CreatedAt   time.Time `json:"created_at"`
-	UpdatedAt   time.Time `json:"updated_at"`
-}
-
 type Server struct {
+	cfg *Config
 	db *sql.DB
+	keys *keySet
+	oidc *oidcProvider // nil when OIDC login is disabled
+	blobs blobstore.Store
+	events *eventHub
+	plugins map[string]*plugin
 	tracer trace.Tracer
 	logger *slog.Logger
 }
-
-type DateRange struct {
-    Start time.Time `json:"start"`
-    End   time.Time `json:"end"`
-}
-
-type GroupedTodos struct {
-    Date   string `json:"date"`
-    Todos  []Todo `json:"todos"`
-}
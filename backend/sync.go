@@ -0,0 +1,578 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/thakurnishu/MinimalDo/crdt"
+	"github.com/thakurnishu/MinimalDo/model"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	maxSyncMutations = 500
+	// maxSyncBodyBytes leaves room for a full batch of crdt states
+	maxSyncBodyBytes = 32 << 20
+)
+
+var errInvalidSyncToken = errors.New("invalid sync token")
+
+// Sync tokens are the xmin of a transaction snapshot: every transaction that
+// had not committed when the token was made has an ID at least as large. A
+// change is sent when its history row's tx_id is, so one that commits after
+// a sync is picked up by the next one, and at worst sent twice.
+
+// parseSyncToken checks a token from a client, nil means a full sync.
+func parseSyncToken(token string) (*string, error) {
+	if token == "" {
+		return nil, nil
+	}
+	if _, err := strconv.ParseUint(token, 10, 64); err != nil {
+		return nil, errInvalidSyncToken
+	}
+	return &token, nil
+}
+
+// syncChanges returns the todos the user can see that changed since the
+// token, with tombstones for the deleted ones, or all of them when since is
+// nil.
+func syncChanges(ctx context.Context, tx *sql.Tx, userID int, since *string) (model.SyncResponse, error) {
+	resp := model.SyncResponse{Todos: []model.SyncTodo{}, Deleted: []model.SyncTombstone{}}
+
+	// read first, whatever commits while the rest runs is sent again next time
+	err := tx.QueryRowContext(ctx, "SELECT pg_snapshot_xmin(pg_current_snapshot())::text").Scan(&resp.Token)
+	if err != nil {
+		return resp, err
+	}
+
+	changed, args := "TRUE", []any{userID}
+	if since != nil {
+		changed, args = "id IN (SELECT todo_id FROM todo_history WHERE tx_id >= $2::xid8)", append(args, *since)
+	}
+	rows, err := tx.QueryContext(ctx, `
+		SELECT todo_uuid(id), title, description, completed, list_id, priority, due_at, `+commentCount+`, created_at, updated_at,
+			(SELECT COALESCE(MAX(h.version), 0) FROM todo_history h WHERE h.todo_id = todos.id), crdt_state
+		FROM todos
+		WHERE `+visibleTodos+` AND `+changed+`
+		ORDER BY id
+	`, args...)
+	if err != nil {
+		return resp, err
+	}
+	defer rows.Close()
+
+	var todos []model.Todo
+	for rows.Next() {
+		var t model.SyncTodo
+		var state []byte
+		err := rows.Scan(&t.ID, &t.Title, &t.Description, &t.Completed, &t.ListID, &t.Priority, &t.DueAt, &t.CommentCount,
+			&t.CreatedAt, &t.UpdatedAt, &t.Version, &state)
+		if err != nil {
+			return resp, err
+		}
+		if state == nil {
+			t.CRDT = crdt.NewTodo(crdtValues(snapshotOf(t.Todo)))
+		} else if err := json.Unmarshal(state, &t.CRDT); err != nil {
+			return resp, err
+		} else {
+			t.CRDT.Fill(crdtValues(snapshotOf(t.Todo)))
+		}
+		resp.Todos = append(resp.Todos, t)
+		todos = append(todos, t.Todo)
+	}
+	if err := rows.Err(); err != nil {
+		return resp, err
+	}
+	rows.Close()
+	if err := loadAssignees(ctx, tx, todos); err != nil {
+		return resp, err
+	}
+	for i := range todos {
+		resp.Todos[i].Todo = todos[i]
+	}
+
+	if since == nil {
+		return resp, nil
+	}
+	// a todo is gone when its last version is a delete, visibility is
+	// checked against the list it was in
+	rows, err = tx.QueryContext(ctx, `
+		SELECT todo_uuid(todo_id), changed_at
+		FROM todo_history h
+		WHERE `+visibleTodos+` AND tx_id >= $2::xid8 AND action = 'delete'
+		AND version = (SELECT MAX(x.version) FROM todo_history x WHERE x.todo_id = h.todo_id)
+		AND NOT EXISTS (SELECT 1 FROM todos t WHERE t.id = h.todo_id)
+		ORDER BY todo_id
+	`, userID, *since)
+	if err != nil {
+		return resp, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var d model.SyncTombstone
+		if err := rows.Scan(&d.ID, &d.DeletedAt); err != nil {
+			return resp, err
+		}
+		resp.Deleted = append(resp.Deleted, d)
+	}
+	return resp, rows.Err()
+}
+
+// getSync returns what changed since the since token, for clients that keep
+// a local copy of their todos.
+func (s *Server) getSync(c *gin.Context) {
+	ctx, span := s.tracer.Start(c.Request.Context(), "get_sync")
+	defer span.End()
+
+	userID := currentUserID(c)
+	span.SetAttributes(attribute.Int("user.id", userID))
+
+	since, err := parseSyncToken(c.Query("since"))
+	if err != nil {
+		logError("invalid sync token", ctx, s.logger, span, err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid sync token"})
+		return
+	}
+
+	tx, err := s.beginTenantTx(ctx, c)
+	if err != nil {
+		logError("begin transaction failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	resp, err := syncChanges(ctx, tx, userID, since)
+	if err != nil {
+		logError("query failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	span.SetAttributes(
+		attribute.Bool("sync.full", since == nil),
+		attribute.Int("sync.todo_count", len(resp.Todos)),
+		attribute.Int("sync.deleted_count", len(resp.Deleted)),
+	)
+	c.JSON(http.StatusOK, resp)
+}
+
+// postSync applies a batch of offline mutations in order, each in its own
+// transaction, and returns their results with the changes since the
+// request's token. Conflicts are resolved the same way whatever order
+// clients sync in: a delete wins over an update, and a field the server
+// changed since the client's base version keeps the server's value.
+func (s *Server) postSync(c *gin.Context) {
+	ctx, span := s.tracer.Start(c.Request.Context(), "post_sync")
+	defer span.End()
+
+	userID := currentUserID(c)
+	span.SetAttributes(attribute.Int("user.id", userID))
+
+	var req model.SyncRequest
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxSyncBodyBytes)
+	if err := c.ShouldBindJSON(&req); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			logError("sync request too large", ctx, s.logger, span, err,
+				slog.Int64("max_bytes", maxSyncBodyBytes),
+			)
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Sync requests can be at most " + strconv.Itoa(maxSyncBodyBytes) + " bytes"})
+			return
+		}
+		logError("failed to parse json", ctx, s.logger, span, err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	since, err := parseSyncToken(req.Since)
+	if err != nil {
+		logError("invalid sync token", ctx, s.logger, span, err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid sync token"})
+		return
+	}
+	if len(req.Mutations) > maxSyncMutations {
+		logError("too many mutations", ctx, s.logger, span, errors.New("batch too large"),
+			slog.Int("mutation_count", len(req.Mutations)),
+		)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "At most " + strconv.Itoa(maxSyncMutations) + " mutations per request"})
+		return
+	}
+
+	results := make([]model.SyncResult, 0, len(req.Mutations))
+	for _, m := range req.Mutations {
+		res, err := s.applyMutation(ctx, c, m)
+		if err != nil {
+			// the mutations before were committed, the client sends the
+			// rest again and the applied ones come back as duplicates
+			logError("applying mutation failed", ctx, s.logger, span, err,
+				slog.String("op", m.Op),
+				slog.String("task_id", m.ID),
+			)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		results = append(results, res)
+	}
+
+	tx, err := s.beginTenantTx(ctx, c)
+	if err != nil {
+		logError("begin transaction failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	resp, err := syncChanges(ctx, tx, userID, since)
+	if err != nil {
+		logError("query failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	resp.Results = results
+
+	s.logger.InfoContext(ctx, "sync applied",
+		slog.Int("user_id", userID),
+		slog.Int("mutation_count", len(results)),
+	)
+	span.SetAttributes(
+		attribute.Int("sync.mutation_count", len(results)),
+		attribute.Int("sync.todo_count", len(resp.Todos)),
+		attribute.Int("sync.deleted_count", len(resp.Deleted)),
+	)
+	c.JSON(http.StatusOK, resp)
+}
+
+// applyMutation applies one mutation in its own transaction. Mutations that
+// can't be applied come back rejected or conflicting and change nothing, err
+// is only for failures of the server.
+func (s *Server) applyMutation(ctx context.Context, c *gin.Context, m model.SyncMutation) (model.SyncResult, error) {
+	ctx, span := s.tracer.Start(ctx, "apply_sync_mutation")
+	defer span.End()
+	span.SetAttributes(
+		attribute.String("sync.op", m.Op),
+		attribute.String("task.uuid", m.ID),
+	)
+
+	res := model.SyncResult{ID: m.ID}
+	u, err := uuid.Parse(m.ID)
+	if err != nil || u == uuid.Nil {
+		return rejected(res, "id must be a UUID"), nil
+	}
+	res.ID = u.String()
+
+	tx, err := s.beginTenantTx(ctx, c)
+	if err != nil {
+		return res, err
+	}
+	defer tx.Rollback()
+
+	// 0 when no todo of the workspace ever had the ID
+	var todoID int
+	err = tx.QueryRowContext(ctx, "SELECT todo_id FROM todo_ids WHERE uuid = $1", res.ID).Scan(&todoID)
+	if err != nil && err != sql.ErrNoRows {
+		return res, err
+	}
+
+	switch m.Op {
+	case model.SyncCreate:
+		res, err = syncCreate(ctx, tx, c, m, res, todoID)
+	case model.SyncUpdate:
+		res, err = syncUpdate(ctx, tx, c, m, res, todoID)
+	case model.SyncDelete:
+		res, err = syncDelete(ctx, tx, c, res, todoID, s.cfg.UndoTTL)
+	default:
+		res = rejected(res, "op must be create, update or delete")
+	}
+	if err != nil || res.Status == model.SyncRejected {
+		return res, err
+	}
+	if err := tx.Commit(); err != nil {
+		return res, err
+	}
+
+	span.SetAttributes(
+		attribute.Int("task.id", todoID),
+		attribute.String("sync.status", res.Status),
+	)
+	return res, nil
+}
+
+func rejected(res model.SyncResult, msg string) model.SyncResult {
+	res.Status, res.Error = model.SyncRejected, msg
+	return res
+}
+
+// crdtError is the reason a client's crdt state is rejected.
+func crdtError(err error) string {
+	if errors.Is(err, crdt.ErrTooLarge) {
+		return "Description can have at most " + strconv.Itoa(crdt.MaxElems) + " characters, deleted ones included"
+	}
+	return "Invalid crdt state"
+}
+
+// checkSyncTodo returns why the values of a mutation can't be written, or
+// "" when they can. The due date is truncated to seconds like the REST API
+// does.
+func checkSyncTodo(t *model.TodoSnapshot) string {
+	if !validTitle(t.Title) {
+		return "title must be 1 to 255 characters"
+	}
+	if !slices.Contains(model.Priorities, t.Priority) {
+		return "Invalid priority"
+	}
+	if t.DueAt != nil {
+		d := t.DueAt.UTC().Truncate(time.Second)
+		t.DueAt = &d
+	}
+	return ""
+}
+
+func syncCreate(ctx context.Context, tx *sql.Tx, c *gin.Context, m model.SyncMutation, res model.SyncResult, todoID int) (model.SyncResult, error) {
+	if todoID != 0 {
+		res.Status = model.SyncDuplicate
+		return res, nil
+	}
+	if m.Todo == nil {
+		return rejected(res, "todo is required"), nil
+	}
+	after := *m.Todo
+	if m.CRDT != nil {
+		if err := m.CRDT.Validate(); err != nil {
+			return rejected(res, crdtError(err)), nil
+		}
+		// registers the client's state doesn't have yet take the todo's
+		// values
+		m.CRDT.Fill(crdtValues(after))
+		setCRDTValues(&after, m.CRDT.Values())
+	}
+	if msg := checkSyncTodo(&after); msg != "" {
+		return rejected(res, msg), nil
+	}
+
+	userID, workspaceID := currentUserID(c), currentWorkspaceID(c)
+	if after.ListID != nil {
+		r, err := listRole(ctx, tx, *after.ListID, userID)
+		if err == sql.ErrNoRows || (err == nil && r < roleEditor) {
+			return rejected(res, "You need the editor role on this list"), nil
+		}
+		if err != nil {
+			return res, err
+		}
+	}
+
+	err := tx.QueryRowContext(ctx, `
+		INSERT INTO todos (title, description, completed, owner_id, list_id, workspace_id, priority, due_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING id
+	`, after.Title, after.Description, after.Completed, userID, after.ListID, workspaceID,
+		after.Priority, after.DueAt).Scan(&todoID)
+	if err != nil {
+		return res, err
+	}
+	inserted, err := insertTodoID(ctx, tx, res.ID, todoID, workspaceID)
+	if err != nil {
+		return res, err
+	}
+	if !inserted {
+		// a todo of another workspace has it
+		return rejected(res, "id is taken"), nil
+	}
+	if m.CRDT != nil {
+		if err := saveCRDT(ctx, tx, todoID, m.CRDT); err != nil {
+			return res, err
+		}
+	}
+	_, _, err = recordChange(ctx, tx, todoChange{
+		todoID:      todoID,
+		workspaceID: workspaceID,
+		ownerID:     userID,
+		action:      model.HistoryCreate,
+		after:       &after,
+		changedBy:   userID,
+	})
+	res.Status = model.SyncApplied
+	return res, err
+}
+
+func syncUpdate(ctx context.Context, tx *sql.Tx, c *gin.Context, m model.SyncMutation, res model.SyncResult, todoID int) (model.SyncResult, error) {
+	if todoID == 0 {
+		return rejected(res, "Task not found"), nil
+	}
+	if m.Todo == nil {
+		return rejected(res, "todo is required"), nil
+	}
+	userID := currentUserID(c)
+
+	exists, have, err := historyRole(ctx, tx, todoID, userID)
+	if err == sql.ErrNoRows || (err == nil && have < roleViewer) {
+		return rejected(res, "Task not found"), nil
+	}
+	if err != nil {
+		return res, err
+	}
+	if !exists {
+		res.Status, res.Conflicts = model.SyncConflict, []string{"deleted"}
+		return res, nil
+	}
+	if have < roleEditor {
+		return rejected(res, "You need the editor role on this task"), nil
+	}
+
+	current, ownerID, err := lockTodo(ctx, tx, todoID)
+	if err != nil {
+		return res, err
+	}
+	var version int
+	err = tx.QueryRowContext(ctx, `
+		SELECT COALESCE(MAX(version), 0) FROM todo_history WHERE todo_id = $1
+	`, todoID).Scan(&version)
+	if err != nil {
+		return res, err
+	}
+
+	target := *m.Todo
+	if m.CRDT != nil {
+		// the state has every edit the client saw, the base version isn't
+		// needed
+		state, err := loadCRDT(ctx, tx, todoID, current)
+		if err != nil {
+			return res, err
+		}
+		if err := state.Merge(m.CRDT); err != nil {
+			return rejected(res, crdtError(err)), nil
+		}
+		if err := saveCRDT(ctx, tx, todoID, state); err != nil {
+			return res, err
+		}
+		setCRDTValues(&target, state.Values())
+		// state from before priority and due_at were in it can't change
+		// them, a different value in the todo conflicts
+		changed := diffTodo(&target, m.Todo)
+		if _, ok := changed["due_at"]; ok && m.CRDT.DueAt.Stamp == (crdt.Stamp{}) {
+			res.Conflicts = append(res.Conflicts, "due_at")
+		}
+		if _, ok := changed["priority"]; ok && m.CRDT.Priority.Stamp == (crdt.Stamp{}) {
+			res.Conflicts = append(res.Conflicts, "priority")
+		}
+	} else if m.BaseVersion != 0 && m.BaseVersion != version {
+		base, err := queryHistory(ctx, tx, todoID, m.BaseVersion)
+		if err != nil {
+			return res, err
+		}
+		if len(base) == 0 {
+			return rejected(res, "Unknown base_version"), nil
+		}
+		target, res.Conflicts = mergeTodo(base[0].Todo, current, target)
+	}
+	if msg := checkSyncTodo(&target); msg != "" {
+		return rejected(res, msg), nil
+	}
+	// the list isn't changed, todos stay in the list they were created in
+	target.ListID = current.ListID
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE todos SET title = $2, description = $3, completed = $4, priority = $5, due_at = $6 WHERE id = $1
+	`, todoID, target.Title, target.Description, target.Completed, target.Priority, target.DueAt)
+	if err != nil {
+		return res, err
+	}
+	_, _, err = recordChange(ctx, tx, todoChange{
+		todoID:      todoID,
+		workspaceID: currentWorkspaceID(c),
+		ownerID:     ownerID,
+		action:      model.HistoryUpdate,
+		before:      &current,
+		after:       &target,
+		changedBy:   userID,
+	})
+	res.Status = model.SyncApplied
+	if len(res.Conflicts) > 0 {
+		res.Status = model.SyncMerged
+	}
+	return res, err
+}
+
+// mergeTodo applies the fields the client changed from base onto the
+// server's current state, except those the server changed too. Those keep
+// the server's value and are returned as conflicts, sorted.
+func mergeTodo(base, server, client model.TodoSnapshot) (model.TodoSnapshot, []string) {
+	merged := server
+	serverChanges := diffTodo(&base, &server)
+	var conflicts []string
+	for name, change := range diffTodo(&base, &client) {
+		if sc, ok := serverChanges[name]; ok && sc.New != change.New {
+			conflicts = append(conflicts, name)
+			continue
+		}
+		switch name {
+		case "title":
+			merged.Title = client.Title
+		case "description":
+			merged.Description = client.Description
+		case "completed":
+			merged.Completed = client.Completed
+		case "priority":
+			merged.Priority = client.Priority
+		case "due_at":
+			merged.DueAt = client.DueAt
+		}
+	}
+	slices.Sort(conflicts)
+	return merged, conflicts
+}
+
+func syncDelete(ctx context.Context, tx *sql.Tx, c *gin.Context, res model.SyncResult, todoID int, undoTTL time.Duration) (model.SyncResult, error) {
+	if todoID == 0 {
+		return rejected(res, "Task not found"), nil
+	}
+	userID := currentUserID(c)
+
+	exists, have, err := historyRole(ctx, tx, todoID, userID)
+	if err == sql.ErrNoRows || (err == nil && have < roleViewer) {
+		return rejected(res, "Task not found"), nil
+	}
+	if err != nil {
+		return res, err
+	}
+	if !exists {
+		res.Status = model.SyncDuplicate
+		return res, nil
+	}
+	if have < roleEditor {
+		return rejected(res, "You need the editor role on this task"), nil
+	}
+
+	before, ownerID, err := lockTodo(ctx, tx, todoID)
+	if err != nil {
+		return res, err
+	}
+	_, _, err = recordChange(ctx, tx, todoChange{
+		todoID:      todoID,
+		workspaceID: currentWorkspaceID(c),
+		ownerID:     ownerID,
+		action:      model.HistoryDelete,
+		before:      &before,
+		changedBy:   userID,
+	})
+	if err != nil {
+		return res, err
+	}
+	// kept like any other delete, so a revert can bring its comments back
+	if err := trashTodo(ctx, tx, todoID, currentWorkspaceID(c), undoTTL); err != nil {
+		return res, err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM todos WHERE id = $1", todoID); err != nil {
+		return res, err
+	}
+	res.Status = model.SyncApplied
+	return res, nil
+}
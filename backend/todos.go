@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/thakurnishu/MinimalDo/model"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The todo writes behind the REST handlers and the WebSocket commands, so
+// authorization, history and undo are the same for both. They run as the
+// user in the workspace of c, log what goes wrong and return an apiError for
+// what the request got wrong.
+
+// todoWrite is what a create, update or delete did.
+type todoWrite struct {
+	todo      model.Todo // the todo as written, empty for a delete
+	undoToken string     // empty when nothing changed
+	eventID   int64      // the history row of the change, 0 when nothing changed
+}
+
+// addTodo creates a todo from a JSON body.
+func (s *Server) addTodo(ctx context.Context, span trace.Span, c *gin.Context, body []byte) (todoWrite, error) {
+	var t model.Todo
+	if err := json.Unmarshal(body, &t); err != nil {
+		logError("failed to parse json", ctx, s.logger, span, err)
+		return todoWrite{}, &apiError{http.StatusBadRequest, err.Error()}
+	}
+	// clients may bring the id, to refer to the todo before it is created
+	id, err := newTodoID(t.ID)
+	if err != nil {
+		logError("invalid id", ctx, s.logger, span, err,
+			slog.String("task_id", t.ID),
+		)
+		return todoWrite{}, &apiError{http.StatusBadRequest, "Invaild ID"}
+	}
+	t.ID = id
+	if err := normalizeTodoFields(&t); err != nil {
+		logError("invalid task", ctx, s.logger, span, err)
+		return todoWrite{}, &apiError{http.StatusBadRequest, err.Error()}
+	}
+
+	userID, workspaceID := currentUserID(c), currentWorkspaceID(c)
+	span.SetAttributes(attribute.Int("user.id", userID))
+
+	tx, err := s.beginTenantTx(ctx, c)
+	if err != nil {
+		logError("begin transaction failed", ctx, s.logger, span, err)
+		return todoWrite{}, err
+	}
+	defer tx.Rollback()
+
+	if t.ListID != nil {
+		if err := s.checkList(c, ctx, span, tx, *t.ListID, roleEditor); err != nil {
+			return todoWrite{}, err
+		}
+	}
+
+	var todoID int
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO todos (title, description, completed, owner_id, list_id, workspace_id, priority, due_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING id, created_at, updated_at
+	`, t.Title, t.Description, t.Completed, userID, t.ListID, workspaceID, t.Priority, t.DueAt,
+	).Scan(&todoID, &t.CreatedAt, &t.UpdatedAt)
+	if err != nil {
+		logError("row scan failed", ctx, s.logger, span, err)
+		return todoWrite{}, err
+	}
+	inserted, err := insertTodoID(ctx, tx, t.ID, todoID, workspaceID)
+	if err != nil {
+		logError("query execution failed", ctx, s.logger, span, err)
+		return todoWrite{}, err
+	}
+	if !inserted {
+		s.logger.WarnContext(ctx, "task id taken",
+			slog.String("task_id", t.ID),
+		)
+		span.SetStatus(codes.Error, "task id taken")
+		return todoWrite{}, &apiError{http.StatusConflict, "A task with this ID already exists"}
+	}
+	t.Assignees = []model.User{}
+
+	after := snapshotOf(t)
+	w := todoWrite{todo: t}
+	version, eventID, err := recordChange(ctx, tx, todoChange{
+		todoID:      todoID,
+		workspaceID: workspaceID,
+		ownerID:     userID,
+		action:      model.HistoryCreate,
+		after:       &after,
+		changedBy:   userID,
+	})
+	if err != nil {
+		logError("recording history failed", ctx, s.logger, span, err)
+		return todoWrite{}, err
+	}
+	if err := s.finishTodoWrite(ctx, span, c, tx, &w, todoID, version, eventID); err != nil {
+		return todoWrite{}, err
+	}
+
+	s.logger.InfoContext(ctx, "created task",
+		slog.String("task_title", t.Title),
+		slog.Bool("task_creation_completed", true),
+	)
+	span.SetAttributes(
+		attribute.String("task.title", t.Title),
+		attribute.Bool("task.creation_completed", true),
+	)
+	return w, nil
+}
+
+// editTodo updates a todo from a JSON body. Priority and due_at are left as
+// they are when the body doesn't have them, for clients that don't know them.
+func (s *Server) editTodo(ctx context.Context, span trace.Span, c *gin.Context, idStr string, body []byte) (todoWrite, error) {
+	id, err := s.resolveTodo(ctx, span, idStr)
+	if err != nil {
+		return todoWrite{}, err
+	}
+
+	s.logger.InfoContext(ctx, "todo to update",
+		slog.String("todo_id", idStr),
+	)
+	userID := currentUserID(c)
+	span.SetAttributes(
+		attribute.String("todo.id", idStr),
+		attribute.Int("user.id", userID),
+	)
+
+	var t model.Todo
+	var sent map[string]json.RawMessage
+	if err := json.Unmarshal(body, &t); err != nil {
+		logError("failed to parse json", ctx, s.logger, span, err)
+		return todoWrite{}, &apiError{http.StatusBadRequest, err.Error()}
+	}
+	if err := json.Unmarshal(body, &sent); err != nil {
+		logError("failed to parse json", ctx, s.logger, span, err)
+		return todoWrite{}, &apiError{http.StatusBadRequest, err.Error()}
+	}
+	_, setPriority := sent["priority"]
+	_, setDueAt := sent["due_at"]
+	if err := normalizeTodoFields(&t); err != nil {
+		logError("invalid task", ctx, s.logger, span, err)
+		return todoWrite{}, &apiError{http.StatusBadRequest, err.Error()}
+	}
+
+	tx, err := s.beginTenantTx(ctx, c)
+	if err != nil {
+		logError("begin transaction failed", ctx, s.logger, span, err)
+		return todoWrite{}, err
+	}
+	defer tx.Rollback()
+
+	if err := s.checkTodo(c, ctx, span, tx, id, roleEditor); err != nil {
+		return todoWrite{}, err
+	}
+	before, ownerID, err := lockTodo(ctx, tx, id)
+	if err != nil {
+		logError("task lookup failed", ctx, s.logger, span, err)
+		return todoWrite{}, err
+	}
+
+	// list_id is not updated, todos stay in the list they were created in
+	err = tx.QueryRowContext(ctx, `
+		UPDATE todos
+		SET title = $1, description = $2, completed = $3,
+			priority = CASE WHEN $5 THEN $6 ELSE priority END,
+			due_at = CASE WHEN $7 THEN $8 ELSE due_at END
+		WHERE id = $4
+		RETURNING todo_uuid(id), title, description, completed, list_id, priority, due_at, `+commentCount+`, created_at, updated_at
+	`, t.Title, t.Description, t.Completed, id, setPriority, t.Priority, setDueAt, t.DueAt,
+	).Scan(&t.ID, &t.Title, &t.Description, &t.Completed, &t.ListID, &t.Priority, &t.DueAt, &t.CommentCount, &t.CreatedAt, &t.UpdatedAt)
+	if err == sql.ErrNoRows {
+		logError("task not found", ctx, s.logger, span, err,
+			slog.Int("task_id", id),
+		)
+		return todoWrite{}, &apiError{http.StatusNotFound, "Task not found"}
+	}
+	if err != nil {
+		logError("row scan failed", ctx, s.logger, span, err)
+		return todoWrite{}, err
+	}
+	todos := []model.Todo{t}
+	if err := loadAssignees(ctx, tx, todos); err != nil {
+		logError("assignee lookup failed", ctx, s.logger, span, err)
+		return todoWrite{}, err
+	}
+	t = todos[0]
+
+	after := snapshotOf(t)
+	w := todoWrite{todo: t}
+	version, eventID, err := recordChange(ctx, tx, todoChange{
+		todoID:      id,
+		workspaceID: currentWorkspaceID(c),
+		ownerID:     ownerID,
+		action:      model.HistoryUpdate,
+		before:      &before,
+		after:       &after,
+		changedBy:   userID,
+	})
+	if err != nil {
+		logError("recording history failed", ctx, s.logger, span, err)
+		return todoWrite{}, err
+	}
+	if err := s.finishTodoWrite(ctx, span, c, tx, &w, id, version, eventID); err != nil {
+		return todoWrite{}, err
+	}
+
+	s.logger.InfoContext(ctx, "task updated",
+		slog.Int("task_id", id),
+		slog.String("task_title", t.Title),
+		slog.Bool("task_updation_completed", true),
+	)
+	span.SetAttributes(
+		attribute.Int("task.id", id),
+		attribute.String("task.title", t.Title),
+		attribute.Bool("task.updation_completed", true),
+	)
+	return w, nil
+}
+
+// removeTodo deletes a todo.
+func (s *Server) removeTodo(ctx context.Context, span trace.Span, c *gin.Context, idStr string) (todoWrite, error) {
+	id, err := s.resolveTodo(ctx, span, idStr)
+	if err != nil {
+		return todoWrite{}, err
+	}
+
+	userID := currentUserID(c)
+	span.SetAttributes(attribute.Int("user.id", userID))
+
+	tx, err := s.beginTenantTx(ctx, c)
+	if err != nil {
+		logError("begin transaction failed", ctx, s.logger, span, err)
+		return todoWrite{}, err
+	}
+	defer tx.Rollback()
+
+	if err := s.checkTodo(c, ctx, span, tx, id, roleEditor); err != nil {
+		return todoWrite{}, err
+	}
+
+	before, ownerID, err := lockTodo(ctx, tx, id)
+	if err != nil {
+		logError("task lookup failed", ctx, s.logger, span, err)
+		return todoWrite{}, err
+	}
+	var w todoWrite
+	version, eventID, err := recordChange(ctx, tx, todoChange{
+		todoID:      id,
+		workspaceID: currentWorkspaceID(c),
+		ownerID:     ownerID,
+		action:      model.HistoryDelete,
+		before:      &before,
+		changedBy:   userID,
+	})
+	if err != nil {
+		logError("recording history failed", ctx, s.logger, span, err)
+		return todoWrite{}, err
+	}
+
+	if err := trashTodo(ctx, tx, id, currentWorkspaceID(c), s.cfg.UndoTTL); err != nil {
+		logError("query execution failed", ctx, s.logger, span, err)
+		return todoWrite{}, err
+	}
+	result, err := tx.ExecContext(ctx, "DELETE FROM todos WHERE id = $1", id)
+	if err != nil {
+		logError("query execution failed", ctx, s.logger, span, err)
+		return todoWrite{}, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		logError("affected rows check failed", ctx, s.logger, span, err)
+		return todoWrite{}, err
+	}
+	if rowsAffected == 0 {
+		s.logger.WarnContext(ctx, "task not found",
+			slog.Int("task_id", id),
+		)
+		span.SetStatus(codes.Error, "task not found")
+		return todoWrite{}, &apiError{http.StatusNotFound, "Task not found"}
+	}
+
+	if err := s.finishTodoWrite(ctx, span, c, tx, &w, id, version, eventID); err != nil {
+		return todoWrite{}, err
+	}
+
+	s.logger.InfoContext(ctx, "task delete",
+		slog.Int("task_id", id),
+		slog.Bool("task_deletion_completed", true),
+	)
+	span.SetAttributes(
+		attribute.Int("task.id", id),
+		attribute.Bool("task.deletion_completed", true),
+	)
+	return w, nil
+}
+
+// finishTodoWrite issues the undo token of a recorded change and commits it.
+func (s *Server) finishTodoWrite(ctx context.Context, span trace.Span, c *gin.Context, tx *sql.Tx, w *todoWrite, todoID, version int, eventID int64) error {
+	token, err := s.issueUndo(c, ctx, tx, todoID, version)
+	if err != nil {
+		logError("issuing undo token failed", ctx, s.logger, span, err)
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		logError("commit failed", ctx, s.logger, span, err)
+		return err
+	}
+	w.undoToken, w.eventID = token, eventID
+	return nil
+}
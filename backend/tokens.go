@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"github.com/thakurnishu/MinimalDo/model"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// apiTokenPrefix marks personal access tokens so AuthMiddleware can tell them
+// from JWTs, and makes leaked tokens easy to find with secret scanners.
+const apiTokenPrefix = "mdo_pat_"
+
+var validScopes = []string{model.ScopeTodosRead, model.ScopeTodosWrite}
+
+func (s *Server) listAPITokens(c *gin.Context) {
+	ctx, span := s.tracer.Start(c.Request.Context(), "list_api_tokens")
+	defer span.End()
+
+	userID := currentUserID(c)
+	span.SetAttributes(attribute.Int("user.id", userID))
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, name, token_prefix, scopes, created_at, expires_at, last_used_at
+		FROM api_tokens
+		WHERE user_id = $1 AND revoked_at IS NULL
+		ORDER BY created_at DESC
+	`, userID)
+	if err != nil {
+		logError("query execution failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	tokens := []model.APIToken{}
+	for rows.Next() {
+		var t model.APIToken
+		if err := rows.Scan(&t.ID, &t.Name, &t.Prefix, pq.Array(&t.Scopes), &t.CreatedAt, &t.ExpiresAt, &t.LastUsedAt); err != nil {
+			logError("row scan failed", ctx, s.logger, span, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		tokens = append(tokens, t)
+	}
+	if err := rows.Err(); err != nil {
+		logError("row iteration failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, tokens)
+}
+
+func (s *Server) createAPIToken(c *gin.Context) {
+	ctx, span := s.tracer.Start(c.Request.Context(), "create_api_token")
+	defer span.End()
+
+	var req model.CreateTokenRequest
+	if err := c.BindJSON(&req); err != nil {
+		logError("failed to parse json", ctx, s.logger, span, err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+
+	if err := validateTokenRequest(req); err != nil {
+		logError("invalid token request", ctx, s.logger, span, err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	slices.Sort(req.Scopes)
+	req.Scopes = slices.Compact(req.Scopes)
+
+	secret, err := newToken()
+	if err != nil {
+		logError("token generation failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	token := apiTokenPrefix + secret
+
+	userID := currentUserID(c)
+	span.SetAttributes(attribute.Int("user.id", userID))
+
+	var expiresAt *time.Time
+	if req.ExpiresAt != nil {
+		utc := req.ExpiresAt.UTC()
+		expiresAt = &utc
+	}
+
+	created := model.CreatedToken{Token: token}
+	err = s.db.QueryRowContext(ctx, `
+		INSERT INTO api_tokens (user_id, name, token_hash, token_prefix, scopes, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, name, token_prefix, scopes, created_at, expires_at, last_used_at
+	`, userID, req.Name, hashToken(token), token[:len(apiTokenPrefix)+4], pq.Array(req.Scopes), expiresAt).Scan(
+		&created.ID, &created.Name, &created.Prefix, pq.Array(&created.Scopes), &created.CreatedAt, &created.ExpiresAt, &created.LastUsedAt,
+	)
+	if err != nil {
+		logError("row scan failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	s.logger.InfoContext(ctx, "api token created",
+		slog.Int("user_id", userID),
+		slog.Int("api_token_id", created.ID),
+		slog.String("scopes", strings.Join(created.Scopes, " ")),
+	)
+	span.SetAttributes(attribute.Int("api_token.id", created.ID))
+
+	c.JSON(http.StatusCreated, created)
+}
+
+func (s *Server) revokeAPIToken(c *gin.Context) {
+	ctx, span := s.tracer.Start(c.Request.Context(), "revoke_api_token")
+	defer span.End()
+
+	idStr := c.Param("id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		logError("invalid id", ctx, s.logger, span, err,
+			slog.String("api_token_id", idStr),
+		)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invaild ID"})
+		return
+	}
+
+	userID := currentUserID(c)
+	span.SetAttributes(attribute.Int("user.id", userID))
+
+	result, err := s.db.ExecContext(ctx, `
+		UPDATE api_tokens SET revoked_at = NOW()
+		WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL
+	`, id, userID)
+	if err != nil {
+		logError("query execution failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		logError("affected rows check failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if rowsAffected == 0 {
+		s.logger.WarnContext(ctx, "api token not found",
+			slog.Int("api_token_id", id),
+		)
+		span.SetStatus(codes.Error, "api token not found")
+		c.JSON(http.StatusNotFound, gin.H{"error": "Token not found"})
+		return
+	}
+
+	s.logger.InfoContext(ctx, "api token revoked",
+		slog.Int("user_id", userID),
+		slog.Int("api_token_id", id),
+	)
+	span.SetAttributes(attribute.Int("api_token.id", id))
+
+	c.Status(http.StatusNoContent)
+}
+
+// authenticateAPIToken is the AuthMiddleware path for personal access tokens.
+func (s *Server) authenticateAPIToken(c *gin.Context, token string) {
+	ctx := c.Request.Context()
+	span := trace.SpanFromContext(ctx)
+
+	// last_used_at is only written once a minute so a busy script doesn't
+	// turn every request into a write.
+	var tokenID, userID int
+	var scopes []string
+	err := s.db.QueryRowContext(ctx, `
+		WITH t AS (
+			SELECT id, user_id, scopes, last_used_at
+			FROM api_tokens
+			WHERE token_hash = $1 AND revoked_at IS NULL
+			AND (expires_at IS NULL OR expires_at > NOW())
+		), touched AS (
+			UPDATE api_tokens SET last_used_at = NOW()
+			FROM t
+			WHERE api_tokens.id = t.id
+			AND (t.last_used_at IS NULL OR t.last_used_at < NOW() - INTERVAL '1 minute')
+		)
+		SELECT id, user_id, scopes FROM t
+	`, hashToken(token)).Scan(&tokenID, &userID, pq.Array(&scopes))
+	if err == sql.ErrNoRows {
+		s.logger.WarnContext(ctx, "invalid api token",
+			slog.String("path", c.Request.URL.Path),
+		)
+		span.SetStatus(codes.Error, "invalid api token")
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired token"})
+		return
+	}
+	if err != nil {
+		logError("api token lookup failed", ctx, s.logger, span, err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	span.SetAttributes(
+		attribute.Int("enduser.id", userID),
+		attribute.Int("api_token.id", tokenID),
+	)
+	c.Set(ctxUserID, userID)
+	c.Set(ctxAPITokenID, tokenID)
+	c.Set(ctxScopes, scopes)
+	c.Next()
+}
+
+// requireScope rejects personal access tokens without scope. Sessions from a
+// password or SSO login are not scoped.
+func (s *Server) requireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		if err := s.checkScope(c, ctx, trace.SpanFromContext(ctx), scope); err != nil {
+			writeError(c, err)
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// checkScope is requireScope for a request that is already running, like a
+// WebSocket command.
+func (s *Server) checkScope(c *gin.Context, ctx context.Context, span trace.Span, scope string) error {
+	if hasScope(c, scope) {
+		return nil
+	}
+	logError("missing token scope", ctx, s.logger, span, errors.New("token lacks scope "+scope),
+		slog.Int("user_id", currentUserID(c)),
+		slog.Int("api_token_id", c.GetInt(ctxAPITokenID)),
+		slog.String("path", c.Request.URL.Path),
+	)
+	return &apiError{http.StatusForbidden, "Token is missing the " + scope + " scope"}
+}
+
+// hasScope tells whether the request may use scope: it has a session or a
+// token with the scope.
+func hasScope(c *gin.Context, scope string) bool {
+	scopes, scoped := c.Get(ctxScopes)
+	return !scoped || slices.Contains(scopes.([]string), scope)
+}
+
+// readScope and writeScope are the scopes personal access tokens need for
+// reading and changing todos and lists.
+func (s *Server) readScope() gin.HandlerFunc {
+	return s.requireScope(model.ScopeTodosRead)
+}
+
+func (s *Server) writeScope() gin.HandlerFunc {
+	return s.requireScope(model.ScopeTodosWrite)
+}
+
+// requireSession rejects personal access tokens, for endpoints that manage
+// the account itself.
+func (s *Server) requireSession() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, scoped := c.Get(ctxScopes); !scoped {
+			c.Next()
+			return
+		}
+
+		ctx := c.Request.Context()
+		span := trace.SpanFromContext(ctx)
+		logError("api token used for session endpoint", ctx, s.logger, span, errors.New("session required"),
+			slog.Int("user_id", currentUserID(c)),
+			slog.Int("api_token_id", c.GetInt(ctxAPITokenID)),
+			slog.String("path", c.Request.URL.Path),
+		)
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "This endpoint needs a login session, not an API token"})
+	}
+}
+
+func validateTokenRequest(req model.CreateTokenRequest) error {
+	if req.Name == "" || len(req.Name) > 100 {
+		return errors.New("name must be 1-100 characters")
+	}
+	if len(req.Scopes) == 0 {
+		return errors.New("at least one scope is required (" + strings.Join(validScopes, ", ") + ")")
+	}
+	for _, scope := range req.Scopes {
+		if !slices.Contains(validScopes, scope) {
+			return errors.New("unknown scope " + strconv.Quote(scope) + ", want one of " + strings.Join(validScopes, ", "))
+		}
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		return errors.New("expires_at must be in the future")
+	}
+	return nil
+}
@@ -0,0 +1,288 @@
+package tui
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/mattn/go-runewidth"
+
+	"github.com/thakurnishu/MinimalDo/client"
+	"github.com/thakurnishu/MinimalDo/model"
+)
+
+var (
+	styleDefault  = tcell.StyleDefault
+	styleTitleBar = tcell.StyleDefault.Reverse(true).Bold(true)
+	styleHeader   = tcell.StyleDefault.Bold(true).Underline(true)
+	styleSelected = tcell.StyleDefault.Reverse(true)
+	styleDone     = tcell.StyleDefault.Dim(true)
+	styleBorder   = tcell.StyleDefault.Dim(true)
+	styleHint     = tcell.StyleDefault.Dim(true)
+	styleError    = tcell.StyleDefault.Foreground(tcell.ColorRed)
+	styleLabel    = tcell.StyleDefault.Bold(true)
+)
+
+const helpText = `Keys
+
+  j / k, ↓ / ↑      move selection
+  h / l, ← / →      previous / next period
+  1 2 3, tab        day / week / month view
+  t                 jump to today
+  a                 add a todo
+  e, enter          edit the selected todo
+  space, x          toggle completed
+  d, delete         delete the selected todo
+  r                 refresh now
+  q, ctrl-c         quit
+
+Press any key to close this help.`
+
+func (u *ui) draw() {
+	s := u.screen
+	s.Clear()
+	s.HideCursor()
+	width, height := s.Size()
+	if width < 20 || height < 6 {
+		drawText(s, 0, 0, width, styleDefault, "terminal too small")
+		s.Show()
+		return
+	}
+
+	u.drawTitleBar(width)
+
+	// Body sits between the title bar and the two bottom lines.
+	bodyTop, bodyHeight := 1, height-3
+	if u.mode == modeHelp {
+		for i, line := range strings.Split(helpText, "\n") {
+			if i >= bodyHeight {
+				break
+			}
+			drawText(s, 2, bodyTop+i, width-2, styleDefault, line)
+		}
+	} else {
+		listWidth := width * 55 / 100
+		u.drawList(0, bodyTop, listWidth, bodyHeight)
+		for y := bodyTop; y < bodyTop+bodyHeight; y++ {
+			s.SetContent(listWidth, y, tcell.RuneVLine, nil, styleBorder)
+		}
+		u.drawDetail(listWidth+2, bodyTop, width-listWidth-3, bodyHeight)
+	}
+
+	u.drawBottom(width, height)
+	s.Show()
+}
+
+func (u *ui) drawTitleBar(width int) {
+	for x := 0; x < width; x++ {
+		u.screen.SetContent(x, 0, ' ', nil, styleTitleBar)
+	}
+
+	var tabs []string
+	for _, r := range ranges {
+		if r == u.rangeType {
+			tabs = append(tabs, "["+strings.ToUpper(r)+"]")
+		} else {
+			tabs = append(tabs, " "+r+" ")
+		}
+	}
+	left := fmt.Sprintf(" MinimalDo · %s", periodLabel(u.rangeType, u.date))
+	right := strings.Join(tabs, " ") + " "
+
+	drawText(u.screen, 0, 0, width, styleTitleBar, left)
+	if w := runewidth.StringWidth(right); w+runewidth.StringWidth(left)+1 < width {
+		drawText(u.screen, width-w, 0, w, styleTitleBar, right)
+	}
+}
+
+func (u *ui) drawList(x, y, width, height int) {
+	if len(u.rows) == 0 {
+		msg := "No tasks for this period. Press a to add one."
+		if u.loading {
+			msg = "Loading…"
+		}
+		drawText(u.screen, x+1, y+1, width-2, styleHint, msg)
+		return
+	}
+
+	// Keep the selection on screen.
+	if u.selected >= 0 {
+		if u.selected < u.offset {
+			u.offset = u.selected
+		}
+		if u.selected >= u.offset+height {
+			u.offset = u.selected - height + 1
+		}
+	}
+	if u.offset > len(u.rows)-1 {
+		u.offset = 0
+	}
+
+	for i := 0; i < height && u.offset+i < len(u.rows); i++ {
+		idx := u.offset + i
+		r := u.rows[idx]
+		line := y + i
+
+		if r.todo == nil {
+			drawText(u.screen, x+1, line, width-2, styleHeader, formatDay(r.header))
+			continue
+		}
+
+		style := styleDefault
+		if r.todo.Completed {
+			style = styleDone
+		}
+		if idx == u.selected {
+			style = styleSelected
+			for cx := x; cx < x+width; cx++ {
+				u.screen.SetContent(cx, line, ' ', nil, style)
+			}
+		}
+		check := "[ ]"
+		if r.todo.Completed {
+			check = "[x]"
+		}
+		drawText(u.screen, x+1, line, width-2, style,
+			fmt.Sprintf("%s #%s %s", check, client.ShortID(r.todo.ID), r.todo.Title))
+	}
+}
+
+func (u *ui) drawDetail(x, y, width, height int) {
+	if width < 10 {
+		return
+	}
+	t := u.current()
+	if t == nil {
+		drawText(u.screen, x, y+1, width, styleHint, "Nothing selected")
+		return
+	}
+
+	line := y + 1
+	put := func(style tcell.Style, text string) {
+		for _, l := range wrap(text, width) {
+			if line >= y+height {
+				return
+			}
+			drawText(u.screen, x, line, width, style, l)
+			line++
+		}
+	}
+
+	put(styleLabel, t.Title)
+	line++
+	put(styleDefault, "Status:  "+statusText(t))
+	put(styleDefault, "ID:      "+t.ID)
+	put(styleDefault, "Created: "+t.CreatedAt.Local().Format("2006-01-02 15:04"))
+	put(styleDefault, "Updated: "+t.UpdatedAt.Local().Format("2006-01-02 15:04"))
+	line++
+	if t.Description == "" {
+		put(styleHint, "No description")
+		return
+	}
+	for _, para := range strings.Split(t.Description, "\n") {
+		put(styleDefault, para)
+	}
+}
+
+func (u *ui) drawBottom(width, height int) {
+	hintY, statusY := height-2, height-1
+
+	switch u.mode {
+	case modePrompt:
+		p := u.prompt
+		drawText(u.screen, 0, hintY, width, styleLabel, p.label)
+		start := runewidth.StringWidth(p.label)
+		drawText(u.screen, start, hintY, width-start, styleDefault, string(p.value))
+		u.screen.ShowCursor(start+runewidth.StringWidth(string(p.value[:p.cursor])), hintY)
+	case modeConfirm:
+		drawText(u.screen, 0, hintY, width, styleLabel, u.confirm.question)
+	default:
+		drawText(u.screen, 0, hintY, width, styleHint,
+			"a add  e edit  space done  d delete  ←/→ period  1/2/3 range  r refresh  ? help  q quit")
+	}
+
+	status := u.status
+	style := styleDefault
+	if u.statusErr {
+		style = styleError
+	}
+	drawText(u.screen, 0, statusY, width, style, status)
+
+	sync := "never synced"
+	if !u.lastSync.IsZero() {
+		sync = "synced " + u.lastSync.Format("15:04:05")
+	}
+	if u.loading {
+		sync = "loading… " + sync
+	}
+	if w := runewidth.StringWidth(sync); w+runewidth.StringWidth(status)+2 < width {
+		drawText(u.screen, width-w, statusY, w, styleHint, sync)
+	}
+}
+
+// drawText writes s at (x, y) and clips it to width cells.
+func drawText(s tcell.Screen, x, y, width int, style tcell.Style, text string) {
+	col := 0
+	for _, r := range text {
+		w := runewidth.RuneWidth(r)
+		if w == 0 {
+			continue
+		}
+		if col+w > width {
+			return
+		}
+		s.SetContent(x+col, y, r, nil, style)
+		col += w
+	}
+}
+
+// wrap breaks text into lines of at most width cells on word boundaries.
+func wrap(text string, width int) []string {
+	words := strings.Fields(text)
+	if len(words) == 0 {
+		return []string{""}
+	}
+
+	var lines []string
+	current := ""
+	for _, word := range words {
+		for runewidth.StringWidth(word) > width {
+			if current != "" {
+				lines = append(lines, current)
+				current = ""
+			}
+			head := runewidth.Truncate(word, width, "")
+			lines = append(lines, head)
+			word = word[len(head):]
+		}
+		switch {
+		case current == "":
+			current = word
+		case runewidth.StringWidth(current)+1+runewidth.StringWidth(word) <= width:
+			current += " " + word
+		default:
+			lines = append(lines, current)
+			current = word
+		}
+	}
+	if current != "" {
+		lines = append(lines, current)
+	}
+	return lines
+}
+
+func formatDay(date string) string {
+	d, err := time.Parse(dateLayout, date)
+	if err != nil {
+		return date
+	}
+	return d.Format("Monday, January 2")
+}
+
+func statusText(t *model.Todo) string {
+	if t.Completed {
+		return "completed"
+	}
+	return "pending"
+}
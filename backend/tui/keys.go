@@ -0,0 +1,178 @@
+package tui
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/gdamore/tcell/v2"
+
+	"github.com/thakurnishu/MinimalDo/client"
+	"github.com/thakurnishu/MinimalDo/model"
+)
+
+// handleKey dispatches a key press for the current mode and reports whether
+// the UI should exit.
+func (u *ui) handleKey(ev *tcell.EventKey) bool {
+	if ev.Key() == tcell.KeyCtrlC {
+		return true
+	}
+
+	switch u.mode {
+	case modePrompt:
+		u.prompt.handleKey(ev)
+		return false
+	case modeConfirm:
+		c := u.confirm
+		u.mode, u.confirm = modeNormal, nil
+		if ev.Key() == tcell.KeyRune && (ev.Rune() == 'y' || ev.Rune() == 'Y') {
+			c.onYes()
+		} else {
+			u.setStatus("cancelled", false)
+		}
+		return false
+	case modeHelp:
+		u.mode = modeNormal
+		return false
+	}
+
+	switch ev.Key() {
+	case tcell.KeyUp:
+		u.move(-1)
+	case tcell.KeyDown:
+		u.move(1)
+	case tcell.KeyLeft:
+		u.shiftPeriod(-1)
+	case tcell.KeyRight:
+		u.shiftPeriod(1)
+	case tcell.KeyTab:
+		u.cycleRange()
+	case tcell.KeyEnter:
+		u.editTodo()
+	case tcell.KeyDelete:
+		u.deleteTodo()
+	case tcell.KeyRune:
+		switch ev.Rune() {
+		case 'q':
+			return true
+		case 'k':
+			u.move(-1)
+		case 'j':
+			u.move(1)
+		case 'h':
+			u.shiftPeriod(-1)
+		case 'l':
+			u.shiftPeriod(1)
+		case 't':
+			u.date = time.Now()
+			u.reload()
+		case '1':
+			u.setRange("day")
+		case '2':
+			u.setRange("week")
+		case '3':
+			u.setRange("month")
+		case 'a':
+			u.addTodo()
+		case 'e':
+			u.editTodo()
+		case ' ', 'x', 'c':
+			u.toggleTodo()
+		case 'd':
+			u.deleteTodo()
+		case 'r':
+			u.reload()
+		case '?':
+			u.mode = modeHelp
+		}
+	}
+	return false
+}
+
+func (u *ui) addTodo() {
+	u.ask("New title: ", "", func(title string) {
+		if title == "" {
+			u.setStatus("title must not be empty", true)
+			return
+		}
+		u.ask("Description: ", "", func(description string) {
+			u.run(fmt.Sprintf("create %q", title), func(ctx context.Context) error {
+				_, err := u.client.CreateTodo(ctx, model.Todo{Title: title, Description: description})
+				return err
+			})
+		})
+	})
+}
+
+func (u *ui) editTodo() {
+	t := u.current()
+	if t == nil {
+		return
+	}
+	todo := *t
+	u.ask("Title: ", todo.Title, func(title string) {
+		if title == "" {
+			u.setStatus("title must not be empty", true)
+			return
+		}
+		u.ask("Description: ", todo.Description, func(description string) {
+			todo.Title, todo.Description = title, description
+			u.run("update #"+client.ShortID(todo.ID), func(ctx context.Context) error {
+				_, err := u.client.UpdateTodo(ctx, todo)
+				return err
+			})
+		})
+	})
+}
+
+func (u *ui) toggleTodo() {
+	t := u.current()
+	if t == nil {
+		return
+	}
+	todo := *t
+	todo.Completed = !todo.Completed
+	// Flip it locally right away, the reload confirms it.
+	t.Completed = todo.Completed
+
+	verb := "complete"
+	if !todo.Completed {
+		verb = "reopen"
+	}
+	u.run(verb+" #"+client.ShortID(todo.ID), func(ctx context.Context) error {
+		_, err := u.client.UpdateTodo(ctx, todo)
+		return err
+	})
+}
+
+func (u *ui) deleteTodo() {
+	t := u.current()
+	if t == nil {
+		return
+	}
+	id, title := t.ID, t.Title
+	u.mode = modeConfirm
+	u.confirm = &confirm{
+		question: fmt.Sprintf("Delete #%s %q? [y/N]", client.ShortID(id), title),
+		onYes: func() {
+			u.run("delete #"+client.ShortID(id), func(ctx context.Context) error {
+				return u.client.DeleteTodo(ctx, id)
+			})
+		},
+	}
+}
+
+// ask shows a one-line prompt and calls onSubmit with the entered text.
+func (u *ui) ask(label, initial string, onSubmit func(string)) {
+	u.mode = modePrompt
+	u.prompt = newPrompt(label, initial,
+		func(value string) {
+			u.mode, u.prompt = modeNormal, nil
+			onSubmit(value)
+		},
+		func() {
+			u.mode, u.prompt = modeNormal, nil
+			u.setStatus("cancelled", false)
+		},
+	)
+}
@@ -0,0 +1,65 @@
+package tui
+
+import (
+	"strings"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+// prompt is a single-line text input with basic readline-style editing.
+type prompt struct {
+	label    string
+	value    []rune
+	cursor   int
+	onSubmit func(string)
+	onCancel func()
+}
+
+func newPrompt(label, initial string, onSubmit func(string), onCancel func()) *prompt {
+	value := []rune(initial)
+	return &prompt{
+		label:    label,
+		value:    value,
+		cursor:   len(value),
+		onSubmit: onSubmit,
+		onCancel: onCancel,
+	}
+}
+
+func (p *prompt) handleKey(ev *tcell.EventKey) {
+	switch ev.Key() {
+	case tcell.KeyEnter:
+		p.onSubmit(strings.TrimSpace(string(p.value)))
+	case tcell.KeyEscape:
+		p.onCancel()
+	case tcell.KeyLeft, tcell.KeyCtrlB:
+		if p.cursor > 0 {
+			p.cursor--
+		}
+	case tcell.KeyRight, tcell.KeyCtrlF:
+		if p.cursor < len(p.value) {
+			p.cursor++
+		}
+	case tcell.KeyHome, tcell.KeyCtrlA:
+		p.cursor = 0
+	case tcell.KeyEnd, tcell.KeyCtrlE:
+		p.cursor = len(p.value)
+	case tcell.KeyBackspace, tcell.KeyBackspace2:
+		if p.cursor > 0 {
+			p.value = append(p.value[:p.cursor-1], p.value[p.cursor:]...)
+			p.cursor--
+		}
+	case tcell.KeyDelete, tcell.KeyCtrlD:
+		if p.cursor < len(p.value) {
+			p.value = append(p.value[:p.cursor], p.value[p.cursor+1:]...)
+		}
+	case tcell.KeyCtrlU:
+		p.value = p.value[p.cursor:]
+		p.cursor = 0
+	case tcell.KeyCtrlK:
+		p.value = p.value[:p.cursor]
+	case tcell.KeyRune:
+		p.value = append(p.value[:p.cursor], append([]rune{ev.Rune()}, p.value[p.cursor:]...)...)
+		p.cursor++
+	}
+}
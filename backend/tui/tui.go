@@ -0,0 +1,343 @@
+// Package tui is a full-screen terminal UI for MinimalDo. It only needs a
+// terminal (terminfo), so it works the same locally and over SSH.
+package tui
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gdamore/tcell/v2"
+
+	"github.com/thakurnishu/MinimalDo/client"
+	"github.com/thakurnishu/MinimalDo/model"
+)
+
+const dateLayout = "2006-01-02"
+
+var ranges = []string{"day", "week", "month"}
+
+type Options struct {
+	Client *client.Client
+	// Range is one of day, week or month.
+	Range string
+	Date  time.Time
+	// RefreshInterval is how often the list is reloaded in the background.
+	// Zero disables live refresh.
+	RefreshInterval time.Duration
+}
+
+type mode int
+
+const (
+	modeNormal mode = iota
+	modePrompt
+	modeConfirm
+	modeHelp
+)
+
+// row is one line of the list pane, either a day header or a todo.
+type row struct {
+	header string
+	todo   *model.Todo
+}
+
+// Events posted to the screen from background goroutines.
+type (
+	loadedMsg struct {
+		seq    int
+		groups []model.GroupedTodos
+		err    error
+	}
+	actionMsg struct {
+		status string
+		err    error
+	}
+	tickMsg struct{}
+)
+
+type ui struct {
+	ctx    context.Context
+	screen tcell.Screen
+	client *client.Client
+
+	rangeType string
+	date      time.Time
+
+	groups   []model.GroupedTodos
+	rows     []row
+	selected int
+	offset   int
+
+	loading  bool
+	fetchSeq int
+	lastSync time.Time
+
+	status    string
+	statusErr bool
+
+	mode    mode
+	prompt  *prompt
+	confirm *confirm
+}
+
+type confirm struct {
+	question string
+	onYes    func()
+}
+
+// Run takes over the terminal until the user quits or ctx is cancelled.
+func Run(ctx context.Context, opts Options) error {
+	if opts.Client == nil {
+		return errors.New("tui: a client is required")
+	}
+	if opts.Range == "" {
+		opts.Range = "day"
+	}
+	if opts.Date.IsZero() {
+		opts.Date = time.Now()
+	}
+
+	screen, err := tcell.NewScreen()
+	if err != nil {
+		return fmt.Errorf("open terminal: %w", err)
+	}
+	if err := screen.Init(); err != nil {
+		return fmt.Errorf("init terminal: %w", err)
+	}
+	defer screen.Fini()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	u := &ui{
+		ctx:       ctx,
+		screen:    screen,
+		client:    opts.Client,
+		rangeType: opts.Range,
+		date:      opts.Date,
+	}
+
+	if opts.RefreshInterval > 0 {
+		go func() {
+			ticker := time.NewTicker(opts.RefreshInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					screen.PostEvent(tcell.NewEventInterrupt(tickMsg{}))
+				}
+			}
+		}()
+	}
+	go func() {
+		<-ctx.Done()
+		// Wake up PollEvent so the loop can notice the cancellation.
+		screen.PostEvent(tcell.NewEventInterrupt(nil))
+	}()
+
+	u.reload()
+	for {
+		u.draw()
+
+		ev := screen.PollEvent()
+		if ev == nil || ctx.Err() != nil {
+			return nil
+		}
+
+		switch ev := ev.(type) {
+		case *tcell.EventResize:
+			screen.Sync()
+		case *tcell.EventInterrupt:
+			u.handleMsg(ev.Data())
+		case *tcell.EventKey:
+			if quit := u.handleKey(ev); quit {
+				return nil
+			}
+		}
+	}
+}
+
+// reload fetches the current period in the background. Results of older
+// requests that finish late are dropped.
+func (u *ui) reload() {
+	u.fetchSeq++
+	seq := u.fetchSeq
+	rangeType, date := u.rangeType, u.date
+	u.loading = true
+
+	go func() {
+		ctx, cancel := context.WithTimeout(u.ctx, 15*time.Second)
+		defer cancel()
+		groups, err := u.client.TodosByDate(ctx, rangeType, date)
+		u.screen.PostEvent(tcell.NewEventInterrupt(loadedMsg{seq: seq, groups: groups, err: err}))
+	}()
+}
+
+// run executes a mutation in the background and reloads once it is done.
+func (u *ui) run(status string, fn func(ctx context.Context) error) {
+	u.setStatus(status+"…", false)
+	go func() {
+		ctx, cancel := context.WithTimeout(u.ctx, 15*time.Second)
+		defer cancel()
+		err := fn(ctx)
+		u.screen.PostEvent(tcell.NewEventInterrupt(actionMsg{status: status, err: err}))
+	}()
+}
+
+func (u *ui) handleMsg(data any) {
+	switch msg := data.(type) {
+	case loadedMsg:
+		if msg.seq != u.fetchSeq {
+			return
+		}
+		u.loading = false
+		if msg.err != nil {
+			u.setStatus("refresh failed: "+msg.err.Error(), true)
+			return
+		}
+		u.setGroups(msg.groups)
+		u.lastSync = time.Now()
+	case actionMsg:
+		if msg.err != nil {
+			u.setStatus(msg.status+" failed: "+msg.err.Error(), true)
+			return
+		}
+		u.setStatus(msg.status+" done", false)
+		u.reload()
+	case tickMsg:
+		// Skip the tick while a request is in flight or the user is typing.
+		if !u.loading && u.mode == modeNormal {
+			u.reload()
+		}
+	}
+}
+
+// setGroups replaces the list, keeping the same todo selected if it is
+// still there.
+func (u *ui) setGroups(groups []model.GroupedTodos) {
+	selectedID := ""
+	if t := u.current(); t != nil {
+		selectedID = t.ID
+	}
+
+	u.groups = groups
+	u.rows = u.rows[:0]
+	for gi := range groups {
+		if u.rangeType != "day" {
+			u.rows = append(u.rows, row{header: groups[gi].Date})
+		}
+		for ti := range groups[gi].Todos {
+			u.rows = append(u.rows, row{todo: &groups[gi].Todos[ti]})
+		}
+	}
+
+	u.selected = -1
+	for i, r := range u.rows {
+		if r.todo == nil {
+			continue
+		}
+		if u.selected == -1 || r.todo.ID == selectedID {
+			u.selected = i
+		}
+		if r.todo.ID == selectedID {
+			break
+		}
+	}
+}
+
+func (u *ui) current() *model.Todo {
+	if u.selected < 0 || u.selected >= len(u.rows) {
+		return nil
+	}
+	return u.rows[u.selected].todo
+}
+
+// move changes the selection by delta todos, skipping day headers.
+func (u *ui) move(delta int) {
+	i := u.selected
+	for {
+		i += delta
+		if i < 0 || i >= len(u.rows) {
+			return
+		}
+		if u.rows[i].todo != nil {
+			u.selected = i
+			return
+		}
+	}
+}
+
+func (u *ui) setStatus(msg string, isErr bool) {
+	u.status = msg
+	u.statusErr = isErr
+}
+
+// shiftPeriod moves the date one period back or forward. Like the web
+// frontend it refuses to go further back than the backend's 1 year limit.
+func (u *ui) shiftPeriod(direction int) {
+	var next time.Time
+	switch u.rangeType {
+	case "day":
+		next = u.date.AddDate(0, 0, direction)
+	case "week":
+		next = u.date.AddDate(0, 0, 7*direction)
+	case "month":
+		next = u.date.AddDate(0, direction, 0)
+	}
+	if next.Before(time.Now().AddDate(-1, 0, 0)) {
+		u.setStatus("dates older than 1 year are not available", true)
+		return
+	}
+	u.date = next
+	u.reload()
+}
+
+func (u *ui) setRange(rangeType string) {
+	if rangeType == u.rangeType {
+		return
+	}
+	u.rangeType = rangeType
+	u.groups, u.rows, u.selected = nil, nil, -1
+	u.reload()
+}
+
+func (u *ui) cycleRange() {
+	for i, r := range ranges {
+		if r == u.rangeType {
+			u.setRange(ranges[(i+1)%len(ranges)])
+			return
+		}
+	}
+}
+
+// periodBounds mirrors the range calculation of getTodosByDate.
+func periodBounds(rangeType string, date time.Time) (time.Time, time.Time) {
+	switch rangeType {
+	case "week":
+		start := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.UTC)
+		start = start.AddDate(0, 0, -int(date.Weekday()))
+		return start, start.AddDate(0, 0, 6)
+	case "month":
+		start := time.Date(date.Year(), date.Month(), 1, 0, 0, 0, 0, time.UTC)
+		return start, start.AddDate(0, 1, -1)
+	default:
+		day := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.UTC)
+		return day, day
+	}
+}
+
+func periodLabel(rangeType string, date time.Time) string {
+	start, end := periodBounds(rangeType, date)
+	switch rangeType {
+	case "week":
+		return fmt.Sprintf("Week %s – %s", start.Format("Jan 2"), end.Format("Jan 2, 2006"))
+	case "month":
+		return start.Format("January 2006")
+	default:
+		return start.Format("Monday, January 2, 2006")
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"github.com/thakurnishu/MinimalDo/model"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// undoHeader carries the undo token of a todo change. It is set before the
+// change commits, clients only use it from a successful response.
+const undoHeader = "X-Undo-Token"
+
+// issueUndo returns a token for the caller that undoes version of a todo,
+// for UndoTTL. It runs in the transaction that recorded the version, so a
+// change that rolled back leaves no token behind. Nothing is issued for
+// version 0, a change that changed nothing.
+func (s *Server) issueUndo(c *gin.Context, ctx context.Context, tx *sql.Tx, todoID, version int) (string, error) {
+	if version == 0 {
+		return "", nil
+	}
+	userID := currentUserID(c)
+
+	// tokens are useless once expired, drop the caller's old ones as we go
+	_, err := tx.ExecContext(ctx, `
+		DELETE FROM undo_tokens WHERE user_id = $1 AND expires_at < CURRENT_TIMESTAMP
+	`, userID)
+	if err != nil {
+		return "", err
+	}
+
+	token, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO undo_tokens (token_hash, user_id, workspace_id, todo_id, version, expires_at)
+		VALUES ($1, $2, $3, $4, $5, CURRENT_TIMESTAMP + make_interval(secs => $6))
+	`, hashToken(token), userID, currentWorkspaceID(c), todoID, version, s.cfg.UndoTTL.Seconds())
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// undo reverses the todo change a token was issued for: a created or restored
+// todo is deleted again, a deleted one is restored under its ID, and an edit
+// is reverted to the version before it. The change must still be the latest
+// version of the todo, undoing it after someone else changed the todo would
+// throw their change away. Undo is itself a change and returns a token, which
+// redoes it.
+func (s *Server) undo(c *gin.Context) {
+	ctx, span := s.tracer.Start(c.Request.Context(), "undo")
+	defer span.End()
+
+	userID := currentUserID(c)
+	span.SetAttributes(attribute.Int("user.id", userID))
+
+	tx, err := s.beginTenantTx(ctx, c)
+	if err != nil {
+		logError("begin transaction failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	// locking the token makes a double-clicked undo run once
+	tokenHash := hashToken(c.Param("token"))
+	var ownerID, todoID, version int
+	var expired, used bool
+	err = tx.QueryRowContext(ctx, `
+		SELECT user_id, todo_id, version, expires_at < CURRENT_TIMESTAMP, used_at IS NOT NULL
+		FROM undo_tokens WHERE token_hash = $1
+		FOR UPDATE
+	`, tokenHash).Scan(&ownerID, &todoID, &version, &expired, &used)
+	if err != nil && err != sql.ErrNoRows {
+		logError("token lookup failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err == sql.ErrNoRows || ownerID != userID {
+		s.logger.WarnContext(ctx, "undo token not found")
+		span.SetStatus(codes.Error, "undo token not found")
+		c.JSON(http.StatusNotFound, gin.H{"error": "Undo token not found"})
+		return
+	}
+	span.SetAttributes(
+		attribute.Int("task.id", todoID),
+		attribute.Int("task.version", version),
+	)
+	if expired || used {
+		s.logger.WarnContext(ctx, "undo token expired",
+			slog.Int("task_id", todoID),
+			slog.Bool("used", used),
+		)
+		span.SetStatus(codes.Error, "undo token expired")
+		c.JSON(http.StatusGone, gin.H{"error": "Undo is no longer available"})
+		return
+	}
+
+	// lock the todo before reading its latest version, so no other change
+	// can slip in between
+	if _, err := tx.ExecContext(ctx, "SELECT id FROM todos WHERE id = $1 FOR UPDATE", todoID); err != nil {
+		logError("task lookup failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	var latest int
+	var action string
+	err = tx.QueryRowContext(ctx, `
+		SELECT version, action FROM todo_history WHERE todo_id = $1 ORDER BY version DESC LIMIT 1
+	`, todoID).Scan(&latest, &action)
+	if err != nil {
+		logError("query failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if latest != version {
+		s.logger.WarnContext(ctx, "task changed since",
+			slog.Int("task_id", todoID),
+			slog.Int("version", version),
+			slog.Int("latest_version", latest),
+		)
+		span.SetStatus(codes.Error, "task changed since")
+		c.JSON(http.StatusConflict, gin.H{"error": "Task was changed since, undo is no longer possible"})
+		return
+	}
+
+	var t model.Todo
+	var newVersion int
+	ok := false
+	switch action {
+	case model.HistoryCreate, model.HistoryRestore:
+		newVersion, ok = s.undoCreate(c, ctx, span, tx, todoID)
+	case model.HistoryDelete:
+		t, newVersion, ok = s.revertInTx(c, ctx, span, tx, todoID, version)
+	default:
+		t, newVersion, ok = s.revertInTx(c, ctx, span, tx, todoID, version-1)
+	}
+	if !ok {
+		return
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE undo_tokens SET used_at = CURRENT_TIMESTAMP WHERE token_hash = $1
+	`, tokenHash); err != nil {
+		logError("query execution failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	undoToken, err := s.issueUndo(c, ctx, tx, todoID, newVersion)
+	if err != nil {
+		logError("issuing undo token failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Header(undoHeader, undoToken)
+	if err := tx.Commit(); err != nil {
+		logError("commit failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	s.logger.InfoContext(ctx, "task change undone",
+		slog.Int("task_id", todoID),
+		slog.Int("undone_version", version),
+		slog.String("undone_action", action),
+		slog.Int("new_version", newVersion),
+	)
+	span.SetAttributes(
+		attribute.String("task.undone_action", action),
+		attribute.Int("task.new_version", newVersion),
+	)
+
+	if action == model.HistoryCreate || action == model.HistoryRestore {
+		c.Status(http.StatusNoContent)
+		return
+	}
+	c.JSON(http.StatusOK, t)
+}
+
+// undoCreate deletes a todo the way deleteTodo does, writing the response
+// when the request can't go on.
+func (s *Server) undoCreate(c *gin.Context, ctx context.Context, span trace.Span, tx *sql.Tx, todoID int) (version int, ok bool) {
+	if !s.authorizeTodo(c, ctx, span, tx, todoID, roleEditor) {
+		return 0, false
+	}
+
+	before, ownerID, err := lockTodo(ctx, tx, todoID)
+	if err != nil {
+		logError("task lookup failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return 0, false
+	}
+	version, _, err = recordChange(ctx, tx, todoChange{
+		todoID:      todoID,
+		workspaceID: currentWorkspaceID(c),
+		ownerID:     ownerID,
+		action:      model.HistoryDelete,
+		before:      &before,
+		changedBy:   currentUserID(c),
+	})
+	if err != nil {
+		logError("recording history failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return 0, false
+	}
+	if err := trashTodo(ctx, tx, todoID, currentWorkspaceID(c), s.cfg.UndoTTL); err != nil {
+		logError("query execution failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return 0, false
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM todos WHERE id = $1", todoID); err != nil {
+		logError("query execution failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return 0, false
+	}
+	return version, true
+}
+
+// Deleting a todo cascades to its comments, attachments and assignees. So
+// that undoing the delete brings them back, trashTodo keeps a copy of them in
+// deleted_todos for UNDO_TTL, and the blobs of the attachments are only
+// deleted when purgeDeletedTodos drops the copy.
+
+// restoreChildren put the rows trashTodo kept back, in the order of their
+// foreign keys. References to users deleted since are dropped the way the
+// foreign keys would have.
+var restoreChildren = []string{`
+	INSERT INTO todo_assignees (todo_id, user_id, assigned_by, assigned_at)
+	SELECT x.todo_id, x.user_id, (SELECT u.id FROM users u WHERE u.id = x.assigned_by), x.assigned_at
+	FROM jsonb_populate_recordset(NULL::todo_assignees, $1::jsonb->'assignees') x
+	WHERE x.user_id IN (SELECT id FROM users)
+`, `
+	INSERT INTO todo_assignment_log (id, todo_id, user_id, action, changed_by, changed_at)
+	SELECT x.id, x.todo_id, x.user_id, x.action, (SELECT u.id FROM users u WHERE u.id = x.changed_by), x.changed_at
+	FROM jsonb_populate_recordset(NULL::todo_assignment_log, $1::jsonb->'assignment_log') x
+	WHERE x.user_id IN (SELECT id FROM users)
+`, `
+	INSERT INTO todo_comments (id, todo_id, author_id, body, created_at, updated_at)
+	SELECT x.id, x.todo_id, (SELECT u.id FROM users u WHERE u.id = x.author_id), x.body, x.created_at, x.updated_at
+	FROM jsonb_populate_recordset(NULL::todo_comments, $1::jsonb->'comments') x
+`, `
+	INSERT INTO todo_comment_revisions (id, comment_id, body, edited_by, edited_at)
+	SELECT x.id, x.comment_id, x.body, (SELECT u.id FROM users u WHERE u.id = x.edited_by), x.edited_at
+	FROM jsonb_populate_recordset(NULL::todo_comment_revisions, $1::jsonb->'comment_revisions') x
+`, `
+	INSERT INTO todo_comment_mentions (comment_id, user_id)
+	SELECT x.comment_id, x.user_id
+	FROM jsonb_populate_recordset(NULL::todo_comment_mentions, $1::jsonb->'comment_mentions') x
+	WHERE x.user_id IN (SELECT id FROM users)
+`, `
+	INSERT INTO todo_attachments (id, todo_id, uploaded_by, filename, content_type, size_bytes, storage_key, created_at)
+	SELECT x.id, x.todo_id, (SELECT u.id FROM users u WHERE u.id = x.uploaded_by), x.filename, x.content_type,
+		x.size_bytes, x.storage_key, x.created_at
+	FROM jsonb_populate_recordset(NULL::todo_attachments, $1::jsonb->'attachments') x
+`}
+
+// trashTodo keeps the rows that deleting a todo in tx cascades to, until the
+// delete can't be undone anymore.
+func trashTodo(ctx context.Context, tx *sql.Tx, todoID, workspaceID int, ttl time.Duration) error {
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO deleted_todos (todo_id, workspace_id, children, blob_keys, expires_at)
+		SELECT $1, $2, jsonb_build_object(
+			'assignees', (SELECT COALESCE(jsonb_agg(a), '[]') FROM todo_assignees a WHERE a.todo_id = $1),
+			'assignment_log', (SELECT COALESCE(jsonb_agg(l), '[]') FROM todo_assignment_log l WHERE l.todo_id = $1),
+			'comments', (SELECT COALESCE(jsonb_agg(c), '[]') FROM todo_comments c WHERE c.todo_id = $1),
+			'comment_revisions', (SELECT COALESCE(jsonb_agg(r), '[]') FROM todo_comment_revisions r
+				JOIN todo_comments c ON c.id = r.comment_id WHERE c.todo_id = $1),
+			'comment_mentions', (SELECT COALESCE(jsonb_agg(m), '[]') FROM todo_comment_mentions m
+				JOIN todo_comments c ON c.id = m.comment_id WHERE c.todo_id = $1),
+			'attachments', (SELECT COALESCE(jsonb_agg(f), '[]') FROM todo_attachments f WHERE f.todo_id = $1)
+		), ARRAY(SELECT storage_key FROM todo_attachments WHERE todo_id = $1),
+		CURRENT_TIMESTAMP + make_interval(secs => $3)
+	`, todoID, workspaceID, ttl.Seconds())
+	return err
+}
+
+// restoreTodoChildren puts back what trashTodo kept of a todo that was just
+// inserted again in tx. Nothing is restored once the copy was purged.
+func restoreTodoChildren(ctx context.Context, tx *sql.Tx, todoID int) error {
+	var children []byte
+	err := tx.QueryRowContext(ctx, `
+		DELETE FROM deleted_todos WHERE todo_id = $1 RETURNING children
+	`, todoID).Scan(&children)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, q := range restoreChildren {
+		if _, err := tx.ExecContext(ctx, q, string(children)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runPurgeDeletedTodos drops the kept rows of deleted todos once their delete
+// can't be undone anymore, forever, and deletes the blobs of their
+// attachments. Several servers can run it, each row is deleted once.
+func (s *Server) runPurgeDeletedTodos() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := s.purgeDeletedTodos(context.Background()); err != nil {
+			s.logger.Error("purging deleted todos failed", slog.String("error", err.Error()))
+		}
+	}
+}
+
+func (s *Server) purgeDeletedTodos(ctx context.Context) error {
+	rows, err := s.db.QueryContext(ctx, `
+		DELETE FROM deleted_todos WHERE expires_at < CURRENT_TIMESTAMP RETURNING blob_keys
+	`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var blobKeys []string
+	for rows.Next() {
+		var keys []string
+		if err := rows.Scan(pq.Array(&keys)); err != nil {
+			return err
+		}
+		blobKeys = append(blobKeys, keys...)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	s.deleteBlobs(ctx, blobKeys)
+	return nil
+}
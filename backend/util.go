@@ -3,6 +3,8 @@ package main
 import (
 	"log/slog"
 	"os"
+	"strconv"
+	"time"
 )
 
 func GetEnv(key string) string {
@@ -13,3 +15,37 @@ func GetEnv(key string) string {
 	}
 	return value
 }
+
+func GetEnvOrDefault(key, fallback string) string {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	return value
+}
+
+func GetEnvDuration(key string, fallback time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		slog.Error("Invalid duration in environment", "key", key, "value", value, "error", err)
+		os.Exit(1)
+	}
+	return d
+}
+
+func GetEnvInt64(key string, fallback int64) int64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		slog.Error("Invalid integer in environment", "key", key, "value", value, "error", err)
+		os.Exit(1)
+	}
+	return n
+}
@@ -0,0 +1,843 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"github.com/thakurnishu/MinimalDo/model"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Webhooks get the todo events of their workspace by POST. A delivery is
+// queued by the outbox relay, runWebhooks sends it later and retries it with
+// exponential backoff. Every delivery carries the trace context of the
+// request that made the change, so it shows up in its trace.
+
+const (
+	webhookSecretPrefix = "whsec_"
+	webhookBatch        = 20 // deliveries claimed per poll
+	maxBackoff          = time.Hour
+	maxWebhookURL       = 2048
+
+	defaultDeliveryLimit = 50
+	maxDeliveryLimit     = 200
+
+	signatureHeader = "X-MinimalDo-Signature"
+	eventHeader     = "X-MinimalDo-Event"
+	deliveryHeader  = "X-MinimalDo-Delivery"
+)
+
+var webhookEventTypes = []string{
+	model.EventTodoCreated,
+	model.EventTodoUpdated,
+	model.EventTodoDeleted,
+	model.WebhookTodoCompleted,
+}
+
+var errPrivateAddress = errors.New("webhook address is not public")
+
+// webhookSink queues the events of the outbox for the active webhooks that
+// want them and whose creator is still a member who can see the todo. An
+// event that is published again doesn't queue it twice.
+type webhookSink struct {
+	db *sql.DB
+}
+
+func (webhookSink) Name() string { return "webhook" }
+
+func (w webhookSink) Publish(ctx context.Context, e outboxEvent) error {
+	traceContext, err := traceCarrier(ctx)
+	if err != nil {
+		return err
+	}
+	for _, t := range eventTypes(e.event) {
+		payload, err := json.Marshal(model.WebhookPayload{Type: t, CreatedAt: e.event.ChangedAt, Data: e.event})
+		if err != nil {
+			return err
+		}
+		_, err = w.db.ExecContext(ctx, `
+			INSERT INTO webhook_deliveries (webhook_id, workspace_id, event_type, payload, trace_context, outbox_id)
+			SELECT w.id, w.workspace_id, $2, $3, $4, $7
+			FROM webhooks w
+			WHERE w.workspace_id = $1 AND w.active AND $2 = ANY(w.event_types)
+			AND EXISTS (
+				SELECT 1 FROM workspace_members m WHERE m.workspace_id = w.workspace_id AND m.user_id = w.user_id
+			)
+			AND (
+				($5::INTEGER IS NULL AND w.user_id = $6)
+				OR EXISTS (SELECT 1 FROM list_members lm WHERE lm.list_id = $5 AND lm.user_id = w.user_id)
+			)
+			ON CONFLICT (outbox_id, webhook_id, event_type) DO NOTHING
+		`, e.workspaceID, t, payload, traceContext, e.event.Todo.ListID, e.ownerID, e.id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// traceCarrier returns the W3C trace context of ctx as JSON.
+func traceCarrier(ctx context.Context) ([]byte, error) {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	return json.Marshal(carrier)
+}
+
+func (s *Server) getWebhooks(c *gin.Context) {
+	ctx, span := s.tracer.Start(c.Request.Context(), "get_webhooks")
+	defer span.End()
+
+	userID := currentUserID(c)
+	span.SetAttributes(attribute.Int("user.id", userID))
+
+	tx, err := s.beginTenantTx(ctx, c)
+	if err != nil {
+		logError("begin transaction failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT id, url, event_types, active, created_at, updated_at
+		FROM webhooks
+		WHERE user_id = $1
+		ORDER BY id
+	`, userID)
+	if err != nil {
+		logError("query execution failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	webhooks := []model.Webhook{}
+	for rows.Next() {
+		var w model.Webhook
+		if err := rows.Scan(&w.ID, &w.URL, pq.Array(&w.EventTypes), &w.Active, &w.CreatedAt, &w.UpdatedAt); err != nil {
+			logError("row scan failed", ctx, s.logger, span, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		webhooks = append(webhooks, w)
+	}
+	if err := rows.Err(); err != nil {
+		logError("row iteration failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, webhooks)
+}
+
+func (s *Server) createWebhook(c *gin.Context) {
+	ctx, span := s.tracer.Start(c.Request.Context(), "create_webhook")
+	defer span.End()
+
+	req, ok := s.bindWebhookRequest(c, ctx, span)
+	if !ok {
+		return
+	}
+	active := req.Active == nil || *req.Active
+
+	secret, err := newToken()
+	if err != nil {
+		logError("secret generation failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	userID := currentUserID(c)
+	workspaceID := currentWorkspaceID(c)
+	span.SetAttributes(attribute.Int("user.id", userID))
+
+	tx, err := s.beginTenantTx(ctx, c)
+	if err != nil {
+		logError("begin transaction failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	w := model.Webhook{Secret: webhookSecretPrefix + secret}
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO webhooks (workspace_id, user_id, url, secret, event_types, active)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, url, event_types, active, created_at, updated_at
+	`, workspaceID, userID, req.URL, w.Secret, pq.Array(req.EventTypes), active).Scan(
+		&w.ID, &w.URL, pq.Array(&w.EventTypes), &w.Active, &w.CreatedAt, &w.UpdatedAt,
+	)
+	if err != nil {
+		logError("row scan failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		logError("commit failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	s.logger.InfoContext(ctx, "webhook created",
+		slog.Int("user_id", userID),
+		slog.Int("workspace_id", workspaceID),
+		slog.Int("webhook_id", w.ID),
+	)
+	span.SetAttributes(attribute.Int("webhook.id", w.ID))
+
+	c.JSON(http.StatusCreated, w)
+}
+
+func (s *Server) getWebhook(c *gin.Context) {
+	ctx, span := s.tracer.Start(c.Request.Context(), "get_webhook")
+	defer span.End()
+
+	id, ok := s.webhookParam(c, ctx, span)
+	if !ok {
+		return
+	}
+
+	tx, err := s.beginTenantTx(ctx, c)
+	if err != nil {
+		logError("begin transaction failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	w, ok := s.findWebhook(c, ctx, span, tx, id)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, w)
+}
+
+// updateWebhook replaces the URL and event types of a webhook. Active is
+// left as it is when the request doesn't have it.
+func (s *Server) updateWebhook(c *gin.Context) {
+	ctx, span := s.tracer.Start(c.Request.Context(), "update_webhook")
+	defer span.End()
+
+	id, ok := s.webhookParam(c, ctx, span)
+	if !ok {
+		return
+	}
+	req, ok := s.bindWebhookRequest(c, ctx, span)
+	if !ok {
+		return
+	}
+	userID := currentUserID(c)
+
+	tx, err := s.beginTenantTx(ctx, c)
+	if err != nil {
+		logError("begin transaction failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	var w model.Webhook
+	err = tx.QueryRowContext(ctx, `
+		UPDATE webhooks SET url = $3, event_types = $4, active = COALESCE($5, active)
+		WHERE id = $1 AND user_id = $2
+		RETURNING id, url, event_types, active, created_at, updated_at
+	`, id, userID, req.URL, pq.Array(req.EventTypes), req.Active).Scan(
+		&w.ID, &w.URL, pq.Array(&w.EventTypes), &w.Active, &w.CreatedAt, &w.UpdatedAt,
+	)
+	if err == sql.ErrNoRows {
+		logError("webhook not found", ctx, s.logger, span, err,
+			slog.Int("webhook_id", id),
+		)
+		c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+		return
+	}
+	if err != nil {
+		logError("row scan failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		logError("commit failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	s.logger.InfoContext(ctx, "webhook updated",
+		slog.Int("user_id", userID),
+		slog.Int("webhook_id", id),
+		slog.Bool("active", w.Active),
+	)
+	c.JSON(http.StatusOK, w)
+}
+
+func (s *Server) deleteWebhook(c *gin.Context) {
+	ctx, span := s.tracer.Start(c.Request.Context(), "delete_webhook")
+	defer span.End()
+
+	id, ok := s.webhookParam(c, ctx, span)
+	if !ok {
+		return
+	}
+	userID := currentUserID(c)
+
+	tx, err := s.beginTenantTx(ctx, c)
+	if err != nil {
+		logError("begin transaction failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, "DELETE FROM webhooks WHERE id = $1 AND user_id = $2", id, userID)
+	if err != nil {
+		logError("query execution failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		logError("affected rows check failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if rowsAffected == 0 {
+		logError("webhook not found", ctx, s.logger, span, sql.ErrNoRows,
+			slog.Int("webhook_id", id),
+		)
+		c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		logError("commit failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	s.logger.InfoContext(ctx, "webhook deleted",
+		slog.Int("user_id", userID),
+		slog.Int("webhook_id", id),
+	)
+	c.Status(http.StatusNoContent)
+}
+
+// testWebhook queues a webhook.test event for a webhook, inactive ones too,
+// and returns the delivery to poll the log with.
+func (s *Server) testWebhook(c *gin.Context) {
+	ctx, span := s.tracer.Start(c.Request.Context(), "test_webhook")
+	defer span.End()
+
+	id, ok := s.webhookParam(c, ctx, span)
+	if !ok {
+		return
+	}
+
+	tx, err := s.beginTenantTx(ctx, c)
+	if err != nil {
+		logError("begin transaction failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	if _, ok := s.findWebhook(c, ctx, span, tx, id); !ok {
+		return
+	}
+
+	payload, err := json.Marshal(model.WebhookPayload{
+		Type:      model.WebhookTest,
+		CreatedAt: time.Now().UTC(),
+		Data:      gin.H{"webhook_id": id},
+	})
+	if err != nil {
+		logError("payload encoding failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	traceContext, err := traceCarrier(ctx)
+	if err != nil {
+		logError("trace context encoding failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	d := model.WebhookDelivery{Attempts: []model.WebhookAttempt{}}
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO webhook_deliveries (webhook_id, workspace_id, event_type, payload, trace_context)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, event_type, status, payload, attempts, next_attempt_at, created_at
+	`, id, currentWorkspaceID(c), model.WebhookTest, payload, traceContext).Scan(
+		&d.ID, &d.EventType, &d.Status, &d.Payload, &d.AttemptCount, &d.NextAttemptAt, &d.CreatedAt,
+	)
+	if err != nil {
+		logError("row scan failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		logError("commit failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	s.logger.InfoContext(ctx, "webhook test queued",
+		slog.Int("webhook_id", id),
+		slog.Int64("delivery_id", d.ID),
+	)
+	span.SetAttributes(attribute.Int64("webhook.delivery.id", d.ID))
+
+	c.JSON(http.StatusAccepted, d)
+}
+
+// getWebhookDeliveries returns the delivery log of a webhook, newest first.
+func (s *Server) getWebhookDeliveries(c *gin.Context) {
+	ctx, span := s.tracer.Start(c.Request.Context(), "get_webhook_deliveries")
+	defer span.End()
+
+	id, ok := s.webhookParam(c, ctx, span)
+	if !ok {
+		return
+	}
+	limit := defaultDeliveryLimit
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxDeliveryLimit {
+			if err == nil {
+				err = errors.New("limit out of range")
+			}
+			logError("invalid limit", ctx, s.logger, span, err,
+				slog.String("limit", v),
+			)
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and " + strconv.Itoa(maxDeliveryLimit)})
+			return
+		}
+		limit = n
+	}
+
+	tx, err := s.beginTenantTx(ctx, c)
+	if err != nil {
+		logError("begin transaction failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	if _, ok := s.findWebhook(c, ctx, span, tx, id); !ok {
+		return
+	}
+	deliveries, err := loadDeliveries(ctx, tx, id, limit)
+	if err != nil {
+		logError("delivery query failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, deliveries)
+}
+
+func loadDeliveries(ctx context.Context, tx *sql.Tx, webhookID, limit int) ([]model.WebhookDelivery, error) {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT id, event_type, status, payload, attempts,
+			CASE WHEN status = 'pending' THEN next_attempt_at END, created_at
+		FROM webhook_deliveries
+		WHERE webhook_id = $1
+		ORDER BY id DESC
+		LIMIT $2
+	`, webhookID, limit)
+	if err != nil {
+		return nil, err
+	}
+	deliveries := []model.WebhookDelivery{}
+	index := map[int64]int{}
+	var ids []int64
+	for rows.Next() {
+		d := model.WebhookDelivery{Attempts: []model.WebhookAttempt{}}
+		if err := rows.Scan(&d.ID, &d.EventType, &d.Status, &d.Payload, &d.AttemptCount, &d.NextAttemptAt, &d.CreatedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		index[d.ID] = len(deliveries)
+		ids = append(ids, d.ID)
+		deliveries = append(deliveries, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return deliveries, nil
+	}
+
+	rows, err = tx.QueryContext(ctx, `
+		SELECT delivery_id, response_status, COALESCE(error, ''), duration_ms, attempted_at
+		FROM webhook_attempts
+		WHERE delivery_id = ANY($1)
+		ORDER BY id DESC
+	`, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var deliveryID int64
+		var a model.WebhookAttempt
+		if err := rows.Scan(&deliveryID, &a.ResponseStatus, &a.Error, &a.DurationMS, &a.AttemptedAt); err != nil {
+			return nil, err
+		}
+		d := &deliveries[index[deliveryID]]
+		d.Attempts = append(d.Attempts, a)
+	}
+	return deliveries, rows.Err()
+}
+
+// webhookParam parses the :id path parameter, writing the error response
+// when it can't.
+func (s *Server) webhookParam(c *gin.Context, ctx context.Context, span trace.Span) (int, bool) {
+	idStr := c.Param("id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		logError("invalid id", ctx, s.logger, span, err,
+			slog.String("webhook_id", idStr),
+		)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invaild ID"})
+		return 0, false
+	}
+	span.SetAttributes(attribute.Int("webhook.id", id))
+	return id, true
+}
+
+// findWebhook reads a webhook of the caller, writing the error response when
+// there is none.
+func (s *Server) findWebhook(c *gin.Context, ctx context.Context, span trace.Span, tx *sql.Tx, id int) (model.Webhook, bool) {
+	var w model.Webhook
+	err := tx.QueryRowContext(ctx, `
+		SELECT id, url, event_types, active, created_at, updated_at
+		FROM webhooks
+		WHERE id = $1 AND user_id = $2
+	`, id, currentUserID(c)).Scan(&w.ID, &w.URL, pq.Array(&w.EventTypes), &w.Active, &w.CreatedAt, &w.UpdatedAt)
+	if err == sql.ErrNoRows {
+		logError("webhook not found", ctx, s.logger, span, err,
+			slog.Int("webhook_id", id),
+		)
+		c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+		return w, false
+	}
+	if err != nil {
+		logError("webhook lookup failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return w, false
+	}
+	return w, true
+}
+
+func (s *Server) bindWebhookRequest(c *gin.Context, ctx context.Context, span trace.Span) (model.WebhookRequest, bool) {
+	var req model.WebhookRequest
+	if err := c.BindJSON(&req); err != nil {
+		logError("failed to parse json", ctx, s.logger, span, err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return req, false
+	}
+	if err := validateWebhookRequest(req); err != nil {
+		logError("invalid webhook request", ctx, s.logger, span, err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return req, false
+	}
+	slices.Sort(req.EventTypes)
+	req.EventTypes = slices.Compact(req.EventTypes)
+	return req, true
+}
+
+func validateWebhookRequest(req model.WebhookRequest) error {
+	if err := validateHTTPURL(req.URL); err != nil {
+		return err
+	}
+	if len(req.EventTypes) == 0 {
+		return errors.New("at least one event type is required")
+	}
+	for _, t := range req.EventTypes {
+		if !slices.Contains(webhookEventTypes, t) {
+			return fmt.Errorf("unknown event type %q", t)
+		}
+	}
+	return nil
+}
+
+// validateHTTPURL checks a URL the backend is to call.
+func validateHTTPURL(rawURL string) error {
+	if len(rawURL) > maxWebhookURL {
+		return errors.New("url is too long")
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("url must be an absolute http or https URL")
+	}
+	if u.User != nil {
+		return errors.New("url must not contain credentials")
+	}
+	return nil
+}
+
+// pendingDelivery is a delivery claimed by the worker.
+type pendingDelivery struct {
+	id           int64
+	webhookID    int
+	eventType    string
+	payload      []byte
+	traceContext propagation.MapCarrier
+	attempt      int
+	url          string
+	secret       string
+}
+
+// runWebhooks sends the due deliveries, forever. Deliveries are claimed with
+// SKIP LOCKED and leased for the timeout, so several servers can run it and
+// a delivery whose server died is retried.
+func (s *Server) runWebhooks() {
+	client := newWebhookClient(s.cfg)
+	ticker := time.NewTicker(s.cfg.WebhookPollInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		deliveries, err := s.claimDeliveries()
+		if err != nil {
+			s.logger.Error("claiming webhook deliveries failed", slog.String("error", err.Error()))
+			continue
+		}
+		var wg sync.WaitGroup
+		for _, d := range deliveries {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.deliverWebhook(client, d)
+			}()
+		}
+		wg.Wait()
+	}
+}
+
+// claimDeliveries takes the due deliveries of active webhooks, and tests.
+// The attempt counts from the claim, a delivery that was claimed and never
+// answered still used up an attempt.
+func (s *Server) claimDeliveries() ([]pendingDelivery, error) {
+	lease := 2*s.cfg.WebhookTimeout + time.Minute
+	rows, err := s.db.Query(`
+		UPDATE webhook_deliveries d
+		SET attempts = d.attempts + 1, next_attempt_at = NOW() + make_interval(secs => $1)
+		FROM webhooks w
+		WHERE w.id = d.webhook_id
+		AND d.id IN (
+			SELECT dd.id FROM webhook_deliveries dd
+			JOIN webhooks ww ON ww.id = dd.webhook_id
+			WHERE dd.status = 'pending' AND dd.next_attempt_at <= NOW()
+			AND (ww.active OR dd.event_type = $3)
+			ORDER BY dd.next_attempt_at
+			LIMIT $2
+			FOR UPDATE OF dd SKIP LOCKED
+		)
+		RETURNING d.id, d.webhook_id, d.event_type, d.payload, d.trace_context, d.attempts, w.url, w.secret
+	`, lease.Seconds(), webhookBatch, model.WebhookTest)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []pendingDelivery
+	for rows.Next() {
+		var d pendingDelivery
+		var traceContext []byte
+		if err := rows.Scan(&d.id, &d.webhookID, &d.eventType, &d.payload, &traceContext, &d.attempt, &d.url, &d.secret); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(traceContext, &d.traceContext); err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+// deliverWebhook makes one attempt at a delivery and records it. The span is
+// a child of the span that queued the delivery.
+func (s *Server) deliverWebhook(client *http.Client, d pendingDelivery) {
+	parent := otel.GetTextMapPropagator().Extract(context.Background(), d.traceContext)
+	ctx, span := s.tracer.Start(parent, "deliver_webhook", trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+	span.SetAttributes(
+		attribute.Int("webhook.id", d.webhookID),
+		attribute.Int64("webhook.delivery.id", d.id),
+		attribute.String("webhook.event", d.eventType),
+		attribute.Int("webhook.attempt", d.attempt),
+	)
+
+	var status *int
+	var errMsg string
+	start := time.Now()
+	resp, err := s.postWebhook(ctx, client, d)
+	duration := time.Since(start)
+	if err != nil {
+		errMsg = err.Error()
+	} else {
+		status = &resp.StatusCode
+		span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+	}
+	ok := err == nil && resp.StatusCode >= 200 && resp.StatusCode < 300
+
+	next := model.DeliverySucceeded
+	var retryIn time.Duration
+	if !ok {
+		next = model.DeliveryFailed
+		if int64(d.attempt) < s.cfg.WebhookMaxAttempts {
+			next = model.DeliveryPending
+			retryIn = retryBackoff(s.cfg.WebhookRetryBase, d.attempt)
+		}
+	}
+
+	if err := s.recordAttempt(ctx, d.id, status, errMsg, duration, next, retryIn); err != nil {
+		logError("recording webhook attempt failed", ctx, s.logger, span, err,
+			slog.Int64("delivery_id", d.id),
+		)
+		return
+	}
+
+	attrs := []any{
+		slog.Int("webhook_id", d.webhookID),
+		slog.Int64("delivery_id", d.id),
+		slog.String("event_type", d.eventType),
+		slog.Int("attempt", d.attempt),
+		slog.String("status", next),
+		slog.Duration("duration", duration),
+	}
+	if ok {
+		s.logger.InfoContext(ctx, "webhook delivered", attrs...)
+		return
+	}
+	if status != nil {
+		attrs = append(attrs, slog.Int("response_status", *status))
+		errMsg = "unexpected response status " + strconv.Itoa(*status)
+	}
+	s.logger.WarnContext(ctx, "webhook delivery failed", append(attrs, slog.String("error", errMsg))...)
+	span.SetStatus(codes.Error, errMsg)
+}
+
+// postWebhook sends a delivery. The body of the response is read and thrown
+// away so the connection can be reused.
+func (s *Server) postWebhook(ctx context.Context, client *http.Client, d pendingDelivery) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.url, bytes.NewReader(d.payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "MinimalDo-Webhooks")
+	req.Header.Set(eventHeader, d.eventType)
+	req.Header.Set(deliveryHeader, strconv.FormatInt(d.id, 10))
+	req.Header.Set(signatureHeader, signWebhook(d.secret, time.Now(), d.payload))
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	return resp, nil
+}
+
+func (s *Server) recordAttempt(ctx context.Context, deliveryID int64, status *int, errMsg string, duration time.Duration,
+	next string, retryIn time.Duration) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO webhook_attempts (delivery_id, response_status, error, duration_ms)
+		VALUES ($1, $2, NULLIF($3, ''), $4)
+	`, deliveryID, status, errMsg, duration.Milliseconds())
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `
+		UPDATE webhook_deliveries SET status = $2, next_attempt_at = NOW() + make_interval(secs => $3)
+		WHERE id = $1
+	`, deliveryID, next, retryIn.Seconds())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// signWebhook returns the signature header of a delivery:
+// t=<unix time>,v1=<hex HMAC-SHA256 of "<unix time>.<body>" with the secret>.
+// Receivers should check it and reject old timestamps.
+func signWebhook(secret string, t time.Time, body []byte) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts + "."))
+	mac.Write(body)
+	return "t=" + ts + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// retryBackoff is the wait after the attempt-th failed attempt, base doubled
+// for each earlier one, up to an hour.
+func retryBackoff(base time.Duration, attempt int) time.Duration {
+	d := base
+	for i := 1; i < attempt && d < maxBackoff; i++ {
+		d *= 2
+	}
+	return min(d, maxBackoff)
+}
+
+// newWebhookClient returns the client deliveries are sent with. It doesn't
+// follow redirects, and unless WebhookAllowPrivate is set it refuses to
+// connect to loopback, private and link-local addresses, whatever the URL
+// resolved to.
+func newWebhookClient(cfg *Config) *http.Client {
+	dialer := &net.Dialer{Timeout: cfg.WebhookTimeout}
+	if !cfg.WebhookAllowPrivate {
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+				ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() {
+				return errPrivateAddress
+			}
+			return nil
+		}
+	}
+	return &http.Client{
+		Timeout: cfg.WebhookTimeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: cfg.WebhookTimeout,
+			MaxIdleConnsPerHost: 4,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
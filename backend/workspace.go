@@ -0,0 +1,493 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/thakurnishu/MinimalDo/model"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// gin context key set by WorkspaceMiddleware
+	ctxWorkspaceID = "workspace_id"
+
+	workspaceHeader = "X-Workspace-ID"
+)
+
+var errLastAdmin = errors.New("a workspace needs at least one admin")
+
+// WorkspaceMiddleware selects the workspace of the request from the
+// /api/w/:workspace prefix or the X-Workspace-ID header, falling back to the
+// user's personal workspace, and rejects users who are not a member.
+func (s *Server) WorkspaceMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		span := trace.SpanFromContext(ctx)
+		userID := currentUserID(c)
+
+		fromPath, fromHeader := c.Param("workspace"), c.GetHeader(workspaceHeader)
+		if fromPath != "" && fromHeader != "" && fromPath != fromHeader {
+			logError("conflicting workspace", ctx, s.logger, span, errors.New("path and header name different workspaces"),
+				slog.String("workspace_path", fromPath),
+				slog.String("workspace_header", fromHeader),
+			)
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Workspace in path and " + workspaceHeader + " header differ"})
+			return
+		}
+		requested := fromPath
+		if requested == "" {
+			requested = fromHeader
+		}
+
+		var workspaceID int
+		var err error
+		if requested == "" {
+			err = s.db.QueryRowContext(ctx, `
+				SELECT id FROM workspaces WHERE personal_user_id = $1
+			`, userID).Scan(&workspaceID)
+		} else {
+			workspaceID, err = strconv.Atoi(requested)
+			if err != nil {
+				logError("invalid workspace id", ctx, s.logger, span, err,
+					slog.String("workspace_id", requested),
+				)
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid workspace ID"})
+				return
+			}
+			_, err = workspaceRole(ctx, s.db, workspaceID, userID)
+		}
+		if err == sql.ErrNoRows {
+			span.SetAttributes(
+				attribute.Int("user.id", userID),
+				attribute.String("authz.resource.type", "workspace"),
+				attribute.String("authz.resource.id", requested),
+			)
+			logError("access denied", ctx, s.logger, span, errForbidden,
+				slog.Int("user_id", userID),
+				slog.String("resource_type", "workspace"),
+				slog.String("resource_id", requested),
+			)
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "You are not a member of this workspace"})
+			return
+		}
+		if err != nil {
+			logError("workspace lookup failed", ctx, s.logger, span, err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		span.SetAttributes(attribute.Int("workspace.id", workspaceID))
+		c.Set(ctxWorkspaceID, workspaceID)
+		c.Next()
+	}
+}
+
+// currentWorkspaceID returns the workspace set by WorkspaceMiddleware.
+func currentWorkspaceID(c *gin.Context) int {
+	return c.GetInt(ctxWorkspaceID)
+}
+
+// beginTenantTx starts the transaction a workspace scoped handler runs its
+// queries in. It switches to the minimaldo_app role, which is subject to row
+// level security, and sets app.workspace_id for the policies. Both only last
+// until the transaction ends, so read-only handlers can leave the deferred
+// Rollback to end it.
+func (s *Server) beginTenantTx(ctx context.Context, c *gin.Context) (*sql.Tx, error) {
+	return s.beginWorkspaceTx(ctx, currentWorkspaceID(c))
+}
+
+// beginWorkspaceTx is beginTenantTx for a workspace that doesn't come from
+// the request. The caller must have checked the user is a member.
+func (s *Server) beginWorkspaceTx(ctx context.Context, workspaceID int) (*sql.Tx, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, "SET LOCAL ROLE minimaldo_app"); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	_, err = tx.ExecContext(ctx, "SELECT set_config('app.workspace_id', $1, true)", strconv.Itoa(workspaceID))
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return tx, nil
+}
+
+// workspaceRole returns userID's role in a workspace, sql.ErrNoRows if they
+// are not a member.
+func workspaceRole(ctx context.Context, db dbtx, workspaceID, userID int) (string, error) {
+	var r string
+	err := db.QueryRowContext(ctx, `
+		SELECT role FROM workspace_members WHERE workspace_id = $1 AND user_id = $2
+	`, workspaceID, userID).Scan(&r)
+	return r, err
+}
+
+// authorizeWorkspace checks the caller's workspace role for the workspace
+// management endpoints, which are not scoped by WorkspaceMiddleware.
+func (s *Server) authorizeWorkspace(c *gin.Context, ctx context.Context, span trace.Span, workspaceID int, needAdmin bool) bool {
+	userID := currentUserID(c)
+	span.SetAttributes(
+		attribute.Int("user.id", userID),
+		attribute.Int("workspace.id", workspaceID),
+	)
+
+	r, err := workspaceRole(ctx, s.db, workspaceID, userID)
+	if err != nil && err != sql.ErrNoRows {
+		logError("role lookup failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return false
+	}
+	if err == nil && (!needAdmin || r == model.WorkspaceRoleAdmin) {
+		return true
+	}
+
+	need := model.WorkspaceRoleMember
+	if needAdmin {
+		need = model.WorkspaceRoleAdmin
+	}
+	span.SetAttributes(
+		attribute.String("authz.resource.type", "workspace"),
+		attribute.Int("authz.resource.id", workspaceID),
+		attribute.String("authz.role", r),
+		attribute.String("authz.required_role", need),
+	)
+	logError("access denied", ctx, s.logger, span, errForbidden,
+		slog.Int("user_id", userID),
+		slog.String("resource_type", "workspace"),
+		slog.Int("resource_id", workspaceID),
+		slog.String("role", r),
+		slog.String("required_role", need),
+	)
+	c.JSON(http.StatusForbidden, gin.H{"error": "You need to be a workspace " + need})
+	return false
+}
+
+func (s *Server) getWorkspaces(c *gin.Context) {
+	ctx, span := s.tracer.Start(c.Request.Context(), "get_workspaces")
+	defer span.End()
+
+	userID := currentUserID(c)
+	span.SetAttributes(attribute.Int("user.id", userID))
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT w.id, w.name, m.role, COALESCE(w.personal_user_id = $1, FALSE), w.created_at
+		FROM workspaces w
+		JOIN workspace_members m ON m.workspace_id = w.id AND m.user_id = $1
+		ORDER BY 4 DESC, w.name
+	`, userID)
+	if err != nil {
+		logError("query failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	workspaces := []model.Workspace{}
+	for rows.Next() {
+		var w model.Workspace
+		if err := rows.Scan(&w.ID, &w.Name, &w.Role, &w.Personal, &w.CreatedAt); err != nil {
+			logError("rows scan failed", ctx, s.logger, span, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		workspaces = append(workspaces, w)
+	}
+	if err := rows.Err(); err != nil {
+		logError("row iteration failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, workspaces)
+}
+
+func (s *Server) createWorkspace(c *gin.Context) {
+	ctx, span := s.tracer.Start(c.Request.Context(), "create_workspace")
+	defer span.End()
+
+	var req model.WorkspaceRequest
+	if err := c.BindJSON(&req); err != nil {
+		logError("failed to parse json", ctx, s.logger, span, err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	name := strings.TrimSpace(req.Name)
+	if name == "" || len(name) > 100 {
+		logError("invalid workspace name", ctx, s.logger, span, errors.New("invalid name"))
+		c.JSON(http.StatusBadRequest, gin.H{"error": "workspace name must be 1-100 characters"})
+		return
+	}
+
+	userID := currentUserID(c)
+	span.SetAttributes(attribute.Int("user.id", userID))
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		logError("begin transaction failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	w := model.Workspace{Name: name, Role: model.WorkspaceRoleAdmin}
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO workspaces (name) VALUES ($1) RETURNING id, created_at
+	`, name).Scan(&w.ID, &w.CreatedAt)
+	if err != nil {
+		logError("row scan failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO workspace_members (workspace_id, user_id, role) VALUES ($1, $2, 'admin')
+	`, w.ID, userID)
+	if err != nil {
+		logError("query execution failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		logError("commit failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	s.logger.InfoContext(ctx, "created workspace",
+		slog.Int("workspace_id", w.ID),
+		slog.Int("user_id", userID),
+	)
+	span.SetAttributes(attribute.Int("workspace.id", w.ID))
+
+	c.JSON(http.StatusCreated, w)
+}
+
+func (s *Server) getWorkspaceMembers(c *gin.Context) {
+	ctx, span := s.tracer.Start(c.Request.Context(), "get_workspace_members")
+	defer span.End()
+
+	workspaceID, ok := s.paramID(c, ctx, span, "id")
+	if !ok {
+		return
+	}
+	if !s.authorizeWorkspace(c, ctx, span, workspaceID, false) {
+		return
+	}
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT u.id, u.username, COALESCE(u.email, ''), u.created_at, m.role, m.added_at
+		FROM workspace_members m
+		JOIN users u ON u.id = m.user_id
+		WHERE m.workspace_id = $1
+		ORDER BY m.added_at
+	`, workspaceID)
+	if err != nil {
+		logError("query failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	members := []model.WorkspaceMember{}
+	for rows.Next() {
+		var m model.WorkspaceMember
+		if err := rows.Scan(&m.User.ID, &m.User.Username, &m.User.Email, &m.User.CreatedAt, &m.Role, &m.AddedAt); err != nil {
+			logError("rows scan failed", ctx, s.logger, span, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		members = append(members, m)
+	}
+	if err := rows.Err(); err != nil {
+		logError("row iteration failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, members)
+}
+
+func (s *Server) addWorkspaceMember(c *gin.Context) {
+	ctx, span := s.tracer.Start(c.Request.Context(), "add_workspace_member")
+	defer span.End()
+
+	workspaceID, ok := s.paramID(c, ctx, span, "id")
+	if !ok {
+		return
+	}
+
+	var req model.AddWorkspaceMemberRequest
+	if err := c.BindJSON(&req); err != nil {
+		logError("failed to parse json", ctx, s.logger, span, err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.Username = strings.TrimSpace(req.Username)
+	req.Email = strings.TrimSpace(req.Email)
+	if req.Role == "" {
+		req.Role = model.WorkspaceRoleMember
+	}
+	if (req.Role != model.WorkspaceRoleMember && req.Role != model.WorkspaceRoleAdmin) || (req.Username == "") == (req.Email == "") {
+		logError("invalid workspace member", ctx, s.logger, span, errors.New("invalid member request"))
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Give either username or email, and a role of member or admin"})
+		return
+	}
+
+	if !s.authorizeWorkspace(c, ctx, span, workspaceID, true) {
+		return
+	}
+
+	var m model.WorkspaceMember
+	err := s.db.QueryRowContext(ctx, `
+		SELECT id, username, COALESCE(email, ''), created_at FROM users
+		WHERE ($1 <> '' AND username = $1) OR ($2 <> '' AND email = $2)
+		LIMIT 1
+	`, req.Username, req.Email).Scan(&m.User.ID, &m.User.Username, &m.User.Email, &m.User.CreatedAt)
+	if err == sql.ErrNoRows {
+		logError("user not found", ctx, s.logger, span, err)
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if err != nil {
+		logError("row scan failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	err = s.db.QueryRowContext(ctx, `
+		INSERT INTO workspace_members (workspace_id, user_id, role) VALUES ($1, $2, $3)
+		ON CONFLICT (workspace_id, user_id) DO NOTHING
+		RETURNING role, added_at
+	`, workspaceID, m.User.ID, req.Role).Scan(&m.Role, &m.AddedAt)
+	if err == sql.ErrNoRows {
+		logError("already a workspace member", ctx, s.logger, span, err,
+			slog.Int("member_id", m.User.ID),
+		)
+		c.JSON(http.StatusConflict, gin.H{"error": "User is already a member"})
+		return
+	}
+	if err != nil {
+		logError("row scan failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	s.logger.InfoContext(ctx, "workspace member added",
+		slog.Int("workspace_id", workspaceID),
+		slog.Int("member_id", m.User.ID),
+		slog.String("role", m.Role),
+	)
+	span.SetAttributes(attribute.Int("member.id", m.User.ID))
+
+	c.JSON(http.StatusCreated, m)
+}
+
+// removeWorkspaceMember removes a member and their list memberships in the
+// workspace. Admins can remove anyone, members can remove themselves. Nobody
+// leaves their personal workspace.
+func (s *Server) removeWorkspaceMember(c *gin.Context) {
+	ctx, span := s.tracer.Start(c.Request.Context(), "remove_workspace_member")
+	defer span.End()
+
+	workspaceID, ok := s.paramID(c, ctx, span, "id")
+	if !ok {
+		return
+	}
+	memberID, ok := s.paramID(c, ctx, span, "user_id")
+	if !ok {
+		return
+	}
+	if !s.authorizeWorkspace(c, ctx, span, workspaceID, memberID != currentUserID(c)) {
+		return
+	}
+	span.SetAttributes(attribute.Int("member.id", memberID))
+
+	err := s.removeFromWorkspace(ctx, workspaceID, memberID)
+	switch {
+	case err == sql.ErrNoRows:
+		s.logger.WarnContext(ctx, "workspace member not found")
+		span.SetStatus(codes.Error, "workspace member not found")
+		c.JSON(http.StatusNotFound, gin.H{"error": "Member not found"})
+		return
+	case errors.Is(err, errLastAdmin):
+		logError("last admin of workspace", ctx, s.logger, span, err)
+		c.JSON(http.StatusConflict, gin.H{"error": "A workspace needs at least one admin"})
+		return
+	case errors.Is(err, errForbidden):
+		logError("leaving personal workspace", ctx, s.logger, span, err)
+		c.JSON(http.StatusConflict, gin.H{"error": "Nobody can leave their personal workspace"})
+		return
+	case err != nil:
+		logError("removing workspace member failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	s.logger.InfoContext(ctx, "workspace member removed",
+		slog.Int("workspace_id", workspaceID),
+		slog.Int("member_id", memberID),
+	)
+	c.Status(http.StatusNoContent)
+}
+
+func (s *Server) removeFromWorkspace(ctx context.Context, workspaceID, memberID int) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var personalUserID sql.NullInt64
+	err = tx.QueryRowContext(ctx, `
+		SELECT personal_user_id FROM workspaces WHERE id = $1 FOR UPDATE
+	`, workspaceID).Scan(&personalUserID)
+	if err != nil {
+		return err
+	}
+	if personalUserID.Valid && int(personalUserID.Int64) == memberID {
+		return errForbidden
+	}
+
+	result, err := tx.ExecContext(ctx, `
+		DELETE FROM workspace_members WHERE workspace_id = $1 AND user_id = $2
+	`, workspaceID, memberID)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	var admins int
+	err = tx.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM workspace_members WHERE workspace_id = $1 AND role = 'admin'
+	`, workspaceID).Scan(&admins)
+	if err != nil {
+		return err
+	}
+	if admins == 0 {
+		return errLastAdmin
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		DELETE FROM list_members
+		WHERE user_id = $2 AND list_id IN (SELECT id FROM lists WHERE workspace_id = $1)
+	`, workspaceID, memberID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
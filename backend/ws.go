@@ -0,0 +1,421 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/thakurnishu/MinimalDo/model"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// wsProtocol is the subprotocol of /api/ws. Browsers can't set the
+	// Authorization header on a WebSocket, they offer the access token as a
+	// second subprotocol: new WebSocket(url, ["minimaldo.v1", token]).
+	wsProtocol = "minimaldo.v1"
+
+	wsMaxMessageBytes = 64 << 10
+	wsWriteWait       = 10 * time.Second
+	wsPongWait        = 60 * time.Second
+	wsPingPeriod      = wsPongWait * 9 / 10
+	// messages queued for a connection before it counts as too slow
+	wsSendBuffer = 256
+)
+
+var errSlowConsumer = errors.New("client is not reading its messages fast enough")
+
+// wsBearerToken is the access token offered as the second subprotocol of a
+// WebSocket handshake.
+func wsBearerToken(r *http.Request) (string, bool) {
+	if !websocket.IsWebSocketUpgrade(r) {
+		return "", false
+	}
+	protocols := websocket.Subprotocols(r)
+	if len(protocols) != 2 || protocols[0] != wsProtocol || protocols[1] == "" {
+		return "", false
+	}
+	return protocols[1], true
+}
+
+func (s *Server) wsUpgrader() *websocket.Upgrader {
+	return &websocket.Upgrader{
+		Subprotocols: []string{wsProtocol},
+		// the token is not a cookie, but only the frontend has any business
+		// opening a socket from a browser
+		CheckOrigin: func(r *http.Request) bool {
+			origin := r.Header.Get("Origin")
+			return origin == "" || origin == s.cfg.FrontendURL
+		},
+	}
+}
+
+// wsConn is one WebSocket connection. Commands and events are handled on one
+// goroutine, so an ack always comes before the events that follow it and the
+// connection's own changes can be left out of its broadcasts. A second
+// goroutine owns writing.
+type wsConn struct {
+	s    *Server
+	conn *websocket.Conn
+	// the upgrade request, commands run as its user in its workspace
+	c    *gin.Context
+	span trace.Span
+
+	sub      *eventSub
+	done     chan struct{} // closed once the connection stops handling commands
+	send     chan model.WSMessage
+	seq      int64
+	lists    map[int]bool
+	personal bool
+	lastID   int64 // the newest event handled
+	// events already sent, or made by this connection's own commands
+	seen *recentIDs
+}
+
+// serveWS is the WebSocket API. Clients subscribe to lists and get the
+// changes others make to them as events, and send create, update and delete
+// commands, which run through the same todo writes as the REST API.
+func (s *Server) serveWS(c *gin.Context) {
+	ctx, span := s.tracer.Start(c.Request.Context(), "ws_connection")
+	defer span.End()
+
+	userID := currentUserID(c)
+	workspaceID := currentWorkspaceID(c)
+	span.SetAttributes(attribute.Int("user.id", userID))
+
+	// subscribe before reading the starting point, so nothing written in
+	// between is lost
+	sub := s.events.subscribe(workspaceID)
+	defer s.events.unsubscribe(workspaceID, sub)
+	lastID, err := s.latestEventID(ctx, workspaceID)
+	if err != nil {
+		logError("query failed", ctx, s.logger, span, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	conn, err := s.wsUpgrader().Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		// the upgrader has already answered
+		logError("websocket upgrade failed", ctx, s.logger, span, err)
+		return
+	}
+	defer conn.Close()
+	conn.SetReadLimit(wsMaxMessageBytes)
+
+	w := &wsConn{
+		s:      s,
+		conn:   conn,
+		c:      c,
+		span:   span,
+		sub:    sub,
+		done:   make(chan struct{}),
+		send:   make(chan model.WSMessage, wsSendBuffer),
+		lists:  map[int]bool{},
+		lastID: lastID,
+		seen:   newRecentIDs(maxEventBacklog),
+	}
+	s.logger.InfoContext(ctx, "websocket opened",
+		slog.Int("user_id", userID),
+		slog.Int("workspace_id", workspaceID),
+	)
+
+	commands := make(chan model.WSCommand)
+	go w.readLoop(commands)
+	var writer sync.WaitGroup
+	writer.Add(1)
+	go func() {
+		defer writer.Done()
+		w.writeLoop()
+	}()
+
+	reason := w.run(ctx, commands)
+	close(w.done)
+	close(w.send)
+	writer.Wait()
+
+	span.SetAttributes(attribute.Int64("ws.messages_sent", w.seq))
+	s.logger.InfoContext(ctx, "websocket closed",
+		slog.Int("user_id", userID),
+		slog.String("reason", reason),
+		slog.Int64("messages_sent", w.seq),
+	)
+}
+
+// run handles commands and events until the connection ends, and returns
+// why it did.
+func (w *wsConn) run(ctx context.Context, commands <-chan model.WSCommand) string {
+	var expired <-chan time.Time
+	if exp := w.c.GetTime(ctxTokenExp); !exp.IsZero() {
+		timer := time.NewTimer(time.Until(exp))
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	for {
+		select {
+		case cmd, ok := <-commands:
+			if !ok {
+				return "client went away"
+			}
+			if err := w.enqueue(w.handle(ctx, cmd)); err != nil {
+				return w.fail(ctx, websocket.CloseTryAgainLater, err)
+			}
+		case <-w.sub.wake:
+			switch err := w.deliver(ctx); err {
+			case nil:
+			case errSlowConsumer:
+				return w.fail(ctx, websocket.CloseTryAgainLater, err)
+			case errNotMember:
+				return w.fail(ctx, websocket.ClosePolicyViolation, err)
+			default:
+				return w.fail(ctx, websocket.CloseInternalServerErr, err)
+			}
+		case <-expired:
+			// the client reconnects with a fresh token
+			w.close(websocket.ClosePolicyViolation, "access token expired")
+			return "access token expired"
+		}
+	}
+}
+
+// fail closes the connection because of err.
+func (w *wsConn) fail(ctx context.Context, code int, err error) string {
+	if code == websocket.CloseInternalServerErr {
+		logError("websocket failed", ctx, w.s.logger, w.span, err)
+		w.close(code, "internal error")
+	} else {
+		w.s.logger.WarnContext(ctx, "websocket closed by server",
+			slog.Int("user_id", currentUserID(w.c)),
+			slog.String("error", err.Error()),
+		)
+		w.span.SetStatus(codes.Error, err.Error())
+		w.close(code, err.Error())
+	}
+	return err.Error()
+}
+
+// close sends a close frame, which is safe next to the writer goroutine, and
+// closes the connection so the reader stops.
+func (w *wsConn) close(code int, text string) {
+	msg := websocket.FormatCloseMessage(code, text)
+	w.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(wsWriteWait))
+	w.conn.Close()
+}
+
+// enqueue numbers msg and queues it for the writer. A full queue means the
+// client is not keeping up, it is disconnected rather than left to fall
+// further behind or sent a stream with holes in it.
+func (w *wsConn) enqueue(msg model.WSMessage) error {
+	w.seq++
+	msg.Seq = w.seq
+	select {
+	case w.send <- msg:
+		return nil
+	default:
+		return errSlowConsumer
+	}
+}
+
+func (w *wsConn) readLoop(commands chan<- model.WSCommand) {
+	defer close(commands)
+	w.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	w.conn.SetPongHandler(func(string) error {
+		return w.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+	for {
+		var cmd model.WSCommand
+		if err := w.conn.ReadJSON(&cmd); err != nil {
+			var syntaxErr *json.SyntaxError
+			var typeErr *json.UnmarshalTypeError
+			if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+				cmd = model.WSCommand{Type: "invalid"}
+			} else {
+				return
+			}
+		}
+		w.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		select {
+		case commands <- cmd:
+		case <-w.done:
+			return
+		}
+	}
+}
+
+func (w *wsConn) writeLoop() {
+	ping := time.NewTicker(wsPingPeriod)
+	defer ping.Stop()
+	for {
+		select {
+		case msg, ok := <-w.send:
+			if !ok {
+				return
+			}
+			w.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := w.conn.WriteJSON(msg); err != nil {
+				w.conn.Close()
+				return
+			}
+		case <-ping.C:
+			if err := w.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)); err != nil {
+				w.conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// handle runs one command in its own span and returns the reply.
+func (w *wsConn) handle(ctx context.Context, cmd model.WSCommand) model.WSMessage {
+	ctx, span := w.s.tracer.Start(ctx, "ws_command")
+	defer span.End()
+	span.SetAttributes(
+		attribute.String("ws.command.id", cmd.ID),
+		attribute.String("ws.command.type", cmd.Type),
+	)
+
+	var reply model.WSMessage
+	switch cmd.Type {
+	case model.WSSubscribe:
+		reply = w.subscribe(ctx, span, cmd)
+	case model.WSUnsubscribe:
+		for _, id := range cmd.ListIDs {
+			delete(w.lists, id)
+		}
+		if cmd.Personal {
+			w.personal = false
+		}
+		reply = model.WSMessage{Type: model.WSAck, Status: http.StatusOK}
+	case model.WSCreate, model.WSUpdate, model.WSDelete:
+		reply = w.command(ctx, span, cmd)
+	default:
+		reply = model.WSMessage{Type: model.WSError, Status: http.StatusBadRequest, Error: "Unknown command type"}
+	}
+	reply.ID = cmd.ID
+
+	span.SetAttributes(attribute.Int("ws.reply.status", reply.Status))
+	if reply.Type == model.WSError {
+		span.SetStatus(codes.Error, reply.Error)
+	}
+	return reply
+}
+
+// subscribe adds lists, and the personal todos, to what the connection gets
+// events for. With since, the events after it are sent first.
+func (w *wsConn) subscribe(ctx context.Context, span trace.Span, cmd model.WSCommand) model.WSMessage {
+	userID := currentUserID(w.c)
+	tx, err := w.s.beginTenantTx(ctx, w.c)
+	if err != nil {
+		logError("begin transaction failed", ctx, w.s.logger, span, err)
+		return model.WSMessage{Type: model.WSError, Status: http.StatusInternalServerError, Error: err.Error()}
+	}
+	defer tx.Rollback()
+
+	for _, id := range cmd.ListIDs {
+		r, err := listRole(ctx, tx, id, userID)
+		if err == sql.ErrNoRows || (err == nil && r < roleViewer) {
+			return model.WSMessage{Type: model.WSError, Status: http.StatusNotFound, Error: "List " + strconv.Itoa(id) + " not found"}
+		}
+		if err != nil {
+			logError("role lookup failed", ctx, w.s.logger, span, err)
+			return model.WSMessage{Type: model.WSError, Status: http.StatusInternalServerError, Error: err.Error()}
+		}
+	}
+	for _, id := range cmd.ListIDs {
+		w.lists[id] = true
+	}
+	if cmd.Personal {
+		w.personal = true
+	}
+	if cmd.Since != nil {
+		w.lastID = *cmd.Since
+		w.sub.requestResync()
+	}
+	return model.WSMessage{Type: model.WSAck, Status: http.StatusOK}
+}
+
+// command runs a create, update or delete through the same todo writes as
+// the REST API, with the user and workspace of the connection, and turns
+// what it did into the reply.
+func (w *wsConn) command(ctx context.Context, span trace.Span, cmd model.WSCommand) model.WSMessage {
+	if err := w.s.checkScope(w.c, ctx, span, model.ScopeTodosWrite); err != nil {
+		return wsError(err)
+	}
+
+	var res todoWrite
+	var err error
+	status := http.StatusOK
+	switch cmd.Type {
+	case model.WSCreate:
+		res, err = w.s.addTodo(ctx, span, w.c, cmd.Todo)
+	case model.WSUpdate:
+		res, err = w.s.editTodo(ctx, span, w.c, cmd.TodoID, cmd.Todo)
+	case model.WSDelete:
+		res, err = w.s.removeTodo(ctx, span, w.c, cmd.TodoID)
+		status = http.StatusNoContent
+	}
+	if err != nil {
+		return wsError(err)
+	}
+
+	// the change isn't broadcast back to the connection that made it
+	if res.eventID != 0 {
+		w.seen.add(res.eventID)
+	}
+	reply := model.WSMessage{Type: model.WSAck, Status: status, UndoToken: res.undoToken}
+	if status == http.StatusOK {
+		reply.Todo = &res.todo
+	}
+	return reply
+}
+
+// wsError is the reply for a command that failed with err.
+func wsError(err error) model.WSMessage {
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		return model.WSMessage{Type: model.WSError, Status: apiErr.status, Error: apiErr.msg}
+	}
+	return model.WSMessage{Type: model.WSError, Status: http.StatusInternalServerError, Error: err.Error()}
+}
+
+// deliver queues the events the connection was woken for that match its
+// subscriptions.
+func (w *wsConn) deliver(ctx context.Context) error {
+	ids, resync := w.sub.take()
+	workspaceID := currentWorkspaceID(w.c)
+	events, reset, err := w.s.loadEvents(ctx, workspaceID, currentUserID(w.c), w.lastID, ids, resync)
+	if err != nil {
+		return err
+	}
+	if reset {
+		if w.lastID, err = w.s.latestEventID(ctx, workspaceID); err != nil {
+			return err
+		}
+		return w.enqueue(model.WSMessage{Type: model.WSReset})
+	}
+	for _, e := range events {
+		w.lastID = max(w.lastID, e.ID)
+		if w.seen.contains(e.ID) {
+			continue
+		}
+		if (e.Todo.ListID == nil && !w.personal) || (e.Todo.ListID != nil && !w.lists[*e.Todo.ListID]) {
+			continue
+		}
+		w.seen.add(e.ID)
+		if err := w.enqueue(model.WSMessage{Type: model.WSEvent, Event: &e}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,7 +1,10 @@
-import React, { useState, useEffect } from 'react';
+import React, { useState, useEffect, useRef } from 'react';
 import PropTypes from 'prop-types';
 import './App.css';
-import { API_URL } from './utils/env';
+import Login from './Login';
+import { apiFetch, subscribeEvents, loadSession, saveSession, logout, SESSION_EXPIRED_EVENT } from './utils/api';
+
+const UNDO_TOAST_MS = 10000;
 
 const EditTodoForm = ({ todo, onSave, onCancel }) => {
   const [title, setTitle] = useState(todo.title);
@@ -52,7 +55,7 @@ EditTodoForm.propTypes = {
   onCancel: PropTypes.func.isRequired
 };
 
-function App() {
+function TodoApp({ user, onLogout }) {
   // State management
   const [todos, setTodos] = useState([]);
   const [dateGroups, setDateGroups] = useState([]);
@@ -66,6 +69,7 @@ function App() {
   const [dragOverItem, setDragOverItem] = useState(null);
   const [dateRange, setDateRange] = useState('day');
   const [currentDate, setCurrentDate] = useState(new Date());
+  const [undo, setUndo] = useState(null); // { message, token } of the last delete
 
   // Date navigation functions
   const navigateDate = (direction) => {
@@ -132,12 +136,13 @@ function App() {
   };
 
   // Data loading
-  const loadTodos = async () => {
+  // A quiet reload keeps the list on screen, it is used for live updates
+  const loadTodos = async ({ quiet = false } = {}) => {
     try {
-      setLoading(true);
+      if (!quiet) setLoading(true);
       const dateStr = currentDate.toISOString().split('T')[0];
-      const response = await fetch(
-        `${API_URL}/todos/by-date?range=${dateRange}&date=${dateStr}`
+      const response = await apiFetch(
+        `/todos/by-date?range=${dateRange}&date=${dateStr}`
       );
       
       if (!response.ok) throw new Error('Failed to fetch todos');
@@ -166,6 +171,15 @@ function App() {
     loadTodos();
   }, [currentDate, dateRange]);
 
+  // Reload when someone else changes a todo, or when events were missed.
+  // The ref keeps the stream open across date changes.
+  const loadTodosRef = useRef(loadTodos);
+  loadTodosRef.current = loadTodos;
+  useEffect(() => subscribeEvents((type, event) => {
+    if (event.changed_by === user.id) return;
+    loadTodosRef.current({ quiet: true });
+  }), [user.id]);
+
   // Drag and drop handlers
   const handleDragStart = (e, todo) => {
     setDraggedItem(todo);
@@ -267,7 +281,7 @@ function App() {
   };
 
   const createTodo = async (todoData) => {
-    const response = await fetch(`${API_URL}/todos`, {
+    const response = await apiFetch('/todos', {
       method: 'POST',
       headers: { 'Content-Type': 'application/json' },
       body: JSON.stringify(todoData),
@@ -314,7 +328,7 @@ function App() {
   };
 
   const sendUpdateRequest = async (todo) => {
-    const response = await fetch(`${API_URL}/todos/${todo.id}`, {
+    const response = await apiFetch(`/todos/${todo.id}`, {
       method: 'PUT',
       headers: { 'Content-Type': 'application/json' },
       body: JSON.stringify(todo)
@@ -361,27 +375,44 @@ function App() {
     return dateGroups.flatMap(group => group.todos).find(t => t.id === id);
   };
 
+  // No confirmation dialog, the toast offers an undo instead
   const deleteTodo = async (id) => {
-    const confirmed = confirmDelete();
-    if (!confirmed) return;
-
     try {
-      await deleteTodoFromServer(id);
+      const token = await deleteTodoFromServer(id);
       removeTodoFromState(id);
+      if (token) setUndo({ message: 'Task deleted', token });
     } catch (err) {
       setError('Failed to delete todo');
     }
   };
 
-  const confirmDelete = () => {
-    return window.confirm('Are you sure you want to delete this task?');
-  };
-
   const deleteTodoFromServer = async (id) => {
-    const response = await fetch(`${API_URL}/todos/${id}`, { method: 'DELETE' });
+    const response = await apiFetch(`/todos/${id}`, { method: 'DELETE' });
     if (!response.ok) throw new Error('Delete request failed');
+    return response.headers.get('X-Undo-Token');
   };
 
+  // The backend restores the todo under its original ID, so reloading
+  // puts it back where it was
+  const undoLastChange = async () => {
+    const { token } = undo;
+    setUndo(null);
+    try {
+      const response = await apiFetch(`/undo/${token}`, { method: 'POST' });
+      if (!response.ok) throw new Error('Undo request failed');
+      await loadTodos();
+    } catch (err) {
+      setError('Failed to undo');
+    }
+  };
+
+  // The server keeps the token a little longer than the toast is shown
+  useEffect(() => {
+    if (!undo) return undefined;
+    const timer = setTimeout(() => setUndo(null), UNDO_TOAST_MS);
+    return () => clearTimeout(timer);
+  }, [undo]);
+
   const removeTodoFromState = (id) => {
     if (dateRange === 'day') {
       setTodos(prev => removeFromFlatList(prev, id));
@@ -518,7 +549,13 @@ function App() {
   return (
     <div className="container">
       <div className={`main-content ${sidebarCollapsed ? 'expanded' : ''}`}>
-        <h1>MinimalDo</h1>
+        <div className="app-header">
+          <h1>MinimalDo</h1>
+          <div className="user-menu">
+            <span>{user.username}</span>
+            <button onClick={onLogout} className="nav-btn">Sign out</button>
+          </div>
+        </div>
         
         <div className="date-controls">
           <button 
@@ -601,8 +638,93 @@ function App() {
       <button className={`toggle-btn ${sidebarCollapsed ? 'sidebar-closed' : 'sidebar-open'}`} onClick={() => setSidebarCollapsed(!sidebarCollapsed)}>
         {sidebarCollapsed ? '➕' : '✕'}
       </button>
+
+      {undo && (
+        <div className="toast" role="status">
+          <span>{undo.message}</span>
+          <button onClick={undoLastChange}>Undo</button>
+          <button onClick={() => setUndo(null)} className="toast-close" aria-label="Dismiss">✕</button>
+        </div>
+      )}
     </div>
   );
 }
 
+TodoApp.propTypes = {
+  user: PropTypes.shape({
+    id: PropTypes.number.isRequired,
+    username: PropTypes.string.isRequired
+  }).isRequired,
+  onLogout: PropTypes.func.isRequired
+};
+
+function App() {
+  const [session, setSession] = useState(loadSession);
+  const [loginError, setLoginError] = useState(null);
+  const [exchanging, setExchanging] = useState(false);
+
+  // After an SSO login the backend sends the browser back with a one-time
+  // login_code (or a login_error) in the query string.
+  useEffect(() => {
+    const params = new URLSearchParams(window.location.search);
+    const code = params.get('login_code');
+    const error = params.get('login_error');
+    if (!code && !error) return;
+
+    params.delete('login_code');
+    params.delete('login_error');
+    const query = params.toString();
+    window.history.replaceState(null, '', window.location.pathname + (query ? `?${query}` : ''));
+
+    if (error) {
+      setLoginError(error);
+      return;
+    }
+
+    setExchanging(true);
+    apiFetch('/auth/oidc/exchange', {
+      method: 'POST',
+      headers: { 'Content-Type': 'application/json' },
+      body: JSON.stringify({ code }),
+    })
+      .then(async (response) => {
+        const data = await response.json();
+        if (!response.ok) throw new Error(data.error || 'Login failed');
+        saveSession(data);
+        setSession(data);
+      })
+      .catch((err) => setLoginError(err.message))
+      .finally(() => setExchanging(false));
+  }, []);
+
+  useEffect(() => {
+    const onExpired = () => setSession(null);
+    window.addEventListener(SESSION_EXPIRED_EVENT, onExpired);
+    return () => window.removeEventListener(SESSION_EXPIRED_EVENT, onExpired);
+  }, []);
+
+  const handleLogin = (newSession) => {
+    saveSession(newSession);
+    setSession(newSession);
+  };
+
+  const handleLogout = async () => {
+    try {
+      await logout();
+    } finally {
+      setSession(null);
+    }
+  };
+
+  if (exchanging) {
+    return <div className="auth-container">Signing in...</div>;
+  }
+
+  if (!session) {
+    return <Login key={loginError} onLogin={handleLogin} initialError={loginError} />;
+  }
+
+  return <TodoApp key={session.user.id} user={session.user} onLogout={handleLogout} />;
+}
+
 export default App;
@@ -0,0 +1,115 @@
+import React, { useEffect, useState } from 'react';
+import PropTypes from 'prop-types';
+import { apiFetch } from './utils/api';
+import { API_URL } from './utils/env';
+
+const Login = ({ onLogin, initialError = null }) => {
+  const [mode, setMode] = useState('login');
+  const [username, setUsername] = useState('');
+  const [email, setEmail] = useState('');
+  const [password, setPassword] = useState('');
+  const [error, setError] = useState(initialError);
+  const [submitting, setSubmitting] = useState(false);
+  const [sso, setSso] = useState(null);
+
+  useEffect(() => {
+    apiFetch('/auth/providers')
+      .then((response) => (response.ok ? response.json() : null))
+      .then((providers) => setSso(providers && providers.oidc))
+      .catch(() => setSso(null));
+  }, []);
+
+  const isRegister = mode === 'register';
+
+  const handleSubmit = async (e) => {
+    e.preventDefault();
+    setSubmitting(true);
+    setError(null);
+
+    try {
+      const body = isRegister ? { username, email, password } : { username, password };
+      const response = await apiFetch(`/auth/${mode}`, {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify(body),
+      });
+      const data = await response.json();
+      if (!response.ok) throw new Error(data.error || 'Request failed');
+      onLogin(data);
+    } catch (err) {
+      setError(err.message);
+    } finally {
+      setSubmitting(false);
+    }
+  };
+
+  return (
+    <div className="auth-container">
+      <form onSubmit={handleSubmit} className="auth-form">
+        <h1>MinimalDo</h1>
+        <h2>{isRegister ? 'Create an account' : 'Sign in'}</h2>
+        {error && <div className="auth-error">{error}</div>}
+        <div className="form-group">
+          <label htmlFor="username">Username</label>
+          <input
+            id="username"
+            type="text"
+            value={username}
+            onChange={(e) => setUsername(e.target.value)}
+            autoComplete="username"
+            required
+          />
+        </div>
+        {isRegister && (
+          <div className="form-group">
+            <label htmlFor="email">Email (optional)</label>
+            <input
+              id="email"
+              type="email"
+              value={email}
+              onChange={(e) => setEmail(e.target.value)}
+              autoComplete="email"
+            />
+          </div>
+        )}
+        <div className="form-group">
+          <label htmlFor="password">Password</label>
+          <input
+            id="password"
+            type="password"
+            value={password}
+            onChange={(e) => setPassword(e.target.value)}
+            autoComplete={isRegister ? 'new-password' : 'current-password'}
+            minLength={isRegister ? 8 : undefined}
+            required
+          />
+        </div>
+        <button type="submit" disabled={submitting}>
+          {isRegister ? 'Create account' : 'Sign in'}
+        </button>
+        <button
+          type="button"
+          className="link-btn"
+          onClick={() => setMode(isRegister ? 'login' : 'register')}
+        >
+          {isRegister ? 'Already have an account? Sign in' : 'No account yet? Register'}
+        </button>
+        {sso && (
+          <>
+            <div className="auth-divider">or</div>
+            <a className="sso-btn" href={`${API_URL}${sso.login_url}?return_to=/`}>
+              Sign in with {sso.name}
+            </a>
+          </>
+        )}
+      </form>
+    </div>
+  );
+};
+
+Login.propTypes = {
+  onLogin: PropTypes.func.isRequired,
+  initialError: PropTypes.string
+};
+
+export default Login;
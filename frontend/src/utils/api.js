@@ -0,0 +1,155 @@
+import { API_URL } from './env';
+
+const SESSION_KEY = 'minimaldo_session';
+
+export const loadSession = () => {
+  try {
+    return JSON.parse(window.localStorage.getItem(SESSION_KEY));
+  } catch (err) {
+    return null;
+  }
+};
+
+export const saveSession = (session) => {
+  window.localStorage.setItem(SESSION_KEY, JSON.stringify(session));
+};
+
+export const clearSession = () => {
+  window.localStorage.removeItem(SESSION_KEY);
+};
+
+// Fired when the backend rejects the stored token so the app can show the login form again.
+export const SESSION_EXPIRED_EVENT = 'minimaldo:session-expired';
+
+let refreshInFlight = null;
+
+// refreshSession trades the refresh token for a new session. Refresh tokens
+// are single use and reusing one logs the user out everywhere, so concurrent
+// callers share one request.
+const refreshSession = () => {
+  if (!refreshInFlight) {
+    refreshInFlight = (async () => {
+      const session = loadSession();
+      if (!session || !session.refresh_token) return null;
+
+      const response = await fetch(`${API_URL}/auth/refresh`, {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ refresh_token: session.refresh_token }),
+      });
+      if (!response.ok) return null;
+
+      const refreshed = await response.json();
+      saveSession(refreshed);
+      return refreshed;
+    })().finally(() => {
+      refreshInFlight = null;
+    });
+  }
+  return refreshInFlight;
+};
+
+const withToken = (options, session) => {
+  const headers = { ...(options.headers || {}) };
+  if (session && session.access_token) {
+    headers.Authorization = `Bearer ${session.access_token}`;
+  }
+  return { ...options, headers };
+};
+
+// apiFetch is fetch() against the API with the access token attached. An
+// expired access token is refreshed once and the request retried.
+export const apiFetch = async (path, options = {}) => {
+  const session = loadSession();
+  let response = await fetch(`${API_URL}${path}`, withToken(options, session));
+  if (response.status !== 401 || !session || path.startsWith('/auth/')) {
+    return response;
+  }
+
+  const refreshed = await refreshSession();
+  if (refreshed) {
+    response = await fetch(`${API_URL}${path}`, withToken(options, refreshed));
+    if (response.status !== 401) return response;
+  }
+
+  clearSession();
+  window.dispatchEvent(new Event(SESSION_EXPIRED_EVENT));
+  return response;
+};
+
+const EVENTS_RECONNECT_MS = 3000;
+
+// parseEvent reads one server-sent event block into { id, type, data }.
+const parseEvent = (block) => {
+  const event = { id: null, type: 'message', data: '' };
+  block.split('\n').forEach((line) => {
+    if (line.startsWith('id: ')) event.id = line.slice(4);
+    else if (line.startsWith('event: ')) event.type = line.slice(7);
+    else if (line.startsWith('data: ')) event.data += line.slice(6);
+  });
+  return event;
+};
+
+// subscribeEvents calls onEvent(type, data) for every event of the
+// /events stream until the returned function is called. EventSource can't
+// send the Authorization header, so the stream is read with fetch. It
+// reconnects with Last-Event-ID, and the backend replays what was missed.
+export const subscribeEvents = (onEvent) => {
+  const controller = new AbortController();
+  let lastEventId = null;
+
+  const readStream = async () => {
+    const headers = lastEventId ? { 'Last-Event-ID': lastEventId } : {};
+    const response = await apiFetch('/events', { headers, signal: controller.signal });
+    if (!response.ok || !response.body) throw new Error('Event stream failed');
+
+    const reader = response.body.pipeThrough(new TextDecoderStream()).getReader();
+    let buffer = '';
+    for (;;) {
+      const { value, done } = await reader.read();
+      if (done) return;
+      buffer += value;
+      let end = buffer.indexOf('\n\n');
+      while (end >= 0) {
+        const event = parseEvent(buffer.slice(0, end));
+        buffer = buffer.slice(end + 2);
+        if (event.id) lastEventId = event.id;
+        if (event.data) onEvent(event.type, JSON.parse(event.data));
+        end = buffer.indexOf('\n\n');
+      }
+    }
+  };
+
+  (async () => {
+    while (!controller.signal.aborted) {
+      try {
+        await readStream();
+      } catch (err) {
+        // reconnect below, unless we were unsubscribed
+      }
+      if (controller.signal.aborted) return;
+      await new Promise((resolve) => setTimeout(resolve, EVENTS_RECONNECT_MS));
+    }
+  })();
+
+  return () => controller.abort();
+};
+
+// logout revokes the access token and the refresh token's session. The second
+// call still works when the access token has already expired.
+export const logout = async () => {
+  const session = loadSession();
+  if (!session) return;
+  try {
+    await fetch(`${API_URL}/auth/logout`, withToken({ method: 'POST' }, session));
+    if (session.refresh_token) {
+      await fetch(`${API_URL}/auth/revoke`, {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ refresh_token: session.refresh_token }),
+      });
+    }
+  } finally {
+    clearSession();
+  }
+};